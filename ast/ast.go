@@ -2,29 +2,28 @@ package ast
 
 import (
 	"fmt"
+	"path"
 	"sometimes/token"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type (
-	Pos interface {
-		Line() int
-		Col() int
-	}
 	// Node represents an AST node.
 	Node interface {
-		StartPos() Pos
-		EndPos() Pos
+		StartPos() token.Pos
+		EndPos() token.Pos
 	}
 	BaseNode struct {
-		startPos, endPos Pos
+		startPos, endPos token.Pos
 	}
 )
 
-func (bn *BaseNode) StartPos() Pos { return bn.startPos }
-func (bn *BaseNode) EndPos() Pos   { return bn.endPos }
+func (bn *BaseNode) StartPos() token.Pos { return bn.startPos }
+func (bn *BaseNode) EndPos() token.Pos   { return bn.endPos }
 
-func NewBaseNode(startPos, endPos Pos) *BaseNode {
+func NewBaseNode(startPos, endPos token.Pos) *BaseNode {
 	return &BaseNode{
 		startPos: startPos,
 		endPos:   endPos,
@@ -73,7 +72,7 @@ type (
 	Literal struct {
 		*BaseExpr
 		Kind token.Kind // token.INT_LITERAL, token.FLOAT_LITERAL, token.CHAR_LITERAL, token.STRING_LITERAL, token.BOOLEAN_LITERAL
-		Val  string     // 123, 3.14, 'a', "我的"
+		Val  string     // 123, 3.14, a, 我的; string and char literals are unescaped
 	}
 
 	// (1+1), ...
@@ -95,6 +94,12 @@ type (
 		Element []Expr
 	}
 
+	// {"a": 1, b: 2}, the keys are expressions
+	MapExpr struct {
+		*BaseExpr
+		Entries []MapEntry
+	}
+
 	// say(1+1, 99), ...
 	CallExpr struct {
 		*BaseExpr
@@ -123,21 +128,60 @@ type (
 		Op       *token.Token // =, +=, *=, ...
 	}
 
+	// r?, the value of an ok, or else the err is returned from the function
+	PropagateExpr struct {
+		*BaseExpr
+		X Expr
+	}
+
+	// i++ or i--
+	IncDecExpr struct {
+		*BaseExpr
+		X  Expr
+		Op *token.Token // ++ or --
+	}
+
+	// a := 10
+	DefineExpr struct {
+		*BaseExpr
+		Ident *Ident
+		Value Expr
+	}
+
 	// return 1+1, ...
+	// return, return a or return a, b
 	ReturnExpr struct {
 		*BaseExpr
-		Ret Expr // optional
+		Results []Expr // empty if no value is returned
+	}
+
+	// throw err
+	ThrowExpr struct {
+		*BaseExpr
+		X Expr
+	}
+
+	// try { Body } catch Catch { CatchBody } finally { Finally },
+	// either the catch or the finally may be omitted
+	TryExpr struct {
+		*BaseExpr
+		Body      *BlockExpr
+		Catch     *Ident // the thrown value; optional
+		CatchBody *BlockExpr
+		Finally   *BlockExpr
 	}
 
 	// break 1+1, ...
 	BreakExpr struct {
 		*BaseExpr
-		Expr Expr // optional
+		Label *Ident // the loop to break out of; optional
+		Expr  Expr   // optional
 	}
 
-	// continue
+	// continue or continue 'outer
 	ContinueExpr struct {
 		*BaseExpr
+		Label *Ident // optional
 	}
 
 	// { a = 1+1; b = 2+2; }
@@ -158,8 +202,55 @@ type (
 	// loop (Cond) { Body }
 	LoopExpr struct {
 		*BaseExpr
-		Cond Expr // condition; optional
-		Body *BlockExpr
+		Label *Ident // 'outer: loop { ... }; optional
+		Cond  Expr   // condition; optional
+		Body  *BlockExpr
+	}
+
+	// loop x in arr { ... }, loop i, x in arr { ... } or loop i in 0..n { ... }
+	LoopInExpr struct {
+		*BaseExpr
+		Label *Ident // optional
+		Index *Ident // optional
+		Elem  *Ident
+		X     Expr // the array, or the start of the range
+		End   Expr // the end of the range, exclusive; nil if X is an array
+		Body  *BlockExpr
+	}
+
+	// switch Tag { case 1, 2 { ... } default { ... } }
+	SwitchExpr struct {
+		*BaseExpr
+		Tag   Expr
+		Cases []*CaseClause
+	}
+
+	// match Subject { 0 => a, [x, ..] if x > 0 => { b }, _ => c }
+	MatchExpr struct {
+		*BaseExpr
+		Subject Expr
+		Arms    []*MatchArm
+	}
+
+	// fn(a, b) { a + b } or fn(a, b) -> a + b
+	FuncLit struct {
+		*BaseExpr
+		Args []Param
+		Body *BlockExpr // the body of `-> x` is a block whose value is x
+	}
+
+	// p.x
+	SelectorExpr struct {
+		*BaseExpr
+		X   Expr   // p
+		Sel *Ident // x
+	}
+
+	// Point { x: 1, y: 2 }
+	StructLit struct {
+		*BaseExpr
+		Type   Expr // Point, or m.Point of an imported module m
+		Fields []FieldInit
 	}
 
 	// let a = 10, b=20, ...
@@ -182,7 +273,7 @@ type (
 
 func (BaseNode) exprNode() {}
 
-func NewBaseExpr(startPos, endPos Pos) *BaseExpr {
+func NewBaseExpr(startPos, endPos token.Pos) *BaseExpr {
 	return &BaseExpr{
 		BaseNode: NewBaseNode(startPos, endPos),
 	}
@@ -192,23 +283,260 @@ func NewBaseExpr(startPos, endPos Pos) *BaseExpr {
 type (
 	// let Ident = 100;
 	ValueDecl struct {
-		Ident *Ident
-		Value Expr
+		Ident   *Ident
+		Pattern *Pattern // set instead of Ident if the value is destructured
+		Value   Expr
+	}
+
+	// (q, r) or [head, ..tail] on the left side of a let
+	Pattern struct {
+		*BaseNode
+		Array bool
+		Names []*Ident // `_` discards the value
+		Rest  *Ident   // the rest of an array; optional
 	}
 )
 
 func (v ValueDecl) String() string {
+	if v.Pattern != nil {
+		return v.Pattern.String() + " = " + v.Value.String()
+	}
 	return v.Ident.String() + " = " + v.Value.String()
 }
 
+func (p *Pattern) String() string {
+	names := make([]string, 0, len(p.Names)+1)
+	for _, id := range p.Names {
+		names = append(names, id.Name)
+	}
+	if p.Rest != nil {
+		names = append(names, ".."+p.Rest.Name)
+	}
+	if p.Array {
+		return "[" + strings.Join(names, ", ") + "]"
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// case 1, 2 { ... } or default { ... }
+type CaseClause struct {
+	*BaseNode
+	Values []Expr // nil for default
+	Body   *BlockExpr
+}
+
+func (c *CaseClause) String() string {
+	if c.Values == nil {
+		return "default " + c.Body.String()
+	}
+	var sb strings.Builder
+	sb.WriteString("case ")
+	for i, v := range c.Values {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(v.String())
+	}
+	sb.WriteRune(' ')
+	sb.WriteString(c.Body.String())
+	return sb.String()
+}
+
+// Pat if Guard => Body
+type MatchArm struct {
+	*BaseNode
+	Pat   Pat
+	Guard Expr // optional
+	Body  Expr // an expression or a block
+}
+
+func (a *MatchArm) String() string {
+	var sb strings.Builder
+	sb.WriteString(a.Pat.String())
+	if a.Guard != nil {
+		sb.WriteString(" if ")
+		sb.WriteString(a.Guard.String())
+	}
+	sb.WriteString(" => ")
+	sb.WriteString(a.Body.String())
+	return sb.String()
+}
+
+// patterns of match arms
+type (
+	Pat interface {
+		Node
+		// patNode ensures that only pattern nodes can be assigned to a Pat.
+		patNode()
+		String() string
+	}
+
+	// x binds the value to x, `_` matches any value and a constant like MAX matches its value
+	IdentPat struct {
+		*BaseNode
+		Ident *Ident
+	}
+
+	// 1, -1.5, 'a', "abc", true or a constant of another module like m.MAX
+	LiteralPat struct {
+		*BaseNode
+		Value Expr
+	}
+
+	// 1..10 or 'a'..='z'
+	RangePat struct {
+		*BaseNode
+		Lo, Hi    Expr // literals or constants like the value of LiteralPat
+		Inclusive bool // true if Hi is in the range
+	}
+
+	// [a, 0, ..rest]
+	ArrayPat struct {
+		*BaseNode
+		Elems []Pat
+		Rest  *Ident // `..rest`, or `..` which is named `_`; nil if the array has exactly len(Elems) elements
+	}
+
+	// Point { x, y: 0 }
+	StructPat struct {
+		*BaseNode
+		Type   Expr // Point, or m.Point of an imported module m
+		Fields []FieldPat
+	}
+)
+
+func (*IdentPat) patNode()   {}
+func (*LiteralPat) patNode() {}
+func (*RangePat) patNode()   {}
+func (*ArrayPat) patNode()   {}
+func (*StructPat) patNode()  {}
+
+func (p *IdentPat) String() string {
+	return p.Ident.Name
+}
+
+func (p *LiteralPat) String() string {
+	return p.Value.String()
+}
+
+func (p *RangePat) String() string {
+	if p.Inclusive {
+		return p.Lo.String() + "..=" + p.Hi.String()
+	}
+	return p.Lo.String() + ".." + p.Hi.String()
+}
+
+func (p *ArrayPat) String() string {
+	elems := make([]string, 0, len(p.Elems)+1)
+	for _, e := range p.Elems {
+		elems = append(elems, e.String())
+	}
+	if p.Rest != nil {
+		if p.Rest.Name == "_" {
+			elems = append(elems, "..")
+		} else {
+			elems = append(elems, ".."+p.Rest.Name)
+		}
+	}
+	return "[" + strings.Join(elems, ", ") + "]"
+}
+
+func (p *StructPat) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.Type.String())
+	sb.WriteString(" {")
+	for i, f := range p.Fields {
+		if i > 0 {
+			sb.WriteRune(',')
+		}
+		sb.WriteRune(' ')
+		sb.WriteString(f.String())
+	}
+	sb.WriteString(" }")
+	return sb.String()
+}
+
+// x: 0, or x which binds the field to x
+type FieldPat struct {
+	Name *Ident
+	Pat  Pat // nil for the shorthand
+}
+
+func (f FieldPat) String() string {
+	if f.Pat == nil {
+		return f.Name.String()
+	}
+	return f.Name.String() + ": " + f.Pat.String()
+}
+
+// x: 1
+type FieldInit struct {
+	Name  *Ident
+	Value Expr
+}
+
+func (f FieldInit) String() string {
+	return f.Name.String() + ": " + f.Value.String()
+}
+
+type MapEntry struct {
+	Key   Expr
+	Value Expr
+}
+
+func (e MapEntry) String() string {
+	return e.Key.String() + ": " + e.Value.String()
+}
+
+// Param is a parameter of a function, like `a`, `a = 1` or `..rest`.
+type Param struct {
+	Name    *Ident
+	Default Expr // nil if the parameter has no default value
+	Rest    bool // the parameter is an array of the remaining arguments, it is the last one
+}
+
+func (p Param) String() string {
+	switch {
+	case p.Rest:
+		return ".." + p.Name.String()
+	case p.Default != nil:
+		return p.Name.String() + " = " + p.Default.String()
+	}
+	return p.Name.String()
+}
+
+// File is a parsed source file.
+type File struct {
+	Imports []*ImportDecl
+	Consts  []*ConstDecl
+	Structs []*StructDecl
+	Fns     []*FnDecl
+}
+
+// import "path/to/mod"
+type ImportDecl struct {
+	*BaseNode
+	Path *Literal // a string literal
+}
+
+// Name returns the name the module is qualified by, which is the last element of its path.
+func (id *ImportDecl) Name() string {
+	return path.Base(id.Path.Val)
+}
+
+func (id *ImportDecl) String() string {
+	return "import " + id.Path.String() + ";"
+}
+
 // const A=10, B=1+1
 type ConstDecl struct {
 	*BaseNode
+	Doc   string // text of the comments directly above; optional
 	Decls []ValueDecl
 }
 
-func (cd *ConstDecl) StartPos() Pos { return cd.startPos }
-func (cd *ConstDecl) EndPos() Pos   { return cd.endPos }
+func (cd *ConstDecl) StartPos() token.Pos { return cd.startPos }
+func (cd *ConstDecl) EndPos() token.Pos   { return cd.endPos }
 
 func (cd *ConstDecl) String() string {
 	var sb strings.Builder
@@ -222,23 +550,55 @@ func (cd *ConstDecl) String() string {
 	return sb.String()
 }
 
+// struct Point { x, y }
+type StructDecl struct {
+	*BaseNode
+	Doc    string // text of the comments directly above; optional
+	Name   *Ident
+	Fields []*Ident
+}
+
+func (sd *StructDecl) String() string {
+	var sb strings.Builder
+	sb.WriteString("struct ")
+	sb.WriteString(sd.Name.String())
+	sb.WriteString(" {")
+	for i, f := range sd.Fields {
+		if i > 0 {
+			sb.WriteRune(',')
+		}
+		sb.WriteRune(' ')
+		sb.WriteString(f.String())
+	}
+	sb.WriteString(" }")
+	return sb.String()
+}
+
 // fn f(n) { xxx }
 type FnDecl struct {
 	*BaseNode
+	Doc    string // text of the comments directly above; optional
 	FnName *Ident
-	Args   []*Ident
+	Args   []Param
 	// Ret  Type
 	Body *BlockExpr
 }
 
-func (fd *FnDecl) StartPos() Pos { return fd.startPos }
-func (fd *FnDecl) EndPos() Pos   { return fd.endPos }
+func (fd *FnDecl) StartPos() token.Pos { return fd.startPos }
+func (fd *FnDecl) EndPos() token.Pos   { return fd.endPos }
 
 func (id *Ident) String() string {
 	return id.Name
 }
 
 func (l *Literal) String() string {
+	switch l.Kind {
+	case token.STRING_LITERAL:
+		return strconv.Quote(l.Val)
+	case token.CHAR_LITERAL:
+		r, _ := utf8.DecodeRuneInString(l.Val)
+		return strconv.QuoteRune(r)
+	}
 	return l.Val
 }
 
@@ -253,25 +613,39 @@ func (i *IndexExpr) String() string {
 func (a *ArrayExpr) String() string {
 	var sb strings.Builder
 	sb.WriteRune('[')
-	for i := len(a.Element) - 2; i >= 0; i-- {
-		sb.WriteString(a.Element[i].String())
-		sb.WriteString(", ")
+	for i, e := range a.Element {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(e.String())
 	}
-
-	sb.WriteString(a.Element[len(a.Element)-1].String())
 	sb.WriteRune(']')
 	return sb.String()
 }
 
+func (m *MapExpr) String() string {
+	var sb strings.Builder
+	sb.WriteRune('{')
+	for i, e := range m.Entries {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(e.String())
+	}
+	sb.WriteRune('}')
+	return sb.String()
+}
+
 func (c *CallExpr) String() string {
 	var sb strings.Builder
 	sb.WriteString(c.Func.String())
 	sb.WriteRune('(')
-	for i := len(c.Args) - 2; i >= 0; i-- {
-		sb.WriteString(c.Args[i].String())
-		sb.WriteString(", ")
+	for i, arg := range c.Args {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(arg.String())
 	}
-	sb.WriteString(c.Args[len(c.Args)-1].String())
 	sb.WriteRune(')')
 	return sb.String()
 }
@@ -285,26 +659,67 @@ func (b *BinaryExpr) String() string {
 }
 
 func (a *AssignExpr) String() string {
-	return a.Lhs.String() + "=" + a.Rhs.String()
+	return a.Lhs.String() + a.Op.Val + a.Rhs.String()
+}
+
+func (e *PropagateExpr) String() string {
+	return e.X.String() + "?"
+}
+
+func (e *IncDecExpr) String() string {
+	return e.X.String() + e.Op.Val
+}
+
+func (d *DefineExpr) String() string {
+	return d.Ident.String() + ":=" + d.Value.String()
 }
 
 func (r *ReturnExpr) String() string {
-	s := "return "
-	if r.Ret != nil {
-		s += r.Ret.String()
+	results := make([]string, 0, len(r.Results))
+	for _, x := range r.Results {
+		results = append(results, x.String())
 	}
-	return s
+	return "return " + strings.Join(results, ", ")
+}
+
+func (t *ThrowExpr) String() string {
+	return "throw " + t.X.String()
+}
+
+func (t *TryExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString("try ")
+	sb.WriteString(t.Body.String())
+	if t.CatchBody != nil {
+		sb.WriteString(" catch ")
+		if t.Catch != nil {
+			sb.WriteString(t.Catch.String())
+			sb.WriteRune(' ')
+		}
+		sb.WriteString(t.CatchBody.String())
+	}
+	if t.Finally != nil {
+		sb.WriteString(" finally ")
+		sb.WriteString(t.Finally.String())
+	}
+	return sb.String()
 }
 
 func (b *BreakExpr) String() string {
 	s := "break"
+	if b.Label != nil {
+		s += " '" + b.Label.Name
+	}
 	if b.Expr != nil {
-		s += b.Expr.String()
+		s += " " + b.Expr.String()
 	}
 	return s
 }
 
 func (c *ContinueExpr) String() string {
+	if c.Label != nil {
+		return "continue '" + c.Label.Name
+	}
 	return "continue"
 }
 
@@ -340,13 +755,95 @@ func (i *IfExpr) String() string {
 
 func (l *LoopExpr) String() string {
 	var sb strings.Builder
+	writeLabel(&sb, l.Label)
 	sb.WriteString("loop ")
-	sb.WriteString(l.Cond.String())
+	if l.Cond != nil {
+		sb.WriteString(l.Cond.String())
+		sb.WriteRune(' ')
+	}
+	sb.WriteString(l.Body.String())
+	return sb.String()
+}
+
+func (l *LoopInExpr) String() string {
+	var sb strings.Builder
+	writeLabel(&sb, l.Label)
+	sb.WriteString("loop ")
+	if l.Index != nil {
+		sb.WriteString(l.Index.String())
+		sb.WriteString(", ")
+	}
+	sb.WriteString(l.Elem.String())
+	sb.WriteString(" in ")
+	sb.WriteString(l.X.String())
+	if l.End != nil {
+		sb.WriteString("..")
+		sb.WriteString(l.End.String())
+	}
 	sb.WriteRune(' ')
 	sb.WriteString(l.Body.String())
 	return sb.String()
 }
 
+func (s *SwitchExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString("switch ")
+	sb.WriteString(s.Tag.String())
+	sb.WriteString(" {\n")
+	for _, c := range s.Cases {
+		sb.WriteString(c.String())
+		sb.WriteRune('\n')
+	}
+	sb.WriteRune('}')
+	return sb.String()
+}
+
+func (m *MatchExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString("match ")
+	sb.WriteString(m.Subject.String())
+	sb.WriteString(" {\n")
+	for _, a := range m.Arms {
+		sb.WriteString(a.String())
+		sb.WriteString(",\n")
+	}
+	sb.WriteRune('}')
+	return sb.String()
+}
+
+func (f *FuncLit) String() string {
+	var sb strings.Builder
+	sb.WriteString("fn(")
+	for i, arg := range f.Args {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(arg.String())
+	}
+	sb.WriteString(") ")
+	sb.WriteString(f.Body.String())
+	return sb.String()
+}
+
+func (s *SelectorExpr) String() string {
+	return s.X.String() + "." + s.Sel.String()
+}
+
+func (s *StructLit) String() string {
+	var sb strings.Builder
+	sb.WriteString(s.Type.String())
+	sb.WriteString(" {")
+	for i, f := range s.Fields {
+		if i > 0 {
+			sb.WriteRune(',')
+		}
+		sb.WriteRune(' ')
+		sb.WriteString(f.String())
+	}
+	sb.WriteString(" }")
+	return sb.String()
+}
+
 func (l *LetExpr) String() string {
 	var sb strings.Builder
 	sb.WriteString("let ")
@@ -358,3 +855,12 @@ func (l *LetExpr) String() string {
 	sb.WriteRune(';')
 	return sb.String()
 }
+
+// writeLabel writes the label of a loop, which is optional.
+func writeLabel(sb *strings.Builder, label *Ident) {
+	if label != nil {
+		sb.WriteString("'")
+		sb.WriteString(label.Name)
+		sb.WriteString(": ")
+	}
+}
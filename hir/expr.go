@@ -1,5 +1,7 @@
 package hir
 
+import "sometimes/token"
+
 //go:generate stringer -type=ExprType -trimprefix=ExprType
 type ExprType int
 
@@ -24,6 +26,26 @@ const (
 	ExprTypeSetElement
 	ExprTypeGetElement
 	ExprTypePrint
+	ExprTypeDiscard
+	ExprTypeStruct
+	ExprTypeGetField
+	ExprTypeSetField
+	ExprTypeSwitch
+	ExprTypeUpvalue
+	ExprTypeLen
+	ExprTypeDestructure
+	ExprTypeMatch
+	ExprTypeMap
+	ExprTypeDelete
+	ExprTypeEntry
+	ExprTypeThrow
+	ExprTypeTry
+	ExprTypeResult
+	ExprTypeIsOk
+	ExprTypeUnwrap
+	ExprTypePropagate
+	ExprTypeIter
+	ExprTypeNext
 )
 
 type Expr interface {
@@ -41,6 +63,12 @@ type (
 		VarBinding *Binding
 	}
 
+	// access a variable captured by the closure being executed
+	ExprUpvalue struct {
+		Index int // index in Function.Upvalues
+		Name  string
+	}
+
 	ExprBinding struct {
 		Binding *Binding
 		Rhs     Expr
@@ -54,17 +82,21 @@ type (
 	ExprBinary struct {
 		Lhs, Rhs Expr
 		Op       BinaryOp
+		Pos      token.Pos // position of the expression, used by runtime errors
 	}
 
 	ExprCall struct {
-		Callee Expr
-		Args   []Expr
+		Callee  Expr
+		Args    []Expr
+		Pos     token.Pos
+		Results int // number of values the caller destructures; 0 if it takes one value
 	}
 
 	ExprFunction struct {
 		Func *Function
 	}
 
+	// like `fn(x) -> x + 1`, the value is a closure of Func
 	ExprAnonFunction struct {
 		Func *Function
 	}
@@ -72,21 +104,35 @@ type (
 	ExprUnary struct {
 		Op   UnaryOp
 		Expr Expr
+		Pos  token.Pos
 	}
 
 	ExprReturn struct {
-		Expr Expr // optional
+		Expr  Expr      // optional
+		Exprs []Expr    // set instead of Expr by `return a, b`
+		Pos   token.Pos // position of an explicit return, used by runtime errors
 	}
 
 	ExprIf struct {
 		Cond Expr
 		Body *ExprBlock
-		Else Expr // optional
+		Else Expr      // optional
+		Pos  token.Pos // position of Cond, used by runtime errors
+	}
+
+	ExprSwitch struct {
+		Tag     Expr
+		Cases   []*SwitchCase
+		Default *ExprBlock // optional
+		Pos     token.Pos
 	}
 
 	ExprLoop struct {
-		Cond Expr
-		Body *ExprBlock
+		Cond     Expr
+		Body     *ExprBlock
+		Label    string    // optional
+		HasValue bool      // the loop leaves the value of the break which ends it, or nil if Cond is false
+		Pos      token.Pos // position of Cond, used by runtime errors
 	}
 
 	ExprBlock struct {
@@ -94,27 +140,159 @@ type (
 	}
 
 	ExprBreak struct {
-		Expr Expr // optional
+		Expr  Expr   // set if the loop has a value
+		Label string // the loop to break out of; the innermost loop if empty
 	}
 
-	ExprContinue struct{}
+	ExprContinue struct {
+		Label string // optional
+	}
 
+	// like `[1, 2]`, the elements are allocated on the heap each time the expression is evaluated
 	ExprArray struct {
-		Arr   *ExprVar
 		Exprs []Expr
 	}
 
+	// like `{"a": 1, "b": 2}`, the entries are set in order
+	ExprMap struct {
+		Keys, Values []Expr
+		Pos          token.Pos
+	}
+
+	// like `delete(m, k)`, removes the entry of the key if the map has one
+	ExprDelete struct {
+		Map, Key Expr
+		Pos      token.Pos
+	}
+
+	// the state of a loop over the elements of an array or the entries of a map,
+	// a map is iterated over the keys it has when the loop starts
+	ExprIter struct {
+		Expr Expr
+		Pos  token.Pos
+	}
+
+	// the index after Index of the next element or entry of Iter, or -1 if there is none,
+	// the keys deleted from a map since the loop started are skipped
+	ExprNext struct {
+		Iter, Index Expr
+	}
+
+	// the element at Index of the array of Iter or the value of the entry at Index of its map,
+	// with Key, the index of the element or the key of the entry
+	ExprEntry struct {
+		Iter, Index Expr
+		Key         bool
+		Pos         token.Pos
+	}
+
+	// like `throw err`, unwinds to the innermost try which encloses it, in this function or a caller
+	ExprThrow struct {
+		Expr Expr
+		Pos  token.Pos
+	}
+
+	// like `try { a } catch e { b } finally { c }`, either CatchBody or Finally is set.
+	// CatchBody is evaluated with the value thrown by Body bound to Catch,
+	// Finally is evaluated after Body or CatchBody however they end.
+	ExprTry struct {
+		Body      *ExprBlock
+		Catch     *Binding // nil drops the thrown value
+		CatchBody *ExprBlock
+		Finally   *ExprBlock
+		Height    *Binding // a hidden local which holds the height of the operand stack when Body starts
+		Exception *Binding // a hidden local which holds the value thrown by Body or CatchBody while Finally is evaluated
+	}
+
+	// like `ok(v)` or `err(e)`
+	ExprResult struct {
+		Expr Expr
+		Ok   bool
+	}
+	// like `is_ok(r)`
+	ExprIsOk struct {
+		Expr Expr
+		Pos  token.Pos
+	}
+	// like `unwrap(r)` or `unwrap_or(r, d)`, Default is nil for unwrap which throws if r is an err
+	ExprUnwrap struct {
+		Expr, Default Expr
+		Pos           token.Pos
+	}
+	// like `r?`, the value of an ok, or else the err is returned from the function.
+	// The operand stack is unwound to Function.Height before the return.
+	ExprPropagate struct {
+		Expr Expr
+		Pos  token.Pos
+	}
+
+	// ArrayAddr[Index] = Value, ArrayAddr may also be a map
 	ExprSetElement struct {
 		ArrayAddr, Index, Value Expr
+		Pos                     token.Pos
 	}
+	// ArrayAddr[Index], ArrayAddr may also be a map
 	ExprGetElement struct {
 		ArrayAddr, Index Expr
+		Pos              token.Pos
 	}
 	ExprPrint struct {
 		Expr []Expr
 	}
+
+	// like `f();`, evaluates Expr and drops its value
+	ExprDiscard struct {
+		Expr Expr
+	}
+
+	// like `Point { x: 1, y: 2 }`
+	ExprStruct struct {
+		Struct *Struct
+		Values []Expr // values of Struct.Fields, in the same order
+		Pos    token.Pos
+	}
+
+	// like `p.x`
+	ExprGetField struct {
+		Expr  Expr
+		Field string
+		Pos   token.Pos
+	}
+
+	// like `p.x = 1`
+	ExprSetField struct {
+		Expr, Value Expr
+		Field       string
+		Pos         token.Pos
+	}
+
+	// the number of elements of an array or entries of a map
+	ExprLen struct {
+		Expr Expr
+		Pos  token.Pos
+	}
+
+	// like `let (q, r) = f()`, binds the values returned by Call in order
+	ExprDestructure struct {
+		Bindings []*Binding // nil drops the value
+		Call     *ExprCall  // Call.Results is len(Bindings)
+	}
+
+	// like `match x { 0 => a, [h, ..t] if h > 0 => b, _ => c }`,
+	// the body of the first arm whose pattern matches and whose guard is true is evaluated
+	ExprMatch struct {
+		Subject Expr
+		Binding *Binding // a hidden local which holds the value of Subject while the patterns are tested
+		Arms    []*MatchArm
+	}
 )
 
+// SwitchCase is a case of ExprSwitch, Body is evaluated if the tag equals one of Values.
+type SwitchCase struct {
+	Values []Expr
+	Body   *ExprBlock
+}
+
 func (*ExprLiteral) ExprType() ExprType      { return ExprTypeLiteral }
 func (*ExprVar) ExprType() ExprType          { return ExprTypeVar }
 func (*ExprBinding) ExprType() ExprType      { return ExprTypeBinding }
@@ -134,3 +312,23 @@ func (*ExprArray) ExprType() ExprType        { return ExprTypeArray }
 func (*ExprSetElement) ExprType() ExprType   { return ExprTypeSetElement }
 func (*ExprGetElement) ExprType() ExprType   { return ExprTypeGetElement }
 func (*ExprPrint) ExprType() ExprType        { return ExprTypePrint }
+func (*ExprDiscard) ExprType() ExprType      { return ExprTypeDiscard }
+func (*ExprStruct) ExprType() ExprType       { return ExprTypeStruct }
+func (*ExprGetField) ExprType() ExprType     { return ExprTypeGetField }
+func (*ExprSetField) ExprType() ExprType     { return ExprTypeSetField }
+func (*ExprSwitch) ExprType() ExprType       { return ExprTypeSwitch }
+func (*ExprUpvalue) ExprType() ExprType      { return ExprTypeUpvalue }
+func (*ExprLen) ExprType() ExprType          { return ExprTypeLen }
+func (*ExprDestructure) ExprType() ExprType  { return ExprTypeDestructure }
+func (*ExprMatch) ExprType() ExprType        { return ExprTypeMatch }
+func (*ExprMap) ExprType() ExprType          { return ExprTypeMap }
+func (*ExprDelete) ExprType() ExprType       { return ExprTypeDelete }
+func (*ExprEntry) ExprType() ExprType        { return ExprTypeEntry }
+func (*ExprThrow) ExprType() ExprType        { return ExprTypeThrow }
+func (*ExprTry) ExprType() ExprType          { return ExprTypeTry }
+func (*ExprResult) ExprType() ExprType       { return ExprTypeResult }
+func (*ExprIsOk) ExprType() ExprType         { return ExprTypeIsOk }
+func (*ExprUnwrap) ExprType() ExprType       { return ExprTypeUnwrap }
+func (*ExprPropagate) ExprType() ExprType    { return ExprTypePropagate }
+func (*ExprIter) ExprType() ExprType         { return ExprTypeIter }
+func (*ExprNext) ExprType() ExprType         { return ExprTypeNext }
@@ -4,6 +4,7 @@ type Program struct {
 	funcs         map[string]*ExprFunction
 	entryFuncName string
 	consts        map[string]Value
+	structs       map[string]*Struct
 }
 
 func (p *Program) FindConst(name string) (val Value, isExist bool) {
@@ -11,6 +12,11 @@ func (p *Program) FindConst(name string) (val Value, isExist bool) {
 	return
 }
 
+func (p *Program) FindStruct(name string) (s *Struct, isExist bool) {
+	s, isExist = p.structs[name]
+	return
+}
+
 func (p *Program) FindFunc(name string) (f *ExprFunction, isExist bool) {
 	f, isExist = p.funcs[name]
 	return
@@ -36,6 +42,7 @@ type Builder struct {
 	Funcs        []*ExprFunction
 	EntryFuncIdx int
 	consts       map[string]Value
+	structs      map[string]*Struct
 }
 
 func NewBuilder() *Builder {
@@ -43,6 +50,7 @@ func NewBuilder() *Builder {
 		Funcs:        []*ExprFunction{},
 		EntryFuncIdx: -1,
 		consts:       make(map[string]Value),
+		structs:      make(map[string]*Struct),
 	}
 }
 
@@ -50,6 +58,10 @@ func (b *Builder) InsertConst(name string, val Value) {
 	b.consts[name] = val
 }
 
+func (b *Builder) InsertStruct(s *Struct) {
+	b.structs[s.Name] = s
+}
+
 func (b *Builder) InsertFunc(f *ExprFunction, entryFunc bool) {
 	if entryFunc {
 		b.EntryFuncIdx = len(b.Funcs)
@@ -74,6 +86,7 @@ func (b *Builder) Build() *Program {
 		funcs:         funcs,
 		entryFuncName: entryFuncName,
 		consts:        b.consts,
+		structs:       b.structs,
 	}
 }
 
@@ -81,6 +94,10 @@ type FuncBuilder struct {
 	funcName string
 	funcBody []Expr
 	args     []*Binding
+	doc      string
+	height   *Binding
+	defaults []Expr
+	rest     *Binding
 }
 
 func NewFuncBuilder(funcName string, args []*Binding) *FuncBuilder {
@@ -95,14 +112,33 @@ func (b *FuncBuilder) Emit(e Expr) {
 	b.funcBody = append(b.funcBody, e)
 }
 
+func (b *FuncBuilder) SetDoc(doc string) {
+	b.doc = doc
+}
+
+// SetParams sets the default values of the arguments, nil if none has one, and the rest argument if any.
+func (b *FuncBuilder) SetParams(defaults []Expr, rest *Binding) {
+	b.defaults = defaults
+	b.rest = rest
+}
+
+// SetHeight sets the hidden local which holds the height of the operand stack when the body starts.
+func (b *FuncBuilder) SetHeight(height *Binding) {
+	b.height = height
+}
+
 func (b *FuncBuilder) Build() *ExprFunction {
 	return &ExprFunction{
 		Func: &Function{
 			Name: b.funcName,
+			Doc:  b.doc,
 			Body: &ExprBlock{
 				Body: b.funcBody,
 			},
-			Args: b.args,
+			Args:     b.args,
+			Defaults: b.defaults,
+			Rest:     b.rest,
+			Height:   b.height,
 		},
 	}
 }
@@ -124,9 +160,49 @@ func NewBindingWithLen(name string, len int) *Binding {
 }
 
 type Function struct {
-	Name string
-	Body *ExprBlock
-	Args []*Binding
+	Name     string
+	Doc      string // documentation from the source; optional
+	Body     *ExprBlock
+	Args     []*Binding
+	Defaults []Expr     // the default value of each argument, nil if it has none; nil if no argument has one
+	Rest     *Binding   // the array of the arguments after Args; nil if the function is not variadic
+	Upvalues []*Upvalue // variables captured from the enclosing functions; only anonymous functions have upvalues
+	Height   *Binding   // a hidden local which holds the height of the operand stack when the body starts; nil if no `?` in the body
+}
+
+// Required returns the number of arguments a call must pass, the arguments with a default value may be left out.
+func (f *Function) Required() int {
+	n := 0
+	for n < len(f.Args) && (f.Defaults == nil || f.Defaults[n] == nil) {
+		n++
+	}
+	return n
+}
+
+// Upvalue is a variable of an enclosing function captured by an anonymous function.
+// The variable is captured by reference.
+type Upvalue struct {
+	Name    string
+	IsLocal bool     // captured from the locals of the directly enclosing function, or else from its upvalues
+	Binding *Binding // the captured local if IsLocal
+	Index   int      // index of the upvalue in the enclosing function if !IsLocal
+}
+
+// Struct is a struct declaration like `struct Point { x, y }`.
+type Struct struct {
+	Name   string
+	Doc    string // documentation from the source; optional
+	Fields []string
+}
+
+// FieldIndex returns the index of the field, or -1 if s has no such field.
+func (s *Struct) FieldIndex(name string) int {
+	for i, f := range s.Fields {
+		if f == name {
+			return i
+		}
+	}
+	return -1
 }
 
 type BinaryOp uint8
@@ -146,6 +222,11 @@ const (
 	OpAnd
 	OpOr
 	OpIndex
+	OpBitAnd
+	OpBitOr
+	OpXor
+	OpShl // shift left
+	OpShr // arithmetic shift right
 )
 
 type UnaryOp uint8
@@ -153,4 +234,5 @@ type UnaryOp uint8
 const (
 	OpNeg UnaryOp = iota
 	OpNot
+	OpBitNot
 )
@@ -0,0 +1,108 @@
+package hir
+
+// MatchArm is an arm of ExprMatch, the bindings of Pat are visible in Guard and Body.
+type MatchArm struct {
+	Pat   Pat
+	Guard Expr // optional
+	Body  Expr
+}
+
+// Pat is a pattern of a match arm.
+type Pat interface {
+	isPat()
+}
+
+type (
+	// PatWildcard matches any value.
+	PatWildcard struct{}
+
+	// PatBinding matches any value and binds it.
+	PatBinding struct {
+		Binding *Binding
+	}
+
+	// PatLiteral matches the values of the type of Val which equal Val.
+	PatLiteral struct {
+		Val Value
+	}
+
+	// PatRange matches the ints or chars from Lo to Hi, Lo and Hi have the same type.
+	PatRange struct {
+		Lo, Hi    Value
+		Inclusive bool // Hi is in the range
+	}
+
+	// PatArray matches the arrays of len(Elems) elements, or of at least len(Elems) elements if HasRest.
+	PatArray struct {
+		Elems   []Pat
+		HasRest bool
+		Rest    *Binding // binds the elements after Elems; optional
+	}
+
+	// PatStruct matches the values of Struct.
+	PatStruct struct {
+		Struct *Struct
+		Fields []Pat // patterns of Struct.Fields in the same order, PatWildcard for an unlisted field
+	}
+)
+
+func (*PatWildcard) isPat() {}
+func (*PatBinding) isPat()  {}
+func (*PatLiteral) isPat()  {}
+func (*PatRange) isPat()    {}
+func (*PatArray) isPat()    {}
+func (*PatStruct) isPat()   {}
+
+// Bounds returns the inclusive bounds of an int or char literal or range, lo > hi if the range is empty.
+// ok is false for the other patterns, and for a range whose bounds are not ints or chars of the same type.
+func Bounds(p Pat) (lo, hi int, ok bool) {
+	switch p := p.(type) {
+	case *PatLiteral:
+		x, ok := IntValue(p.Val)
+		return x, x, ok
+	case *PatRange:
+		lo, lok := IntValue(p.Lo)
+		hi, hok := IntValue(p.Hi)
+		if !lok || !hok || isChar(p.Lo) != isChar(p.Hi) {
+			return 0, 0, false
+		}
+		if !p.Inclusive {
+			if hi <= lo {
+				// empty
+				return 1, 0, true
+			}
+			hi--
+		}
+		return lo, hi, true
+	}
+	return 0, 0, false
+}
+
+// BoundValue returns the value of a literal or the low bound of a range.
+func BoundValue(p Pat) Value {
+	if r, ok := p.(*PatRange); ok {
+		return r.Lo
+	}
+	return p.(*PatLiteral).Val
+}
+
+// SameKind reports whether two patterns with bounds are both of ints or both of chars.
+func SameKind(p, q Pat) bool {
+	return isChar(BoundValue(p)) == isChar(BoundValue(q))
+}
+
+// IntValue returns the int value of an int or a char.
+func IntValue(v Value) (int, bool) {
+	switch v := v.(type) {
+	case *ValueInt:
+		return v.Val, true
+	case *ValueChar:
+		return int(v.Val), true
+	}
+	return 0, false
+}
+
+func isChar(v Value) bool {
+	_, ok := v.(*ValueChar)
+	return ok
+}
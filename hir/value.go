@@ -3,6 +3,7 @@ package hir
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 type Ptr = int
@@ -25,6 +26,10 @@ type (
 		Val string
 	}
 
+	ValueChar struct {
+		Val rune
+	}
+
 	ValueBoolean struct {
 		Val bool
 	}
@@ -34,6 +39,14 @@ type (
 	ValueFunc struct {
 		FuncName  string
 		MaxLoacls int
+		Params    int  // number of arguments without the rest argument
+		Required  int  // number of arguments without a default value
+		Variadic  bool // the function has a rest argument
+	}
+
+	// a constant map, the keys are distinct and none of them is a map or a function
+	ValueMap struct {
+		Keys, Vals []Value
 	}
 )
 
@@ -49,6 +62,10 @@ func NewValueString(v string) *ValueString {
 	return &ValueString{Val: v}
 }
 
+func NewValueChar(v rune) *ValueChar {
+	return &ValueChar{Val: v}
+}
+
 func NewValueBoolean(v bool) *ValueBoolean {
 	return &ValueBoolean{Val: v}
 }
@@ -60,9 +77,11 @@ func NewValueNil() *ValueNil {
 func (*ValueInt) isValue()     {}
 func (*ValueFloat) isValue()   {}
 func (*ValueString) isValue()  {}
+func (*ValueChar) isValue()    {}
 func (*ValueBoolean) isValue() {}
 func (*ValueNil) isValue()     {}
 func (*ValueFunc) isValue()    {}
+func (*ValueMap) isValue()     {}
 
 func (i *ValueInt) String() string {
 	return strconv.Itoa(i.Val)
@@ -73,6 +92,9 @@ func (f *ValueFloat) String() string {
 func (s *ValueString) String() string {
 	return s.Val
 }
+func (c *ValueChar) String() string {
+	return string(c.Val)
+}
 func (b *ValueBoolean) String() string {
 	if b.Val {
 		return "true"
@@ -89,6 +111,21 @@ func (f *ValueFunc) String() string {
 	return fmt.Sprintf("Func @%s", f.FuncName)
 }
 
+func (m *ValueMap) String() string {
+	var sb strings.Builder
+	sb.WriteRune('{')
+	for i, k := range m.Keys {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(k.String())
+		sb.WriteString(": ")
+		sb.WriteString(m.Vals[i].String())
+	}
+	sb.WriteRune('}')
+	return sb.String()
+}
+
 func ValueEqual(x, y Value) bool {
 	switch a := x.(type) {
 	case *ValueInt:
@@ -107,6 +144,10 @@ func ValueEqual(x, y Value) bool {
 		if b, ok := y.(*ValueString); ok {
 			return a.Val == b.Val
 		}
+	case *ValueChar:
+		if b, ok := y.(*ValueChar); ok {
+			return a.Val == b.Val
+		}
 	case *ValueNil:
 		_, ok := y.(*ValueNil)
 		return ok
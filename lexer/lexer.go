@@ -1,47 +1,46 @@
 package lexer
 
 import (
+	"bytes"
+	"fmt"
 	"sometimes/token"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
-// Using Char as an alias for byte.
-// Because our simple language only support ASCII
-type Char = byte
+// Using Char as an alias for rune.
+// Source code is UTF-8 encoded, the cursor decodes it rune by rune.
+type Char = rune
 
-type SrcPos struct {
-	line, col int
-}
-
-func (s *SrcPos) Line() int {
-	return s.line
+type SrcCursor struct {
+	file  *token.File
+	src   []byte // source code
+	rdOff int    // byte offset of the next character
+	last  int    // byte offset of the last read character
 }
 
-func (s *SrcPos) Col() int {
-	return s.col
+// NewSrcCursor returns a cursor over the source code of file.
+func NewSrcCursor(file *token.File) *SrcCursor {
+	return &SrcCursor{
+		file: file,
+		src:  file.Src(),
+	}
 }
 
-type SrcCursor struct {
-	src      []Char // source code
-	rdOffset int    // read offset of src
-	rdPos    SrcPos
+// File returns the file being read.
+func (sc *SrcCursor) File() *token.File {
+	return sc.file
 }
 
-func NewSrcCursor(src []Char) *SrcCursor {
-	return &SrcCursor{
-		src:      src,
-		rdOffset: -1,
-		rdPos: SrcPos{
-			line: 0,
-			col:  0,
-		},
-	}
+// Pos returns the position of the next character.
+func (sc *SrcCursor) Pos() token.Pos {
+	return sc.file.Pos(sc.rdOff)
 }
 
-/// Eof returns true if rdOffset is end of src
+/// Eof returns true if all characters in src are read
 func (sc *SrcCursor) Eof() bool {
-	return sc.rdOffset >= len(sc.src)-1
+	return sc.rdOff >= len(sc.src)
 }
 
 // Peek returns the next character without advancing the cursor.
@@ -50,11 +49,18 @@ func (sc *SrcCursor) Peek() Char {
 	return sc.PeekN(1)
 }
 
+// PeekN returns the nth next character without advancing the cursor.
+// If there are less than n characters left, PeekN returns 0.
 func (sc *SrcCursor) PeekN(n int) Char {
-	if sc.rdOffset+n >= len(sc.src) {
-		return 0
+	offset := sc.rdOff
+	for ; n > 0 && offset < len(sc.src); n-- {
+		ch, size := utf8.DecodeRune(sc.src[offset:])
+		if n == 1 {
+			return ch
+		}
+		offset += size
 	}
-	return sc.src[sc.rdOffset+n]
+	return 0
 }
 
 // Next Moves to the next character.
@@ -63,14 +69,9 @@ func (sc *SrcCursor) Next() Char {
 	if sc.Eof() {
 		return 0
 	}
-	sc.rdOffset++
-	ch := sc.src[sc.rdOffset]
-	if ch == '\n' {
-		sc.rdPos.line++
-		sc.rdPos.col = 0
-	} else {
-		sc.rdPos.col++
-	}
+	ch, size := utf8.DecodeRune(sc.src[sc.rdOff:])
+	sc.last = sc.rdOff
+	sc.rdOff += size
 	return ch
 }
 
@@ -79,15 +80,38 @@ func (sc *SrcCursor) EatWhile(predicate func(c Char) bool) string {
 
 	var v strings.Builder
 	for ch := sc.Peek(); ch > 0 && predicate(ch); ch = sc.Peek() {
-		v.WriteByte(ch)
+		v.WriteRune(ch)
 		sc.Next()
 	}
 	return v.String()
 }
 
+// Error is a lexical error, like an unterminated string literal.
+type Error struct {
+	Pos token.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// Mode controls how a TokenCursor tokenizes the source code.
+type Mode uint
+
+const (
+	// KeepTrivia makes the cursor attach whitespace, newlines and comments to the neighbouring
+	// tokens instead of dropping them, no COMMENT token is returned.
+	// Every token gets its Raw text, so the source can be rebuilt from the tokens byte for byte.
+	KeepTrivia Mode = 1 << iota
+)
+
 /// TokenCursor 代表一个token游标的源代码.
 type TokenCursor struct {
-	sc *SrcCursor
+	sc         *SrcCursor
+	mode       Mode
+	errors     []*Error
+	insertSemi bool // insert a semicolon if the line ends before the next token
 }
 
 /// NewTokenCursor 返回一个新的token游标
@@ -95,40 +119,174 @@ func NewTokenCursor(sc *SrcCursor) *TokenCursor {
 	return &TokenCursor{sc: sc}
 }
 
+// NewTokenCursorMode returns a token cursor which tokenizes in the given mode.
+func NewTokenCursorMode(sc *SrcCursor, mode Mode) *TokenCursor {
+	return &TokenCursor{sc: sc, mode: mode}
+}
+
+// Next returns the next token.
+//
+// Like Go, a semicolon is automatically inserted at the end of a line (or the source)
+// if the last token of the line is
+//
+//	an identifier or a literal
+//	one of the keywords break, continue or return
+//	one of the operators ++, --, ), ] or }
+//
+// The inserted semicolon has the value "\n".
 func (tc *TokenCursor) Next() *token.Token {
+	if tc.mode&KeepTrivia == 0 {
+		if tc.insertSemi && tc.atLineEnd() {
+			return tc.autoSemicolon()
+		}
+		tc.eatWhitespace()
+		return tc.next()
+	}
 
-	tc.eatWhitespace()
-	startPos := tc.sc.rdPos
+	if tc.insertSemi && tc.atLineEnd() {
+		tok := tc.autoSemicolon()
+		tok.TrailingTrivia = tc.eatTrivia(true)
+		return tok
+	}
+	leading := tc.eatTrivia(false)
+	start := tc.sc.rdOff
+	tok := tc.next()
+	tok.Raw = string(tc.sc.src[start:tc.sc.rdOff])
+	tok.LeadingTrivia = leading
+	// the trivia up to the end of line belongs to the inserted semicolon
+	if tok.Kind != token.EOF && !(tc.insertSemi && tc.atLineEnd()) {
+		tok.TrailingTrivia = tc.eatTrivia(true)
+	}
+	return tok
+}
+
+func (tc *TokenCursor) autoSemicolon() *token.Token {
+	tc.insertSemi = false
+	pos := tc.sc.Pos()
+	return token.NewToken(token.SEMICOLON, "\n", pos, pos)
+}
+
+// atLineEnd reports whether there is nothing but whitespace and comments before the end of the line.
+// A multi-line comment ends the line.
+func (tc *TokenCursor) atLineEnd() bool {
+	src := tc.sc.src[tc.sc.rdOff:]
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case c == '\n':
+			return true
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			return true
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			n, terminated := blockCommentLen(src[i:])
+			if !terminated || bytes.IndexByte(src[i:i+n], '\n') >= 0 {
+				return true
+			}
+			i += n - 1
+		case c == ' ' || c == '\t' || c == '\r':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (tc *TokenCursor) next() *token.Token {
+	tok := tc.scan()
+	switch tok.Kind {
+	case token.COMMENT:
+		// a comment does not change the state
+	case token.IDENT, token.LABEL, token.INT_LITERAL, token.FLOAT_LITERAL, token.CHAR_LITERAL, token.STRING_LITERAL,
+		token.BOOLEAN_LITERAL, token.BREAK, token.CONTINUE, token.RETURN,
+		token.INC, token.DEC, token.RPAREN, token.RBRACK, token.RBRACE, token.QUESTION:
+		tc.insertSemi = true
+	default:
+		tc.insertSemi = false
+	}
+	return tok
+}
+
+func (tc *TokenCursor) scan() *token.Token {
+	startPos := tc.sc.Pos()
 
 	if tc.sc.Eof() {
-		return token.NewToken(token.EOF, "", &startPos, &startPos)
+		return token.NewToken(token.EOF, "", startPos, startPos)
 	}
 	switch ch := tc.sc.Peek(); {
 	case IsCommentStart(ch) && strings.ContainsRune("/*", rune(tc.sc.PeekN(2))):
-		return tc.eatComment(&startPos)
+		return tc.eatComment(startPos)
 	case IsIdentStart(ch):
-		return tc.eatIdent(&startPos)
-	case IsNumberLiteral(ch):
-		return tc.eatNumberLiteral(&startPos)
+		return tc.eatIdent(startPos)
+	case IsDecimalDigit(ch) || ch == '.' && IsDecimalDigit(tc.sc.PeekN(2)):
+		return tc.eatNumberLiteral(startPos)
+	case ch == '"':
+		return tc.eatStringLiteral(startPos)
+	case ch == '\'' && tc.atLabel():
+		return tc.eatLabel(startPos)
+	case ch == '\'':
+		return tc.eatCharLiteral(startPos)
 	case token.IsOperatorStart(ch):
-		return tc.eatOperator(&startPos)
+		return tc.eatOperator(startPos)
 	}
 
 	// illegal want
-	illegalStr := tc.sc.EatWhile(IsWhitespace)
-	return token.NewToken(token.ILLEGAL, illegalStr, &startPos, tc.endPos())
+	illegalStr := string(tc.sc.Next())
+	tc.error(startPos, fmt.Sprintf("illegal character %q", illegalStr))
+	return token.NewToken(token.ILLEGAL, illegalStr, startPos, tc.endPos())
+}
+
+// Errors returns the lexical errors found so far.
+func (tc *TokenCursor) Errors() []*Error {
+	return tc.errors
+}
+
+// File returns the file being tokenized.
+func (tc *TokenCursor) File() *token.File {
+	return tc.sc.file
+}
+
+func (tc *TokenCursor) error(pos token.Pos, msg string) {
+	tc.errors = append(tc.errors, &Error{Pos: tc.sc.file.Position(pos), Msg: msg})
 }
 
 func (tc *TokenCursor) endPos() token.Pos {
-	ep := tc.sc.rdPos
-	ep.col--
-	return &ep
+	return tc.sc.file.Pos(tc.sc.last)
 }
 
 func (tc *TokenCursor) eatWhitespace() {
 	tc.sc.EatWhile(IsWhitespace)
 }
 
+// eatTrivia eats whitespace, newlines and comments.
+// Trailing trivia ends at the first newline, which belongs to it.
+func (tc *TokenCursor) eatTrivia(trailing bool) []token.Trivia {
+	var l []token.Trivia
+	for !tc.sc.Eof() {
+		switch ch := tc.sc.Peek(); {
+		case ch == '\n':
+			tc.sc.Next()
+			l = append(l, token.Trivia{Kind: token.TriviaNewline, Val: "\n"})
+			if trailing {
+				return l
+			}
+		case IsWhitespace(ch):
+			ws := tc.sc.EatWhile(func(c Char) bool { return c != '\n' && IsWhitespace(c) })
+			l = append(l, token.Trivia{Kind: token.TriviaWhitespace, Val: ws})
+		case IsCommentStart(ch) && strings.ContainsRune("/*", tc.sc.PeekN(2)):
+			start := tc.sc.rdOff
+			tc.eatComment(tc.sc.Pos())
+			c := string(tc.sc.src[start:tc.sc.rdOff])
+			l = append(l, token.Trivia{Kind: token.TriviaComment, Val: c})
+			if trailing && strings.ContainsRune(c, '\n') {
+				// a multi-line comment ends the line of the token
+				return l
+			}
+		default:
+			return l
+		}
+	}
+	return l
+}
+
 func (tc *TokenCursor) eatComment(startPos token.Pos) *token.Token {
 	tc.sc.Next() // eat '/'
 
@@ -138,13 +296,22 @@ func (tc *TokenCursor) eatComment(startPos token.Pos) *token.Token {
 		c := tc.sc.EatWhile(func(c Char) bool { return c != '\n' })
 		return token.NewToken(token.COMMENT, c, startPos, tc.endPos())
 	case '*':
-		// multi line comment; /* xxx */
+		// multi line comment; /* xxx */, may be nested
+		n, terminated := blockCommentLen(tc.sc.src[tc.sc.last-1:])
+		end := tc.sc.last - 1 + n
+		if terminated {
+			end -= len("*/")
+		}
 		var c strings.Builder
-		for tc.sc.PeekN(2) != '/' {
-			comment := tc.sc.EatWhile(func(c Char) bool { return c != '*' })
-			c.WriteString(comment)
+		for tc.sc.rdOff < end {
+			c.WriteRune(tc.sc.Next())
+		}
+		if !terminated {
+			tc.error(startPos, "comment not terminated")
+		} else {
+			tc.sc.Next() // eat '*'
+			tc.sc.Next() // eat '/'
 		}
-		tc.sc.Next() // eat last '/'
 		return token.NewToken(token.COMMENT, c.String(), startPos, tc.endPos())
 
 	default:
@@ -154,6 +321,27 @@ func (tc *TokenCursor) eatComment(startPos token.Pos) *token.Token {
 
 }
 
+// blockCommentLen returns the length of the block comment at the start of src,
+// nested block comments are part of it.
+// If the comment is not terminated, it takes the rest of src.
+func blockCommentLen(src []byte) (n int, terminated bool) {
+	depth := 0
+	for i := 0; i+1 < len(src); i++ {
+		switch {
+		case src[i] == '/' && src[i+1] == '*':
+			depth++
+			i++
+		case src[i] == '*' && src[i+1] == '/':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1, true
+			}
+		}
+	}
+	return len(src), false
+}
+
 func (tc *TokenCursor) eatIdent(startPos token.Pos) *token.Token {
 	idVal := tc.sc.EatWhile(IsIdentBody)
 	if tk, ok := token.Keyword(idVal); ok {
@@ -167,42 +355,275 @@ func (tc *TokenCursor) eatIdent(startPos token.Pos) *token.Token {
 	}
 }
 
+// eatNumberLiteral eats an int or float literal:
+//
+//	123, 1_000, 0x7f, 0o17, 0b1010, 3.14, .5, 1e-9, 2.5E3
 func (tc *TokenCursor) eatNumberLiteral(startPos token.Pos) *token.Token {
-	numVal := tc.sc.EatWhile(IsNumberLiteral)
-	if strings.ContainsRune(numVal, '.') {
-		return token.NewToken(token.FLOAT_LITERAL, numVal, startPos, tc.endPos())
+	var v strings.Builder
+	kind := token.INT_LITERAL
+	errMsg := ""
+
+	if tc.sc.Peek() == '0' && strings.ContainsRune("xXoObB", tc.sc.PeekN(2)) {
+		v.WriteRune(tc.sc.Next())
+		prefix := tc.sc.Next()
+		v.WriteRune(prefix)
+		var name string
+		var base int
+		var digits string
+		switch prefix {
+		case 'x', 'X':
+			name, base = "hexadecimal", 16
+			digits = tc.eatDigits(&v, IsHexDigit)
+		case 'o', 'O':
+			name, base = "octal", 8
+			digits = tc.eatDigits(&v, IsDecimalDigit)
+		default:
+			name, base = "binary", 2
+			digits = tc.eatDigits(&v, IsDecimalDigit)
+		}
+		if strings.Trim(digits, "_") == "" {
+			errMsg = name + " literal has no digits"
+		} else if !isValidSeparators(digits, true) {
+			errMsg = "'_' must separate successive digits"
+		} else if i := strings.IndexFunc(digits, func(c rune) bool { return c != '_' && digitValue(c) >= base }); i >= 0 {
+			errMsg = fmt.Sprintf("invalid digit '%c' in %s literal", digits[i], name)
+		}
 	} else {
-		return token.NewToken(token.INT_LITERAL, numVal, startPos, tc.endPos())
+		intPart := tc.eatDigits(&v, IsDecimalDigit)
+		valid := isValidSeparators(intPart, false)
+		if tc.sc.Peek() == '.' && IsDecimalDigit(tc.sc.PeekN(2)) {
+			kind = token.FLOAT_LITERAL
+			v.WriteRune(tc.sc.Next()) // eat '.'
+			valid = valid && isValidSeparators(tc.eatDigits(&v, IsDecimalDigit), false)
+		}
+		if ch := tc.sc.Peek(); ch == 'e' || ch == 'E' {
+			kind = token.FLOAT_LITERAL
+			v.WriteRune(tc.sc.Next()) // eat 'e'
+			if ch := tc.sc.Peek(); ch == '+' || ch == '-' {
+				v.WriteRune(tc.sc.Next())
+			}
+			exp := tc.eatDigits(&v, IsDecimalDigit)
+			if strings.Trim(exp, "_") == "" {
+				errMsg = "exponent has no digits"
+			}
+			valid = valid && isValidSeparators(exp, false)
+		}
+		if !valid && errMsg == "" {
+			errMsg = "'_' must separate successive digits"
+		}
+	}
+
+	// like `1.2.3`
+	if tc.sc.Peek() == '.' && IsDecimalDigit(tc.sc.PeekN(2)) {
+		for ch := tc.sc.Peek(); ch == '.' || IsIdentBody(ch); ch = tc.sc.Peek() {
+			v.WriteRune(tc.sc.Next())
+		}
+		errMsg = "malformed number literal " + v.String()
+	}
+
+	if errMsg != "" {
+		tc.error(startPos, errMsg)
+		return token.NewToken(token.ILLEGAL, v.String(), startPos, tc.endPos())
 	}
+	return token.NewToken(kind, v.String(), startPos, tc.endPos())
+}
 
+// eatDigits eats digits and '_' separators, writes them to v and returns them.
+func (tc *TokenCursor) eatDigits(v *strings.Builder, isDigit func(c Char) bool) string {
+	digits := tc.sc.EatWhile(func(c Char) bool { return isDigit(c) || c == '_' })
+	v.WriteString(digits)
+	return digits
 }
 
-func (tc *TokenCursor) eatOperator(startPos token.Pos) *token.Token {
-	opFirstChar := tc.sc.Next()
-	opContinueChars := tc.sc.EatWhile(token.IsOperatorContinue)
-	opVal := string(opFirstChar) + opContinueChars
-	if tk, ok := token.Operator(opVal); ok {
-		return token.NewToken(tk, opVal, startPos, tc.endPos())
+// isValidSeparators reports whether every '_' in digits is between two digits.
+// A leading '_' is allowed after a base prefix, like `0x_ff`.
+func isValidSeparators(digits string, leadingOK bool) bool {
+	if digits == "" {
+		return true
+	}
+	return !strings.Contains(digits, "__") &&
+		!strings.HasSuffix(digits, "_") &&
+		(leadingOK || !strings.HasPrefix(digits, "_"))
+}
+
+func digitValue(c Char) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return 16 // larger than any base
+}
+
+func (tc *TokenCursor) eatStringLiteral(startPos token.Pos) *token.Token {
+	val, ok := tc.eatQuoted('"')
+	if !ok {
+		tc.error(startPos, "string literal not terminated")
+		return token.NewToken(token.ILLEGAL, val, startPos, tc.endPos())
+	}
+	return token.NewToken(token.STRING_LITERAL, val, startPos, tc.endPos())
+}
+
+func (tc *TokenCursor) eatCharLiteral(startPos token.Pos) *token.Token {
+	val, ok := tc.eatQuoted('\'')
+	if !ok {
+		tc.error(startPos, "char literal not terminated")
+		return token.NewToken(token.ILLEGAL, val, startPos, tc.endPos())
+	}
+	if utf8.RuneCountInString(val) != 1 {
+		tc.error(startPos, "char literal must contain exactly one character")
+		return token.NewToken(token.ILLEGAL, val, startPos, tc.endPos())
+	}
+	return token.NewToken(token.CHAR_LITERAL, val, startPos, tc.endPos())
+}
+
+// atLabel reports whether the cursor is at a label, which is a quote followed by an identifier.
+// Unlike a char literal, the identifier is not followed by a quote or EOF.
+func (tc *TokenCursor) atLabel() bool {
+	if !IsIdentStart(tc.sc.PeekN(2)) {
+		return false
+	}
+	n := 3
+	for IsIdentBody(tc.sc.PeekN(n)) {
+		n++
+	}
+	c := tc.sc.PeekN(n)
+	return c != '\'' && c != 0
+}
+
+// eatLabel eats a loop label like 'outer, the value of the token is the name without the quote.
+func (tc *TokenCursor) eatLabel(startPos token.Pos) *token.Token {
+	tc.sc.Next() // eat '\''
+	name := tc.sc.EatWhile(IsIdentBody)
+	return token.NewToken(token.LABEL, name, startPos, tc.endPos())
+}
 
+// eatQuoted eats a literal enclosed in quote and returns its unescaped value.
+// It returns false if the literal is not terminated before the end of line.
+func (tc *TokenCursor) eatQuoted(quote Char) (string, bool) {
+	tc.sc.Next() // eat opening quote
+	var v strings.Builder
+	for {
+		if tc.sc.Eof() || tc.sc.Peek() == '\n' {
+			return v.String(), false
+		}
+		switch ch := tc.sc.Peek(); ch {
+		case quote:
+			tc.sc.Next() // eat closing quote
+			return v.String(), true
+		case '\\':
+			tc.eatEscape(&v)
+		default:
+			v.WriteRune(tc.sc.Next())
+		}
+	}
+}
+
+// eatEscape eats an escape sequence and writes the escaped character to v.
+func (tc *TokenCursor) eatEscape(v *strings.Builder) {
+	escPos := tc.sc.Pos()
+	tc.sc.Next() // eat '\'
+	if tc.sc.Eof() {
+		return
+	}
+	switch ch := tc.sc.Next(); ch {
+	case 'n':
+		v.WriteByte('\n')
+	case 't':
+		v.WriteByte('\t')
+	case 'r':
+		v.WriteByte('\r')
+	case '0':
+		v.WriteByte(0)
+	case '\\', '"', '\'':
+		v.WriteRune(ch)
+	case 'x':
+		// \xNN, an ASCII character
+		digits := tc.eatHexDigits(2)
+		n, ok := hexValue(digits)
+		if len(digits) != 2 || !ok || n > utf8.RuneSelf-1 {
+			tc.error(escPos, "invalid escape sequence \\x"+digits+", want \\x00 to \\x7F")
+			return
+		}
+		v.WriteByte(byte(n))
+	case 'u':
+		// \u{NNNN}, a unicode code point of 1 to 6 hex digits
+		if tc.sc.Peek() != '{' {
+			tc.error(escPos, "invalid escape sequence, want \\u{NNNN}")
+			return
+		}
+		tc.sc.Next() // eat '{'
+		digits := tc.eatHexDigits(6)
+		if tc.sc.Peek() != '}' {
+			tc.error(escPos, "invalid escape sequence, want \\u{NNNN}")
+			return
+		}
+		tc.sc.Next() // eat '}'
+		n, ok := hexValue(digits)
+		if !ok || !utf8.ValidRune(rune(n)) {
+			tc.error(escPos, "invalid unicode code point \\u{"+digits+"}")
+			return
+		}
+		v.WriteRune(rune(n))
+	default:
+		tc.error(escPos, fmt.Sprintf("unknown escape sequence \\%c", ch))
+	}
+}
+
+// eatHexDigits eats at most n hex digits.
+func (tc *TokenCursor) eatHexDigits(n int) string {
+	var v strings.Builder
+	for ; n > 0 && IsHexDigit(tc.sc.Peek()); n-- {
+		v.WriteRune(tc.sc.Next())
+	}
+	return v.String()
+}
+
+func hexValue(digits string) (int, bool) {
+	if digits == "" {
+		return 0, false
 	}
-	return token.NewToken(token.ILLEGAL, opVal, startPos, tc.endPos())
+	n := 0
+	for _, c := range digits {
+		n = n*16 + digitValue(c)
+	}
+	return n, true
+}
 
+// eatOperator eats the longest operator, so `a=-1` is split into `=` and `-`.
+func (tc *TokenCursor) eatOperator(startPos token.Pos) *token.Token {
+	kind, n := token.LookupOperator(tc.sc.src[tc.sc.rdOff:])
+	opVal := string(tc.sc.src[tc.sc.rdOff : tc.sc.rdOff+n])
+	for i := 0; i < n; i++ {
+		tc.sc.Next() // operators are ASCII
+	}
+	if kind == token.ILLEGAL {
+		tc.error(startPos, fmt.Sprintf("invalid operator %s", opVal))
+	}
+	return token.NewToken(kind, opVal, startPos, tc.endPos())
 }
 
 func IsWhitespace(c Char) bool {
-	return unicode.IsSpace(rune(c))
+	return unicode.IsSpace(c)
 }
 
 func IsIdentStart(c Char) bool {
-	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c == '_')
+	return unicode.IsLetter(c) || c == '_'
 }
 
 func IsIdentBody(c Char) bool {
-	return IsIdentStart(c) || (c >= '0' && c <= '9')
+	return IsIdentStart(c) || unicode.IsDigit(c)
+}
+
+func IsDecimalDigit(c Char) bool {
+	return c >= '0' && c <= '9'
 }
 
-func IsNumberLiteral(c Char) bool {
-	return (c >= '0' && c <= '9') || c == '.'
+func IsHexDigit(c Char) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
 }
 
 func IsCommentStart(c Char) bool {
@@ -1,21 +1,31 @@
 package lexer
 
 import (
+	"fmt"
 	"reflect"
 	"sometimes/token"
 	"strings"
 	"testing"
 )
 
+func newTokenCursor(src string) *TokenCursor {
+	return NewTokenCursor(NewSrcCursor(token.NewFileSet().AddFile("", []byte(src))))
+}
+
+// pos returns the Pos of offset in the first file of a FileSet.
+func pos(offset int) token.Pos {
+	return token.Pos(1 + offset)
+}
+
 func TestTokenCursorNext(t *testing.T) {
-	startPos := &SrcPos{0, 0}
+	startPos := pos(0)
 	tests := []struct {
 		src  string
 		want *token.Token
 	}{
 		{
 			src:  "// 你麻痹",
-			want: token.NewToken(token.COMMENT, " 你麻痹", startPos, &SrcPos{0, 11}),
+			want: token.NewToken(token.COMMENT, " 你麻痹", startPos, pos(9)),
 		},
 		{
 			src: `/* 我操
@@ -23,60 +33,156 @@ func TestTokenCursorNext(t *testing.T) {
 🐂*/`,
 			want: token.NewToken(token.COMMENT, ` 我操
 真的牛逼i啊
-🐂`, startPos, &SrcPos{2, 4}),
+🐂`, startPos, pos(32)),
+		},
+		{
+			src:  "/* a * b **/",
+			want: token.NewToken(token.COMMENT, " a * b *", startPos, pos(11)),
+		},
+		{
+			src:  "/* a /* nested */ b */ c",
+			want: token.NewToken(token.COMMENT, " a /* nested */ b ", startPos, pos(21)),
 		},
 		{
 			src:  "T",
-			want: token.NewToken(token.IDENT, "T", startPos, &SrcPos{0, 0}),
+			want: token.NewToken(token.IDENT, "T", startPos, pos(0)),
 		},
 		{
 			src:  "taoyu",
-			want: token.NewToken(token.IDENT, "taoyu", startPos, &SrcPos{0, 4}),
+			want: token.NewToken(token.IDENT, "taoyu", startPos, pos(4)),
 		},
 		{
 			src:  "tao_Yu8",
-			want: token.NewToken(token.IDENT, "tao_Yu8", startPos, &SrcPos{0, 6}),
+			want: token.NewToken(token.IDENT, "tao_Yu8", startPos, pos(6)),
+		},
+		{
+			src:  "变量_1",
+			want: token.NewToken(token.IDENT, "变量_1", startPos, pos(7)),
+		},
+		{
+			src:  "π",
+			want: token.NewToken(token.IDENT, "π", startPos, pos(0)),
+		},
+		{
+			src:  `"你好"`,
+			want: token.NewToken(token.STRING_LITERAL, "你好", startPos, pos(7)),
 		},
 		{
 			src:  "1taoyu",
-			want: token.NewToken(token.INT_LITERAL, "1", startPos, &SrcPos{0, 0}),
+			want: token.NewToken(token.INT_LITERAL, "1", startPos, pos(0)),
 		},
 		{
 			src:  "if",
-			want: token.NewToken(token.IF, "if", startPos, &SrcPos{0, 1}),
+			want: token.NewToken(token.IF, "if", startPos, pos(1)),
 		},
 		{
 			src:  "314159",
-			want: token.NewToken(token.INT_LITERAL, "314159", startPos, &SrcPos{0, 5}),
+			want: token.NewToken(token.INT_LITERAL, "314159", startPos, pos(5)),
 		},
 		{
 			src:  "3.14159",
-			want: token.NewToken(token.FLOAT_LITERAL, "3.14159", startPos, &SrcPos{0, 6}),
+			want: token.NewToken(token.FLOAT_LITERAL, "3.14159", startPos, pos(6)),
 		},
 		{
 			src:  ".123",
-			want: token.NewToken(token.FLOAT_LITERAL, ".123", startPos, &SrcPos{0, 3}),
+			want: token.NewToken(token.FLOAT_LITERAL, ".123", startPos, pos(3)),
+		},
+		{
+			src:  "1_000_000",
+			want: token.NewToken(token.INT_LITERAL, "1_000_000", startPos, pos(8)),
+		},
+		{
+			src:  "0x7F_ff",
+			want: token.NewToken(token.INT_LITERAL, "0x7F_ff", startPos, pos(6)),
+		},
+		{
+			src:  "0o17",
+			want: token.NewToken(token.INT_LITERAL, "0o17", startPos, pos(3)),
+		},
+		{
+			src:  "0b1010",
+			want: token.NewToken(token.INT_LITERAL, "0b1010", startPos, pos(5)),
+		},
+		{
+			src:  "1e-9",
+			want: token.NewToken(token.FLOAT_LITERAL, "1e-9", startPos, pos(3)),
+		},
+		{
+			src:  "2.5E3",
+			want: token.NewToken(token.FLOAT_LITERAL, "2.5E3", startPos, pos(4)),
+		},
+		{
+			src:  "1..5",
+			want: token.NewToken(token.INT_LITERAL, "1", startPos, pos(0)),
+		},
+		{
+			src:  ".",
+			want: token.NewToken(token.PERIOD, ".", startPos, pos(0)),
+		},
+		{
+			src:  "1.2.3",
+			want: token.NewToken(token.ILLEGAL, "1.2.3", startPos, pos(4)),
 		},
 		{
 			src:  "8",
-			want: token.NewToken(token.INT_LITERAL, "8", startPos, &SrcPos{0, 0}),
+			want: token.NewToken(token.INT_LITERAL, "8", startPos, pos(0)),
 		},
 		{
 			src:  "&&",
-			want: token.NewToken(token.LAND, "&&", startPos, &SrcPos{0, 1}),
+			want: token.NewToken(token.LAND, "&&", startPos, pos(1)),
 		},
 		{
 			src:  "+",
-			want: token.NewToken(token.ADD, "+", startPos, &SrcPos{0, 0}),
+			want: token.NewToken(token.ADD, "+", startPos, pos(0)),
 		},
 		{
 			src:  "&",
-			want: token.NewToken(token.ILLEGAL, "&", startPos, &SrcPos{0, 0}),
+			want: token.NewToken(token.AND, "&", startPos, pos(0)),
+		},
+		{
+			src:  "~",
+			want: token.NewToken(token.TILDE, "~", startPos, pos(0)),
+		},
+		{
+			src:  `"hello"`,
+			want: token.NewToken(token.STRING_LITERAL, "hello", startPos, pos(6)),
+		},
+		{
+			src:  `""`,
+			want: token.NewToken(token.STRING_LITERAL, "", startPos, pos(1)),
+		},
+		{
+			src:  `"a\tb\n\\\"\'"`,
+			want: token.NewToken(token.STRING_LITERAL, "a\tb\n\\\"'", startPos, pos(13)),
+		},
+		{
+			src:  `"\x41\u{4e2d}\u{1F402}"`,
+			want: token.NewToken(token.STRING_LITERAL, "A中🐂", startPos, pos(22)),
+		},
+		{
+			src:  `'a'`,
+			want: token.NewToken(token.CHAR_LITERAL, "a", startPos, pos(2)),
+		},
+		{
+			src:  `'\''`,
+			want: token.NewToken(token.CHAR_LITERAL, "'", startPos, pos(3)),
+		},
+		{
+			src:  `'\u{4e2d}'`,
+			want: token.NewToken(token.CHAR_LITERAL, "中", startPos, pos(9)),
+		},
+		{
+			src:  `'outer: loop`,
+			want: token.NewToken(token.LABEL, "outer", startPos, pos(5)),
+		},
+		{
+			src:  "'a\n",
+			want: token.NewToken(token.LABEL, "a", startPos, pos(1)),
 		},
 	}
 
 	for _, testcase := range tests {
-		tc := NewTokenCursor(NewSrcCursor([]byte(testcase.src)))
+		tc := newTokenCursor(testcase.src)
 		got := tc.Next()
 		if !reflect.DeepEqual(testcase.want, got) {
 			t.Errorf("\n`%s`\n fisrt want want %s; \n              got %s",
@@ -85,6 +191,99 @@ func TestTokenCursorNext(t *testing.T) {
 	}
 }
 
+func TestTokenCursorErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []*Error
+	}{
+		{
+			src:  `"abc`,
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "string literal not terminated"}},
+		},
+		{
+			src: `"abc
+"`,
+			want: []*Error{
+				{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "string literal not terminated"},
+				{Pos: token.Position{Offset: 5, Line: 2, Column: 1}, Msg: "string literal not terminated"},
+			},
+		},
+		{
+			src:  `'a`,
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "char literal not terminated"}},
+		},
+		{
+			src:  `''`,
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "char literal must contain exactly one character"}},
+		},
+		{
+			src:  `'ab'`,
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "char literal must contain exactly one character"}},
+		},
+		{
+			src:  `"a\qb"`,
+			want: []*Error{{Pos: token.Position{Offset: 2, Line: 1, Column: 3}, Msg: "unknown escape sequence \\q"}},
+		},
+		{
+			src:  `"\xFF"`,
+			want: []*Error{{Pos: token.Position{Offset: 1, Line: 1, Column: 2}, Msg: "invalid escape sequence \\xFF, want \\x00 to \\x7F"}},
+		},
+		{
+			src:  `"\u{110000}"`,
+			want: []*Error{{Pos: token.Position{Offset: 1, Line: 1, Column: 2}, Msg: "invalid unicode code point \\u{110000}"}},
+		},
+		{
+			src:  "1.2.3",
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "malformed number literal 1.2.3"}},
+		},
+		{
+			src:  "0x",
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "hexadecimal literal has no digits"}},
+		},
+		{
+			src:  "0b102",
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "invalid digit '2' in binary literal"}},
+		},
+		{
+			src:  "0o78",
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "invalid digit '8' in octal literal"}},
+		},
+		{
+			src:  "1__000",
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "'_' must separate successive digits"}},
+		},
+		{
+			src:  "1_.5",
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "'_' must separate successive digits"}},
+		},
+		{
+			src:  "1e+",
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "exponent has no digits"}},
+		},
+		{
+			src:  `"\u1234"`,
+			want: []*Error{{Pos: token.Position{Offset: 1, Line: 1, Column: 2}, Msg: "invalid escape sequence, want \\u{NNNN}"}},
+		},
+		{
+			src:  "/* a /* b */",
+			want: []*Error{{Pos: token.Position{Offset: 0, Line: 1, Column: 1}, Msg: "comment not terminated"}},
+		},
+		{
+			src:  "a # b",
+			want: []*Error{{Pos: token.Position{Offset: 2, Line: 1, Column: 3}, Msg: "illegal character \"#\""}},
+		},
+	}
+
+	for _, testcase := range tests {
+		tc := newTokenCursor(testcase.src)
+		for next := tc.Next(); next.Kind != token.EOF; next = tc.Next() {
+		}
+		if !reflect.DeepEqual(testcase.want, tc.Errors()) {
+			t.Errorf("\n`%s`\n want %v;\n  got %v", testcase.src, testcase.want, tc.Errors())
+		}
+	}
+}
+
 func TestLexer(t *testing.T) {
 	tests := []struct {
 		src  string
@@ -97,25 +296,85 @@ fn main() -> int {
 }
 `,
 			want: []*token.Token{
-				token.NewToken(token.IDENT, "fn", &SrcPos{1, 0}, &SrcPos{1, 1}),
-				token.NewToken(token.IDENT, "main", &SrcPos{1, 3}, &SrcPos{1, 6}),
-				token.NewToken(token.LPAREN, "(", &SrcPos{1, 7}, &SrcPos{1, 7}),
-				token.NewToken(token.RPAREN, ")", &SrcPos{1, 8}, &SrcPos{1, 8}),
-				token.NewToken(token.ARROW, "->", &SrcPos{1, 10}, &SrcPos{1, 11}),
-				token.NewToken(token.IDENT, "int", &SrcPos{1, 13}, &SrcPos{1, 15}),
-				token.NewToken(token.LBRACE, "{", &SrcPos{1, 17}, &SrcPos{1, 17}),
-				token.NewToken(token.RETURN, "return", &SrcPos{2, 4}, &SrcPos{2, 9}),
-				token.NewToken(token.IDENT, "a", &SrcPos{2, 11}, &SrcPos{2, 11}),
-				token.NewToken(token.ADD, "+", &SrcPos{2, 12}, &SrcPos{2, 12}),
-				token.NewToken(token.IDENT, "b", &SrcPos{2, 13}, &SrcPos{2, 13}),
-				token.NewToken(token.SEMICOLON, ";", &SrcPos{2, 14}, &SrcPos{2, 14}),
-				token.NewToken(token.RBRACE, "}", &SrcPos{3, 0}, &SrcPos{3, 0}),
+				token.NewToken(token.FN, "fn", pos(1), pos(2)),
+				token.NewToken(token.IDENT, "main", pos(4), pos(7)),
+				token.NewToken(token.LPAREN, "(", pos(8), pos(8)),
+				token.NewToken(token.RPAREN, ")", pos(9), pos(9)),
+				token.NewToken(token.ARROW, "->", pos(11), pos(12)),
+				token.NewToken(token.IDENT, "int", pos(14), pos(16)),
+				token.NewToken(token.LBRACE, "{", pos(18), pos(18)),
+				token.NewToken(token.RETURN, "return", pos(24), pos(29)),
+				token.NewToken(token.IDENT, "a", pos(31), pos(31)),
+				token.NewToken(token.ADD, "+", pos(32), pos(32)),
+				token.NewToken(token.IDENT, "b", pos(33), pos(33)),
+				token.NewToken(token.SEMICOLON, ";", pos(34), pos(34)),
+				token.NewToken(token.RBRACE, "}", pos(36), pos(36)),
+				token.NewToken(token.SEMICOLON, "\n", pos(37), pos(37)),
+			},
+		},
+		{
+			src: `let 名字 = "值";`,
+			want: []*token.Token{
+				token.NewToken(token.LET, "let", pos(0), pos(2)),
+				token.NewToken(token.IDENT, "名字", pos(4), pos(7)),
+				token.NewToken(token.ASSIGN, "=", pos(11), pos(11)),
+				token.NewToken(token.STRING_LITERAL, "值", pos(13), pos(17)),
+				token.NewToken(token.SEMICOLON, ";", pos(18), pos(18)),
+			},
+		},
+		{
+			src: `a=-1!=!-b<-c->d`,
+			want: []*token.Token{
+				token.NewToken(token.IDENT, "a", pos(0), pos(0)),
+				token.NewToken(token.ASSIGN, "=", pos(1), pos(1)),
+				token.NewToken(token.SUB, "-", pos(2), pos(2)),
+				token.NewToken(token.INT_LITERAL, "1", pos(3), pos(3)),
+				token.NewToken(token.NEQ, "!=", pos(4), pos(5)),
+				token.NewToken(token.NOT, "!", pos(6), pos(6)),
+				token.NewToken(token.SUB, "-", pos(7), pos(7)),
+				token.NewToken(token.IDENT, "b", pos(8), pos(8)),
+				token.NewToken(token.LSS, "<", pos(9), pos(9)),
+				token.NewToken(token.SUB, "-", pos(10), pos(10)),
+				token.NewToken(token.IDENT, "c", pos(11), pos(11)),
+				token.NewToken(token.ARROW, "->", pos(12), pos(13)),
+				token.NewToken(token.IDENT, "d", pos(14), pos(14)),
+				token.NewToken(token.SEMICOLON, "\n", pos(15), pos(15)),
+			},
+		},
+		{
+			src: `i in 0..n.m..1.5`,
+			want: []*token.Token{
+				token.NewToken(token.IDENT, "i", pos(0), pos(0)),
+				token.NewToken(token.IN, "in", pos(2), pos(3)),
+				token.NewToken(token.INT_LITERAL, "0", pos(5), pos(5)),
+				token.NewToken(token.RANGE, "..", pos(6), pos(7)),
+				token.NewToken(token.IDENT, "n", pos(8), pos(8)),
+				token.NewToken(token.PERIOD, ".", pos(9), pos(9)),
+				token.NewToken(token.IDENT, "m", pos(10), pos(10)),
+				token.NewToken(token.RANGE, "..", pos(11), pos(12)),
+				token.NewToken(token.FLOAT_LITERAL, "1.5", pos(13), pos(15)),
+				token.NewToken(token.SEMICOLON, "\n", pos(16), pos(16)),
+			},
+		},
+		{
+			src: `match c { 'a'..='z' => 1 }`,
+			want: []*token.Token{
+				token.NewToken(token.MATCH, "match", pos(0), pos(4)),
+				token.NewToken(token.IDENT, "c", pos(6), pos(6)),
+				token.NewToken(token.LBRACE, "{", pos(8), pos(8)),
+				token.NewToken(token.CHAR_LITERAL, "a", pos(10), pos(12)),
+				token.NewToken(token.RANGE_INCL, "..=", pos(13), pos(15)),
+				token.NewToken(token.CHAR_LITERAL, "z", pos(16), pos(18)),
+				token.NewToken(token.FAT_ARROW, "=>", pos(20), pos(21)),
+				token.NewToken(token.INT_LITERAL, "1", pos(23), pos(23)),
+				token.NewToken(token.RBRACE, "}", pos(25), pos(25)),
+				token.NewToken(token.SEMICOLON, "\n", pos(26), pos(26)),
 			},
 		},
 	}
 
 	for _, testcase := range tests {
-		tc := NewTokenCursor(NewSrcCursor([]byte(testcase.src)))
+		tc := newTokenCursor(testcase.src)
 		var got []*token.Token
 		for next := tc.Next(); next.Kind != token.EOF; next = tc.Next() {
 			got = append(got, next)
@@ -140,3 +399,137 @@ func tokensToString(tokens ...*token.Token) string {
 	sb.WriteRune(']')
 	return sb.String()
 }
+
+func TestTokenCursorSemicolon(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string // token values, "\n" is an inserted semicolon
+	}{
+		{src: "a\nb", want: []string{"a", "\n", "b", "\n"}},
+		{src: "a;\n", want: []string{"a", ";"}},
+		{src: "f(1)\n[2]\n", want: []string{"f", "(", "1", ")", "\n", "[", "2", "]", "\n"}},
+		{src: "a +\nb", want: []string{"a", "+", "b", "\n"}},
+		{src: "return\nbreak\ncontinue\n", want: []string{"return", "\n", "break", "\n", "continue", "\n"}},
+		{src: "i++ // inc\n", want: []string{"i", "++", "\n", " inc"}},
+		{src: "f()?\ng(x?)\n", want: []string{"f", "(", ")", "?", "\n", "g", "(", "x", "?", ")", "\n"}},
+		{src: "1.5\n'c'\n\"s\"\ntrue\n", want: []string{"1.5", "\n", "c", "\n", "s", "\n", "true", "\n"}},
+		{src: "if a {\n} else {\n}", want: []string{"if", "a", "{", "}", "else", "{", "}", "\n"}},
+		{src: "let\nfn\n", want: []string{"let", "fn"}},
+		{src: "a /* x */ + b", want: []string{"a", " x ", "+", "b", "\n"}},
+		{src: "a /* x\n */ b", want: []string{"a", "\n", " x\n ", "b", "\n"}},
+	}
+	for _, testcase := range tests {
+		tc := newTokenCursor(testcase.src)
+		var got []string
+		for tok := tc.Next(); tok.Kind != token.EOF; tok = tc.Next() {
+			got = append(got, tok.Val)
+		}
+		if !reflect.DeepEqual(testcase.want, got) {
+			t.Errorf("`%s`:\n want %q\n  got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestTokenCursorTrivia(t *testing.T) {
+	src := "// add\nfn add(a, b) { // sum\n\treturn a+b;\n}\n"
+	tc := NewTokenCursorMode(NewSrcCursor(token.NewFileSet().AddFile("", []byte(src))), KeepTrivia)
+
+	ws := func(s string) token.Trivia { return token.Trivia{Kind: token.TriviaWhitespace, Val: s} }
+	nl := token.Trivia{Kind: token.TriviaNewline, Val: "\n"}
+	comment := func(s string) token.Trivia { return token.Trivia{Kind: token.TriviaComment, Val: s} }
+	tests := []struct {
+		raw               string
+		leading, trailing []token.Trivia
+	}{
+		{raw: "fn", leading: []token.Trivia{comment("// add"), nl}, trailing: []token.Trivia{ws(" ")}},
+		{raw: "add"},
+		{raw: "("},
+		{raw: "a"},
+		{raw: ",", trailing: []token.Trivia{ws(" ")}},
+		{raw: "b"},
+		{raw: ")", trailing: []token.Trivia{ws(" ")}},
+		{raw: "{", trailing: []token.Trivia{ws(" "), comment("// sum"), nl}},
+		{raw: "return", leading: []token.Trivia{ws("\t")}, trailing: []token.Trivia{ws(" ")}},
+		{raw: "a"},
+		{raw: "+"},
+		{raw: "b"},
+		{raw: ";", trailing: []token.Trivia{nl}},
+		{raw: "}"},
+		{raw: "", trailing: []token.Trivia{nl}}, // inserted ';'
+		{raw: ""},                               // EOF
+	}
+	for _, want := range tests {
+		got := tc.Next()
+		if got.Raw != want.raw ||
+			!reflect.DeepEqual(want.leading, got.LeadingTrivia) ||
+			!reflect.DeepEqual(want.trailing, got.TrailingTrivia) {
+			t.Errorf("want %q %v %v; got %q %v %v", want.raw, want.leading, want.trailing,
+				got.Raw, got.LeadingTrivia, got.TrailingTrivia)
+		}
+	}
+}
+
+func TestTokenCursorRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"   \n\n",
+		"fn main() {\n\tprint(\"你好\\n\");\n}",
+		"let a = 1; // trailing comment without newline",
+		"const A = 0x7f;\r\nconst B = 'b';\r\n",
+		"let s = \"abc\n# @ 1.2.3 &| 'ab'",
+		"\t// only a comment\n",
+		"fn f() { /* a /* b */ * c */ }\n/* unterminated",
+	}
+	for _, src := range tests {
+		tc := NewTokenCursorMode(NewSrcCursor(token.NewFileSet().AddFile("", []byte(src))), KeepTrivia)
+		var sb strings.Builder
+		for {
+			tok := tc.Next()
+			if tok.Kind == token.COMMENT {
+				t.Errorf("`%s`: unexpected COMMENT token", src)
+			}
+			sb.WriteString(tok.FullText())
+			if tok.Kind == token.EOF {
+				break
+			}
+		}
+		if got := sb.String(); got != src {
+			t.Errorf("round trip:\n want %q\n  got %q", src, got)
+		}
+	}
+}
+
+// genSource generates a syntactically valid source of about size bytes.
+func genSource(size int) []byte {
+	const fn = `
+// fibonacci
+fn fib%d(n) {
+	let a=1, b=1, t=0, i=2;
+	loop (i<n && !(a>=1000000)) {
+		t = a; a = b; b = t+a; i += 1;
+		if b%%2 == 0 { b = -b*-1; } else { b /= 1; };
+	};
+	return b != 0 || a <= -1;
+}
+`
+	var sb strings.Builder
+	for i := 0; sb.Len() < size; i++ {
+		fmt.Fprintf(&sb, fn, i)
+	}
+	return []byte(sb.String())
+}
+
+func benchmarkTokenCursor(b *testing.B, size int, mode Mode) {
+	src := genSource(size)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tc := NewTokenCursorMode(NewSrcCursor(token.NewFileSet().AddFile("", src)), mode)
+		for tok := tc.Next(); tok.Kind != token.EOF; tok = tc.Next() {
+		}
+	}
+}
+
+func BenchmarkTokenCursor64K(b *testing.B)      { benchmarkTokenCursor(b, 64<<10, 0) }
+func BenchmarkTokenCursor1M(b *testing.B)       { benchmarkTokenCursor(b, 1<<20, 0) }
+func BenchmarkTokenCursorTrivia1M(b *testing.B) { benchmarkTokenCursor(b, 1<<20, KeepTrivia) }
@@ -1,8 +1,11 @@
 package main
 
 import (
-	"sometimes/lexer"
-	"sometimes/parser"
+	"errors"
+	"fmt"
+	"os"
+	"sometimes/module"
+	"sometimes/token"
 	"sometimes/visitor"
 	"sometimes/vm"
 	"sometimes/vm/assembly"
@@ -13,20 +16,34 @@ func main() {
 		`
 // 计算第 n 项斐波拉契数列小程序
 fn main() {
-	let a=1, b=1, t=0;
-	let i=2, n=7;
+	let a=1, b=1, t=0
+	let i=2, n=7
 	loop (i<n) {
-		t = a;
-		a = b;
-		b = t + a;
-		i += 1;
-	};
-	print(b);
+		t = a
+		a = b
+		b = t + a
+		i += 1
+	}
+	print(b)
 }
 `
-	parser := parser.NewParser(lexer.NewTokenCursor(lexer.NewSrcCursor([]byte(code))))
-	vis := visitor.NewVistor()
-	prog := vis.Visit(parser.Parse())
+	fset := token.NewFileSet()
+	resolver := module.NewResolver(fset, os.DirFS("."))
+	mod, parseDiags := resolver.LoadMain("main.st", []byte(code))
+	if len(parseDiags) > 0 {
+		for _, d := range parseDiags {
+			fmt.Fprintln(os.Stderr, d.Format(fset))
+		}
+		os.Exit(1)
+	}
+	vis := visitor.NewVistor(fset)
+	prog := vis.VisitModule(mod)
+	if diags := vis.Diagnostics(); len(diags) > 0 {
+		for _, d := range diags {
+			fmt.Fprintln(os.Stderr, d.Format(fset))
+		}
+		os.Exit(1)
+	}
 
 	asmCompiler := assembly.NewCompiler(prog)
 	asm := asmCompiler.Compile()
@@ -34,5 +51,16 @@ fn main() {
 
 	program := vm.NewProgramFromAsm(asm)
 	machine := vm.New(program, 256, 128)
-	machine.Execute()
+	if err := machine.Execute(); err != nil {
+		var rerr *vm.RuntimeError
+		if errors.As(err, &rerr) {
+			fmt.Fprintf(os.Stderr, "%s: runtime error: %s\n", fset.Position(rerr.Pos), rerr.Err)
+			for _, pos := range rerr.Trace {
+				fmt.Fprintf(os.Stderr, "\tcalled from %s\n", fset.Position(pos))
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
 }
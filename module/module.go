@@ -0,0 +1,151 @@
+// Package module loads the modules imported by a program.
+package module
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sometimes/ast"
+	"sometimes/lexer"
+	"sometimes/parser"
+	"sometimes/token"
+	"strings"
+)
+
+// Ext is the extension of source files, the module "a/b" is the file "a/b.st".
+const Ext = ".st"
+
+// Module is a parsed source file and the modules it imports.
+type Module struct {
+	Path    string // import path; empty for the main module
+	File    *ast.File
+	Imports map[string]*Module // by import path; nil if the module could not be loaded
+}
+
+// Resolver loads modules from a list of roots, a module is loaded from the first root which has it.
+// Modules are cached, a module imported by several modules is parsed once.
+type Resolver struct {
+	fset    *token.FileSet
+	roots   []fs.FS
+	modules map[string]*Module
+	loading []string // import paths of the modules being loaded, innermost last
+	diags   []parser.Diagnostic
+}
+
+// NewResolver returns a Resolver which loads modules from roots, files are added to fset.
+func NewResolver(fset *token.FileSet, roots ...fs.FS) *Resolver {
+	return &Resolver{
+		fset:    fset,
+		roots:   roots,
+		modules: make(map[string]*Module),
+	}
+}
+
+// SearchPath returns the roots of a list of directories.
+func SearchPath(dirs ...string) []fs.FS {
+	roots := make([]fs.FS, 0, len(dirs))
+	for _, dir := range dirs {
+		roots = append(roots, os.DirFS(dir))
+	}
+	return roots
+}
+
+// LoadMain parses the main module and loads the modules it imports, recursively.
+// Syntax errors and modules which cannot be loaded are returned as diagnostics.
+func (r *Resolver) LoadMain(filename string, src []byte) (*Module, []parser.Diagnostic) {
+	n := len(r.diags)
+	file := r.fset.AddFile(filename, src)
+	m := &Module{File: r.parse(file)}
+	r.resolveImports(m)
+	return m, r.diags[n:]
+}
+
+func (r *Resolver) parse(file *token.File) *ast.File {
+	f, diags := parser.NewParser(lexer.NewTokenCursor(lexer.NewSrcCursor(file))).Parse()
+	r.diags = append(r.diags, diags...)
+	return f
+}
+
+func (r *Resolver) resolveImports(m *Module) {
+	m.Imports = make(map[string]*Module, len(m.File.Imports))
+	for _, imp := range m.File.Imports {
+		m.Imports[imp.Path.Val] = r.load(imp)
+	}
+}
+
+// load loads the module imported by imp.
+func (r *Resolver) load(imp *ast.ImportDecl) *Module {
+	path := imp.Path.Val
+	for i, p := range r.loading {
+		if p == path {
+			cycle := append(r.loading[i:len(r.loading):len(r.loading)], path)
+			r.errorf(imp.Path, "import cycle not allowed: %s", strings.Join(cycle, " -> "))
+			return nil
+		}
+	}
+	if m, ok := r.modules[path]; ok {
+		return m
+	}
+	if !validPath(path) {
+		r.errorf(imp.Path, "invalid import path %q", path)
+		return nil
+	}
+
+	src, err := r.read(path + Ext)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			r.errorf(imp.Path, "cannot find module %q", path)
+		} else {
+			r.errorf(imp.Path, "cannot load module %q: %v", path, err)
+		}
+		r.modules[path] = nil
+		return nil
+	}
+	f := r.fset.AddFile(path+Ext, src)
+	m := &Module{Path: path, File: r.parse(f)}
+	r.modules[path] = m
+
+	r.loading = append(r.loading, path)
+	r.resolveImports(m)
+	r.loading = r.loading[:len(r.loading)-1]
+	return m
+}
+
+// read reads a file from the first root which has it.
+func (r *Resolver) read(name string) ([]byte, error) {
+	err := fs.ErrNotExist
+	for _, root := range r.roots {
+		var src []byte
+		src, err = fs.ReadFile(root, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return src, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+}
+
+// validPath reports whether path is a slash-separated path whose last element is an identifier,
+// which qualifies the names of the module.
+func validPath(path string) bool {
+	if !fs.ValidPath(path) || path == "." {
+		return false
+	}
+	name := path[strings.LastIndexByte(path, '/')+1:]
+	for i, c := range name {
+		if i == 0 && !lexer.IsIdentStart(c) || !lexer.IsIdentBody(c) {
+			return false
+		}
+	}
+	_, isKeyword := token.Keyword(name)
+	return !isKeyword
+}
+
+func (r *Resolver) errorf(n ast.Node, format string, args ...interface{}) {
+	r.diags = append(r.diags, parser.Diagnostic{
+		Severity: parser.SeverityError,
+		Start:    n.StartPos(),
+		End:      n.EndPos(),
+		Msg:      fmt.Sprintf(format, args...),
+	})
+}
@@ -0,0 +1,66 @@
+package module
+
+import (
+	"reflect"
+	"sometimes/token"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMain(t *testing.T) {
+	std := fstest.MapFS{
+		"math.st": {Data: []byte("const Pi = 3.14\n")},
+	}
+	local := fstest.MapFS{
+		"geo/point.st": {Data: []byte("import \"math\"\nfn area(r) { math.Pi * r * r }\n")},
+		"math.st":      {Data: []byte("shadowed by std")},
+	}
+	r := NewResolver(token.NewFileSet(), std, local)
+	m, diags := r.LoadMain("main.st", []byte("import \"geo/point\"\nimport \"math\"\nfn main() {}\n"))
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	point, math := m.Imports["geo/point"], m.Imports["math"]
+	if point == nil || point.Path != "geo/point" || len(point.File.Fns) != 1 {
+		t.Fatalf("want module geo/point with 1 fn; got %+v", point)
+	}
+	if math == nil || len(math.File.Consts) != 1 {
+		t.Fatalf("want module math of the first root; got %+v", math)
+	}
+	if point.Imports["math"] != math {
+		t.Errorf("want math loaded once")
+	}
+}
+
+func TestLoadMainDiagnostics(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.st":      {Data: []byte("import \"b\"\n")},
+		"b.st":      {Data: []byte("import \"c\"\n")},
+		"c.st":      {Data: []byte("import \"a\"\n")},
+		"self.st":   {Data: []byte("import \"self\"\n")},
+		"syntax.st": {Data: []byte("fn f( {}\n")},
+	}
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{src: `import "a"`, want: []string{`c.st:1:8: Error: import cycle not allowed: a -> b -> c -> a`}},
+		{src: `import "self"`, want: []string{`self.st:1:8: Error: import cycle not allowed: self -> self`}},
+		{src: `import "nope"`, want: []string{`main.st:1:8: Error: cannot find module "nope"`}},
+		{src: `import "a-b"`, want: []string{`main.st:1:8: Error: invalid import path "a-b"`}},
+		{src: `import "../a"`, want: []string{`main.st:1:8: Error: invalid import path "../a"`}},
+		{src: `import "syntax"`, want: []string{`syntax.st:1:7: Error: expected 'IDENT', found '{'`}},
+	}
+	for _, testcase := range tests {
+		fset := token.NewFileSet()
+		_, diags := NewResolver(fset, fsys).LoadMain("main.st", []byte(testcase.src))
+		var got []string
+		for _, d := range diags {
+			got = append(got, d.Format(fset))
+		}
+		if !reflect.DeepEqual(testcase.want, got) {
+			t.Errorf("`%s`:\n want %q;\n  got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package parser
+
+import (
+	"fmt"
+	"sometimes/token"
+)
+
+//go:generate stringer -type=Severity -trimprefix=Severity
+type Severity uint8
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+// Diagnostic is a problem found in the source code.
+type Diagnostic struct {
+	Severity   Severity
+	Start, End token.Pos
+	Msg        string
+	Expected   []string // the tokens expected at Start; optional
+}
+
+// Format returns the diagnostic after its position, which is resolved by fset.
+func (d Diagnostic) Format(fset *token.FileSet) string {
+	return fmt.Sprintf("%s: %s: %s", fset.Position(d.Start).String(), d.Severity.String(), d.Msg)
+}
+
+// bailout is used to unwind the parser to the nearest recovery point after a syntax error.
+type bailout struct{}
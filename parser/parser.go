@@ -2,101 +2,289 @@ package parser
 
 import (
 	"fmt"
-	"log"
 	"sometimes/ast"
 	"sometimes/lexer"
 	"sometimes/token"
+	"strings"
 )
 
 type Parser struct {
-	tc  *lexer.TokenCursor
-	tok *token.Token
+	tc      *lexer.TokenCursor
+	file    *token.File
+	tok     *token.Token
+	doc     string // text of the comments directly above tok
+	diags   []Diagnostic
+	lexErrs int       // number of lexer errors reported
+	exprLev int       // < 0: in a condition followed by a block, where `T {` is not a struct literal
+	stmtPos token.Pos // start of the statement being parsed, `x++` and `x := e` may only begin there
 }
 
 func NewParser(tc *lexer.TokenCursor) *Parser {
 	return &Parser{
-		tc: tc,
+		tc:   tc,
+		file: tc.File(),
 	}
 }
 
-func (p *Parser) Parse() (consts []*ast.ConstDecl, fns []*ast.FnDecl) {
+// Parse parses a source file.
+// Syntax errors are returned as diagnostics, the file contains every declaration that could be parsed.
+func (p *Parser) Parse() (*ast.File, []Diagnostic) {
+	file := &ast.File{}
 	p.next()
 	for p.tok.Kind != token.EOF {
-		switch p.tok.Kind {
-		case token.CONST:
-			consts = append(consts, p.parseConstDecl())
-		case token.FN:
-			fns = append(fns, p.parseFnDecl())
-		default:
-			p.errorExpect("const' or 'fn")
-		}
-		p.next()
+		p.parseDecl(file)
 	}
-	return
+	return file, p.diags
 }
 
 func (p *Parser) next() {
+	prevLine := 0
+	if p.tok != nil {
+		prevLine = p.line(p.tok.EndPos)
+	}
+	// group the comments before the next token, a blank line ends a group
+	var group []*token.Token
 	tok := p.tc.Next()
 	for tok.Kind == token.COMMENT {
+		switch {
+		case len(group) == 0 && p.line(tok.StartPos) == prevLine:
+			// a comment at the end of the previous line
+		case len(group) > 0 && p.line(tok.StartPos) > p.line(group[len(group)-1].EndPos)+1:
+			group = []*token.Token{tok}
+		default:
+			group = append(group, tok)
+		}
 		tok = p.tc.Next()
 	}
+	p.doc = ""
+	if len(group) > 0 && p.line(group[len(group)-1].EndPos)+1 == p.line(tok.StartPos) {
+		p.doc = p.commentText(group)
+	}
 	p.tok = tok
+
+	errs := p.tc.Errors()
+	for _, err := range errs[p.lexErrs:] {
+		p.diags = append(p.diags, Diagnostic{
+			Severity: SeverityError,
+			Start:    p.file.Pos(err.Pos.Offset),
+			End:      p.file.Pos(err.Pos.Offset),
+			Msg:      err.Msg,
+		})
+	}
+	p.lexErrs = len(errs)
 }
 
-func (p *Parser) parseConstDecl() *ast.ConstDecl {
+func (p *Parser) line(pos token.Pos) int {
+	return p.file.Position(pos).Line
+}
+
+// commentText returns the text of a comment group.
+// Comment markers, the first space of a line comment and leading and trailing blank lines are removed.
+func (p *Parser) commentText(group []*token.Token) string {
+	var lines []string
+	for _, c := range group {
+		if p.file.Src()[p.file.Offset(c.StartPos)+1] == '/' {
+			lines = append(lines, strings.TrimPrefix(c.Val, " "))
+		} else {
+			lines = append(lines, strings.Split(c.Val, "\n")...)
+		}
+	}
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *Parser) parseDecl(file *ast.File) {
+	defer p.sync(token.FN, token.CONST, token.IMPORT, token.STRUCT)
+
+	switch p.tok.Kind {
+	case token.IMPORT:
+		file.Imports = append(file.Imports, p.parseImportDecl())
+	case token.CONST:
+		file.Consts = append(file.Consts, p.parseConstDecl())
+	case token.STRUCT:
+		file.Structs = append(file.Structs, p.parseStructDecl())
+	case token.FN:
+		file.Fns = append(file.Fns, p.parseFnDecl())
+	default:
+		p.errorExpect("const", "fn", "import", "struct")
+	}
+}
+
+// sync recovers from a syntax error by skipping tokens until one of kinds or EOF is found.
+// It must be deferred.
+func (p *Parser) sync(kinds ...token.Kind) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(bailout); !ok {
+		panic(r)
+	}
+	p.exprLev = 0
+	for p.tok.Kind != token.EOF && !p.tokIn(kinds...) {
+		p.next()
+	}
+}
+
+func (p *Parser) tokIn(kinds ...token.Kind) bool {
+	for _, kind := range kinds {
+		if p.tok.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Parser) parseImportDecl() *ast.ImportDecl {
 	startPos := p.tok.StartPos
+	p.expect(token.IMPORT)
+	if p.tok.Kind != token.STRING_LITERAL {
+		p.errorExpect("import path")
+	}
+	path := &ast.Literal{
+		BaseExpr: ast.NewBaseExpr(p.tok.StartPos, p.tok.EndPos),
+		Kind:     p.tok.Kind,
+		Val:      p.tok.Val,
+	}
+	p.next()
+	endPos := p.tok.EndPos
+	p.expect(token.SEMICOLON)
+	return &ast.ImportDecl{
+		BaseNode: ast.NewBaseNode(startPos, endPos),
+		Path:     path,
+	}
+}
+
+func (p *Parser) parseConstDecl() *ast.ConstDecl {
+	startPos, doc := p.tok.StartPos, p.doc
 	p.expect(token.CONST)
 	var l []ast.ValueDecl
 	for {
 		l = append(l, p.parseValueDecl())
 		if p.tok.Kind == token.SEMICOLON || p.tok.Kind == token.EOF {
-			p.next()
 			break
 		} else {
-			p.expect(token.COMMA)
+			p.expectComma(token.SEMICOLON)
 		}
 	}
-	p.next()
+	endPos := p.tok.EndPos
+	p.expect(token.SEMICOLON)
 	return &ast.ConstDecl{
-		BaseNode: ast.NewBaseNode(startPos, p.tok.EndPos),
+		BaseNode: ast.NewBaseNode(startPos, endPos),
+		Doc:      doc,
 		Decls:    l,
 	}
 }
 
-func (p *Parser) parseFnDecl() *ast.FnDecl {
-	startPos := p.tok.StartPos
-	p.expect(token.FN)
-	fnName := p.parseIdent()
-	p.expect(token.LPAREN)
+func (p *Parser) parseStructDecl() *ast.StructDecl {
+	startPos, doc := p.tok.StartPos, p.doc
+	p.expect(token.STRUCT)
+	name := p.parseIdent()
+	p.expect(token.LBRACE)
 
-	var params []*ast.Ident
-	for p.tok.Kind != token.RPAREN && p.tok.Kind != token.EOF {
-		params = append(params, p.parseIdent())
-		if p.tok.Kind == token.RPAREN || p.tok.Kind == token.EOF {
+	var fields []*ast.Ident
+	for p.tok.Kind != token.RBRACE && p.tok.Kind != token.EOF {
+		fields = append(fields, p.parseIdent())
+		if p.tok.Kind == token.RBRACE || p.tok.Kind == token.EOF {
 			break
 		} else {
-			p.expect(token.COMMA)
+			p.expectFieldSep()
 		}
 	}
 
-	p.next() // eat ')'
+	endPos := p.tok.EndPos
+	p.expect(token.RBRACE)
+	if p.tok.Kind == token.SEMICOLON {
+		p.next()
+	}
+	return &ast.StructDecl{
+		BaseNode: ast.NewBaseNode(startPos, endPos),
+		Doc:      doc,
+		Name:     name,
+		Fields:   fields,
+	}
+}
+
+func (p *Parser) parseFnDecl() *ast.FnDecl {
+	startPos, doc := p.tok.StartPos, p.doc
+	p.expect(token.FN)
+	fnName := p.parseIdent()
+	params := p.parseParams()
 	body := p.parseBlockExpr()
+	if p.tok.Kind == token.SEMICOLON {
+		p.next() // `fn f() {}` may be followed by a semicolon, usually an inserted one
+	}
 
 	return &ast.FnDecl{
 		BaseNode: ast.NewBaseNode(startPos, body.EndPos()),
+		Doc:      doc,
 		FnName:   fnName,
 		Args:     params,
 		Body:     body,
 	}
 }
+
+// parseParams parses `(a, b = 1, ..rest)`, the rest parameter must be the last.
+func (p *Parser) parseParams() []ast.Param {
+	p.expect(token.LPAREN)
+	var params []ast.Param
+	for p.tok.Kind != token.RPAREN && p.tok.Kind != token.EOF {
+		var param ast.Param
+		if p.tok.Kind == token.RANGE {
+			p.next() // eat '..'
+			param.Rest = true
+		}
+		param.Name = p.parseIdent()
+		if !param.Rest && p.tok.Kind == token.ASSIGN {
+			p.next() // eat '='
+			param.Default = p.parseExpr()
+		}
+		params = append(params, param)
+		if p.tok.Kind == token.RPAREN || p.tok.Kind == token.EOF {
+			break
+		} else {
+			p.expectComma(token.RPAREN)
+		}
+		if param.Rest {
+			// only a trailing comma may follow the rest parameter
+			break
+		}
+	}
+	p.expect(token.RPAREN)
+	return params
+}
+
 func (p *Parser) parseExpr() ast.Expr {
 	switch p.tok.Kind {
 	case token.IF:
 		return p.parseIfExpr()
 	case token.LOOP:
-		return p.parseLoopExpr()
+		return p.parseLoopExpr(nil)
+	case token.LABEL:
+		label := p.parseLabel()
+		p.expect(token.COLON)
+		if p.tok.Kind != token.LOOP {
+			p.errorExpect("loop")
+		}
+		return p.parseLoopExpr(label)
+	case token.SWITCH:
+		return p.parseSwitchExpr()
+	case token.MATCH:
+		return p.parseMatchExpr()
 	case token.RETURN:
 		return p.parseRetExpr()
+	case token.THROW:
+		return p.parseThrowExpr()
+	case token.TRY:
+		return p.parseTryExpr()
 	case token.LET:
 		return p.parseLetExpr()
 	case token.BREAK:
@@ -105,6 +293,8 @@ func (p *Parser) parseExpr() ast.Expr {
 		return p.parseContinueExpr()
 	case token.LBRACK: // '['
 		return p.parseArrayExpr()
+	case token.LBRACE: // '{'
+		return p.parseMapExpr()
 	default:
 		return p.parseBinaryExpr(token.LowestPrec + 1)
 	}
@@ -112,7 +302,7 @@ func (p *Parser) parseExpr() ast.Expr {
 
 func (p *Parser) parseUnaryExpr() ast.Expr {
 	switch p.tok.Kind {
-	case token.NOT, token.SUB:
+	case token.NOT, token.SUB, token.TILDE:
 		op := p.tok
 		p.next()
 		e := p.parseUnaryExpr()
@@ -149,6 +339,9 @@ func (p *Parser) parseOperand() ast.Expr {
 	switch p.tok.Kind {
 	case token.IDENT:
 		x := p.parseIdent()
+		if p.tok.Kind == token.LBRACE && p.exprLev >= 0 {
+			return p.parseStructLit(x)
+		}
 		return x
 	case token.INT_LITERAL, token.FLOAT_LITERAL, token.CHAR_LITERAL, token.STRING_LITERAL, token.BOOLEAN_LITERAL:
 		x := &ast.Literal{
@@ -158,10 +351,14 @@ func (p *Parser) parseOperand() ast.Expr {
 		}
 		p.next()
 		return x
+	case token.FN:
+		return p.parseFuncLit()
 	case token.LPAREN:
 		lparenPos := p.tok.StartPos
 		p.next() // eat '('
+		p.exprLev++
 		inner := p.parseExpr()
+		p.exprLev--
 		p.expect(token.RPAREN) // eat ')'
 		rparenPos := p.tok.EndPos
 		return &ast.ParenExpr{
@@ -181,30 +378,105 @@ func (p *Parser) parsePrimaryExpr() ast.Expr {
 			x = p.parseIndexExpr(x)
 		case token.LPAREN: // (
 			x = p.parseCallExpr(x)
+		case token.PERIOD: // .
+			p.next()
+			sel := p.parseIdent()
+			_, qualified := x.(*ast.Ident)
+			x = &ast.SelectorExpr{
+				BaseExpr: ast.NewBaseExpr(x.StartPos(), sel.EndPos()),
+				X:        x,
+				Sel:      sel,
+			}
+			if qualified && p.tok.Kind == token.LBRACE && p.exprLev >= 0 {
+				// a struct of an imported module
+				x = p.parseStructLit(x)
+			}
 		case token.ASSIGN, token.ADD_ASSIGN, token.MUL_ASSIGN,
-			token.QUO_ASSIGN, token.REM_ASSIGN, token.SUB_ASSIGN:
-			if _, isIdent := x.(*ast.Ident); isIdent {
-				op := p.tok
-				p.next()
+			token.QUO_ASSIGN, token.REM_ASSIGN, token.SUB_ASSIGN,
+			token.AND_ASSIGN, token.OR_ASSIGN, token.XOR_ASSIGN,
+			token.SHL_ASSIGN, token.SHR_ASSIGN:
+			p.checkAssignable(x)
+			op := p.tok
+			p.next()
 
-				rhs := p.parseExpr()
-				// p.expect(token.SEMICOLON)
-				x = &ast.AssignExpr{
-					BaseExpr: ast.NewBaseExpr(x.StartPos(), p.tok.EndPos),
-					Lhs:      x,
-					Rhs:      rhs,
-					Op:       op,
+			rhs := p.parseExpr()
+			// p.expect(token.SEMICOLON)
+			x = &ast.AssignExpr{
+				BaseExpr: ast.NewBaseExpr(x.StartPos(), p.tok.EndPos),
+				Lhs:      x,
+				Rhs:      rhs,
+				Op:       op,
+			}
+		case token.QUESTION: // ?
+			x = &ast.PropagateExpr{
+				BaseExpr: ast.NewBaseExpr(x.StartPos(), p.tok.EndPos),
+				X:        x,
+			}
+			p.next()
+		case token.INC, token.DEC, token.DEFINE:
+			// parsed by parseSimpleStmt
+			if x.StartPos() != p.stmtPos {
+				stmt := x.String() + p.tok.Kind.String()
+				if p.tok.Kind == token.DEFINE {
+					stmt = x.String() + " := ..."
 				}
+				p.error(x.StartPos(), p.tok.EndPos, fmt.Sprintf("cannot use %s as value", stmt))
 			}
+			return x
 		default:
 			return x
 		}
 	}
 }
 
+// parseFuncLit parses `fn(a, b) { ... }` or `fn(a, b) -> expr`.
+func (p *Parser) parseFuncLit() *ast.FuncLit {
+	startPos := p.tok.StartPos
+	p.expect(token.FN)
+	params := p.parseParams()
+
+	// the body is not a condition even if the literal is in one
+	outer := p.exprLev
+	p.exprLev = 0
+	var body *ast.BlockExpr
+	if p.tok.Kind == token.ARROW {
+		p.next()
+		x := p.parseExpr()
+		body = &ast.BlockExpr{
+			BaseExpr: ast.NewBaseExpr(x.StartPos(), x.EndPos()),
+			RetExpr:  x,
+		}
+	} else {
+		body = p.parseBlockExpr()
+	}
+	p.exprLev = outer
+	return &ast.FuncLit{
+		BaseExpr: ast.NewBaseExpr(startPos, body.EndPos()),
+		Args:     params,
+		Body:     body,
+	}
+}
+
+// isAssignable reports whether x may appear on the left side of an assignment.
+func isAssignable(x ast.Expr) bool {
+	switch x.(type) {
+	case *ast.Ident, *ast.IndexExpr, *ast.SelectorExpr:
+		return true
+	}
+	return false
+}
+
+func (p *Parser) checkAssignable(x ast.Expr) {
+	if !isAssignable(x) {
+		p.error(x.StartPos(), x.EndPos(), fmt.Sprintf("cannot assign to %s", x.String()))
+	}
+}
+
 func (p *Parser) parseIndexExpr(addr ast.Expr) *ast.IndexExpr {
 	p.expect(token.LBRACK)
+	p.exprLev++
 	e := p.parseExpr()
+	p.exprLev--
 	p.expect(token.RBRACK)
 	return &ast.IndexExpr{
 		BaseExpr: ast.NewBaseExpr(addr.StartPos(), p.tok.EndPos),
@@ -215,16 +487,18 @@ func (p *Parser) parseIndexExpr(addr ast.Expr) *ast.IndexExpr {
 
 func (p *Parser) parseCallExpr(f ast.Expr) *ast.CallExpr {
 	p.expect(token.LPAREN)
+	p.exprLev++
 	var args []ast.Expr
 	for p.tok.Kind != token.RPAREN && p.tok.Kind != token.EOF {
 		args = append(args, p.parseExpr())
 		if p.tok.Kind == token.RPAREN || p.tok.Kind == token.EOF {
 			break
 		} else {
-			p.expect(token.COMMA) // eat ','
+			p.expectComma(token.RPAREN)
 		}
 	}
-	p.next()
+	p.exprLev--
+	p.expect(token.RPAREN)
 	return &ast.CallExpr{
 		BaseExpr: ast.NewBaseExpr(f.StartPos(), p.tok.EndPos),
 		Func:     f,
@@ -232,10 +506,46 @@ func (p *Parser) parseCallExpr(f ast.Expr) *ast.CallExpr {
 	}
 }
 
+// parseStructLit parses `T { a: x, b: y }`, typ is the already parsed T.
+// parseStructLit parses `T { a: 1 }`, typ is the already parsed T or m.T.
+func (p *Parser) parseStructLit(typ ast.Expr) *ast.StructLit {
+	p.expect(token.LBRACE)
+	p.exprLev++
+	var fields []ast.FieldInit
+	for p.tok.Kind != token.RBRACE && p.tok.Kind != token.EOF {
+		name := p.parseIdent()
+		p.expect(token.COLON)
+		fields = append(fields, ast.FieldInit{Name: name, Value: p.parseExpr()})
+		if p.tok.Kind == token.RBRACE || p.tok.Kind == token.EOF {
+			break
+		} else {
+			p.expectFieldSep()
+		}
+	}
+	p.exprLev--
+	endPos := p.tok.EndPos
+	p.expect(token.RBRACE)
+	return &ast.StructLit{
+		BaseExpr: ast.NewBaseExpr(typ.StartPos(), endPos),
+		Type:     typ,
+		Fields:   fields,
+	}
+}
+
+// parseCond parses the condition of if or loop, or the tag or a case of switch.
+// A struct literal must be parenthesized there.
+func (p *Parser) parseCond() ast.Expr {
+	outer := p.exprLev
+	p.exprLev = -1
+	cond := p.parseExpr()
+	p.exprLev = outer
+	return cond
+}
+
 func (p *Parser) parseIfExpr() *ast.IfExpr {
 	startPos := p.tok.StartPos
 	p.expect(token.IF)
-	cond := p.parseExpr()
+	cond := p.parseCond()
 	body := p.parseBlockExpr()
 
 	var elseExpr ast.Expr
@@ -259,64 +569,470 @@ func (p *Parser) parseBlockExpr() *ast.BlockExpr {
 	startPos := p.tok.StartPos
 	p.expect(token.LBRACE)
 	var exprs []ast.Expr
-	hasRetExpr := false
+	var retExpr ast.Expr
 	for p.tok.Kind != token.RBRACE && p.tok.Kind != token.EOF {
-		exprs = append(exprs, p.parseExpr())
-		if p.tok.Kind == token.RBRACE || p.tok.Kind == token.EOF {
-			hasRetExpr = true
+		e, isRet := p.parseStmt()
+		if isRet {
+			retExpr = e
 			break
-		} else {
-			p.expect(token.SEMICOLON)
+		}
+		if e != nil {
+			exprs = append(exprs, e)
 		}
 	}
-	p.next()
-	var retExpr ast.Expr
-
-	if hasRetExpr {
-		retExpr = exprs[len(exprs)-1]
-		exprs = exprs[:len(exprs)-1]
-	}
+	endPos := p.tok.EndPos
+	p.expect(token.RBRACE)
 	return &ast.BlockExpr{
-		BaseExpr: ast.NewBaseExpr(startPos, p.tok.EndPos),
+		BaseExpr: ast.NewBaseExpr(startPos, endPos),
 		ExprList: exprs,
 		RetExpr:  retExpr,
 	}
 }
 
-func (p *Parser) parseLoopExpr() *ast.LoopExpr {
+// parseStmt parses an expression terminated by ';'.
+// An expression followed by '}', or by an inserted ';' and then '}', is the value of the block, isRet is true.
+// After a syntax error, parseStmt skips to the next statement and returns nil.
+func (p *Parser) parseStmt() (e ast.Expr, isRet bool) {
+	exprLev := p.exprLev
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if _, ok := r.(bailout); !ok {
+			panic(r)
+		}
+		p.exprLev = exprLev
+		for p.tok.Kind != token.EOF && !p.tokIn(token.SEMICOLON, token.RBRACE, token.FN, token.CONST, token.IMPORT, token.STRUCT) {
+			p.next()
+		}
+		switch p.tok.Kind {
+		case token.SEMICOLON:
+			p.next()
+		case token.FN, token.CONST, token.IMPORT, token.STRUCT, token.EOF:
+			// the block is not closed, give up the declaration
+			panic(bailout{})
+		}
+		e, isRet = nil, false
+	}()
+
+	e = p.parseSimpleStmt()
+	if p.tok.Kind == token.RBRACE {
+		return e, true
+	}
+	inserted := p.tok.Kind == token.SEMICOLON && p.tok.Val == "\n"
+	p.expect(token.SEMICOLON)
+	return e, inserted && p.tok.Kind == token.RBRACE
+}
+
+// parseSimpleStmt parses an expression, or the statements `x++`, `x--` and `x := e`, which are not expressions.
+func (p *Parser) parseSimpleStmt() ast.Expr {
+	stmtPos := p.stmtPos
+	defer func() { p.stmtPos = stmtPos }()
+	p.stmtPos = p.tok.StartPos
+
+	x := p.parseExpr()
+	switch p.tok.Kind {
+	case token.INC, token.DEC:
+		p.checkAssignable(x)
+		x = &ast.IncDecExpr{
+			BaseExpr: ast.NewBaseExpr(x.StartPos(), p.tok.EndPos),
+			X:        x,
+			Op:       p.tok,
+		}
+		p.next()
+	case token.DEFINE:
+		id, ok := x.(*ast.Ident)
+		if !ok {
+			p.error(x.StartPos(), x.EndPos(), fmt.Sprintf("non-name %s on left side of :=", x.String()))
+		}
+		p.next()
+		rhs := p.parseExpr()
+		x = &ast.DefineExpr{
+			BaseExpr: ast.NewBaseExpr(x.StartPos(), rhs.EndPos()),
+			Ident:    id,
+			Value:    rhs,
+		}
+	}
+	return x
+}
+
+// parseLoopExpr parses `loop { ... }`, `loop cond { ... }` and the iterations
+// `loop x in arr { ... }`, `loop i, x in arr { ... }` and `loop i in 0..n { ... }`.
+// label is the already parsed label of the loop, it is optional.
+func (p *Parser) parseLoopExpr(label *ast.Ident) ast.Expr {
 	startPos := p.tok.StartPos
+	if label != nil {
+		startPos = label.StartPos()
+	}
 	p.expect(token.LOOP)
-	cond := p.parseExpr()
+	var cond ast.Expr
+	if p.tok.Kind != token.LBRACE {
+		cond = p.parseCond()
+	}
+	if p.tok.Kind == token.IN || p.tok.Kind == token.COMMA {
+		x := p.parseLoopIn(startPos, cond)
+		x.Label = label
+		return x
+	}
 	body := p.parseBlockExpr()
 	return &ast.LoopExpr{
 		BaseExpr: ast.NewBaseExpr(startPos, p.tok.EndPos),
+		Label:    label,
 		Cond:     cond,
 		Body:     body,
 	}
 }
 
+// parseLoopIn parses the rest of `loop i, x in arr { ... }`, first is the already parsed first variable.
+func (p *Parser) parseLoopIn(startPos token.Pos, first ast.Expr) *ast.LoopInExpr {
+	elem, ok := first.(*ast.Ident)
+	if !ok {
+		p.error(first.StartPos(), first.EndPos(), fmt.Sprintf("non-name %s on left side of in", first.String()))
+	}
+	var index *ast.Ident
+	if p.tok.Kind == token.COMMA {
+		p.next()
+		index, elem = elem, p.parseIdent()
+	}
+	p.expect(token.IN)
+	x := p.parseCond()
+	var end ast.Expr
+	if p.tok.Kind == token.RANGE {
+		p.next()
+		end = p.parseCond()
+	}
+	body := p.parseBlockExpr()
+	return &ast.LoopInExpr{
+		BaseExpr: ast.NewBaseExpr(startPos, body.EndPos()),
+		Index:    index,
+		Elem:     elem,
+		X:        x,
+		End:      end,
+		Body:     body,
+	}
+}
+
+func (p *Parser) parseSwitchExpr() *ast.SwitchExpr {
+	startPos := p.tok.StartPos
+	p.expect(token.SWITCH)
+	tag := p.parseCond()
+	p.expect(token.LBRACE)
+	var cases []*ast.CaseClause
+	for p.tok.Kind != token.RBRACE && p.tok.Kind != token.EOF {
+		cases = append(cases, p.parseCaseClause())
+		if p.tok.Kind == token.SEMICOLON {
+			p.next() // `case x {}` may be followed by a semicolon, usually an inserted one
+		}
+	}
+	endPos := p.tok.EndPos
+	p.expect(token.RBRACE)
+	return &ast.SwitchExpr{
+		BaseExpr: ast.NewBaseExpr(startPos, endPos),
+		Tag:      tag,
+		Cases:    cases,
+	}
+}
+
+func (p *Parser) parseCaseClause() *ast.CaseClause {
+	startPos := p.tok.StartPos
+	var values []ast.Expr
+	switch p.tok.Kind {
+	case token.CASE:
+		p.next()
+		for {
+			values = append(values, p.parseCond())
+			if p.tok.Kind != token.COMMA {
+				break
+			}
+			p.next()
+		}
+	case token.DEFAULT:
+		p.next()
+	default:
+		p.errorExpect("case", "default", "}")
+	}
+	body := p.parseBlockExpr()
+	return &ast.CaseClause{
+		BaseNode: ast.NewBaseNode(startPos, body.EndPos()),
+		Values:   values,
+		Body:     body,
+	}
+}
+
+func (p *Parser) parseMatchExpr() *ast.MatchExpr {
+	startPos := p.tok.StartPos
+	p.expect(token.MATCH)
+	subject := p.parseCond()
+	p.expect(token.LBRACE)
+
+	// the arms are not in a condition even if the match is
+	outer := p.exprLev
+	p.exprLev = 0
+	var arms []*ast.MatchArm
+	for p.tok.Kind != token.RBRACE && p.tok.Kind != token.EOF {
+		arm := p.parseMatchArm()
+		arms = append(arms, arm)
+		if p.tok.Kind == token.RBRACE || p.tok.Kind == token.EOF {
+			break
+		}
+		if _, isBlock := arm.Body.(*ast.BlockExpr); isBlock && !p.tokIn(token.COMMA, token.SEMICOLON) {
+			// the ',' after a block is optional
+			continue
+		}
+		p.expectFieldSep()
+	}
+	p.exprLev = outer
+	endPos := p.tok.EndPos
+	p.expect(token.RBRACE)
+	return &ast.MatchExpr{
+		BaseExpr: ast.NewBaseExpr(startPos, endPos),
+		Subject:  subject,
+		Arms:     arms,
+	}
+}
+
+func (p *Parser) parseMatchArm() *ast.MatchArm {
+	startPos := p.tok.StartPos
+	pat := p.parsePat()
+	var guard ast.Expr
+	if p.tok.Kind == token.IF {
+		p.next()
+		guard = p.parseExpr()
+	}
+	p.expect(token.FAT_ARROW)
+	var body ast.Expr
+	if p.tok.Kind == token.LBRACE {
+		body = p.parseBlockExpr()
+	} else {
+		body = p.parseExpr()
+	}
+	return &ast.MatchArm{
+		BaseNode: ast.NewBaseNode(startPos, body.EndPos()),
+		Pat:      pat,
+		Guard:    guard,
+		Body:     body,
+	}
+}
+
+// parsePat parses the pattern of a match arm.
+func (p *Parser) parsePat() ast.Pat {
+	startPos := p.tok.StartPos
+	var x ast.Expr
+	switch p.tok.Kind {
+	case token.LBRACK:
+		return p.parseArrayPat()
+	case token.IDENT:
+		x = p.parseQualified(p.parseIdent())
+		if p.tok.Kind == token.LBRACE {
+			return p.parseStructPat(x)
+		}
+	default:
+		x = p.parsePatLit()
+	}
+	if p.tok.Kind == token.RANGE || p.tok.Kind == token.RANGE_INCL {
+		inclusive := p.tok.Kind == token.RANGE_INCL
+		p.next()
+		hi := p.parsePatValue()
+		return &ast.RangePat{
+			BaseNode:  ast.NewBaseNode(startPos, hi.EndPos()),
+			Lo:        x,
+			Hi:        hi,
+			Inclusive: inclusive,
+		}
+	}
+	if id, ok := x.(*ast.Ident); ok {
+		return &ast.IdentPat{
+			BaseNode: ast.NewBaseNode(id.StartPos(), id.EndPos()),
+			Ident:    id,
+		}
+	}
+	return &ast.LiteralPat{
+		BaseNode: ast.NewBaseNode(startPos, x.EndPos()),
+		Value:    x,
+	}
+}
+
+// parsePatValue parses a literal or a constant in a pattern.
+func (p *Parser) parsePatValue() ast.Expr {
+	if p.tok.Kind == token.IDENT {
+		return p.parseQualified(p.parseIdent())
+	}
+	return p.parsePatLit()
+}
+
+// parseQualified parses `m.X` if id, the already parsed m, is followed by '.'.
+func (p *Parser) parseQualified(id *ast.Ident) ast.Expr {
+	if p.tok.Kind != token.PERIOD {
+		return id
+	}
+	p.next()
+	sel := p.parseIdent()
+	return &ast.SelectorExpr{
+		BaseExpr: ast.NewBaseExpr(id.StartPos(), sel.EndPos()),
+		X:        id,
+		Sel:      sel,
+	}
+}
+
+// parsePatLit parses a literal, numbers may be negated.
+func (p *Parser) parsePatLit() ast.Expr {
+	var neg *token.Token
+	if p.tok.Kind == token.SUB {
+		neg = p.tok
+		p.next()
+		if p.tok.Kind != token.INT_LITERAL && p.tok.Kind != token.FLOAT_LITERAL {
+			p.errorExpect("number")
+		}
+	}
+	switch p.tok.Kind {
+	case token.INT_LITERAL, token.FLOAT_LITERAL, token.CHAR_LITERAL, token.STRING_LITERAL, token.BOOLEAN_LITERAL:
+	default:
+		p.errorExpect("pattern")
+	}
+	var x ast.Expr = &ast.Literal{
+		BaseExpr: ast.NewBaseExpr(p.tok.StartPos, p.tok.EndPos),
+		Kind:     p.tok.Kind,
+		Val:      p.tok.Val,
+	}
+	p.next()
+	if neg != nil {
+		x = &ast.UnaryExpr{
+			BaseExpr: ast.NewBaseExpr(neg.StartPos, x.EndPos()),
+			Op:       neg,
+			Expr:     x,
+		}
+	}
+	return x
+}
+
+// parseArrayPat parses `[a, b, ..rest]`, the rest is the last element.
+func (p *Parser) parseArrayPat() *ast.ArrayPat {
+	startPos := p.tok.StartPos
+	p.expect(token.LBRACK)
+	pat := &ast.ArrayPat{}
+	for p.tok.Kind != token.RBRACK && p.tok.Kind != token.EOF {
+		if p.tok.Kind == token.RANGE {
+			rangeTok := p.tok
+			p.next()
+			if p.tok.Kind == token.IDENT {
+				pat.Rest = p.parseIdent()
+			} else {
+				pat.Rest = &ast.Ident{
+					BaseNode: ast.NewBaseNode(rangeTok.StartPos, rangeTok.EndPos),
+					Name:     "_",
+				}
+			}
+			if p.tok.Kind == token.COMMA {
+				p.next()
+			}
+			break
+		}
+		pat.Elems = append(pat.Elems, p.parsePat())
+		if p.tok.Kind != token.RBRACK {
+			p.expectComma(token.RBRACK)
+		}
+	}
+	endPos := p.tok.EndPos
+	p.expect(token.RBRACK)
+	pat.BaseNode = ast.NewBaseNode(startPos, endPos)
+	return pat
+}
+
+// parseStructPat parses `T { a, b: pat }`, typ is the already parsed T or m.T.
+func (p *Parser) parseStructPat(typ ast.Expr) *ast.StructPat {
+	p.expect(token.LBRACE)
+	var fields []ast.FieldPat
+	for p.tok.Kind != token.RBRACE && p.tok.Kind != token.EOF {
+		f := ast.FieldPat{Name: p.parseIdent()}
+		if p.tok.Kind == token.COLON {
+			p.next()
+			f.Pat = p.parsePat()
+		}
+		fields = append(fields, f)
+		if p.tok.Kind == token.RBRACE || p.tok.Kind == token.EOF {
+			break
+		}
+		p.expectFieldSep()
+	}
+	endPos := p.tok.EndPos
+	p.expect(token.RBRACE)
+	return &ast.StructPat{
+		BaseNode: ast.NewBaseNode(typ.StartPos(), endPos),
+		Type:     typ,
+		Fields:   fields,
+	}
+}
+
 func (p *Parser) parseRetExpr() *ast.ReturnExpr {
 	startPos := p.tok.StartPos
 	p.expect(token.RETURN)
-	e := p.parseExpr()
+	var results []ast.Expr
+	if p.tok.Kind != token.SEMICOLON && p.tok.Kind != token.RBRACE {
+		results = append(results, p.parseExpr())
+		for p.tok.Kind == token.COMMA {
+			p.next()
+			results = append(results, p.parseExpr())
+		}
+	}
 	// p.expect(token.SEMICOLON)
 	return &ast.ReturnExpr{
 		BaseExpr: ast.NewBaseExpr(startPos, p.tok.EndPos),
-		Ret:      e,
+		Results:  results,
+	}
+}
+
+func (p *Parser) parseThrowExpr() *ast.ThrowExpr {
+	startPos := p.tok.StartPos
+	p.expect(token.THROW)
+	x := p.parseExpr()
+	return &ast.ThrowExpr{
+		BaseExpr: ast.NewBaseExpr(startPos, x.EndPos()),
+		X:        x,
 	}
 }
 
+// parseTryExpr parses `try { } catch e { } finally { }`, the name after catch is optional.
+func (p *Parser) parseTryExpr() *ast.TryExpr {
+	startPos := p.tok.StartPos
+	p.expect(token.TRY)
+	x := &ast.TryExpr{Body: p.parseBlockExpr()}
+	endPos := x.Body.EndPos()
+	if p.tok.Kind == token.CATCH {
+		p.next()
+		if p.tok.Kind == token.IDENT {
+			x.Catch = p.parseIdent()
+		}
+		x.CatchBody = p.parseBlockExpr()
+		endPos = x.CatchBody.EndPos()
+	}
+	if p.tok.Kind == token.FINALLY {
+		p.next()
+		x.Finally = p.parseBlockExpr()
+		endPos = x.Finally.EndPos()
+	}
+	if x.CatchBody == nil && x.Finally == nil {
+		p.errorExpect(token.CATCH.String(), token.FINALLY.String())
+	}
+	x.BaseExpr = ast.NewBaseExpr(startPos, endPos)
+	return x
+}
+
 func (p *Parser) parseLetExpr() *ast.LetExpr {
 	startPos := p.tok.StartPos
 	p.expect(token.LET)
 	var l []ast.ValueDecl
 	for {
-		l = append(l, p.parseValueDecl())
+		if p.tok.Kind == token.LPAREN || p.tok.Kind == token.LBRACK {
+			l = append(l, p.parsePatternDecl())
+		} else {
+			l = append(l, p.parseValueDecl())
+		}
 		if p.tok.Kind == token.SEMICOLON || p.tok.Kind == token.EOF {
 			// p.next()
 			break
 		} else {
-			p.expect(token.COMMA)
+			p.expectComma(token.SEMICOLON)
 		}
 	}
 
@@ -336,16 +1052,59 @@ func (p *Parser) parseValueDecl() ast.ValueDecl {
 	}
 }
 
+// parsePatternDecl parses `(q, r) = x` or `[head, ..tail] = x`.
+func (p *Parser) parsePatternDecl() ast.ValueDecl {
+	startPos := p.tok.StartPos
+	pat := &ast.Pattern{Array: p.tok.Kind == token.LBRACK}
+	closing := token.RPAREN
+	if pat.Array {
+		closing = token.RBRACK
+	}
+	p.next()
+	for p.tok.Kind != closing {
+		if pat.Array && p.tok.Kind == token.RANGE {
+			// the rest is the last name
+			p.next()
+			pat.Rest = p.parseIdent()
+			if p.tok.Kind == token.COMMA {
+				p.next()
+			}
+			break
+		}
+		pat.Names = append(pat.Names, p.parseIdent())
+		if p.tok.Kind != closing {
+			p.expectComma(closing)
+		}
+	}
+	if len(pat.Names) == 0 && pat.Rest == nil {
+		p.error(startPos, p.tok.EndPos, "empty pattern on left side of let")
+	}
+	endPos := p.tok.EndPos
+	p.expect(closing)
+	pat.BaseNode = ast.NewBaseNode(startPos, endPos)
+
+	p.expect(token.ASSIGN)
+	return ast.ValueDecl{
+		Pattern: pat,
+		Value:   p.parseExpr(),
+	}
+}
+
 func (p *Parser) parseBreakExpr() *ast.BreakExpr {
 	startPos := p.tok.StartPos
 	p.expect(token.BREAK)
+	var label *ast.Ident
+	if p.tok.Kind == token.LABEL {
+		label = p.parseLabel()
+	}
 	var expr ast.Expr
-	if p.tok.Kind != token.SEMICOLON {
+	if p.tok.Kind != token.SEMICOLON && p.tok.Kind != token.RBRACE {
 		expr = p.parseExpr()
 	}
 	// p.expect(token.SEMICOLON)
 	return &ast.BreakExpr{
 		BaseExpr: ast.NewBaseExpr(startPos, p.tok.EndPos),
+		Label:    label,
 		Expr:     expr,
 	}
 }
@@ -353,33 +1112,66 @@ func (p *Parser) parseBreakExpr() *ast.BreakExpr {
 func (p *Parser) parseContinueExpr() *ast.ContinueExpr {
 	startPos := p.tok.StartPos
 	p.expect(token.CONTINUE)
+	var label *ast.Ident
+	if p.tok.Kind == token.LABEL {
+		label = p.parseLabel()
+	}
 	// p.expect(token.SEMICOLON)
 	return &ast.ContinueExpr{
 		BaseExpr: ast.NewBaseExpr(startPos, p.tok.EndPos),
+		Label:    label,
 	}
 }
 
 func (p *Parser) parseArrayExpr() *ast.ArrayExpr {
 	startPos := p.tok.StartPos
 	p.expect(token.LBRACK)
+	p.exprLev++
 	var l []ast.Expr
 	for p.tok.Kind != token.RBRACK && p.tok.Kind != token.EOF {
 		l = append(l, p.parseExpr())
 		if p.tok.Kind == token.RBRACK || p.tok.Kind == token.EOF {
 			break
 		} else {
-			p.expect(token.COMMA)
+			p.expectComma(token.RBRACK)
 		}
 	}
-	p.next()
+	p.exprLev--
+	p.expect(token.RBRACK)
 	return &ast.ArrayExpr{
 		BaseExpr: ast.NewBaseExpr(startPos, p.tok.EndPos),
 		Element:  l,
 	}
 }
 
+// parseMapExpr parses `{k: v, ...}`, the entries are separated like the fields of a struct literal.
+func (p *Parser) parseMapExpr() *ast.MapExpr {
+	startPos := p.tok.StartPos
+	p.expect(token.LBRACE)
+	p.exprLev++
+	var entries []ast.MapEntry
+	for p.tok.Kind != token.RBRACE && p.tok.Kind != token.EOF {
+		key := p.parseExpr()
+		p.expect(token.COLON)
+		entries = append(entries, ast.MapEntry{Key: key, Value: p.parseExpr()})
+		if p.tok.Kind == token.RBRACE || p.tok.Kind == token.EOF {
+			break
+		} else {
+			p.expectFieldSep()
+		}
+	}
+	p.exprLev--
+	endPos := p.tok.EndPos
+	p.expect(token.RBRACE)
+	return &ast.MapExpr{
+		BaseExpr: ast.NewBaseExpr(startPos, endPos),
+		Entries:  entries,
+	}
+}
+
 func (p *Parser) parseIdent() *ast.Ident {
 	name := "_"
+	tok := p.tok
 	if p.tok.Kind == token.IDENT {
 		name = p.tok.Val
 		p.next()
@@ -387,22 +1179,63 @@ func (p *Parser) parseIdent() *ast.Ident {
 		p.expect(token.IDENT)
 	}
 	return &ast.Ident{
-		BaseNode: ast.NewBaseNode(p.tok.StartPos, p.tok.EndPos),
+		BaseNode: ast.NewBaseNode(tok.StartPos, tok.EndPos),
 		Name:     name,
 	}
 }
 
-func (p *Parser) error(pos token.Pos, msg string) {
-	log.Fatal(fmt.Errorf("-> line %d, column %d\n%s", pos.Line(), pos.Col()+1, msg))
+// parseLabel parses a label like 'outer, the name of the label has no quote.
+func (p *Parser) parseLabel() *ast.Ident {
+	tok := p.tok
+	p.expect(token.LABEL)
+	return &ast.Ident{
+		BaseNode: ast.NewBaseNode(tok.StartPos, tok.EndPos),
+		Name:     tok.Val,
+	}
 }
 
-func (p *Parser) errorExpect(expected string) {
-	found := p.tok.Kind.String()
-	if found != p.tok.Val {
-		found = fmt.Sprintf("%s(%s)", found, p.tok.Val)
+func (p *Parser) error(start, end token.Pos, msg string, expected ...string) {
+	p.diags = append(p.diags, Diagnostic{
+		Severity: SeverityError,
+		Start:    start,
+		End:      end,
+		Msg:      msg,
+		Expected: expected,
+	})
+	panic(bailout{})
+}
+
+func (p *Parser) errorExpect(expected ...string) {
+	if p.tok.Kind == token.ILLEGAL {
+		// already reported by the lexer
+		panic(bailout{})
+	}
+	found := p.tok.Val
+	switch {
+	case p.tok.Kind == token.EOF:
+		found = "EOF"
+	case p.tok.Kind == token.SEMICOLON && p.tok.Val == "\n":
+		found = "newline"
+	}
+	p.error(p.tok.StartPos, p.tok.EndPos,
+		fmt.Sprintf("expected '%s', found '%s'", strings.Join(expected, "' or '"), found),
+		expected...)
+}
+
+// expectComma eats the ',' between list items, closing is the token which ends the list.
+func (p *Parser) expectComma(closing token.Kind) {
+	if p.tok.Kind != token.COMMA {
+		p.errorExpect(token.COMMA.String(), closing.String())
 	}
-	p.error(p.tok.StartPos,
-		fmt.Sprintf("expected '%s', found '%s'", expected, found))
+	p.next()
+}
+
+// expectFieldSep eats the separator between the fields of a struct, the entries of a map or the arms of a match, which is ',' or a newline.
+func (p *Parser) expectFieldSep() {
+	if p.tok.Kind != token.COMMA && !(p.tok.Kind == token.SEMICOLON && p.tok.Val == "\n") {
+		p.errorExpect(token.COMMA.String(), token.RBRACE.String())
+	}
+	p.next()
 }
 
 func (p *Parser) expect(kind token.Kind) {
@@ -1,20 +1,731 @@
 package parser
 
 import (
+	"reflect"
+	"sometimes/ast"
 	"sometimes/lexer"
+	"sometimes/token"
 	"testing"
 )
 
+func newParser(filename, src string) *Parser {
+	return newParserIn(token.NewFileSet(), filename, src)
+}
+
+// newParserIn returns a parser of src, which is added to fset.
+func newParserIn(fset *token.FileSet, filename, src string) *Parser {
+	file := fset.AddFile(filename, []byte(src))
+	return NewParser(lexer.NewTokenCursor(lexer.NewSrcCursor(file)))
+}
+
+// parse parses src, it returns the FileSet which resolves the positions of the diagnostics.
+func parse(src string) (*token.FileSet, []Diagnostic) {
+	fset := token.NewFileSet()
+	_, diags := newParserIn(fset, "", src).Parse()
+	return fset, diags
+}
+
 func TestParse(t *testing.T) {
 	code := `
 // aasdasd
-if (a > 10) {
-	
+const A = 1, B = "b";
+fn main(a, b) {
+	let c = [a, b, A];
+	if (a > 10) {
+		c = 1;
+	} else {
+		c += 1;
+	};
+	loop true { break; };
+	print(c[1])
 }
 `
-	parser := Parser{
-		tc: lexer.NewTokenCursor(lexer.NewSrcCursor([]byte(code))),
+	file, diags := newParser("", code).Parse()
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if len(file.Consts) != 1 || len(file.Fns) != 1 {
+		t.Fatalf("want 1 const and 1 fn; got %d and %d", len(file.Consts), len(file.Fns))
+	}
+	if body := file.Fns[0].Body; len(body.ExprList) != 3 || body.RetExpr == nil {
+		t.Errorf("want 3 statements and a value in main; got %s", body.String())
 	}
+}
 
-	parser.Parse()
+func TestParseSemicolonInsertion(t *testing.T) {
+	code := `
+const A = 1
+fn main() {
+	let i = 0
+	loop i < 10 {
+		i += 1
+		if i == 5 { continue }
+	}
+	print(f(i))
+}
+fn f(x) {
+	x + A
+}
+fn g() {
+	return
+}
+`
+	file, diags := newParser("", code).Parse()
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if len(file.Consts) != 1 || len(file.Fns) != 3 {
+		t.Fatalf("want 1 const and 3 fns; got %d and %d", len(file.Consts), len(file.Fns))
+	}
+	// `print(f(i))` is followed by an inserted semicolon and '}', it is the value of the block
+	if body := file.Fns[0].Body; len(body.ExprList) != 2 || body.RetExpr == nil {
+		t.Errorf("want 2 statements and a value in main; got %s", body.String())
+	}
+	if body := file.Fns[1].Body; len(body.ExprList) != 0 || body.RetExpr == nil {
+		t.Errorf("want a value in f; got %s", body.String())
+	}
+
+	// an explicit semicolon makes it a statement
+	file, _ = newParser("", "fn main() {\n\tprint(1);\n}").Parse()
+	if body := file.Fns[0].Body; len(body.ExprList) != 1 || body.RetExpr != nil {
+		t.Errorf("want 1 statement in main; got %s", body.String())
+	}
+}
+
+func TestParseDoc(t *testing.T) {
+	code := `// the file comment is not a doc
+
+// A is the answer.
+//
+// It is a constant.
+const A = 42 // not a doc of f
+
+fn f() {}
+/*
+  g is documented
+  by a block comment /* with a nested one */.
+*/
+fn g() {}
+// h has a doc comment
+/* and a block */
+fn h() {}
+`
+	file, diags := newParser("", code).Parse()
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if want := "A is the answer.\n\nIt is a constant."; file.Consts[0].Doc != want {
+		t.Errorf("const A want doc %q; got %q", want, file.Consts[0].Doc)
+	}
+	wants := []string{
+		"",
+		"  g is documented\n  by a block comment /* with a nested one */.",
+		"h has a doc comment\n and a block",
+	}
+	for i, want := range wants {
+		if got := file.Fns[i].Doc; got != want {
+			t.Errorf("fn %s want doc %q; got %q", file.Fns[i].FnName.Name, want, got)
+		}
+	}
+}
+
+func TestParseStruct(t *testing.T) {
+	code := `
+// Point is a point.
+struct Point {
+	x
+	y
+}
+struct Line { a, b }
+fn main() {
+	let p = Point { x: 1, y: 2 }
+	let l = Line {
+		a: p,
+		b: Point { x: p.x },
+	}
+	l.a.y = 3
+	let v = geo.Vec { x: p.x }
+	if p.x == l.b.x {
+		print(p)
+	}
+}
+`
+	file, diags := newParser("", code).Parse()
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if len(file.Structs) != 2 || len(file.Fns) != 1 {
+		t.Fatalf("want 2 structs and 1 fn; got %d and %d", len(file.Structs), len(file.Fns))
+	}
+	if got, want := file.Structs[0].String(), "struct Point { x, y }"; got != want {
+		t.Errorf("want %s; got %s", want, got)
+	}
+	if file.Structs[0].Doc != "Point is a point." {
+		t.Errorf("want doc of Point; got %q", file.Structs[0].Doc)
+	}
+
+	tests := []string{
+		"let p = Point { x: 1, y: 2 };",
+		"let l = Line { a: p, b: Point { x: p.x } };",
+		"l.a.y=3",
+		"let v = geo.Vec { x: p.x };",
+	}
+	body := file.Fns[0].Body
+	for i, want := range tests {
+		if got := body.ExprList[i].String(); got != want {
+			t.Errorf("want %s; got %s", want, got)
+		}
+	}
+	// `p.x == l.b.x {` is a condition followed by a block, not a struct literal
+	if _, ok := body.RetExpr.(*ast.IfExpr); !ok {
+		t.Errorf("want if; got %s", body.RetExpr.String())
+	}
+}
+
+func TestParseImport(t *testing.T) {
+	code := `
+import "math"
+import "path/to/geo";
+fn main() {
+	print(geo.dist(math.Pi))
+}
+`
+	file, diags := newParser("", code).Parse()
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	tests := []struct {
+		str, name string
+	}{
+		{str: `import "math";`, name: "math"},
+		{str: `import "path/to/geo";`, name: "geo"},
+	}
+	if len(file.Imports) != len(tests) {
+		t.Fatalf("want %d imports; got %d", len(tests), len(file.Imports))
+	}
+	for i, testcase := range tests {
+		if got := file.Imports[i].String(); got != testcase.str {
+			t.Errorf("want %s; got %s", testcase.str, got)
+		}
+		if got := file.Imports[i].Name(); got != testcase.name {
+			t.Errorf("want name %s; got %s", testcase.name, got)
+		}
+	}
+}
+
+func TestParseSwitch(t *testing.T) {
+	code := `
+fn main() {
+	let s = switch n {
+	case 1, 2 { "a" }
+	case (P {}) { "b" }
+	default { "c" }
+	}
+	switch (P {}) {}
+}
+`
+	file, diags := newParser("", code).Parse()
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	body := file.Fns[0].Body
+	let := body.ExprList[0].(*ast.LetExpr)
+	sw, ok := let.Decls[0].Value.(*ast.SwitchExpr)
+	if !ok {
+		t.Fatalf("want switch; got %s", let.Decls[0].Value.String())
+	}
+	tests := []struct {
+		values int
+		body   string
+	}{
+		{values: 2, body: `"a"`},
+		{values: 1, body: `"b"`},
+		{values: 0, body: `"c"`},
+	}
+	if len(sw.Cases) != len(tests) {
+		t.Fatalf("want %d cases; got %d", len(tests), len(sw.Cases))
+	}
+	for i, testcase := range tests {
+		c := sw.Cases[i]
+		if len(c.Values) != testcase.values {
+			t.Errorf("case %d: want %d values; got %d", i, testcase.values, len(c.Values))
+		}
+		if c.Body.RetExpr == nil || c.Body.RetExpr.String() != testcase.body {
+			t.Errorf("case %d: want %s; got %s", i, testcase.body, c.Body.RetExpr.String())
+		}
+	}
+	if _, ok := body.RetExpr.(*ast.SwitchExpr); !ok {
+		t.Errorf("want switch; got %s", body.RetExpr.String())
+	}
+}
+
+func TestParseMatch(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{
+			src:  "match x { 0 => a, 1..=9 => b, -5..0 => c, MIN..m.MAX => d, _ => e }",
+			want: "match x {\n0 => a,\n1..=9 => b,\n-5..0 => c,\nMIN..m.MAX => d,\n_ => e,\n}",
+		},
+		{
+			src:  "match arr { [] => 0, [a, [b, ..]] => a, [h, ..t] if h > 0 => t, [..] => 1, }",
+			want: "match arr {\n[] => 0,\n[a, [b, ..]] => a,\n[h, ..t] if (h>0) => t,\n[..] => 1,\n}",
+		},
+		{
+			src:  "match p { Point { x, y: 0 } if x > 1 => x, Point {} => { 1 } _ => 'a' }",
+			want: "match p {\nPoint { x, y: 0 } if (x>1) => x,\nPoint { } => {\n1\n},\n_ => 'a',\n}",
+		},
+		{
+			src:  "match v { geo.Vec { x: 0 } => 1, geo.ORIGIN => 2 }",
+			want: "match v {\ngeo.Vec { x: 0 } => 1,\ngeo.ORIGIN => 2,\n}",
+		},
+		{
+			src: `match s {
+	"a" => 1
+	1.5 => { 2 }
+	true => 3
+}`,
+			want: "match s {\n\"a\" => 1,\n1.5 => {\n2\n},\ntrue => 3,\n}",
+		},
+	}
+	for _, testcase := range tests {
+		file, diags := newParser("", "fn main() { "+testcase.src+" }").Parse()
+		if len(diags) > 0 {
+			t.Errorf("`%s`: unexpected diagnostics: %v", testcase.src, diags)
+			continue
+		}
+		if got := file.Fns[0].Body.RetExpr.String(); got != testcase.want {
+			t.Errorf("`%s`: want %q; got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestParseMap(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "{}", want: "{}"},
+		{src: `{"a": 1, b + 1: [2], }`, want: `{"a": 1, (b+1): [2]}`},
+		{src: "{'k': {1: x}}", want: "{'k': {1: x}}"},
+		{
+			src: `{
+	"a": 1
+	"b": f(2)
+}`,
+			want: `{"a": 1, "b": f(2)}`,
+		},
+		{src: `m[k] = {"x": 0}`, want: `m[k]={"x": 0}`},
+	}
+	for _, testcase := range tests {
+		file, diags := newParser("", "fn main() { "+testcase.src+" }").Parse()
+		if len(diags) > 0 {
+			t.Errorf("`%s`: unexpected diagnostics: %v", testcase.src, diags)
+			continue
+		}
+		if got := file.Fns[0].Body.RetExpr.String(); got != testcase.want {
+			t.Errorf("`%s`: want %q; got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestParseTry(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "try { f() } catch e { g(e) }", want: "try {\nf()\n} catch e {\ng(e)\n}"},
+		{src: "try { f() } catch { 0 }", want: "try {\nf()\n} catch {\n0\n}"},
+		{src: "try { f(); } finally { g() }", want: "try {\nf();\n} finally {\ng()\n}"},
+		{src: "try {} catch e {} finally {}", want: "try {\n} catch e {\n} finally {\n}"},
+		{src: `throw "x"`, want: `throw "x"`},
+		{src: "throw [a, b + 1]", want: "throw [a, (b+1)]"},
+		{src: "f(x)? + 1", want: "(f(x)?+1)"},
+		{src: "a.b?.c[0]?", want: "a.b?.c[0]?"},
+		{src: "-r?", want: "-r?"},
+	}
+	for _, testcase := range tests {
+		file, diags := newParser("", "fn main() { "+testcase.src+" }").Parse()
+		if len(diags) > 0 {
+			t.Errorf("`%s`: unexpected diagnostics: %v", testcase.src, diags)
+			continue
+		}
+		if got := file.Fns[0].Body.RetExpr.String(); got != testcase.want {
+			t.Errorf("`%s`: want %q; got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestParseFuncLit(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "fn(a, b) -> a + b", want: "fn(a, b) {\n(a+b)\n}"},
+		{src: "fn() { f() }", want: "fn() {\nf()\n}"},
+		{src: "fn(x) -> fn(y) -> x", want: "fn(x) {\nfn(y) {\nx\n}\n}"},
+		{src: "fn(x) { x }(1)", want: "fn(x) {\nx\n}(1)"},
+		{src: "fn(a, b = a + 1, ..rest,) -> b", want: "fn(a, b = (a+1), ..rest) {\nb\n}"},
+	}
+	for _, testcase := range tests {
+		file, diags := newParser("", "fn main() { let f = "+testcase.src+"; }").Parse()
+		if len(diags) > 0 {
+			t.Errorf("`%s`: unexpected diagnostics: %v", testcase.src, diags)
+			continue
+		}
+		let := file.Fns[0].Body.ExprList[0].(*ast.LetExpr)
+		if got := let.Decls[0].Value.String(); got != testcase.want {
+			t.Errorf("`%s`: want %q; got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestParseAssign(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "a = 1", want: "a=1"},
+		{src: "a[i] = 1", want: "a[i]=1"},
+		{src: "a[i][j] += 2 * x", want: "a[i][j]+=(2*x)"},
+		{src: "p.x *= f(1)[0]", want: "p.x*=f(1)[0]"},
+		{src: "ps[0].x -= 1", want: "ps[0].x-=1"},
+		{src: "a = b = 1", want: "a=b=1"},
+		{src: "flags |= 1 << n", want: "flags|=(1<<n)"},
+	}
+	for _, testcase := range tests {
+		file, diags := newParser("", "fn main() { "+testcase.src+" }").Parse()
+		if len(diags) > 0 {
+			t.Errorf("`%s`: unexpected diagnostics: %v", testcase.src, diags)
+			continue
+		}
+		x, ok := file.Fns[0].Body.RetExpr.(*ast.AssignExpr)
+		if !ok {
+			t.Errorf("`%s`: want assignment; got %T", testcase.src, file.Fns[0].Body.RetExpr)
+			continue
+		}
+		if got := x.String(); got != testcase.want {
+			t.Errorf("`%s`: want %s; got %s", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestParseBinary(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "a | b ^ c", want: "((a|b)^c)"},
+		{src: "a + b & c", want: "(a+(b&c))"},
+		{src: "a << 2 + 1", want: "((a<<2)+1)"},
+		{src: "a & b == 0", want: "((a&b)==0)"},
+		{src: "x >> 1 < y && ~m != 0", want: "(((x>>1)<y)&&(~m!=0))"},
+	}
+	for _, testcase := range tests {
+		file, diags := newParser("", "fn main() { "+testcase.src+" }").Parse()
+		if len(diags) > 0 {
+			t.Errorf("`%s`: unexpected diagnostics: %v", testcase.src, diags)
+			continue
+		}
+		if got := file.Fns[0].Body.RetExpr.String(); got != testcase.want {
+			t.Errorf("`%s`: want %s; got %s", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestParseIncDecDefine(t *testing.T) {
+	code := `
+fn main() {
+	i := 0
+	i++
+	a[i]--
+	p.x++
+	s := a[i] + 1
+}
+`
+	file, diags := newParser("", code).Parse()
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	tests := []string{"i:=0", "i++", "a[i]--", "p.x++", "s:=(a[i]+1)"}
+	body := file.Fns[0].Body
+	exprs := append(body.ExprList, body.RetExpr)
+	if len(exprs) != len(tests) {
+		t.Fatalf("want %d statements; got %d", len(tests), len(exprs))
+	}
+	for i, want := range tests {
+		if got := exprs[i].String(); got != want {
+			t.Errorf("want %s; got %s", want, got)
+		}
+	}
+}
+
+func TestParseLoop(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "loop { break }", want: "loop {\nbreak\n}"},
+		{src: "loop i < n { i++ }", want: "loop (i<n) {\ni++\n}"},
+		{src: "loop x in arr {}", want: "loop x in arr {\n}"},
+		{src: "loop i, x in f(a)[1] {}", want: "loop i, x in f(a)[1] {\n}"},
+		{src: "loop i in 0..n + 1 {}", want: "loop i in 0..(n+1) {\n}"},
+		{src: "loop i in p.lo..p.hi {}", want: "loop i in p.lo..p.hi {\n}"},
+		{src: "'outer: loop { break 'outer x + 1 }", want: "'outer: loop {\nbreak 'outer (x+1)\n}"},
+		{src: "'a: loop x in arr { continue 'a }", want: "'a: loop x in arr {\ncontinue 'a\n}"},
+	}
+	for _, testcase := range tests {
+		file, diags := newParser("", "fn main() { "+testcase.src+" }").Parse()
+		if len(diags) > 0 {
+			t.Errorf("`%s`: unexpected diagnostics: %v", testcase.src, diags)
+			continue
+		}
+		if got := file.Fns[0].Body.RetExpr.String(); got != testcase.want {
+			t.Errorf("`%s`: want %q; got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestParseDestructure(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "return", want: "return "},
+		{src: "return a / b, a % b", want: "return (a/b), (a%b)"},
+		{src: "let (q, r) = divmod(x, y)", want: "let (q, r) = divmod(x, y);"},
+		{src: "let [head, ..tail] = arr", want: "let [head, ..tail] = arr;"},
+		{src: "let [a, _, b,] = f()", want: "let [a, _, b] = f();"},
+		{src: "let [..rest] = arr", want: "let [..rest] = arr;"},
+	}
+	for _, testcase := range tests {
+		file, diags := newParser("", "fn main() { "+testcase.src+"; }").Parse()
+		if len(diags) > 0 {
+			t.Errorf("`%s`: unexpected diagnostics: %v", testcase.src, diags)
+			continue
+		}
+		if got := file.Fns[0].Body.ExprList[0].String(); got != testcase.want {
+			t.Errorf("`%s`: want %q; got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{
+			src:  `if (a > 10) {}`,
+			want: []string{"1:1: Error: expected 'const' or 'fn' or 'import' or 'struct', found 'if'"},
+		},
+		{
+			src:  `import fmt fn main() {}`,
+			want: []string{"1:8: Error: expected 'import path', found 'fmt'"},
+		},
+		{
+			src:  `import "fmt" fn main() {}`,
+			want: []string{"1:14: Error: expected ';', found 'fn'"},
+		},
+		{
+			src:  `struct P { x y }`,
+			want: []string{"1:14: Error: expected ',' or '}', found 'y'"},
+		},
+		{
+			// the statement ends at the first '}', the last one is not expected
+			src: `fn main() { switch x { 1 {} } }`,
+			want: []string{
+				"1:24: Error: expected 'case' or 'default' or '}', found '1'",
+				"1:29: Error: expected 'const' or 'fn' or 'import' or 'struct', found '}'",
+			},
+		},
+		{
+			src: `fn f(..rest, a) {}`,
+			want: []string{
+				"1:14: Error: expected ')', found 'a'",
+			},
+		},
+		{
+			src:  `fn main() { let () = f(); }`,
+			want: []string{"1:17: Error: empty pattern on left side of let"},
+		},
+		{
+			// the match ends at the first '}' as the switch above
+			src: `fn main() { match x { 1 2 }; }`,
+			want: []string{
+				"1:25: Error: expected '=>', found '2'",
+				"1:30: Error: expected 'const' or 'fn' or 'import' or 'struct', found '}'",
+			},
+		},
+		{
+			src: `fn main() { match x { (1) => 2 }; }`,
+			want: []string{
+				"1:23: Error: expected 'pattern', found '('",
+				"1:35: Error: expected 'const' or 'fn' or 'import' or 'struct', found '}'",
+			},
+		},
+		{
+			src: `fn main() { match x { -a => 2 }; }`,
+			want: []string{
+				"1:24: Error: expected 'number', found 'a'",
+				"1:34: Error: expected 'const' or 'fn' or 'import' or 'struct', found '}'",
+			},
+		},
+		{
+			src: `fn main() { match x { [..a, b] => 2 }; }`,
+			want: []string{
+				"1:29: Error: expected ']', found 'b'",
+				"1:40: Error: expected 'const' or 'fn' or 'import' or 'struct', found '}'",
+			},
+		},
+		{
+			src: `fn main() { match x { 1 => 2 3 => 4 }; }`,
+			want: []string{
+				"1:30: Error: expected ',' or '}', found '3'",
+				"1:40: Error: expected 'const' or 'fn' or 'import' or 'struct', found '}'",
+			},
+		},
+		{
+			src:  `fn main() { try { f() }; }`,
+			want: []string{"1:24: Error: expected 'catch' or 'finally', found ';'"},
+		},
+		{
+			src: `fn main() { try { f() } catch 1 {}; }`,
+			want: []string{
+				"1:31: Error: expected '{', found '1'",
+				"1:37: Error: expected 'const' or 'fn' or 'import' or 'struct', found '}'",
+			},
+		},
+		{
+			src:  `fn main() { throw; }`,
+			want: []string{"1:18: Error: expected 'operand', found ';'"},
+		},
+		{
+			src:  `fn main() { let (a, ..b) = f(); }`,
+			want: []string{"1:21: Error: expected 'IDENT', found '..'"},
+		},
+		{
+			src:  `fn main() { let [..a, b] = x; }`,
+			want: []string{"1:23: Error: expected ']', found 'b'"},
+		},
+		{
+			src:  `fn main() { p.; }`,
+			want: []string{"1:15: Error: expected 'IDENT', found ';'"},
+		},
+		{
+			src:  `const A = 1 fn main() {}`,
+			want: []string{"1:13: Error: expected ',' or ';', found 'fn'"},
+		},
+		{
+			src: "fn main() { f(1\n) }",
+			want: []string{
+				"1:16: Error: expected ',' or ')', found 'newline'",
+				"2:1: Error: expected 'operand', found ')'",
+			},
+		},
+		{
+			src:  `fn main() { let = 1; }`,
+			want: []string{"1:17: Error: expected 'IDENT', found '='"},
+		},
+		{
+			src: "fn main() {\n\tf() = 1\n\t(a) += 2\n}",
+			want: []string{
+				"2:2: Error: cannot assign to f()",
+				"3:2: Error: cannot assign to (a)",
+			},
+		},
+		{
+			src: "fn main() {\n\tf()++\n\ta[0] := 1\n}",
+			want: []string{
+				"2:2: Error: cannot assign to f()",
+				"3:2: Error: non-name a[0] on left side of :=",
+			},
+		},
+		{
+			src: "fn main() {\n\tprint(i++)\n\tlet j = i-- + 1\n\tprint(x := 1)\n\ta + i++\n\t-i++\n\ti++ + 1\n}",
+			want: []string{
+				"2:8: Error: cannot use i++ as value",
+				"3:10: Error: cannot use i-- as value",
+				"4:8: Error: cannot use x := ... as value",
+				"5:6: Error: cannot use i++ as value",
+				"6:3: Error: cannot use i++ as value",
+				"7:6: Error: expected ';', found '+'",
+			},
+		},
+		{
+			src:  `fn main() { loop p.x in a; }`,
+			want: []string{"1:18: Error: non-name p.x on left side of in"},
+		},
+		{
+			src:  `fn main() { loop i, 1 in a; }`,
+			want: []string{"1:21: Error: expected 'IDENT', found '1'"},
+		},
+		{
+			src:  `fn main() { loop x in a..; }`,
+			want: []string{"1:26: Error: expected 'operand', found ';'"},
+		},
+		{
+			src:  `fn main() { a = ; }`,
+			want: []string{"1:17: Error: expected 'operand', found ';'"},
+		},
+		{
+			src:  `fn main() { a # 1; }`,
+			want: []string{"1:15: Error: illegal character \"#\""},
+		},
+		{
+			// recovers at the next statement and at the next declaration
+			src: `
+fn main() {
+	let a = ;
+	print(a b);
+	a = 1;
+}
+const A = ) ;
+fn f( {
+fn g() {}
+`,
+			want: []string{
+				"3:10: Error: expected 'operand', found ';'",
+				"4:10: Error: expected ',' or ')', found 'b'",
+				"7:11: Error: expected 'operand', found ')'",
+				"8:7: Error: expected 'IDENT', found '{'",
+			},
+		},
+	}
+
+	for _, testcase := range tests {
+		fset, diags := parse(testcase.src)
+		var got []string
+		for _, d := range diags {
+			got = append(got, d.Format(fset))
+		}
+		if !reflect.DeepEqual(testcase.want, got) {
+			t.Errorf("`%s`:\n want %q;\n  got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestParseFilename(t *testing.T) {
+	fset := token.NewFileSet()
+	_, diags := newParserIn(fset, "a.st", "const A = 1;\nfn main() { 1 + ; }").Parse()
+	want := "a.st:2:17: Error: expected 'operand', found ';'"
+	if len(diags) != 1 || diags[0].Format(fset) != want {
+		t.Errorf("want %q; got %v", want, diags)
+	}
+}
+
+func TestParseRecovery(t *testing.T) {
+	_, diags := parse(`fn main() { let = 1; } fn f() { 1 }`)
+	if len(diags) != 1 {
+		t.Fatalf("want 1 diagnostic; got %v", diags)
+	}
+	d := diags[0]
+	if d.Severity != SeverityError || !reflect.DeepEqual(d.Expected, []string{"IDENT"}) {
+		t.Errorf("unexpected diagnostic %#v", d)
+	}
+	want := token.Pos(1 + 16)
+	if d.Start != want || d.End != want {
+		t.Errorf("want span at %d; got %d..%d", want, d.Start, d.End)
+	}
 }
@@ -0,0 +1,171 @@
+package token
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// Pos is a compact encoding of a source position within a FileSet.
+// It can be converted into a Position for a more convenient, but much larger, representation.
+//
+// The Pos of a byte in a file is File.Base() + offset, so Pos values of different files never overlap.
+type Pos int
+
+// NoPos is the zero value of Pos, it is not associated with any file.
+const NoPos Pos = 0
+
+// IsValid reports whether the position is valid.
+func (p Pos) IsValid() bool {
+	return p != NoPos
+}
+
+// Position describes a printable source position.
+type Position struct {
+	Filename string // filename, if any
+	Offset   int    // byte offset, starting at 0
+	Line     int    // line number, starting at 1
+	Column   int    // column number in characters, starting at 1
+}
+
+// IsValid reports whether the position is valid.
+func (pos Position) IsValid() bool {
+	return pos.Line > 0
+}
+
+// String returns a string in one of several forms:
+//
+//	file:line:column    valid position with file name
+//	line:column         valid position without file name
+//	file                invalid position with file name
+//	-                   invalid position without file name
+func (pos Position) String() string {
+	s := pos.Filename
+	if pos.IsValid() {
+		if s != "" {
+			s += ":"
+		}
+		s += fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+	}
+	if s == "" {
+		s = "-"
+	}
+	return s
+}
+
+// File is a source file registered in a FileSet.
+type File struct {
+	name  string
+	base  int
+	src   []byte
+	lines []int // offset of the first byte of each line
+}
+
+// Name returns the file name of f as registered with AddFile.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Base returns the base offset of f as registered with AddFile.
+func (f *File) Base() int {
+	return f.base
+}
+
+// Size returns the size of f in bytes.
+func (f *File) Size() int {
+	return len(f.src)
+}
+
+// Src returns the source code of f.
+func (f *File) Src() []byte {
+	return f.src
+}
+
+// LineCount returns the number of lines in f.
+func (f *File) LineCount() int {
+	return len(f.lines)
+}
+
+// Pos returns the Pos of the given byte offset, the offset must be in [0, f.Size()].
+func (f *File) Pos(offset int) Pos {
+	if offset < 0 || offset > f.Size() {
+		panic(fmt.Sprintf("invalid file offset %d (should be <= %d)", offset, f.Size()))
+	}
+	return Pos(f.base + offset)
+}
+
+// Offset returns the byte offset of p, p must belong to f.
+func (f *File) Offset(p Pos) int {
+	offset := int(p) - f.base
+	if offset < 0 || offset > f.Size() {
+		panic(fmt.Sprintf("invalid Pos value %d (should be in [%d, %d])", p, f.base, f.base+f.Size()))
+	}
+	return offset
+}
+
+// Position returns the Position of p, p must belong to f or be NoPos.
+func (f *File) Position(p Pos) Position {
+	if !p.IsValid() {
+		return Position{}
+	}
+	offset := f.Offset(p)
+	line := sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > offset }) - 1
+	return Position{
+		Filename: f.name,
+		Offset:   offset,
+		Line:     line + 1,
+		Column:   utf8.RuneCount(f.src[f.lines[line]:offset]) + 1,
+	}
+}
+
+// FileSet is a set of source files.
+// Every file gets a distinct range of Pos values, so a Pos alone identifies the file it belongs to.
+type FileSet struct {
+	base  int
+	files []*File
+}
+
+func NewFileSet() *FileSet {
+	return &FileSet{
+		base: 1, // 0 == NoPos
+	}
+}
+
+// AddFile registers a new file with the given filename and source code.
+func (s *FileSet) AddFile(filename string, src []byte) *File {
+	f := &File{
+		name:  filename,
+		base:  s.base,
+		src:   src,
+		lines: []int{0},
+	}
+	for i, b := range src {
+		if b == '\n' {
+			f.lines = append(f.lines, i+1)
+		}
+	}
+	// +1 so that the position after the last byte (EOF) is still inside the file
+	s.base += len(src) + 1
+	s.files = append(s.files, f)
+	return f
+}
+
+// File returns the file that contains p, or nil if there is none.
+func (s *FileSet) File(p Pos) *File {
+	if !p.IsValid() {
+		return nil
+	}
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].base > int(p) }) - 1
+	if i < 0 || int(p) > s.files[i].base+s.files[i].Size() {
+		return nil
+	}
+	return s.files[i]
+}
+
+// Position converts p into a Position, it returns the zero Position if p is not in s.
+func (s *FileSet) Position(p Pos) Position {
+	if f := s.File(p); f != nil {
+		return f.Position(p)
+	}
+	return Position{}
+}
@@ -0,0 +1,52 @@
+package token
+
+import "testing"
+
+func TestFileSetPosition(t *testing.T) {
+	fset := NewFileSet()
+	a := fset.AddFile("a.st", []byte("fn main() {\n\tprint(1);\n}\n"))
+	b := fset.AddFile("b.st", []byte("const 名字 = 1;\nconst B = 2;"))
+
+	tests := []struct {
+		pos  Pos
+		want string
+	}{
+		{pos: a.Pos(0), want: "a.st:1:1"},
+		{pos: a.Pos(13), want: "a.st:2:2"},
+		{pos: a.Pos(a.Size()), want: "a.st:4:1"}, // EOF
+		{pos: b.Pos(0), want: "b.st:1:1"},
+		{pos: b.Pos(13), want: "b.st:1:10"}, // columns count characters, not bytes
+		{pos: b.Pos(18), want: "b.st:2:1"},
+		{pos: NoPos, want: "-"},
+		{pos: Pos(1000), want: "-"},
+	}
+	for _, testcase := range tests {
+		if got := fset.Position(testcase.pos).String(); got != testcase.want {
+			t.Errorf("Position(%d) want %s; got %s", testcase.pos, testcase.want, got)
+		}
+	}
+
+	if f := fset.File(b.Pos(3)); f != b {
+		t.Errorf("File(%d) want b.st; got %v", b.Pos(3), f)
+	}
+	if a.Pos(a.Size()) >= b.Pos(0) {
+		t.Errorf("positions of a.st and b.st overlap")
+	}
+}
+
+func TestPositionString(t *testing.T) {
+	tests := []struct {
+		pos  Position
+		want string
+	}{
+		{pos: Position{Filename: "a.st", Line: 3, Column: 5}, want: "a.st:3:5"},
+		{pos: Position{Line: 3, Column: 5}, want: "3:5"},
+		{pos: Position{Filename: "a.st"}, want: "a.st"},
+		{pos: Position{}, want: "-"},
+	}
+	for _, testcase := range tests {
+		if got := testcase.pos.String(); got != testcase.want {
+			t.Errorf("want %s; got %s", testcase.want, got)
+		}
+	}
+}
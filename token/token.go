@@ -3,21 +3,38 @@ package token
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
 type (
-	Kind int
-	Pos  interface {
-		Line() int
-		Col() int
-	}
+	Kind  int
 	Token struct {
 		Kind             Kind
 		Val              string
 		StartPos, EndPos Pos
+
+		// The fields below are only set when the lexer keeps trivia.
+		Raw            string   // source text of the token
+		LeadingTrivia  []Trivia // trivia between the previous token's trailing trivia and the token
+		TrailingTrivia []Trivia // trivia after the token up to and including the end of line
 	}
 )
 
+//go:generate stringer -type=TriviaKind -trimprefix=Trivia
+type TriviaKind uint8
+
+const (
+	TriviaWhitespace TriviaKind = iota // spaces and tabs, never contains '\n'
+	TriviaNewline                      // "\n"
+	TriviaComment                      // `// xxx` or `/* xxx */`
+)
+
+// Trivia is a piece of source code which has no meaning to the parser.
+type Trivia struct {
+	Kind TriviaKind
+	Val  string // source text
+}
+
 /// NewToken 返回一个新的 Token.
 func NewToken(tk Kind, val string, startPos, endPos Pos) *Token {
 	return &Token{
@@ -28,13 +45,27 @@ func NewToken(tk Kind, val string, startPos, endPos Pos) *Token {
 	}
 }
 
+// FullText returns the source text of the token with its trivia.
+// Concatenating the full texts of all tokens up to EOF reproduces the source.
+func (token *Token) FullText() string {
+	var sb strings.Builder
+	for _, t := range token.LeadingTrivia {
+		sb.WriteString(t.Val)
+	}
+	sb.WriteString(token.Raw)
+	for _, t := range token.TrailingTrivia {
+		sb.WriteString(t.Val)
+	}
+	return sb.String()
+}
+
 func (token *Token) String() string {
 	return fmt.Sprintf(
-		"{Kind: '%s', Val: '%s', StartPos: {Line: %d, Col: %d}, EndPos: {Line: %d, Col: %d}}",
+		"{Kind: '%s', Val: '%s', StartPos: %d, EndPos: %d}",
 		strings.ToUpper(token.Kind.String()),
 		token.Val,
-		token.StartPos.Line(), token.StartPos.Col(),
-		token.EndPos.Line(), token.EndPos.Col(),
+		token.StartPos,
+		token.EndPos,
 	)
 }
 
@@ -49,6 +80,7 @@ const (
 	// Identifiers and basic type literals
 	// (these tokens stand for classes of literals)
 	IDENT           // main
+	LABEL           // 'outer
 	INT_LITERAL     // 12345
 	FLOAT_LITERAL   // 123.45
 	CHAR_LITERAL    // 'a'
@@ -64,12 +96,24 @@ const (
 	QUO // /
 	REM // %
 
+	AND // &
+	OR  // |
+	XOR // ^
+	SHL // <<
+	SHR // >>
+
 	ADD_ASSIGN // +=
 	SUB_ASSIGN // -=
 	MUL_ASSIGN // *=
 	QUO_ASSIGN // /=
 	REM_ASSIGN // %=
 
+	AND_ASSIGN // &=
+	OR_ASSIGN  // |=
+	XOR_ASSIGN // ^=
+	SHL_ASSIGN // <<=
+	SHR_ASSIGN // >>=
+
 	LAND  // &&
 	LOR   // ||
 	ARROW // ->
@@ -81,6 +125,7 @@ const (
 	GTR    // >
 	ASSIGN // =
 	NOT    // !
+	TILDE  // ~
 
 	NEQ    // !=
 	LEQ    // <=
@@ -98,24 +143,35 @@ const (
 	RBRACE    // }
 	SEMICOLON // ;
 	COLON     // :
+	RANGE     // ..
+
+	RANGE_INCL // ..=
+	FAT_ARROW  // =>
+	QUESTION   // ?
 	operator_end
 
 	keyword_beg
 	// Keywords
 	BREAK
 	CASE
+	CATCH
 	CONST
 	CONTINUE
 
 	DEFAULT
 	ELSE
+	FINALLY
 	LOOP
+	MATCH
 
 	FN
 	IF
 	IMPORT
+	IN
 
 	RETURN
+	THROW
+	TRY
 
 	STRUCT
 	SWITCH
@@ -144,9 +200,9 @@ func (op Kind) Precedence() int {
 		return 2
 	case EQL, NEQ, LSS, LEQ, GTR, GEQ:
 		return 3
-	case ADD, SUB:
+	case ADD, SUB, OR, XOR:
 		return 4
-	case MUL, QUO, REM:
+	case MUL, QUO, REM, AND, SHL, SHR:
 		return 5
 	}
 	return LowestPrec
@@ -160,6 +216,7 @@ var (
 		COMMENT: "COMMENT",
 
 		IDENT:          "IDENT",
+		LABEL:          "LABEL",
 		INT_LITERAL:    "INT",
 		FLOAT_LITERAL:  "FLOAT",
 		CHAR_LITERAL:   "CHAR",
@@ -171,12 +228,24 @@ var (
 		QUO: "/",
 		REM: "%",
 
+		AND: "&",
+		OR:  "|",
+		XOR: "^",
+		SHL: "<<",
+		SHR: ">>",
+
 		ADD_ASSIGN: "+=",
 		SUB_ASSIGN: "-=",
 		MUL_ASSIGN: "*=",
 		QUO_ASSIGN: "/=",
 		REM_ASSIGN: "%=",
 
+		AND_ASSIGN: "&=",
+		OR_ASSIGN:  "|=",
+		XOR_ASSIGN: "^=",
+		SHL_ASSIGN: "<<=",
+		SHR_ASSIGN: ">>=",
+
 		LAND:  "&&",
 		LOR:   "||",
 		ARROW: "->",
@@ -188,6 +257,7 @@ var (
 		GTR:    ">",
 		ASSIGN: "=",
 		NOT:    "!",
+		TILDE:  "~",
 
 		NEQ:    "!=",
 		LEQ:    "<=",
@@ -205,21 +275,32 @@ var (
 		RBRACE:    "}",
 		SEMICOLON: ";",
 		COLON:     ":",
+		RANGE:     "..",
+
+		RANGE_INCL: "..=",
+		FAT_ARROW:  "=>",
+		QUESTION:   "?",
 
 		BREAK:    "break",
 		CASE:     "case",
+		CATCH:    "catch",
 		CONST:    "const",
 		CONTINUE: "continue",
 
 		DEFAULT: "default",
 		ELSE:    "else",
+		FINALLY: "finally",
 		LOOP:    "loop",
+		MATCH:   "match",
 
 		FN:     "fn",
 		IF:     "if",
 		IMPORT: "import",
+		IN:     "in",
 
 		RETURN: "return",
+		THROW:  "throw",
+		TRY:    "try",
 
 		STRUCT: "struct",
 		SWITCH: "switch",
@@ -242,6 +323,7 @@ func init() {
 
 	for i := operator_beg + 1; i < operator_end; i++ {
 		operators[tokens[i]] = i
+		insertOperator(tokens[i], i)
 	}
 }
 
@@ -274,20 +356,49 @@ func Keyword(ident string) (Kind, bool) {
 	return tk, ok
 }
 
-func IsOperatorStart(c byte) bool {
-	for op := range operators {
-		if c == op[0] {
-			return true
+// IsOperatorStart reports whether c is the first character of an operator.
+func IsOperatorStart(c rune) bool {
+	return c >= 0 && c < utf8.RuneSelf && opTrie.children[c] != nil
+}
+
+// LookupOperator returns the longest operator at the start of src and its length in bytes.
+// If there is none, it returns ILLEGAL and the length of the longest prefix of an operator, which is 0
+// if src does not start with an operator character.
+//
+// Operators are looked up in a trie, it takes O(1) per character.
+func LookupOperator(src []byte) (kind Kind, n int) {
+	kind = ILLEGAL
+	node := &opTrie
+	for i, c := range src {
+		if c >= utf8.RuneSelf || node.children[c] == nil {
+			break
+		}
+		node = node.children[c]
+		if node.kind != ILLEGAL {
+			kind, n = node.kind, i+1
+		} else if kind == ILLEGAL {
+			n = i + 1
 		}
 	}
-	return false
+	return kind, n
 }
 
-func IsOperatorContinue(c byte) bool {
-	for op := range operators {
-		if strings.ContainsRune(op[1:], rune(c)) {
-			return true
+// opTrieNode is a node of the operator trie, operators are ASCII.
+type opTrieNode struct {
+	kind     Kind // ILLEGAL if no operator ends at this node
+	children [utf8.RuneSelf]*opTrieNode
+}
+
+var opTrie opTrieNode
+
+func insertOperator(op string, kind Kind) {
+	node := &opTrie
+	for i := 0; i < len(op); i++ {
+		c := op[i]
+		if node.children[c] == nil {
+			node.children[c] = &opTrieNode{}
 		}
+		node = node.children[c]
 	}
-	return false
+	node.kind = kind
 }
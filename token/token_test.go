@@ -33,3 +33,55 @@ func TestTokenTypeIsKeyword(t *testing.T) {
 		}
 	}
 }
+
+func TestLookupOperator(t *testing.T) {
+	tests := []struct {
+		src  string
+		kind Kind
+		n    int
+	}{
+		{src: "=", kind: ASSIGN, n: 1},
+		{src: "==", kind: EQL, n: 2},
+		{src: "=-1", kind: ASSIGN, n: 1},
+		{src: "!-a", kind: NOT, n: 1},
+		{src: "!=b", kind: NEQ, n: 2},
+		{src: "<-", kind: LSS, n: 1},
+		{src: "->", kind: ARROW, n: 2},
+		{src: "+++", kind: INC, n: 2},
+		{src: "&&&", kind: LAND, n: 2},
+		{src: "&|", kind: AND, n: 1},
+		{src: "<<=", kind: SHL_ASSIGN, n: 3},
+		{src: ">>>", kind: SHR, n: 2},
+		{src: "..=", kind: RANGE_INCL, n: 3},
+		{src: "=>=", kind: FAT_ARROW, n: 2},
+		{src: "a", kind: ILLEGAL, n: 0},
+		{src: "中", kind: ILLEGAL, n: 0},
+		{src: "", kind: ILLEGAL, n: 0},
+	}
+	for _, testcase := range tests {
+		kind, n := LookupOperator([]byte(testcase.src))
+		if kind != testcase.kind || n != testcase.n {
+			t.Errorf("LookupOperator(%q) want %s, %d; got %s, %d", testcase.src, testcase.kind, testcase.n, kind, n)
+		}
+	}
+}
+
+func TestIsOperatorStart(t *testing.T) {
+	for op := range operators {
+		if !IsOperatorStart(rune(op[0])) {
+			t.Errorf("IsOperatorStart(%q) want true", op[0])
+		}
+	}
+	for _, c := range "a0_ \"'中" {
+		if IsOperatorStart(c) {
+			t.Errorf("IsOperatorStart(%q) want false", c)
+		}
+	}
+}
+
+func BenchmarkLookupOperator(b *testing.B) {
+	srcs := [][]byte{[]byte("="), []byte("=="), []byte("=-"), []byte("->"), []byte("&&"), []byte("%=")}
+	for i := 0; i < b.N; i++ {
+		LookupOperator(srcs[i%len(srcs)])
+	}
+}
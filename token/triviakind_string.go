@@ -0,0 +1,26 @@
+// Code generated by "stringer -type=TriviaKind -trimprefix=Trivia"; DO NOT EDIT.
+
+package token
+
+import "strconv"
+
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[TriviaWhitespace-0]
+	_ = x[TriviaNewline-1]
+	_ = x[TriviaComment-2]
+}
+
+const _TriviaKind_name = "WhitespaceNewlineComment"
+
+var _TriviaKind_index = [...]uint8{0, 10, 17, 24}
+
+func (i TriviaKind) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_TriviaKind_index)-1 {
+		return "TriviaKind(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _TriviaKind_name[_TriviaKind_index[idx]:_TriviaKind_index[idx+1]]
+}
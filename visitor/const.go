@@ -0,0 +1,231 @@
+package visitor
+
+import (
+	"math"
+	"sometimes/ast"
+	"sometimes/hir"
+)
+
+// evalConst evaluates the value of a constant expression.
+func (v *Visitor) evalConst(e ast.Expr) (hir.Value, bool) {
+	switch e := e.(type) {
+	case *ast.Literal:
+		return v.visitLiteral(e)
+	case *ast.ParenExpr:
+		return v.evalConst(e.Inner)
+	case *ast.MapExpr:
+		return v.evalMap(e)
+	case *ast.Ident:
+		if val, ok := v.mod.consts[e.Name]; ok {
+			return val, true
+		}
+		if !v.isGlobal(e.Name) {
+			v.errorf(e, "undefined: %s", e.Name)
+			return nil, false
+		}
+	case *ast.SelectorExpr:
+		ms, ok := v.importOf(e)
+		if !ok {
+			break
+		}
+		if val, ok := ms.consts[e.Sel.Name]; ok {
+			return val, true
+		}
+		if _, isFunc := ms.funcs[e.Sel.Name]; !isFunc && ms.structs[e.Sel.Name] == nil {
+			v.errorf(e, "undefined: %s", e.String())
+			return nil, false
+		}
+	case *ast.UnaryExpr:
+		if lit, ok := negatedInt(e); ok {
+			return v.visitInt(e, lit.Val, true)
+		}
+		x, ok := v.evalConst(e.Expr)
+		if !ok {
+			return nil, false
+		}
+		if op, ok := unaryOps[e.Op.Kind]; ok {
+			if val, ok := foldUnary(op, x); ok {
+				return val, true
+			}
+		}
+		v.errorf(e, "invalid operation: %s%s", e.Op.Val, x.String())
+		return nil, false
+	case *ast.BinaryExpr:
+		x, xok := v.evalConst(e.Lhs)
+		y, yok := v.evalConst(e.Rhs)
+		if !xok || !yok {
+			return nil, false
+		}
+		if op, ok := binaryOps[e.Op.Kind]; ok {
+			if val, ok := foldBinary(op, x, y); ok {
+				return val, true
+			}
+		}
+		v.errorf(e, "invalid operation: %s %s %s", x.String(), e.Op.Val, y.String())
+		return nil, false
+	}
+	v.errorf(e, "%s is not a constant", e.String())
+	return nil, false
+}
+
+// isConstExpr reports whether e is a constant expression.
+// Unlike evalConst, it reports no error, a local which shadows a constant is not constant.
+func (v *Visitor) isConstExpr(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.Literal:
+		return true
+	case *ast.ParenExpr:
+		return v.isConstExpr(e.Inner)
+	case *ast.MapExpr:
+		for _, entry := range e.Entries {
+			if !v.isConstExpr(entry.Key) || !v.isConstExpr(entry.Value) {
+				return false
+			}
+		}
+		return true
+	case *ast.Ident:
+		if v.isLocal(e.Name) {
+			return false
+		}
+		_, isConst := v.mod.consts[e.Name]
+		return isConst
+	case *ast.SelectorExpr:
+		if ms, ok := v.importOf(e); ok {
+			_, isConst := ms.consts[e.Sel.Name]
+			return isConst
+		}
+	case *ast.UnaryExpr:
+		return v.isConstExpr(e.Expr)
+	case *ast.BinaryExpr:
+		return v.isConstExpr(e.Lhs) && v.isConstExpr(e.Rhs)
+	}
+	return false
+}
+
+func foldUnary(op hir.UnaryOp, x hir.Value) (hir.Value, bool) {
+	switch x := x.(type) {
+	case *hir.ValueInt:
+		switch op {
+		case hir.OpNeg:
+			return hir.NewValueInt(-x.Val), true
+		case hir.OpBitNot:
+			return hir.NewValueInt(^x.Val), true
+		}
+	case *hir.ValueFloat:
+		if op == hir.OpNeg {
+			return hir.NewValueFloat(-x.Val), true
+		}
+	case *hir.ValueBoolean:
+		if op == hir.OpNot {
+			return hir.NewValueBoolean(!x.Val), true
+		}
+	}
+	return nil, false
+}
+
+func foldBinary(op hir.BinaryOp, x, y hir.Value) (hir.Value, bool) {
+	switch op {
+	case hir.OpEq:
+		return hir.NewValueBoolean(hir.ValueEqual(x, y)), true
+	case hir.OpNE:
+		return hir.NewValueBoolean(!hir.ValueEqual(x, y)), true
+	case hir.OpAnd, hir.OpOr:
+		a, xok := x.(*hir.ValueBoolean)
+		b, yok := y.(*hir.ValueBoolean)
+		if !xok || !yok {
+			return nil, false
+		}
+		if op == hir.OpAnd {
+			return hir.NewValueBoolean(a.Val && b.Val), true
+		}
+		return hir.NewValueBoolean(a.Val || b.Val), true
+	}
+
+	a, xIsInt := x.(*hir.ValueInt)
+	b, yIsInt := y.(*hir.ValueInt)
+	if xIsInt && yIsInt {
+		return foldInt(op, a.Val, b.Val)
+	}
+	f, xok := toFloat(x)
+	g, yok := toFloat(y)
+	if xok && yok {
+		return foldFloat(op, f, g)
+	}
+	return nil, false
+}
+
+func foldInt(op hir.BinaryOp, x, y int) (hir.Value, bool) {
+	switch op {
+	case hir.OpAdd:
+		return hir.NewValueInt(x + y), true
+	case hir.OpSub:
+		return hir.NewValueInt(x - y), true
+	case hir.OpMul:
+		return hir.NewValueInt(x * y), true
+	case hir.OpDiv:
+		if y != 0 {
+			return hir.NewValueInt(x / y), true
+		}
+	case hir.OpMod:
+		if y != 0 {
+			return hir.NewValueInt(x % y), true
+		}
+	case hir.OpBitAnd:
+		return hir.NewValueInt(x & y), true
+	case hir.OpBitOr:
+		return hir.NewValueInt(x | y), true
+	case hir.OpXor:
+		return hir.NewValueInt(x ^ y), true
+	case hir.OpShl:
+		if y >= 0 {
+			return hir.NewValueInt(x << y), true
+		}
+	case hir.OpShr:
+		if y >= 0 {
+			return hir.NewValueInt(x >> y), true
+		}
+	case hir.OpGT:
+		return hir.NewValueBoolean(x > y), true
+	case hir.OpLT:
+		return hir.NewValueBoolean(x < y), true
+	case hir.OpGTE:
+		return hir.NewValueBoolean(x >= y), true
+	case hir.OpLTE:
+		return hir.NewValueBoolean(x <= y), true
+	}
+	return nil, false
+}
+
+func foldFloat(op hir.BinaryOp, x, y float64) (hir.Value, bool) {
+	switch op {
+	case hir.OpAdd:
+		return hir.NewValueFloat(x + y), true
+	case hir.OpSub:
+		return hir.NewValueFloat(x - y), true
+	case hir.OpMul:
+		return hir.NewValueFloat(x * y), true
+	case hir.OpDiv:
+		return hir.NewValueFloat(x / y), true
+	case hir.OpMod:
+		return hir.NewValueFloat(math.Mod(x, y)), true
+	case hir.OpGT:
+		return hir.NewValueBoolean(x > y), true
+	case hir.OpLT:
+		return hir.NewValueBoolean(x < y), true
+	case hir.OpGTE:
+		return hir.NewValueBoolean(x >= y), true
+	case hir.OpLTE:
+		return hir.NewValueBoolean(x <= y), true
+	}
+	return nil, false
+}
+
+func toFloat(v hir.Value) (float64, bool) {
+	switch v := v.(type) {
+	case *hir.ValueInt:
+		return float64(v.Val), true
+	case *hir.ValueFloat:
+		return v.Val, true
+	}
+	return 0, false
+}
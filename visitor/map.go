@@ -0,0 +1,68 @@
+package visitor
+
+import (
+	"sometimes/ast"
+	"sometimes/hir"
+)
+
+// visitMap lowers a map literal, the constant keys are checked at compile time.
+func (v *Visitor) visitMap(e *ast.MapExpr) *hir.ExprMap {
+	x := &hir.ExprMap{Pos: e.StartPos()}
+	var seen []hir.Value
+	for _, entry := range e.Entries {
+		if v.isConstExpr(entry.Key) {
+			if key, ok := v.evalConst(entry.Key); ok {
+				v.checkMapKey(entry.Key, key, &seen)
+			}
+		}
+		x.Keys = append(x.Keys, v.visitExpr(entry.Key))
+		x.Values = append(x.Values, v.visitExpr(entry.Value))
+	}
+	return x
+}
+
+// evalMap evaluates a map literal whose keys and values are constants.
+func (v *Visitor) evalMap(e *ast.MapExpr) (hir.Value, bool) {
+	m := &hir.ValueMap{}
+	ok := true
+	for _, entry := range e.Entries {
+		key, kok := v.evalConst(entry.Key)
+		val, vok := v.evalConst(entry.Value)
+		if !kok || !vok || !v.checkMapKey(entry.Key, key, &m.Keys) {
+			ok = false
+			continue
+		}
+		m.Vals = append(m.Vals, val)
+	}
+	return m, ok
+}
+
+// checkMapKey reports a constant key which is unhashable or in seen, a valid key is appended to seen.
+func (v *Visitor) checkMapKey(e ast.Expr, key hir.Value, seen *[]hir.Value) bool {
+	if _, isMap := key.(*hir.ValueMap); isMap {
+		v.errorf(e, "invalid map key %s: a map is unhashable", e.String())
+		return false
+	}
+	if containsValue(*seen, key) {
+		v.errorf(e, "duplicate key %s in map literal", e.String())
+		return false
+	}
+	*seen = append(*seen, key)
+	return true
+}
+
+// visitLen lowers `len(x)`, the number of elements of an array or entries of a map.
+func (v *Visitor) visitLen(e *ast.CallExpr) hir.Expr {
+	if !v.checkArgs(e, 1) {
+		return &hir.ExprBlock{Body: []hir.Expr{v.discardArgs(e), &hir.ExprLiteral{Val: hir.NewValueInt(0)}}}
+	}
+	return &hir.ExprLen{Expr: v.visitExpr(e.Args[0]), Pos: e.StartPos()}
+}
+
+// visitDelete lowers `delete(m, k)`.
+func (v *Visitor) visitDelete(e *ast.CallExpr) hir.Expr {
+	if !v.checkArgs(e, 2) {
+		return v.discardArgs(e)
+	}
+	return &hir.ExprDelete{Map: v.visitExpr(e.Args[0]), Key: v.visitExpr(e.Args[1]), Pos: e.StartPos()}
+}
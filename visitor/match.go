@@ -0,0 +1,300 @@
+package visitor
+
+import (
+	"sometimes/ast"
+	"sometimes/hir"
+)
+
+// visitMatch lowers a match, the subject is evaluated once into a hidden local.
+// A match must have an arm without guard which matches any value, and every arm must be reachable.
+func (v *Visitor) visitMatch(e *ast.MatchExpr, wantValue bool) *hir.ExprMatch {
+	x := &hir.ExprMatch{Subject: v.visitExpr(e.Subject), Binding: v.newTemp()}
+	patErrors := false
+	for _, arm := range e.Arms {
+		v.scope = newScope(v.scope)
+		diags := len(v.diags)
+		a := &hir.MatchArm{Pat: v.visitPat(arm.Pat, make(map[string]bool))}
+		patErrors = patErrors || len(v.diags) > diags
+		if arm.Guard != nil {
+			a.Guard = v.visitExpr(arm.Guard)
+		}
+		if wantValue {
+			a.Body = v.visitExpr(arm.Body)
+		} else {
+			a.Body = v.visitStmt(arm.Body)
+		}
+		v.scope = v.scope.outer
+		x.Arms = append(x.Arms, a)
+	}
+	if !patErrors {
+		// the patterns with errors would be reported again
+		v.checkArms(e, x.Arms)
+	}
+	return x
+}
+
+// visitPat lowers a pattern and declares its bindings in the current scope, seen holds the names bound so far.
+func (v *Visitor) visitPat(p ast.Pat, seen map[string]bool) hir.Pat {
+	switch p := p.(type) {
+	case *ast.IdentPat:
+		if p.Ident.Name == "_" {
+			return &hir.PatWildcard{}
+		}
+		if v.isConstExpr(p.Ident) {
+			val, _ := v.patValue(p.Ident)
+			return &hir.PatLiteral{Val: val}
+		}
+		return v.bindPat(p.Ident, seen)
+	case *ast.LiteralPat:
+		val, _ := v.patValue(p.Value)
+		return &hir.PatLiteral{Val: val}
+	case *ast.RangePat:
+		return v.visitRangePat(p)
+	case *ast.ArrayPat:
+		x := &hir.PatArray{Elems: make([]hir.Pat, 0, len(p.Elems)), HasRest: p.Rest != nil}
+		for _, elem := range p.Elems {
+			x.Elems = append(x.Elems, v.visitPat(elem, seen))
+		}
+		if p.Rest != nil && p.Rest.Name != "_" {
+			x.Rest = v.bindPat(p.Rest, seen).Binding
+		}
+		return x
+	case *ast.StructPat:
+		return v.visitStructPat(p, seen)
+	}
+	panic("unreachable")
+}
+
+func (v *Visitor) bindPat(id *ast.Ident, seen map[string]bool) *hir.PatBinding {
+	if seen[id.Name] {
+		v.errorf(id, "%s bound more than once in pattern", id.Name)
+	}
+	seen[id.Name] = true
+	return &hir.PatBinding{Binding: v.declare(id.Name)}
+}
+
+// patValue evaluates a literal or a constant in a pattern, the value is nil if it has errors.
+func (v *Visitor) patValue(e ast.Expr) (hir.Value, bool) {
+	if id, ok := e.(*ast.Ident); ok && v.isLocal(id.Name) {
+		v.errorf(e, "%s is not a constant", id.Name)
+		return hir.NewValueNil(), false
+	}
+	val, ok := v.evalConst(e)
+	if !ok {
+		return hir.NewValueNil(), false
+	}
+	if _, isMap := val.(*hir.ValueMap); isMap {
+		// a map equals only itself
+		v.errorf(e, "invalid pattern %s: a map cannot be matched", e.String())
+		return hir.NewValueNil(), false
+	}
+	return val, true
+}
+
+func (v *Visitor) visitRangePat(p *ast.RangePat) hir.Pat {
+	lo, lok := v.patValue(p.Lo)
+	hi, hok := v.patValue(p.Hi)
+	x := &hir.PatRange{Lo: lo, Hi: hi, Inclusive: p.Inclusive}
+	if !lok || !hok {
+		return &hir.PatLiteral{Val: hir.NewValueNil()}
+	}
+	min, max, ok := hir.Bounds(x)
+	if !ok {
+		v.errorf(p, "invalid range pattern %s: the bounds must be ints or chars of the same type", p.String())
+		return &hir.PatLiteral{Val: hir.NewValueNil()}
+	}
+	if min > max {
+		v.errorf(p, "empty range pattern %s", p.String())
+	}
+	return x
+}
+
+func (v *Visitor) visitStructPat(p *ast.StructPat, seen map[string]bool) hir.Pat {
+	s, ok := v.lookupStruct(p.Type)
+	if !ok {
+		// lower the fields anyway to declare their bindings
+		s = &hir.Struct{Name: p.Type.String()}
+		for _, f := range p.Fields {
+			s.Fields = append(s.Fields, f.Name.Name)
+		}
+	}
+
+	fields := make([]hir.Pat, len(s.Fields))
+	for _, f := range p.Fields {
+		i := s.FieldIndex(f.Name.Name)
+		switch {
+		case i < 0:
+			v.errorf(f.Name, "unknown field %s in struct %s", f.Name.Name, s.Name)
+			continue
+		case ok && fields[i] != nil:
+			v.errorf(f.Name, "duplicate field %s in struct pattern", f.Name.Name)
+			continue
+		}
+		if f.Pat == nil {
+			fields[i] = v.bindPat(f.Name, seen)
+		} else {
+			fields[i] = v.visitPat(f.Pat, seen)
+		}
+	}
+	for i, x := range fields {
+		if x == nil {
+			fields[i] = &hir.PatWildcard{}
+		}
+	}
+	return &hir.PatStruct{Struct: s, Fields: fields}
+}
+
+// checkArms reports the arms which cannot match because the arms above match all their values,
+// and reports the match if some values match no arm.
+// An arm with a guard matches no value for sure, so it makes no arm below unreachable.
+func (v *Visitor) checkArms(e *ast.MatchExpr, arms []*hir.MatchArm) {
+	var rows []patRow
+	for i, arm := range arms {
+		if !useful(rows, patRow{arm.Pat}) {
+			v.errorf(e.Arms[i].Pat, "unreachable match arm %s", e.Arms[i].Pat.String())
+		}
+		if arm.Guard == nil {
+			rows = append(rows, patRow{arm.Pat})
+		}
+	}
+	if useful(rows, patRow{&hir.PatWildcard{}}) {
+		v.errorf(e, "non-exhaustive match: `_` not covered")
+	}
+}
+
+// patRow is a row of patterns which match the values of the columns.
+type patRow []hir.Pat
+
+// useful reports whether some values match q but none of rows, see
+// "Warnings for pattern matching" by Luc Maranget.
+//
+// Values are dynamically typed, so no finite set of patterns covers a column
+// unless one of them is a wildcard.
+func useful(rows []patRow, q patRow) bool {
+	if len(q) == 0 {
+		return len(rows) == 0
+	}
+	switch head := q[0].(type) {
+	case *hir.PatWildcard, *hir.PatBinding:
+		var def []patRow
+		for _, r := range rows {
+			if isWildcard(r[0]) {
+				def = append(def, r[1:])
+			}
+		}
+		return useful(def, q[1:])
+	case *hir.PatArray:
+		// the arrays of max or more elements are matched by the same rows
+		max := len(head.Elems)
+		if head.HasRest {
+			for _, r := range rows {
+				if a, ok := r[0].(*hir.PatArray); ok {
+					n := len(a.Elems)
+					if !a.HasRest {
+						n++
+					}
+					if n > max {
+						max = n
+					}
+				}
+			}
+		}
+		for n := len(head.Elems); n <= max; n++ {
+			if useful(specializeArray(rows, n), append(arrayElems(head, n), q[1:]...)) {
+				return true
+			}
+		}
+		return false
+	case *hir.PatStruct:
+		var spec []patRow
+		for _, r := range rows {
+			switch x := r[0].(type) {
+			case *hir.PatStruct:
+				if x.Struct.Name == head.Struct.Name {
+					spec = append(spec, append(append(patRow{}, x.Fields...), r[1:]...))
+				}
+			case *hir.PatWildcard, *hir.PatBinding:
+				spec = append(spec, append(wildcards(len(head.Struct.Fields)), r[1:]...))
+			}
+		}
+		return useful(spec, append(append(patRow{}, head.Fields...), q[1:]...))
+	}
+
+	lo, hi, isInterval := hir.Bounds(q[0])
+	if !isInterval {
+		// a literal which is not an int or a char
+		var spec []patRow
+		for _, r := range rows {
+			if isWildcard(r[0]) {
+				spec = append(spec, r[1:])
+			} else if x, ok := r[0].(*hir.PatLiteral); ok && hir.ValueEqual(x.Val, q[0].(*hir.PatLiteral).Val) {
+				spec = append(spec, r[1:])
+			}
+		}
+		return useful(spec, q[1:])
+	}
+
+	// split [lo, hi] at the bounds of the rows, each part is either in or out of a row
+	cuts := []int{lo}
+	for _, r := range rows {
+		if a, b, ok := hir.Bounds(r[0]); ok && hir.SameKind(r[0], q[0]) {
+			if a > lo && a <= hi {
+				cuts = append(cuts, a)
+			}
+			if b >= lo && b < hi {
+				cuts = append(cuts, b+1)
+			}
+		}
+	}
+	for _, start := range cuts {
+		var spec []patRow
+		for _, r := range rows {
+			if isWildcard(r[0]) {
+				spec = append(spec, r[1:])
+			} else if a, b, ok := hir.Bounds(r[0]); ok && hir.SameKind(r[0], q[0]) && a <= start && start <= b {
+				spec = append(spec, r[1:])
+			}
+		}
+		if useful(spec, q[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// specializeArray returns the rows which match arrays of n elements, each element is a column.
+func specializeArray(rows []patRow, n int) []patRow {
+	var spec []patRow
+	for _, r := range rows {
+		switch x := r[0].(type) {
+		case *hir.PatArray:
+			if len(x.Elems) == n || x.HasRest && len(x.Elems) < n {
+				spec = append(spec, append(arrayElems(x, n), r[1:]...))
+			}
+		case *hir.PatWildcard, *hir.PatBinding:
+			spec = append(spec, append(wildcards(n), r[1:]...))
+		}
+	}
+	return spec
+}
+
+// arrayElems returns the patterns of the n elements of the arrays matched by p, the rest are wildcards.
+func arrayElems(p *hir.PatArray, n int) patRow {
+	return append(append(patRow{}, p.Elems...), wildcards(n-len(p.Elems))...)
+}
+
+func wildcards(n int) patRow {
+	row := make(patRow, n)
+	for i := range row {
+		row[i] = &hir.PatWildcard{}
+	}
+	return row
+}
+
+func isWildcard(p hir.Pat) bool {
+	switch p.(type) {
+	case *hir.PatWildcard, *hir.PatBinding:
+		return true
+	}
+	return false
+}
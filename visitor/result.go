@@ -0,0 +1,38 @@
+package visitor
+
+import (
+	"sometimes/ast"
+	"sometimes/hir"
+)
+
+// visitResultCall lowers a call to the builtin ok, err, is_ok, unwrap or unwrap_or.
+func (v *Visitor) visitResultCall(e *ast.CallExpr, name string) hir.Expr {
+	n := 1
+	if name == builtinUnwrapOr {
+		n = 2
+	}
+	if !v.checkArgs(e, n) {
+		return &hir.ExprBlock{Body: []hir.Expr{v.discardArgs(e), nilLiteral()}}
+	}
+	x := v.visitExpr(e.Args[0])
+	switch name {
+	case builtinOk, builtinErr:
+		return &hir.ExprResult{Expr: x, Ok: name == builtinOk}
+	case builtinIsOk:
+		return &hir.ExprIsOk{Expr: x, Pos: e.StartPos()}
+	case builtinUnwrap:
+		return &hir.ExprUnwrap{Expr: x, Pos: e.StartPos()}
+	}
+	return &hir.ExprUnwrap{Expr: x, Default: v.visitExpr(e.Args[1]), Pos: e.StartPos()}
+}
+
+// visitPropagate lowers `r?`, which returns one value from the function if r is an err,
+// so it is reported in a function which returns more than one value.
+func (v *Visitor) visitPropagate(e *ast.PropagateExpr) *hir.ExprPropagate {
+	if v.fn.height == nil {
+		v.fn.height = v.newTemp()
+		v.fn.propagate = e
+	}
+	v.fn.addResults(1)
+	return &hir.ExprPropagate{Expr: v.visitExpr(e.X), Pos: e.StartPos()}
+}
@@ -0,0 +1,1413 @@
+package visitor
+
+import (
+	"errors"
+	"fmt"
+	"sometimes/ast"
+	"sometimes/hir"
+	"sometimes/module"
+	"sometimes/token"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// EntryFuncName is the name of the function the program starts from.
+const EntryFuncName = "main"
+
+// builtin functions, a local or a global of the same name shadows them
+const (
+	builtinPrint    = "print"
+	builtinLen      = "len"
+	builtinDelete   = "delete"
+	builtinOk       = "ok"
+	builtinErr      = "err"
+	builtinIsOk     = "is_ok"
+	builtinUnwrap   = "unwrap"
+	builtinUnwrapOr = "unwrap_or"
+)
+
+var (
+	binaryOps = map[token.Kind]hir.BinaryOp{
+		token.ADD:  hir.OpAdd,
+		token.SUB:  hir.OpSub,
+		token.MUL:  hir.OpMul,
+		token.QUO:  hir.OpDiv,
+		token.REM:  hir.OpMod,
+		token.EQL:  hir.OpEq,
+		token.NEQ:  hir.OpNE,
+		token.GTR:  hir.OpGT,
+		token.LSS:  hir.OpLT,
+		token.GEQ:  hir.OpGTE,
+		token.LEQ:  hir.OpLTE,
+		token.LAND: hir.OpAnd,
+		token.LOR:  hir.OpOr,
+		token.AND:  hir.OpBitAnd,
+		token.OR:   hir.OpBitOr,
+		token.XOR:  hir.OpXor,
+		token.SHL:  hir.OpShl,
+		token.SHR:  hir.OpShr,
+	}
+
+	// compound assignment operators, `a += 1` is `a = a + 1`
+	assignOps = map[token.Kind]hir.BinaryOp{
+		token.ADD_ASSIGN: hir.OpAdd,
+		token.SUB_ASSIGN: hir.OpSub,
+		token.MUL_ASSIGN: hir.OpMul,
+		token.QUO_ASSIGN: hir.OpDiv,
+		token.REM_ASSIGN: hir.OpMod,
+		token.AND_ASSIGN: hir.OpBitAnd,
+		token.OR_ASSIGN:  hir.OpBitOr,
+		token.XOR_ASSIGN: hir.OpXor,
+		token.SHL_ASSIGN: hir.OpShl,
+		token.SHR_ASSIGN: hir.OpShr,
+	}
+
+	unaryOps = map[token.Kind]hir.UnaryOp{
+		token.SUB:   hir.OpNeg,
+		token.NOT:   hir.OpNot,
+		token.TILDE: hir.OpBitNot,
+	}
+)
+
+// Diagnostic is an error found while lowering ast to hir.
+type Diagnostic struct {
+	Pos token.Pos // optional
+	Msg string
+}
+
+// Format returns the diagnostic after its position, which is resolved by fset.
+func (d *Diagnostic) Format(fset *token.FileSet) string {
+	if !d.Pos.IsValid() {
+		return d.Msg
+	}
+	return fset.Position(d.Pos).String() + ": " + d.Msg
+}
+
+type scope struct {
+	outer    *scope
+	bindings map[string]*hir.Binding
+}
+
+func newScope(outer *scope) *scope {
+	return &scope{
+		outer:    outer,
+		bindings: make(map[string]*hir.Binding),
+	}
+}
+
+func (s *scope) lookup(name string) (b *hir.Binding, isExist bool) {
+	for ; s != nil; s = s.outer {
+		if b, isExist = s.bindings[name]; isExist {
+			return
+		}
+	}
+	return
+}
+
+// funcState holds the state of the function being lowered.
+type funcState struct {
+	names  map[string]int // local name -> times declared
+	temps  int            // number of hidden locals
+	loops  []loopState    // enclosing loops, innermost last
+	height *hir.Binding   // hidden local of the height of the operand stack, allocated by the first `?`
+
+	// number of values returned by the returns lowered so far, -1 if they differ
+	results   int
+	multiple  bool     // set if a return returns more than one value
+	propagate ast.Node // the first `?`, it returns one value
+
+	// set if the function is anonymous
+	outer     *funcState
+	enclosing *scope // scope of the outer function where the function is declared
+	upvalues  []*hir.Upvalue
+}
+
+func newFuncState(outer *funcState, enclosing *scope) *funcState {
+	return &funcState{
+		names:     make(map[string]int),
+		outer:     outer,
+		enclosing: enclosing,
+	}
+}
+
+// capture resolves name to a local of an enclosing function and returns the index of its upvalue.
+func (fn *funcState) capture(name string) (int, bool) {
+	if fn.outer == nil {
+		return 0, false
+	}
+	if b, ok := fn.enclosing.lookup(name); ok {
+		return fn.addUpvalue(&hir.Upvalue{Name: name, IsLocal: true, Binding: b}), true
+	}
+	if i, ok := fn.outer.capture(name); ok {
+		return fn.addUpvalue(&hir.Upvalue{Name: name, Index: i}), true
+	}
+	return 0, false
+}
+
+func (fn *funcState) addResults(n int) {
+	if n > 1 {
+		fn.multiple = true
+	}
+	switch fn.results {
+	case 0:
+		fn.results = n
+	case n:
+	default:
+		fn.results = -1
+	}
+}
+
+func (fn *funcState) addUpvalue(uv *hir.Upvalue) int {
+	for i, x := range fn.upvalues {
+		if x.IsLocal == uv.IsLocal && x.Binding == uv.Binding && x.Index == uv.Index {
+			return i
+		}
+	}
+	fn.upvalues = append(fn.upvalues, uv)
+	return len(fn.upvalues) - 1
+}
+
+// moduleState holds the globals of a module.
+type moduleState struct {
+	prefix  string // qualifies the names of the globals in hir; empty for the main module
+	consts  map[string]hir.Value
+	funcs   map[string]*ast.FnDecl
+	structs map[string]*hir.Struct
+	imports map[string]*moduleState // by module name
+}
+
+func newModuleState(path string) *moduleState {
+	ms := &moduleState{
+		consts:  make(map[string]hir.Value),
+		funcs:   make(map[string]*ast.FnDecl),
+		structs: make(map[string]*hir.Struct),
+		imports: make(map[string]*moduleState),
+	}
+	if path != "" {
+		ms.prefix = path + "."
+	}
+	return ms
+}
+
+// Visitor lowers ast to hir.
+type Visitor struct {
+	fset    *token.FileSet
+	modules map[*module.Module]*moduleState
+	mod     *moduleState // module being lowered
+	scope   *scope
+	fn      *funcState
+	anons   int // number of anonymous functions
+	diags   []*Diagnostic
+
+	// number of values returned by the global functions, by name in hir; -1 if it varies.
+	// The calls are checked after all functions are lowered.
+	results      map[string]int
+	resultChecks []resultCheck
+}
+
+// resultCheck is a call of a global function which takes want values.
+type resultCheck struct {
+	fn   string
+	call *ast.CallExpr
+	want int
+}
+
+// NewVistor returns a Visitor, positions of diagnostics are resolved by fset.
+func NewVistor(fset *token.FileSet) *Visitor {
+	return &Visitor{
+		fset:    fset,
+		modules: make(map[*module.Module]*moduleState),
+		results: make(map[string]int),
+	}
+}
+
+// Diagnostics returns the errors reported by Visit.
+func (v *Visitor) Diagnostics() []*Diagnostic {
+	return v.diags
+}
+
+// Visit lowers the declarations of a program without imports to hir.
+// It returns nil if any diagnostic was reported.
+func (v *Visitor) Visit(file *ast.File) *hir.Program {
+	return v.VisitModule(&module.Module{File: file})
+}
+
+// VisitModule lowers the main module and the modules it imports into one program.
+// The globals of an imported module are named after its path, `f` of "a/b" is "a/b.f".
+// It returns nil if any diagnostic was reported.
+func (v *Visitor) VisitModule(m *module.Module) *hir.Program {
+	b := hir.NewBuilder()
+	main := v.visitModule(b, m)
+	v.checkResults()
+	if _, ok := main.funcs[EntryFuncName]; !ok {
+		v.diags = append(v.diags, &Diagnostic{Msg: fmt.Sprintf("function %s is undeclared", EntryFuncName)})
+	}
+	if len(v.diags) > 0 {
+		return nil
+	}
+	return b.Build()
+}
+
+// visitModule lowers a module after the modules it imports, a module is lowered once.
+func (v *Visitor) visitModule(b *hir.Builder, m *module.Module) *moduleState {
+	if ms, ok := v.modules[m]; ok {
+		return ms
+	}
+	ms := newModuleState(m.Path)
+	v.modules[m] = ms
+	for _, imp := range m.File.Imports {
+		dep := m.Imports[imp.Path.Val]
+		if dep == nil {
+			continue // reported by the resolver
+		}
+		name := imp.Name()
+		if _, ok := ms.imports[name]; ok {
+			v.errorf(imp.Path, "%s redeclared", name)
+			continue
+		}
+		ms.imports[name] = v.visitModule(b, dep)
+	}
+
+	outer := v.mod
+	v.mod = ms
+	defer func() { v.mod = outer }()
+
+	file := m.File
+	for _, fd := range file.Fns {
+		if v.isGlobal(fd.FnName.Name) {
+			v.errorf(fd.FnName, "function %s redeclared", fd.FnName.Name)
+			continue
+		}
+		v.mod.funcs[fd.FnName.Name] = fd
+	}
+	for _, sd := range file.Structs {
+		v.visitStructDecl(sd)
+	}
+	for _, cd := range file.Consts {
+		v.visitConstDecl(cd)
+	}
+
+	for _, fd := range file.Fns {
+		if v.mod.funcs[fd.FnName.Name] != fd {
+			continue
+		}
+		b.InsertFunc(v.visitFnDecl(fd), m.Path == "" && fd.FnName.Name == EntryFuncName)
+	}
+	for name, val := range v.mod.consts {
+		b.InsertConst(v.mod.prefix+name, val)
+	}
+	for _, s := range v.mod.structs {
+		b.InsertStruct(s)
+	}
+	return ms
+}
+
+func (v *Visitor) visitConstDecl(cd *ast.ConstDecl) {
+	for _, d := range cd.Decls {
+		name := d.Ident.Name
+		if v.isGlobal(name) {
+			v.errorf(d.Ident, "%s redeclared", name)
+			continue
+		}
+		val, ok := v.evalConst(d.Value)
+		if !ok {
+			// keep the name declared so uses of it are not reported again
+			val = hir.NewValueNil()
+		}
+		v.mod.consts[name] = val
+	}
+}
+
+func (v *Visitor) visitStructDecl(sd *ast.StructDecl) {
+	name := sd.Name.Name
+	if v.isGlobal(name) {
+		v.errorf(sd.Name, "%s redeclared", name)
+		return
+	}
+	s := &hir.Struct{Name: v.mod.prefix + name, Doc: sd.Doc}
+	for _, f := range sd.Fields {
+		if s.FieldIndex(f.Name) >= 0 {
+			v.errorf(f, "duplicate field %s in struct %s", f.Name, name)
+			continue
+		}
+		s.Fields = append(s.Fields, f.Name)
+	}
+	v.mod.structs[name] = s
+}
+
+func (v *Visitor) visitFnDecl(fd *ast.FnDecl) *hir.ExprFunction {
+	v.fn = newFuncState(nil, nil)
+	v.scope = newScope(nil)
+
+	name := v.mod.prefix + fd.FnName.Name
+	fb := v.visitFunc(name, fd.Args, fd.Body)
+	fb.SetDoc(fd.Doc)
+	v.results[name] = v.fn.results
+
+	v.fn, v.scope = nil, nil
+	return fb.Build()
+}
+
+// visitFuncLit lowers an anonymous function, the locals of the enclosing functions it uses are captured.
+func (v *Visitor) visitFuncLit(e *ast.FuncLit) *hir.ExprAnonFunction {
+	outer, outerScope := v.fn, v.scope
+	v.fn = newFuncState(outer, outerScope)
+	v.scope = newScope(nil)
+
+	name := fmt.Sprintf("fn#%d", v.anons)
+	v.anons++
+	fb := v.visitFunc(name, e.Args, e.Body)
+	f := fb.Build().Func
+	f.Upvalues = v.fn.upvalues
+
+	v.fn, v.scope = outer, outerScope
+	return &hir.ExprAnonFunction{Func: f}
+}
+
+// visitFunc lowers the arguments and the body of a function into a FuncBuilder, v.fn must be set.
+// A default value is evaluated when the argument is left out, it may use the arguments before it.
+func (v *Visitor) visitFunc(name string, params []ast.Param, b *ast.BlockExpr) *hir.FuncBuilder {
+	args := make([]*hir.Binding, 0, len(params))
+	defaults := make([]hir.Expr, 0, len(params))
+	var rest *hir.Binding
+	hasDefault := false
+	for _, param := range params {
+		arg := param.Name
+		if _, ok := v.scope.bindings[arg.Name]; ok {
+			v.errorf(arg, "duplicate argument %s", arg.Name)
+		}
+		if param.Rest {
+			rest = v.declare(arg.Name)
+			continue
+		}
+		var d hir.Expr
+		if param.Default != nil {
+			d, hasDefault = v.visitExpr(param.Default), true
+		} else if hasDefault {
+			v.errorf(arg, "missing default value of argument %s after an argument with one", arg.Name)
+		}
+		defaults = append(defaults, d)
+		args = append(args, v.declare(arg.Name))
+	}
+
+	fb := hir.NewFuncBuilder(name, args)
+	if !hasDefault {
+		defaults = nil
+	}
+	fb.SetParams(defaults, rest)
+	body := v.visitBlock(b, true)
+	last := len(body.Body) - 1
+	for _, e := range body.Body[:last] {
+		fb.Emit(e)
+	}
+	// the value of the body is returned
+	fb.Emit(&hir.ExprReturn{Expr: body.Body[last]})
+	if !endsWithReturn(b) {
+		v.fn.addResults(1)
+	}
+	if v.fn.propagate != nil && v.fn.multiple {
+		// an err returned by `?` would be a single value
+		v.errorf(v.fn.propagate, "`?` in a function returning multiple values")
+	}
+	fb.SetHeight(v.fn.height)
+	return fb
+}
+
+func endsWithReturn(b *ast.BlockExpr) bool {
+	last := b.RetExpr
+	if last == nil && len(b.ExprList) > 0 {
+		last = b.ExprList[len(b.ExprList)-1]
+	}
+	_, ok := last.(*ast.ReturnExpr)
+	return ok
+}
+
+// visitExpr lowers an expression whose value is used.
+// The lowered expression always leaves exactly one value on the stack.
+func (v *Visitor) visitExpr(e ast.Expr) hir.Expr {
+	switch e := e.(type) {
+	case *ast.Literal:
+		val, ok := v.visitLiteral(e)
+		if !ok {
+			val = hir.NewValueNil()
+		}
+		return &hir.ExprLiteral{Val: val}
+	case *ast.Ident:
+		return v.visitIdent(e)
+	case *ast.ParenExpr:
+		return v.visitExpr(e.Inner)
+	case *ast.IndexExpr:
+		return &hir.ExprGetElement{
+			ArrayAddr: v.visitExpr(e.Addr),
+			Index:     v.visitExpr(e.Index),
+			Pos:       e.StartPos(),
+		}
+	case *ast.ArrayExpr:
+		return &hir.ExprArray{Exprs: v.visitExprs(e.Element)}
+	case *ast.MapExpr:
+		return v.visitMap(e)
+	case *ast.CallExpr:
+		switch name := v.builtinOf(e); name {
+		case "":
+			return v.visitCall(e, 1)
+		case builtinLen:
+			return v.visitLen(e)
+		case builtinOk, builtinErr, builtinIsOk, builtinUnwrap, builtinUnwrapOr:
+			return v.visitResultCall(e, name)
+		}
+	case *ast.PropagateExpr:
+		return v.visitPropagate(e)
+	case *ast.StructLit:
+		return v.visitStructLit(e)
+	case *ast.FuncLit:
+		return v.visitFuncLit(e)
+	case *ast.SelectorExpr:
+		if x, ok := v.visitQualified(e); ok {
+			return x
+		}
+		return &hir.ExprGetField{
+			Expr:  v.visitExpr(e.X),
+			Field: e.Sel.Name,
+			Pos:   e.Sel.StartPos(),
+		}
+	case *ast.UnaryExpr:
+		if lit, ok := negatedInt(e); ok {
+			val, ok := v.visitInt(e, lit.Val, true)
+			if !ok {
+				val = hir.NewValueNil()
+			}
+			return &hir.ExprLiteral{Val: val}
+		}
+		op, ok := unaryOps[e.Op.Kind]
+		if !ok {
+			v.errorf(e, "unsupported unary operator %s", e.Op.Val)
+		}
+		return &hir.ExprUnary{Op: op, Expr: v.visitExpr(e.Expr), Pos: e.StartPos()}
+	case *ast.BinaryExpr:
+		op, ok := binaryOps[e.Op.Kind]
+		if !ok {
+			v.errorf(e, "unsupported binary operator %s", e.Op.Val)
+		}
+		return &hir.ExprBinary{
+			Lhs: v.visitExpr(e.Lhs),
+			Rhs: v.visitExpr(e.Rhs),
+			Op:  op,
+			Pos: e.Op.StartPos,
+		}
+	case *ast.IfExpr:
+		return v.visitIf(e, true)
+	case *ast.SwitchExpr:
+		return v.visitSwitch(e, true)
+	case *ast.MatchExpr:
+		return v.visitMatch(e, true)
+	case *ast.TryExpr:
+		return v.visitTry(e, true)
+	case *ast.BlockExpr:
+		return v.visitBlock(e, true)
+	case *ast.LoopExpr:
+		return v.visitLoop(e, true)
+	case *ast.LoopInExpr:
+		return v.visitLoopIn(e, true)
+	}
+
+	// expressions without a value evaluate to nil
+	return &hir.ExprBlock{
+		Body: []hir.Expr{v.visitStmt(e), nilLiteral()},
+	}
+}
+
+// visitStmt lowers an expression whose value is unused.
+// The lowered expression leaves nothing on the stack.
+func (v *Visitor) visitStmt(e ast.Expr) hir.Expr {
+	switch e := e.(type) {
+	case *ast.AssignExpr:
+		return v.visitAssign(e)
+	case *ast.IncDecExpr:
+		return v.visitIncDec(e)
+	case *ast.LetExpr:
+		return v.visitLet(e)
+	case *ast.DefineExpr:
+		return v.visitDefine(e)
+	case *ast.ReturnExpr:
+		return v.visitReturn(e)
+	case *ast.ThrowExpr:
+		return &hir.ExprThrow{Expr: v.visitExpr(e.X), Pos: e.StartPos()}
+	case *ast.BreakExpr:
+		return v.visitBreak(e)
+	case *ast.ContinueExpr:
+		if _, ok := v.targetLoop("continue", e, e.Label); !ok {
+			return &hir.ExprContinue{}
+		}
+		return &hir.ExprContinue{Label: labelName(e.Label)}
+	case *ast.LoopExpr:
+		return v.visitLoop(e, false)
+	case *ast.LoopInExpr:
+		return v.visitLoopIn(e, false)
+	case *ast.IfExpr:
+		return v.visitIf(e, false)
+	case *ast.SwitchExpr:
+		return v.visitSwitch(e, false)
+	case *ast.MatchExpr:
+		return v.visitMatch(e, false)
+	case *ast.TryExpr:
+		return v.visitTry(e, false)
+	case *ast.BlockExpr:
+		return v.visitBlock(e, false)
+	case *ast.CallExpr:
+		switch name := v.builtinOf(e); name {
+		case builtinPrint:
+			return &hir.ExprPrint{Expr: v.visitExprs(e.Args)}
+		case builtinDelete:
+			return v.visitDelete(e)
+		case builtinLen:
+			return &hir.ExprDiscard{Expr: v.visitLen(e)}
+		case builtinOk, builtinErr, builtinIsOk, builtinUnwrap, builtinUnwrapOr:
+			return &hir.ExprDiscard{Expr: v.visitResultCall(e, name)}
+		}
+		// all the values of the call are dropped
+		return &hir.ExprDiscard{Expr: v.visitCall(e, 0)}
+	}
+	return &hir.ExprDiscard{Expr: v.visitExpr(e)}
+}
+
+func (v *Visitor) visitExprs(l []ast.Expr) []hir.Expr {
+	exprs := make([]hir.Expr, 0, len(l))
+	for _, e := range l {
+		exprs = append(exprs, v.visitExpr(e))
+	}
+	return exprs
+}
+
+func (v *Visitor) visitLiteral(e *ast.Literal) (hir.Value, bool) {
+	switch e.Kind {
+	case token.INT_LITERAL:
+		return v.visitInt(e, e.Val, false)
+	case token.FLOAT_LITERAL:
+		f, err := strconv.ParseFloat(strings.ReplaceAll(e.Val, "_", ""), 64)
+		if err == nil {
+			return hir.NewValueFloat(f), true
+		}
+		if errors.Is(err, strconv.ErrRange) {
+			v.errorf(e, "float literal %s overflows float64", e.Val)
+			return nil, false
+		}
+	case token.BOOLEAN_LITERAL:
+		return hir.NewValueBoolean(e.Val == "true"), true
+	case token.STRING_LITERAL:
+		return hir.NewValueString(e.Val), true
+	case token.CHAR_LITERAL:
+		if r, size := utf8.DecodeRuneInString(e.Val); size > 0 && size == len(e.Val) {
+			return hir.NewValueChar(r), true
+		}
+	}
+	v.errorf(e, "invalid literal %s", e.Val)
+	return nil, false
+}
+
+// visitInt parses the int literal lit of e, which negates it if neg.
+func (v *Visitor) visitInt(e ast.Expr, lit string, neg bool) (hir.Value, bool) {
+	i, err := parseInt(lit, neg)
+	if err == nil {
+		return hir.NewValueInt(int(i)), true
+	}
+	if neg {
+		lit = "-" + lit
+	}
+	if errors.Is(err, strconv.ErrRange) {
+		v.errorf(e, "integer literal %s overflows int", lit)
+	} else {
+		v.errorf(e, "invalid literal %s", lit)
+	}
+	return nil, false
+}
+
+// negatedInt returns the int literal of e if e negates one, like `-1`.
+// The literal is negated before its range is checked, so that -9223372036854775808 is an int.
+func negatedInt(e *ast.UnaryExpr) (*ast.Literal, bool) {
+	lit, ok := e.Expr.(*ast.Literal)
+	return lit, ok && e.Op.Kind == token.SUB && lit.Kind == token.INT_LITERAL
+}
+
+// parseInt parses an int literal with an optional base prefix, negated if neg.
+// Unlike strconv, a leading zero does not mean octal.
+func parseInt(lit string, neg bool) (int64, error) {
+	digits, base := strings.ReplaceAll(lit, "_", ""), 10
+	if len(digits) > 2 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X':
+			base = 16
+		case 'o', 'O':
+			base = 8
+		case 'b', 'B':
+			base = 2
+		}
+		if base != 10 {
+			digits = digits[2:]
+		}
+	}
+	if neg {
+		digits = "-" + digits
+	}
+	return strconv.ParseInt(digits, base, strconv.IntSize)
+}
+
+func (v *Visitor) visitIdent(e *ast.Ident) hir.Expr {
+	if x, ok := v.lookup(e.Name); ok {
+		return x
+	}
+	if _, ok := v.mod.imports[e.Name]; ok {
+		v.errorf(e, "use of module %s without selector", e.Name)
+		return nilLiteral()
+	}
+	if _, ok := v.mod.structs[e.Name]; ok {
+		v.errorf(e, "struct %s is not a value", e.Name)
+		return nilLiteral()
+	}
+	if v.isGlobal(e.Name) {
+		return &hir.ExprVar{VarBinding: hir.NewBinding(v.mod.prefix + e.Name)}
+	}
+	v.errorf(e, "undefined: %s", e.Name)
+	return nilLiteral()
+}
+
+// visitQualified lowers `mod.name`, a function or a constant of an imported module.
+// It returns false if e is not qualified.
+func (v *Visitor) visitQualified(e *ast.SelectorExpr) (hir.Expr, bool) {
+	ms, ok := v.importOf(e)
+	if !ok {
+		return nil, false
+	}
+	name := e.Sel.Name
+	_, isConst := ms.consts[name]
+	_, isFunc := ms.funcs[name]
+	switch {
+	case isConst || isFunc:
+		return &hir.ExprVar{VarBinding: hir.NewBinding(ms.prefix + name)}, true
+	case ms.structs[name] != nil:
+		v.errorf(e, "struct %s is not a value", e.String())
+	default:
+		v.errorf(e, "undefined: %s", e.String())
+	}
+	return nilLiteral(), true
+}
+
+// importOf returns the module which qualifies e, if e.X names an imported module.
+func (v *Visitor) importOf(e *ast.SelectorExpr) (*moduleState, bool) {
+	id, ok := e.X.(*ast.Ident)
+	if !ok || v.isLocal(id.Name) {
+		return nil, false
+	}
+	ms, ok := v.mod.imports[id.Name]
+	return ms, ok
+}
+
+// lookupStruct resolves the type of a struct literal or pattern, `Point` or `m.Point` of an imported module m.
+func (v *Visitor) lookupStruct(typ ast.Expr) (*hir.Struct, bool) {
+	switch typ := typ.(type) {
+	case *ast.Ident:
+		if s, ok := v.mod.structs[typ.Name]; ok {
+			return s, true
+		}
+		if v.isLocal(typ.Name) || v.isGlobal(typ.Name) {
+			v.errorf(typ, "%s is not a struct", typ.Name)
+			return nil, false
+		}
+	case *ast.SelectorExpr:
+		ms, ok := v.importOf(typ)
+		if !ok {
+			v.errorf(typ, "%s is not a struct", typ.String())
+			return nil, false
+		}
+		if s, ok := ms.structs[typ.Sel.Name]; ok {
+			return s, true
+		}
+		_, isConst := ms.consts[typ.Sel.Name]
+		_, isFunc := ms.funcs[typ.Sel.Name]
+		if isConst || isFunc {
+			v.errorf(typ, "%s is not a struct", typ.String())
+			return nil, false
+		}
+	}
+	v.errorf(typ, "undefined: %s", typ.String())
+	return nil, false
+}
+
+func (v *Visitor) visitStructLit(e *ast.StructLit) hir.Expr {
+	s, ok := v.lookupStruct(e.Type)
+	if !ok {
+		// lower the fields anyway to report their errors
+		s = &hir.Struct{Name: e.Type.String()}
+		for _, f := range e.Fields {
+			s.Fields = append(s.Fields, f.Name.Name)
+		}
+	}
+
+	// fields which are not initialized are nil
+	values := make([]hir.Expr, len(s.Fields))
+	for _, f := range e.Fields {
+		i := s.FieldIndex(f.Name.Name)
+		switch {
+		case i < 0:
+			v.errorf(f.Name, "unknown field %s in struct %s", f.Name.Name, s.Name)
+			continue
+		case ok && values[i] != nil:
+			v.errorf(f.Name, "duplicate field %s in struct literal", f.Name.Name)
+			continue
+		}
+		values[i] = v.visitExpr(f.Value)
+	}
+	for i, x := range values {
+		if x == nil {
+			values[i] = nilLiteral()
+		}
+	}
+	return &hir.ExprStruct{Struct: s, Values: values, Pos: e.StartPos()}
+}
+
+// visitCall lowers a call which takes want values of the callee, or drops them all if want is 0.
+func (v *Visitor) visitCall(e *ast.CallExpr, want int) *hir.ExprCall {
+	if id, ok := e.Func.(*ast.Ident); ok {
+		if !v.isLocal(id.Name) {
+			if _, isConst := v.mod.consts[id.Name]; isConst {
+				v.errorf(id, "cannot call non-function %s", id.Name)
+			}
+		}
+	}
+	if fn, fd, ok := v.globalFunc(e.Func); ok {
+		v.checkCallArgs(e, fd)
+		if want > 0 {
+			v.resultChecks = append(v.resultChecks, resultCheck{fn: fn, call: e, want: want})
+		}
+	}
+	x := &hir.ExprCall{
+		Callee: v.visitExpr(e.Func),
+		Args:   v.visitExprs(e.Args),
+		Pos:    e.StartPos(),
+	}
+	if want > 1 {
+		x.Results = want
+	}
+	return x
+}
+
+// globalFunc returns the name in hir and the declaration of the global function which e refers to.
+func (v *Visitor) globalFunc(e ast.Expr) (string, *ast.FnDecl, bool) {
+	switch e := e.(type) {
+	case *ast.Ident:
+		if fd, ok := v.mod.funcs[e.Name]; ok && !v.isLocal(e.Name) {
+			return v.mod.prefix + e.Name, fd, true
+		}
+	case *ast.SelectorExpr:
+		if ms, ok := v.importOf(e); ok {
+			if fd, ok := ms.funcs[e.Sel.Name]; ok {
+				return ms.prefix + e.Sel.Name, fd, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// checkCallArgs reports a call to a global function with a number of arguments it does not take.
+func (v *Visitor) checkCallArgs(e *ast.CallExpr, fd *ast.FnDecl) {
+	min, max := 0, len(fd.Args)
+	for _, param := range fd.Args {
+		if param.Rest {
+			max = -1
+		} else if param.Default == nil {
+			min++
+		}
+	}
+	v.checkArity(e, min, max)
+}
+
+// checkResults reports the calls of global functions which return a different number of values than taken.
+// A function whose returns differ is checked at runtime.
+func (v *Visitor) checkResults() {
+	for _, c := range v.resultChecks {
+		n, ok := v.results[c.fn]
+		if !ok || n < 0 || n == c.want {
+			continue
+		}
+		if c.want == 1 {
+			v.errorf(c.call, "multiple-value %s in single-value context", c.call.String())
+		} else {
+			v.errorf(c.call, "assignment mismatch: %d variables but %s returns %s", c.want, c.call.String(), values(n))
+		}
+	}
+}
+
+func (v *Visitor) visitReturn(e *ast.ReturnExpr) *hir.ExprReturn {
+	n := len(e.Results)
+	if n == 0 {
+		// returns nil
+		n = 1
+	}
+	v.fn.addResults(n)
+	x := &hir.ExprReturn{Pos: e.StartPos()}
+	switch len(e.Results) {
+	case 0:
+	case 1:
+		x.Expr = v.visitExpr(e.Results[0])
+	default:
+		x.Exprs = v.visitExprs(e.Results)
+	}
+	return x
+}
+
+func (v *Visitor) visitAssign(e *ast.AssignExpr) hir.Expr {
+	rhs := v.visitExpr(e.Rhs)
+	op, compound := assignOps[e.Op.Kind]
+	return v.assign(e.Lhs, rhs, op, compound, e.Op.StartPos)
+}
+
+// visitIncDec lowers `x++` to `x += 1` and `x--` to `x -= 1`.
+func (v *Visitor) visitIncDec(e *ast.IncDecExpr) hir.Expr {
+	op := hir.OpAdd
+	if e.Op.Kind == token.DEC {
+		op = hir.OpSub
+	}
+	return v.assign(e.X, &hir.ExprLiteral{Val: hir.NewValueInt(1)}, op, true, e.Op.StartPos)
+}
+
+// assign lowers an assignment of rhs to lhs, a compound assignment applies op to the value of lhs and rhs.
+func (v *Visitor) assign(lhs ast.Expr, rhs hir.Expr, op hir.BinaryOp, compound bool, opPos token.Pos) hir.Expr {
+	switch lhs := lhs.(type) {
+	case *ast.Ident:
+		x, ok := v.lookup(lhs.Name)
+		if !ok {
+			if v.isGlobal(lhs.Name) {
+				v.errorf(lhs, "cannot assign to %s", lhs.Name)
+			} else {
+				v.errorf(lhs, "undefined: %s", lhs.Name)
+			}
+			return &hir.ExprDiscard{Expr: rhs}
+		}
+		if compound {
+			rhs = &hir.ExprBinary{Lhs: x, Rhs: rhs, Op: op, Pos: opPos}
+		}
+		return &hir.ExprMutate{Lhs: x, Rhs: rhs}
+	case *ast.IndexExpr:
+		addr, index := v.visitExpr(lhs.Addr), v.visitExpr(lhs.Index)
+		var init []hir.Expr
+		if compound {
+			addr, index = v.evalOnce(addr, &init), v.evalOnce(index, &init)
+			rhs = &hir.ExprBinary{
+				Lhs: &hir.ExprGetElement{ArrayAddr: addr, Index: index, Pos: lhs.StartPos()},
+				Rhs: rhs,
+				Op:  op,
+				Pos: opPos,
+			}
+		}
+		return withInit(init, &hir.ExprSetElement{ArrayAddr: addr, Index: index, Value: rhs, Pos: lhs.StartPos()})
+	case *ast.SelectorExpr:
+		x := v.visitExpr(lhs.X)
+		var init []hir.Expr
+		if compound {
+			x = v.evalOnce(x, &init)
+			rhs = &hir.ExprBinary{
+				Lhs: &hir.ExprGetField{Expr: x, Field: lhs.Sel.Name, Pos: lhs.Sel.StartPos()},
+				Rhs: rhs,
+				Op:  op,
+				Pos: opPos,
+			}
+		}
+		return withInit(init, &hir.ExprSetField{Expr: x, Field: lhs.Sel.Name, Value: rhs, Pos: lhs.Sel.StartPos()})
+	}
+	v.errorf(lhs, "cannot assign to %s", lhs.String())
+	return &hir.ExprDiscard{Expr: rhs}
+}
+
+// evalOnce returns an expression to evaluate in place of x more than once, x is bound to a hidden local
+// appended to init unless evaluating it again gives the same value and has no effect.
+func (v *Visitor) evalOnce(x hir.Expr, init *[]hir.Expr) hir.Expr {
+	switch x.(type) {
+	case *hir.ExprVar, *hir.ExprUpvalue, *hir.ExprLiteral:
+		return x
+	}
+	b := v.newTemp()
+	*init = append(*init, &hir.ExprBinding{Binding: b, Rhs: x})
+	return &hir.ExprVar{VarBinding: b}
+}
+
+// withInit returns x preceded by the expressions of init.
+func withInit(init []hir.Expr, x hir.Expr) hir.Expr {
+	if len(init) == 0 {
+		return x
+	}
+	return &hir.ExprBlock{Body: append(init, x)}
+}
+
+func (v *Visitor) visitLet(e *ast.LetExpr) hir.Expr {
+	body := make([]hir.Expr, 0, len(e.Decls))
+	for _, d := range e.Decls {
+		if d.Pattern != nil {
+			body = append(body, v.visitPattern(d.Pattern, d.Value))
+			continue
+		}
+		// the value is lowered first, `let a = a + 1` refers to the outer `a`
+		rhs := v.visitExpr(d.Value)
+		body = append(body, &hir.ExprBinding{
+			Binding: v.declare(d.Ident.Name),
+			Rhs:     rhs,
+		})
+	}
+	if len(body) == 1 {
+		return body[0]
+	}
+	return &hir.ExprBlock{Body: body}
+}
+
+// visitPattern lowers `let (q, r) = f()` and `let [head, ..tail] = arr`.
+//
+// An array pattern is lowered to
+//
+//	let arr# = arr, head = arr#[0], tail = arr# + 1
+//
+// so the rest shares the elements of the array. Elements after the names are ignored,
+// an array literal with fewer elements than the names is reported.
+func (v *Visitor) visitPattern(p *ast.Pattern, value ast.Expr) hir.Expr {
+	seen := make(map[string]bool)
+	declare := func(id *ast.Ident) *hir.Binding {
+		if id.Name == "_" {
+			return nil
+		}
+		if seen[id.Name] {
+			v.errorf(id, "%s repeated on left side of let", id.Name)
+		}
+		seen[id.Name] = true
+		return v.declare(id.Name)
+	}
+
+	if !p.Array {
+		call, ok := value.(*ast.CallExpr)
+		if !ok || v.builtinOf(call) != "" {
+			v.errorf(value, "assignment mismatch: %d variables but 1 value", len(p.Names))
+			// the names are declared anyway, so uses of them are not reported again
+			body := []hir.Expr{&hir.ExprDiscard{Expr: v.visitExpr(value)}}
+			for _, id := range p.Names {
+				if b := declare(id); b != nil {
+					body = append(body, &hir.ExprBinding{Binding: b, Rhs: nilLiteral()})
+				}
+			}
+			return &hir.ExprBlock{Body: body}
+		}
+		x := v.visitCall(call, len(p.Names))
+		bindings := make([]*hir.Binding, 0, len(p.Names))
+		for _, id := range p.Names {
+			bindings = append(bindings, declare(id))
+		}
+		if len(bindings) == 1 && bindings[0] != nil {
+			return &hir.ExprBinding{Binding: bindings[0], Rhs: x}
+		}
+		return &hir.ExprDestructure{Bindings: bindings, Call: x}
+	}
+
+	if lit, ok := value.(*ast.ArrayExpr); ok && len(lit.Element) < len(p.Names) {
+		v.errorf(value, "assignment mismatch: %d variables but %s", len(p.Names), values(len(lit.Element)))
+	}
+	arr := v.newTemp()
+	body := []hir.Expr{&hir.ExprBinding{Binding: arr, Rhs: v.visitExpr(value)}}
+	for i, id := range p.Names {
+		if b := declare(id); b != nil {
+			body = append(body, &hir.ExprBinding{
+				Binding: b,
+				Rhs: &hir.ExprGetElement{
+					ArrayAddr: &hir.ExprVar{VarBinding: arr},
+					Index:     &hir.ExprLiteral{Val: hir.NewValueInt(i)},
+					Pos:       id.StartPos(),
+				},
+			})
+		}
+	}
+	if p.Rest != nil {
+		if b := declare(p.Rest); b != nil {
+			var rest hir.Expr = &hir.ExprVar{VarBinding: arr}
+			if n := len(p.Names); n > 0 {
+				rest = &hir.ExprBinary{Lhs: rest, Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(n)}, Op: hir.OpAdd, Pos: p.Rest.StartPos()}
+			}
+			body = append(body, &hir.ExprBinding{Binding: b, Rhs: rest})
+		}
+	}
+	return &hir.ExprBlock{Body: body}
+}
+
+// visitDefine lowers `a := x`, which is `let a = x` but a cannot be redeclared in the same scope.
+func (v *Visitor) visitDefine(e *ast.DefineExpr) hir.Expr {
+	rhs := v.visitExpr(e.Value)
+	if _, ok := v.scope.bindings[e.Ident.Name]; ok {
+		v.errorf(e.Ident, "%s redeclared in this block", e.Ident.Name)
+	}
+	return &hir.ExprBinding{Binding: v.declare(e.Ident.Name), Rhs: rhs}
+}
+
+func (v *Visitor) visitIf(e *ast.IfExpr, wantValue bool) *hir.ExprIf {
+	x := &hir.ExprIf{
+		Cond: v.visitExpr(e.Cond),
+		Body: v.visitBlock(e.Body, wantValue),
+		Pos:  e.Cond.StartPos(),
+	}
+	switch {
+	case e.Else != nil && wantValue:
+		x.Else = v.visitExpr(e.Else)
+	case e.Else != nil:
+		x.Else = v.visitStmt(e.Else)
+	case wantValue:
+		x.Else = nilLiteral()
+	}
+	return x
+}
+
+// visitSwitch lowers a switch, constant case values are folded so that the compiler can build a jump table.
+func (v *Visitor) visitSwitch(e *ast.SwitchExpr, wantValue bool) *hir.ExprSwitch {
+	x := &hir.ExprSwitch{Tag: v.visitExpr(e.Tag), Pos: e.StartPos()}
+	var seen []hir.Value
+	for _, c := range e.Cases {
+		if c.Values == nil {
+			if x.Default != nil {
+				v.errorf(c, "multiple defaults in switch")
+			}
+			x.Default = v.visitBlock(c.Body, wantValue)
+			continue
+		}
+		sc := &hir.SwitchCase{Values: make([]hir.Expr, 0, len(c.Values))}
+		for _, val := range c.Values {
+			if !v.isConstExpr(val) {
+				sc.Values = append(sc.Values, v.visitExpr(val))
+				continue
+			}
+			cv, ok := v.evalConst(val)
+			if !ok {
+				cv = hir.NewValueNil()
+			} else if containsValue(seen, cv) {
+				v.errorf(val, "duplicate case %s in switch", val.String())
+			} else {
+				seen = append(seen, cv)
+			}
+			sc.Values = append(sc.Values, &hir.ExprLiteral{Val: cv})
+		}
+		sc.Body = v.visitBlock(c.Body, wantValue)
+		x.Cases = append(x.Cases, sc)
+	}
+	if x.Default == nil && wantValue {
+		x.Default = &hir.ExprBlock{Body: []hir.Expr{nilLiteral()}}
+	}
+	return x
+}
+
+// loopState is a loop enclosing the expression being lowered.
+type loopState struct {
+	label    string // empty if the loop has no label
+	hasValue bool   // whether the value of the loop is used
+}
+
+func (v *Visitor) visitLoop(e *ast.LoopExpr, wantValue bool) *hir.ExprLoop {
+	var cond hir.Expr
+	pos := e.StartPos()
+	if e.Cond != nil {
+		cond, pos = v.visitExpr(e.Cond), e.Cond.StartPos()
+	} else {
+		cond = &hir.ExprLiteral{Val: hir.NewValueBoolean(true)}
+	}
+	v.enterLoop(e.Label, wantValue)
+	body := v.visitBlock(e.Body, false)
+	v.exitLoop()
+	return &hir.ExprLoop{Cond: cond, Body: body, Label: labelName(e.Label), HasValue: wantValue, Pos: pos}
+}
+
+func (v *Visitor) enterLoop(label *ast.Ident, wantValue bool) {
+	if label != nil {
+		for _, l := range v.fn.loops {
+			if l.label == label.Name {
+				v.errorf(label, "label '%s already defined", label.Name)
+				break
+			}
+		}
+	}
+	v.fn.loops = append(v.fn.loops, loopState{label: labelName(label), hasValue: wantValue})
+}
+
+func (v *Visitor) exitLoop() {
+	v.fn.loops = v.fn.loops[:len(v.fn.loops)-1]
+}
+
+// targetLoop returns the loop which a break or continue with the label jumps out of,
+// the innermost loop if label is nil.
+func (v *Visitor) targetLoop(kind string, n ast.Node, label *ast.Ident) (loopState, bool) {
+	if len(v.fn.loops) == 0 {
+		v.errorf(n, "%s is not in a loop", kind)
+		return loopState{}, false
+	}
+	if label == nil {
+		return v.fn.loops[len(v.fn.loops)-1], true
+	}
+	for i := len(v.fn.loops) - 1; i >= 0; i-- {
+		if v.fn.loops[i].label == label.Name {
+			return v.fn.loops[i], true
+		}
+	}
+	v.errorf(label, "%s label '%s not defined", kind, label.Name)
+	return loopState{}, false
+}
+
+// visitBreak lowers a break, the value is left on the stack if the loop it breaks has a value.
+func (v *Visitor) visitBreak(e *ast.BreakExpr) hir.Expr {
+	loop, ok := v.targetLoop("break", e, e.Label)
+	if !ok {
+		if e.Expr != nil {
+			v.visitExpr(e.Expr)
+		}
+		return &hir.ExprBreak{}
+	}
+	x := &hir.ExprBreak{Label: labelName(e.Label)}
+	switch {
+	case loop.hasValue && e.Expr != nil:
+		x.Expr = v.visitExpr(e.Expr)
+	case loop.hasValue:
+		x.Expr = nilLiteral()
+	case e.Expr != nil:
+		// the value is unused, but it is still evaluated
+		return &hir.ExprBlock{Body: []hir.Expr{v.visitStmt(e.Expr), x}}
+	}
+	return x
+}
+
+func labelName(label *ast.Ident) string {
+	if label == nil {
+		return ""
+	}
+	return label.Name
+}
+
+// visitLoopIn lowers `loop i, x in arr { body }` to
+//
+//	let it# = iter(arr), i# = -1
+//	loop { i# = next(it#, i#); i# >= 0 } { let i = key(it#, i#), x = value(it#, i#); body }
+//
+// where the key of an array element is its index and arr may also be a map,
+// the entries of a map are iterated in insertion order, over the keys the map has when the loop starts.
+// and `loop x in lo..hi { body }` to
+//
+//	let x# = lo - 1, hi# = hi
+//	loop { x# += 1; x# < hi# } { let x = x#; body }
+//
+// The counter is hidden, assigning to the variables does not change the iteration.
+func (v *Visitor) visitLoopIn(e *ast.LoopInExpr, wantValue bool) *hir.ExprBlock {
+	v.scope = newScope(v.scope)
+	defer func() { v.scope = v.scope.outer }()
+
+	pos := e.X.StartPos()
+	counter := v.newTemp()
+	var init, body []hir.Expr
+	var cond *hir.ExprBlock
+	if e.End != nil {
+		if e.Index != nil {
+			v.errorf(e.Index, "range over integers permits only one iteration variable")
+		}
+		one := &hir.ExprLiteral{Val: hir.NewValueInt(1)}
+		hi := v.newTemp()
+		init = []hir.Expr{
+			&hir.ExprBinding{Binding: counter, Rhs: &hir.ExprBinary{Lhs: v.visitExpr(e.X), Rhs: one, Op: hir.OpSub, Pos: pos}},
+			&hir.ExprBinding{Binding: hi, Rhs: v.visitExpr(e.End)},
+		}
+		cond = &hir.ExprBlock{Body: []hir.Expr{
+			&hir.ExprMutate{
+				Lhs: &hir.ExprVar{VarBinding: counter},
+				Rhs: &hir.ExprBinary{Lhs: &hir.ExprVar{VarBinding: counter}, Rhs: one, Op: hir.OpAdd, Pos: pos},
+			},
+			&hir.ExprBinary{Lhs: &hir.ExprVar{VarBinding: counter}, Rhs: &hir.ExprVar{VarBinding: hi}, Op: hir.OpLT, Pos: pos},
+		}}
+		body = []hir.Expr{&hir.ExprBinding{Binding: v.declare(e.Elem.Name), Rhs: &hir.ExprVar{VarBinding: counter}}}
+	} else {
+		it := v.newTemp()
+		init = []hir.Expr{
+			&hir.ExprBinding{Binding: it, Rhs: &hir.ExprIter{Expr: v.visitExpr(e.X), Pos: pos}},
+			&hir.ExprBinding{Binding: counter, Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(-1)}},
+		}
+		cond = &hir.ExprBlock{Body: []hir.Expr{
+			&hir.ExprMutate{
+				Lhs: &hir.ExprVar{VarBinding: counter},
+				Rhs: &hir.ExprNext{Iter: &hir.ExprVar{VarBinding: it}, Index: &hir.ExprVar{VarBinding: counter}},
+			},
+			&hir.ExprBinary{Lhs: &hir.ExprVar{VarBinding: counter}, Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(0)}, Op: hir.OpGTE, Pos: pos},
+		}}
+		if e.Index != nil {
+			if e.Index.Name == e.Elem.Name {
+				v.errorf(e.Elem, "%s repeated on left side of in", e.Elem.Name)
+			}
+			body = append(body, &hir.ExprBinding{
+				Binding: v.declare(e.Index.Name),
+				Rhs:     &hir.ExprEntry{Iter: &hir.ExprVar{VarBinding: it}, Index: &hir.ExprVar{VarBinding: counter}, Key: true, Pos: pos},
+			})
+		}
+		body = append(body, &hir.ExprBinding{
+			Binding: v.declare(e.Elem.Name),
+			Rhs:     &hir.ExprEntry{Iter: &hir.ExprVar{VarBinding: it}, Index: &hir.ExprVar{VarBinding: counter}, Pos: pos},
+		})
+	}
+
+	v.enterLoop(e.Label, wantValue)
+	body = append(body, v.visitBlock(e.Body, false))
+	v.exitLoop()
+	loop := &hir.ExprLoop{Cond: cond, Body: &hir.ExprBlock{Body: body}, Label: labelName(e.Label), HasValue: wantValue, Pos: pos}
+	return &hir.ExprBlock{Body: append(init, loop)}
+}
+
+// visitTry lowers a try, its value is the value of the body, or of the catch if the body throws.
+func (v *Visitor) visitTry(e *ast.TryExpr, wantValue bool) *hir.ExprTry {
+	x := &hir.ExprTry{Body: v.visitBlock(e.Body, wantValue), Height: v.newTemp()}
+	if e.CatchBody != nil {
+		v.scope = newScope(v.scope)
+		if e.Catch != nil && e.Catch.Name != "_" {
+			x.Catch = v.declare(e.Catch.Name)
+		}
+		x.CatchBody = v.visitBlock(e.CatchBody, wantValue)
+		v.scope = v.scope.outer
+	}
+	if e.Finally != nil {
+		x.Finally = v.visitBlock(e.Finally, false)
+		x.Exception = v.newTemp()
+	}
+	return x
+}
+
+func (v *Visitor) visitBlock(b *ast.BlockExpr, wantValue bool) *hir.ExprBlock {
+	v.scope = newScope(v.scope)
+	defer func() { v.scope = v.scope.outer }()
+
+	body := make([]hir.Expr, 0, len(b.ExprList)+1)
+	for _, e := range b.ExprList {
+		body = append(body, v.visitStmt(e))
+	}
+	switch {
+	case b.RetExpr != nil && wantValue:
+		body = append(body, v.visitExpr(b.RetExpr))
+	case b.RetExpr != nil:
+		body = append(body, v.visitStmt(b.RetExpr))
+	case wantValue:
+		body = append(body, nilLiteral())
+	}
+	return &hir.ExprBlock{Body: body}
+}
+
+// lookup resolves name to a local, a local of an enclosing function is captured as an upvalue.
+func (v *Visitor) lookup(name string) (hir.Expr, bool) {
+	if b, ok := v.scope.lookup(name); ok {
+		return &hir.ExprVar{VarBinding: b}, true
+	}
+	if i, ok := v.fn.capture(name); ok {
+		return &hir.ExprUpvalue{Index: i, Name: name}, true
+	}
+	return nil, false
+}
+
+// isLocal reports whether name is a local of the current function or of an enclosing function.
+// Unlike lookup, it does not capture the local.
+func (v *Visitor) isLocal(name string) bool {
+	if _, ok := v.scope.lookup(name); ok {
+		return true
+	}
+	for fn := v.fn; fn != nil && fn.outer != nil; fn = fn.outer {
+		if _, ok := fn.enclosing.lookup(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// declare binds name in the current scope.
+// Bindings are named uniquely in a function, because the compiler allocates locals by name.
+func (v *Visitor) declare(name string) *hir.Binding {
+	n := v.fn.names[name]
+	v.fn.names[name]++
+	b := hir.NewBinding(name)
+	if n > 0 || v.isGlobal(name) {
+		b.Name = fmt.Sprintf("%s#%d", name, n)
+	}
+	v.scope.bindings[name] = b
+	return b
+}
+
+// newTemp returns a binding for a local the program cannot refer to.
+func (v *Visitor) newTemp() *hir.Binding {
+	b := hir.NewBinding(fmt.Sprintf("in#%d", v.fn.temps))
+	v.fn.temps++
+	return b
+}
+
+func (v *Visitor) isGlobal(name string) bool {
+	_, isConst := v.mod.consts[name]
+	_, isFunc := v.mod.funcs[name]
+	_, isStruct := v.mod.structs[name]
+	_, isImport := v.mod.imports[name]
+	return isConst || isFunc || isStruct || isImport
+}
+
+// builtinOf returns the name of the builtin function e calls, or "" if e calls no builtin.
+func (v *Visitor) builtinOf(e *ast.CallExpr) string {
+	id, ok := e.Func.(*ast.Ident)
+	if !ok || v.isLocal(id.Name) || v.isGlobal(id.Name) {
+		return ""
+	}
+	switch id.Name {
+	case builtinPrint, builtinLen, builtinDelete,
+		builtinOk, builtinErr, builtinIsOk, builtinUnwrap, builtinUnwrapOr:
+		return id.Name
+	}
+	return ""
+}
+
+// checkArgs reports a call to a builtin which does not take n arguments.
+func (v *Visitor) checkArgs(e *ast.CallExpr, n int) bool {
+	return v.checkArity(e, n, n)
+}
+
+// checkArity reports a call with less than min or more than max arguments, max is -1 if there is no limit.
+func (v *Visitor) checkArity(e *ast.CallExpr, min, max int) bool {
+	switch {
+	case len(e.Args) < min:
+		v.errorf(e, "not enough arguments in call to %s", e.Func.String())
+	case max >= 0 && len(e.Args) > max:
+		v.errorf(e.Args[max], "too many arguments in call to %s", e.Func.String())
+	default:
+		return true
+	}
+	return false
+}
+
+// discardArgs evaluates the arguments of a call which is not made.
+func (v *Visitor) discardArgs(e *ast.CallExpr) *hir.ExprBlock {
+	body := make([]hir.Expr, 0, len(e.Args))
+	for _, arg := range e.Args {
+		body = append(body, &hir.ExprDiscard{Expr: v.visitExpr(arg)})
+	}
+	return &hir.ExprBlock{Body: body}
+}
+
+func (v *Visitor) errorf(n ast.Node, format string, args ...interface{}) {
+	v.diags = append(v.diags, &Diagnostic{
+		Pos: n.StartPos(),
+		Msg: fmt.Sprintf(format, args...),
+	})
+}
+
+// values returns "1 value" or "n values".
+func values(n int) string {
+	if n == 1 {
+		return "1 value"
+	}
+	return fmt.Sprintf("%d values", n)
+}
+
+func containsValue(l []hir.Value, x hir.Value) bool {
+	for _, y := range l {
+		if hir.ValueEqual(x, y) {
+			return true
+		}
+	}
+	return false
+}
+
+func nilLiteral() *hir.ExprLiteral {
+	return &hir.ExprLiteral{Val: hir.NewValueNil()}
+}
@@ -0,0 +1,922 @@
+package visitor
+
+import (
+	"io/fs"
+	"math"
+	"reflect"
+	"sometimes/hir"
+	"sometimes/lexer"
+	"sometimes/module"
+	"sometimes/parser"
+	"sometimes/token"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func visit(src string) (*hir.Program, *Visitor) {
+	fset := token.NewFileSet()
+	p := parser.NewParser(lexer.NewTokenCursor(lexer.NewSrcCursor(fset.AddFile("", []byte(src)))))
+	file, _ := p.Parse()
+	v := NewVistor(fset)
+	return v.Visit(file), v
+}
+
+// posOf returns the Pos of the first occurrence of substr in src, src must be the only file of its FileSet.
+func posOf(src, substr string) token.Pos {
+	return token.Pos(1 + strings.Index(src, substr))
+}
+
+func TestVisitDiagnostics(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{
+			src:  `fn main() { print(a); }`,
+			want: []string{"1:19: undefined: a"},
+		},
+		{
+			src:  `fn foo() { 1 }`,
+			want: []string{"function main is undeclared"},
+		},
+		{
+			src:  `fn main() { break; }`,
+			want: []string{"1:13: break is not in a loop"},
+		},
+		{
+			src:  `fn main() { loop { f := fn() { continue; }; } }`,
+			want: []string{"1:32: continue is not in a loop"},
+		},
+		{
+			src:  `fn main() { 'a: loop { 'b: loop { break 'c; }; 'a: loop {}; continue 'b; } }`,
+			want: []string{"1:41: break label 'c not defined", "1:48: label 'a already defined", "1:70: continue label 'b not defined"},
+		},
+		{
+			src:  `fn main() { try { 1 } catch e { 2 }; print(e); }`,
+			want: []string{"1:44: undefined: e"},
+		},
+		{
+			src: `fn main() { ok(); unwrap_or(err(1)); print(is_ok(ok(1), 2)); }`,
+			want: []string{
+				"1:13: not enough arguments in call to ok",
+				"1:19: not enough arguments in call to unwrap_or",
+				"1:57: too many arguments in call to is_ok",
+			},
+		},
+		{
+			src: `fn f(a, b = 1, ..r) {} fn g(a = 1, b) {} fn main() { f(); f(1, 2, 3); g(1, 2, 3); let h = f; h(); }`,
+			want: []string{
+				"1:36: missing default value of argument b after an argument with one",
+				"1:54: not enough arguments in call to f",
+				"1:79: too many arguments in call to g",
+			},
+		},
+		{
+			src:  `const A = 1; fn main() { A = 2; }`,
+			want: []string{"1:26: cannot assign to A"},
+		},
+		{
+			src:  `fn main() {} fn main() {}`,
+			want: []string{"1:17: function main redeclared"},
+		},
+		{
+			src: `fn two() { return 1, 2 } fn main() { let (a, b, c) = two(); print(two()); two(); }`,
+			want: []string{
+				"1:54: assignment mismatch: 3 variables but two() returns 2 values",
+				"1:67: multiple-value two() in single-value context",
+			},
+		},
+		{
+			src: `fn f(r) { let x = r?; return x, 1 } fn g(r) { if r { return 1, 2 }; r? } fn main() { let h = fn(r) { r?; return 1 }; }`,
+			want: []string{
+				"1:19: `?` in a function returning multiple values",
+				"1:69: `?` in a function returning multiple values",
+			},
+		},
+		{
+			src:  `fn main() { let (a, b) = 1; let [c, _, c] = a; }`,
+			want: []string{"1:26: assignment mismatch: 2 variables but 1 value", "1:40: c repeated on left side of let"},
+		},
+		{
+			src:  `fn main() { let [a, b] = [1]; let [c, d, ..e] = []; let [f, g] = [1, 2, 3]; let [..h] = []; }`,
+			want: []string{"1:26: assignment mismatch: 2 variables but 1 value", "1:49: assignment mismatch: 2 variables but 0 values"},
+		},
+		{
+			src:  `const A = 1.5 & 1, B = 1 << -1; fn main() {}`,
+			want: []string{"1:11: invalid operation: 1.500000 & 1", "1:24: invalid operation: 1 << -1"},
+		},
+		{
+			src:  `const A = B; fn main() {}`,
+			want: []string{"1:11: undefined: B"},
+		},
+		{
+			src:  `fn main() { print(9223372036854775808); }`,
+			want: []string{"1:19: integer literal 9223372036854775808 overflows int"},
+		},
+		{
+			src:  `fn main() { print(-9223372036854775808, -9223372036854775809, -(9223372036854775808)); }`,
+			want: []string{"1:41: integer literal -9223372036854775809 overflows int", "1:65: integer literal 9223372036854775808 overflows int"},
+		},
+		{
+			src:  `fn main() { print(1e400); }`,
+			want: []string{"1:19: float literal 1e400 overflows float64"},
+		},
+		{
+			src:  `const A = 1; fn main() { A(); }`,
+			want: []string{"1:26: cannot call non-function A"},
+		},
+		{
+			src:  `struct P { x, x } fn main() {}`,
+			want: []string{"1:15: duplicate field x in struct P"},
+		},
+		{
+			src:  `struct main {} fn main() {}`,
+			want: []string{"1:8: main redeclared"},
+		},
+		{
+			src: `struct P { x } fn main() { let p = Q { x: 1 }; print(P { y: 1, x: 2, x: 3 }, P); }`,
+			want: []string{
+				"1:36: undefined: Q",
+				"1:58: unknown field y in struct P",
+				"1:70: duplicate field x in struct literal",
+				"1:78: struct P is not a value",
+			},
+		},
+		{
+			src:  `const A = 1; fn main() { switch 1 { case 1 {} case 2, A {} default {} default {} }; }`,
+			want: []string{"1:55: duplicate case A in switch", "1:71: multiple defaults in switch"},
+		},
+		{
+			src:  `fn main() { loop true { let f = fn() { break; }; }; fn(a, a) -> b; }`,
+			want: []string{"1:40: break is not in a loop", "1:59: duplicate argument a", "1:65: undefined: b"},
+		},
+		{
+			src:  `fn main() { a := 1; if true { a := 2; }; a := 3; b++; }`,
+			want: []string{"1:42: a redeclared in this block", "1:50: undefined: b"},
+		},
+		{
+			src:  `fn main() { loop i, x in 0..3 {}; loop x, x in [] {}; loop x in [] {}; print(x); }`,
+			want: []string{"1:18: range over integers permits only one iteration variable", "1:43: x repeated on left side of in", "1:78: undefined: x"},
+		},
+		{
+			src:  `fn main() { match 1 { 1..=9 => 1, 5 => 2, [a, ..] => 3, [_, _] => 4, x if x > 0 => 5, y => 6, _ => 7 }; }`,
+			want: []string{"1:35: unreachable match arm 5", "1:57: unreachable match arm [_, _]", "1:95: unreachable match arm _"},
+		},
+		{
+			src:  `fn main() { match 1 { 0..5 => 1, 5..10 => 2, 0..10 => 3, x if x > 0 => 4 }; }`,
+			want: []string{"1:46: unreachable match arm 0..10", "1:13: non-exhaustive match: `_` not covered"},
+		},
+		{
+			src: `const M = {1: 2}; const N = {M: 1}; fn main() { let m = {"a": 1, "a": 2, M: 0}; print(len(m, 1)); delete(m); }`,
+			want: []string{
+				"1:30: invalid map key M: a map is unhashable",
+				"1:66: duplicate key \"a\" in map literal",
+				"1:74: invalid map key M: a map is unhashable",
+				"1:94: too many arguments in call to len",
+				"1:99: not enough arguments in call to delete",
+			},
+		},
+		{
+			src: `struct P { x, y } fn main() { let a = 1; match 1 { [b, b] => 1, P { z } => 2, 'a'..1 => 3, 5..5 => 4, a..9 => 5, Q {} => 6, _ => b }; }`,
+			want: []string{
+				"1:56: b bound more than once in pattern",
+				"1:69: unknown field z in struct P",
+				"1:79: invalid range pattern 'a'..1: the bounds must be ints or chars of the same type",
+				"1:92: empty range pattern 5..5",
+				"1:103: a is not a constant",
+				"1:114: undefined: Q",
+				"1:130: undefined: b",
+			},
+		},
+	}
+
+	for _, testcase := range tests {
+		prog, v := visit(testcase.src)
+		if prog != nil {
+			t.Errorf("`%s`: want nil program", testcase.src)
+		}
+		var got []string
+		for _, d := range v.Diagnostics() {
+			got = append(got, d.Format(v.fset))
+		}
+		if !reflect.DeepEqual(testcase.want, got) {
+			t.Errorf("`%s`:\n want %q;\n  got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestVisitConst(t *testing.T) {
+	prog, v := visit(`
+const A = 10, B = (A + 2) * 3, C = -B, D = 1.5 * 2, E = A > 5 && true;
+const F = "say \"hi\"\n", G = '\u{4e2d}';
+const H = 0x7f + 0o10 + 0b11 + 1_000 + 010, I = .5 + 2.5e1;
+const J = 1 << 4 | 0b1010 & ~0 ^ 3, K = ~A >> 1;
+const L = -9223372036854775808, M = -0x8000000000000000 + 1;
+fn main() {}
+`)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	want := map[string]hir.Value{
+		"A": hir.NewValueInt(10),
+		"B": hir.NewValueInt(36),
+		"C": hir.NewValueInt(-36),
+		"D": hir.NewValueFloat(3),
+		"E": hir.NewValueBoolean(true),
+		"F": hir.NewValueString("say \"hi\"\n"),
+		"G": hir.NewValueChar('中'),
+		"H": hir.NewValueInt(127 + 8 + 3 + 1000 + 10),
+		"I": hir.NewValueFloat(25.5),
+		"J": hir.NewValueInt(16 | 0b1010 ^ 3),
+		"K": hir.NewValueInt(^10 >> 1),
+		"L": hir.NewValueInt(math.MinInt64),
+		"M": hir.NewValueInt(math.MinInt64 + 1),
+	}
+	for name, val := range want {
+		got, ok := prog.FindConst(name)
+		if !ok || !hir.ValueEqual(val, got) {
+			t.Errorf("const %s want %s; got %v", name, val.String(), got)
+		}
+	}
+}
+
+func TestVisitMap(t *testing.T) {
+	src := `
+const M = {"a": {1: 'x'}, "b": 2.5}
+fn main() {
+	let m = {"k": M}
+	delete(m, "k")
+	print(len(m));
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	m := &hir.ValueMap{
+		Keys: []hir.Value{hir.NewValueString("a"), hir.NewValueString("b")},
+		Vals: []hir.Value{
+			&hir.ValueMap{Keys: []hir.Value{hir.NewValueInt(1)}, Vals: []hir.Value{hir.NewValueChar('x')}},
+			hir.NewValueFloat(2.5),
+		},
+	}
+	if got, _ := prog.FindConst("M"); !reflect.DeepEqual(m, got) {
+		t.Errorf("const M want %s; got %v", m.String(), got)
+	}
+
+	main, _ := prog.FindFunc("main")
+	b := hir.NewBinding("m")
+	k := &hir.ExprLiteral{Val: hir.NewValueString("k")}
+	want := []hir.Expr{
+		&hir.ExprBinding{Binding: b, Rhs: &hir.ExprMap{
+			Keys:   []hir.Expr{k},
+			Values: []hir.Expr{&hir.ExprVar{VarBinding: hir.NewBinding("M")}},
+			Pos:    posOf(src, `{"k"`),
+		}},
+		&hir.ExprDelete{Map: &hir.ExprVar{VarBinding: b}, Key: k, Pos: posOf(src, "delete")},
+		&hir.ExprPrint{Expr: []hir.Expr{&hir.ExprLen{Expr: &hir.ExprVar{VarBinding: b}, Pos: posOf(src, "len")}}},
+	}
+	if got := main.Func.Body.Body[:3]; !reflect.DeepEqual(want, got) {
+		t.Errorf("body mismatch:\n want %#v\n  got %#v", want, got)
+	}
+}
+
+func TestVisitStruct(t *testing.T) {
+	src := `
+struct Point { x, y }
+fn main() {
+	let p = Point { y: 2 };
+	p.x += 1;
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	point, ok := prog.FindStruct("Point")
+	if !ok || !reflect.DeepEqual(point.Fields, []string{"x", "y"}) {
+		t.Fatalf("want struct Point { x, y }; got %v", point)
+	}
+	main, _ := prog.FindFunc("main")
+	p := hir.NewBinding("p")
+	nilLit := &hir.ExprLiteral{Val: hir.NewValueNil()}
+	want := []hir.Expr{
+		&hir.ExprBinding{Binding: p, Rhs: &hir.ExprStruct{
+			Struct: point,
+			Values: []hir.Expr{nilLit, &hir.ExprLiteral{Val: hir.NewValueInt(2)}},
+			Pos:    posOf(src, "Point { y"),
+		}},
+		&hir.ExprSetField{
+			Expr:  &hir.ExprVar{VarBinding: p},
+			Field: "x",
+			Value: &hir.ExprBinary{
+				Lhs: &hir.ExprGetField{Expr: &hir.ExprVar{VarBinding: p}, Field: "x", Pos: posOf(src, "x +=")},
+				Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(1)},
+				Op:  hir.OpAdd,
+				Pos: posOf(src, "+="),
+			},
+			Pos: posOf(src, "x +="),
+		},
+		&hir.ExprReturn{Expr: nilLit},
+	}
+	if !reflect.DeepEqual(want, main.Func.Body.Body) {
+		t.Errorf("main body mismatch:\n want %#v\n  got %#v", want, main.Func.Body.Body)
+	}
+}
+
+func TestVisitSwitch(t *testing.T) {
+	src := `
+const A = 2
+fn main() {
+	let A = 1
+	switch 0 { case A + 1, -A { 1 } }
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	a := hir.NewBinding("A#0")
+	nilLit := &hir.ExprLiteral{Val: hir.NewValueNil()}
+	// the local A is not a constant, so the values are not folded
+	want := &hir.ExprSwitch{
+		Tag: &hir.ExprLiteral{Val: hir.NewValueInt(0)},
+		Cases: []*hir.SwitchCase{{
+			Values: []hir.Expr{
+				&hir.ExprBinary{
+					Lhs: &hir.ExprVar{VarBinding: a},
+					Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(1)},
+					Op:  hir.OpAdd,
+					Pos: posOf(src, "+ 1"),
+				},
+				&hir.ExprUnary{Op: hir.OpNeg, Expr: &hir.ExprVar{VarBinding: a}, Pos: posOf(src, "-A")},
+			},
+			Body: &hir.ExprBlock{Body: []hir.Expr{&hir.ExprLiteral{Val: hir.NewValueInt(1)}}},
+		}},
+		Default: &hir.ExprBlock{Body: []hir.Expr{nilLit}},
+		Pos:     posOf(src, "switch"),
+	}
+	if got := main.Func.Body.Body[1].(*hir.ExprReturn).Expr; !reflect.DeepEqual(want, got) {
+		t.Errorf("switch mismatch:\n want %#v\n  got %#v", want, got)
+	}
+
+	// constant values are folded
+	prog, v = visit(`const A = 2; fn main() { switch 0 { case A + 1 {} }; }`)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ = prog.FindFunc("main")
+	sw := main.Func.Body.Body[0].(*hir.ExprSwitch)
+	if got, want := sw.Cases[0].Values[0], (&hir.ExprLiteral{Val: hir.NewValueInt(3)}); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %#v; got %#v", want, got)
+	}
+}
+
+func TestVisitMatch(t *testing.T) {
+	src := `
+const ONE = 1
+fn main() {
+	let n = 2
+	let r = match n { ONE => 1, [h, ..t] if h > 0 => t, h => h }
+	print(r)
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	n, h := hir.NewBinding("n"), hir.NewBinding("h")
+	// a constant is matched by value, each arm has its own scope
+	want := &hir.ExprBinding{
+		Binding: hir.NewBinding("r"),
+		Rhs: &hir.ExprMatch{
+			Subject: &hir.ExprVar{VarBinding: n},
+			Binding: hir.NewBinding("in#0"),
+			Arms: []*hir.MatchArm{
+				{
+					Pat:  &hir.PatLiteral{Val: hir.NewValueInt(1)},
+					Body: &hir.ExprLiteral{Val: hir.NewValueInt(1)},
+				},
+				{
+					Pat: &hir.PatArray{
+						Elems:   []hir.Pat{&hir.PatBinding{Binding: h}},
+						HasRest: true,
+						Rest:    hir.NewBinding("t"),
+					},
+					Guard: &hir.ExprBinary{
+						Lhs: &hir.ExprVar{VarBinding: h},
+						Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(0)},
+						Op:  hir.OpGT,
+						Pos: posOf(src, "> 0"),
+					},
+					Body: &hir.ExprVar{VarBinding: hir.NewBinding("t")},
+				},
+				{
+					Pat:  &hir.PatBinding{Binding: hir.NewBinding("h#1")},
+					Body: &hir.ExprVar{VarBinding: hir.NewBinding("h#1")},
+				},
+			},
+		},
+	}
+	if got := main.Func.Body.Body[1]; !reflect.DeepEqual(want, got) {
+		t.Errorf("match mismatch:\n want %#v\n  got %#v", want, got)
+	}
+}
+
+func TestVisitClosure(t *testing.T) {
+	src := `
+fn main() {
+	let a = 1, b = 2
+	fn(x) {
+		b = a
+		fn() -> a + x
+	}
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	outer := main.Func.Body.Body[1].(*hir.ExprReturn).Expr.(*hir.ExprAnonFunction).Func
+	wantOuter := []*hir.Upvalue{
+		{Name: "a", IsLocal: true, Binding: hir.NewBinding("a")},
+		{Name: "b", IsLocal: true, Binding: hir.NewBinding("b")},
+	}
+	if !reflect.DeepEqual(wantOuter, outer.Upvalues) {
+		t.Errorf("want upvalues %v; got %v", wantOuter, outer.Upvalues)
+	}
+	wantBody := []hir.Expr{
+		&hir.ExprMutate{Lhs: &hir.ExprUpvalue{Index: 1, Name: "b"}, Rhs: &hir.ExprUpvalue{Index: 0, Name: "a"}},
+	}
+	if !reflect.DeepEqual(wantBody, outer.Body.Body[:1]) {
+		t.Errorf("body mismatch:\n want %#v\n  got %#v", wantBody, outer.Body.Body[:1])
+	}
+
+	// a is captured from the upvalues of the outer closure, x from its locals
+	inner := outer.Body.Body[1].(*hir.ExprReturn).Expr.(*hir.ExprAnonFunction).Func
+	wantInner := []*hir.Upvalue{
+		{Name: "a", Index: 0},
+		{Name: "x", IsLocal: true, Binding: hir.NewBinding("x")},
+	}
+	if !reflect.DeepEqual(wantInner, inner.Upvalues) {
+		t.Errorf("want upvalues %v; got %v", wantInner, inner.Upvalues)
+	}
+	if outer.Name == inner.Name {
+		t.Errorf("anonymous functions must be named uniquely; got %s twice", outer.Name)
+	}
+}
+
+// visitModules lowers the main module src, which imports modules of fsys.
+func visitModules(src string, fsys fs.FS) (*hir.Program, *Visitor, []parser.Diagnostic) {
+	fset := token.NewFileSet()
+	m, diags := module.NewResolver(fset, fsys).LoadMain("main.st", []byte(src))
+	v := NewVistor(fset)
+	return v.VisitModule(m), v, diags
+}
+
+func TestVisitModule(t *testing.T) {
+	fsys := fstest.MapFS{
+		"std/math.st": {Data: []byte("const Pi = 3\nfn sq(x) { x * x }\n")},
+		"geo.st":      {Data: []byte("import \"std/math\"\nconst Pi = math.Pi\nfn area(r) { Pi * math.sq(r) }\nfn main() {}\n")},
+	}
+	prog, v, diags := visitModules("import \"geo\"\nfn main() { geo.area(geo.Pi) }\n", fsys)
+	if len(diags) > 0 || len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v %v", diags, v.Diagnostics())
+	}
+	for _, name := range []string{"std/math.sq", "geo.area", "geo.main", "main"} {
+		if _, ok := prog.FindFunc(name); !ok {
+			t.Errorf("want function %s", name)
+		}
+	}
+	for _, name := range []string{"std/math.Pi", "geo.Pi"} {
+		if val, ok := prog.FindConst(name); !ok || !hir.ValueEqual(val, hir.NewValueInt(3)) {
+			t.Errorf("want const %s = 3; got %v", name, val)
+		}
+	}
+	if got := prog.EntryFunc().Func.Name; got != "main" {
+		t.Errorf("want entry main; got %s", got)
+	}
+
+	main, _ := prog.FindFunc("main")
+	want := &hir.ExprCall{
+		Callee: &hir.ExprVar{VarBinding: hir.NewBinding("geo.area")},
+		Args:   []hir.Expr{&hir.ExprVar{VarBinding: hir.NewBinding("geo.Pi")}},
+		Pos:    token.Pos(1 + len("import \"geo\"\nfn main() { ")),
+	}
+	if got := main.Func.Body.Body[0].(*hir.ExprReturn).Expr; !reflect.DeepEqual(want, got) {
+		t.Errorf("main body mismatch:\n want %#v\n  got %#v", want, got)
+	}
+}
+
+func TestVisitModuleStruct(t *testing.T) {
+	fsys := fstest.MapFS{
+		"geo.st": {Data: []byte("struct Vec { x, y }\n")},
+	}
+	src := "import \"geo\"\nfn main() { let v = geo.Vec { x: 5, y: 6 }; match v { geo.Vec { x, y: 6 } => x, _ => 0 } }\n"
+	prog, v, diags := visitModules(src, fsys)
+	if len(diags) > 0 || len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v %v", diags, v.Diagnostics())
+	}
+	vec, ok := prog.FindStruct("geo.Vec")
+	if !ok {
+		t.Fatalf("want struct geo.Vec")
+	}
+	main, _ := prog.FindFunc("main")
+	lit, ok := main.Func.Body.Body[0].(*hir.ExprBinding).Rhs.(*hir.ExprStruct)
+	if !ok || lit.Struct != vec {
+		t.Errorf("want a literal of geo.Vec; got %#v", main.Func.Body.Body[0])
+	}
+	match := main.Func.Body.Body[1].(*hir.ExprReturn).Expr.(*hir.ExprMatch)
+	if pat, ok := match.Arms[0].Pat.(*hir.PatStruct); !ok || pat.Struct != vec {
+		t.Errorf("want a pattern of geo.Vec; got %#v", match.Arms[0].Pat)
+	}
+}
+
+func TestVisitModuleDiagnostics(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/m.st": {Data: []byte("struct P { x }\nfn f() {}\n")},
+		"b/m.st": {Data: []byte("")},
+	}
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{
+			src:  "import \"a/m\"\nfn main() { m.g() }",
+			want: []string{"main.st:2:13: undefined: m.g"},
+		},
+		{
+			src:  "import \"a/m\"\nfn main() { m.P }",
+			want: []string{"main.st:2:13: struct m.P is not a value"},
+		},
+		{
+			src:  "import \"a/m\"\nfn main() { let p = m.Q { x: 1 }; match p { m.f { x } => x, _ => 0 } }",
+			want: []string{"main.st:2:21: undefined: m.Q", "main.st:2:45: m.f is not a struct"},
+		},
+		{
+			src:  "import \"a/m\"\nfn main() { print(m) }",
+			want: []string{"main.st:2:19: use of module m without selector"},
+		},
+		{
+			src:  "import \"a/m\"\nimport \"b/m\"\nfn main() {}",
+			want: []string{"main.st:2:8: m redeclared"},
+		},
+		{
+			src:  "import \"a/m\"\nfn m() {}\nfn main() {}",
+			want: []string{"main.st:2:4: function m redeclared"},
+		},
+		{
+			// a local shadows the module
+			src:  "import \"a/m\"\nfn main() { let m = 1; m.f }",
+			want: nil,
+		},
+	}
+	for _, testcase := range tests {
+		_, v, diags := visitModules(testcase.src, fsys)
+		if len(diags) > 0 {
+			t.Fatalf("`%s`: unexpected diagnostics: %v", testcase.src, diags)
+		}
+		var got []string
+		for _, d := range v.Diagnostics() {
+			got = append(got, d.Format(v.fset))
+		}
+		if !reflect.DeepEqual(testcase.want, got) {
+			t.Errorf("`%s`:\n want %q;\n  got %q", testcase.src, testcase.want, got)
+		}
+	}
+}
+
+func TestVisitIncDecDefine(t *testing.T) {
+	src := `
+fn main() {
+	i := 0
+	let i = i
+	i--
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	i, shadow := hir.NewBinding("i"), hir.NewBinding("i#1")
+	want := []hir.Expr{
+		&hir.ExprBinding{Binding: i, Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(0)}},
+		&hir.ExprBinding{Binding: shadow, Rhs: &hir.ExprVar{VarBinding: i}},
+		&hir.ExprReturn{Expr: &hir.ExprBlock{Body: []hir.Expr{
+			&hir.ExprMutate{
+				Lhs: &hir.ExprVar{VarBinding: shadow},
+				Rhs: &hir.ExprBinary{
+					Lhs: &hir.ExprVar{VarBinding: shadow},
+					Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(1)},
+					Op:  hir.OpSub,
+					Pos: posOf(src, "--"),
+				},
+			},
+			&hir.ExprLiteral{Val: hir.NewValueNil()},
+		}}},
+	}
+	if !reflect.DeepEqual(want, main.Func.Body.Body) {
+		t.Errorf("main body mismatch:\n want %#v\n  got %#v", want, main.Func.Body.Body)
+	}
+}
+
+func TestVisitLoopIn(t *testing.T) {
+	src := `
+fn main() {
+	let n = 3
+	loop n in 1..n { continue }
+	print(n)
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	n, inner := hir.NewBinding("n"), hir.NewBinding("n#1")
+	counter, hi := hir.NewBinding("in#0"), hir.NewBinding("in#1")
+	one := &hir.ExprLiteral{Val: hir.NewValueInt(1)}
+	pos := posOf(src, "1..")
+	want := &hir.ExprBlock{Body: []hir.Expr{
+		// the range is evaluated before n is declared
+		&hir.ExprBinding{Binding: counter, Rhs: &hir.ExprBinary{Lhs: one, Rhs: one, Op: hir.OpSub, Pos: pos}},
+		&hir.ExprBinding{Binding: hi, Rhs: &hir.ExprVar{VarBinding: n}},
+		&hir.ExprLoop{
+			Cond: &hir.ExprBlock{Body: []hir.Expr{
+				&hir.ExprMutate{
+					Lhs: &hir.ExprVar{VarBinding: counter},
+					Rhs: &hir.ExprBinary{Lhs: &hir.ExprVar{VarBinding: counter}, Rhs: one, Op: hir.OpAdd, Pos: pos},
+				},
+				&hir.ExprBinary{Lhs: &hir.ExprVar{VarBinding: counter}, Rhs: &hir.ExprVar{VarBinding: hi}, Op: hir.OpLT, Pos: pos},
+			}},
+			Body: &hir.ExprBlock{Body: []hir.Expr{
+				&hir.ExprBinding{Binding: inner, Rhs: &hir.ExprVar{VarBinding: counter}},
+				&hir.ExprBlock{Body: []hir.Expr{&hir.ExprContinue{}}},
+			}},
+			Pos: pos,
+		},
+	}}
+	if got := main.Func.Body.Body[1]; !reflect.DeepEqual(want, got) {
+		t.Errorf("loop mismatch:\n want %#v\n  got %#v", want, got)
+	}
+}
+
+func TestVisitBreakValue(t *testing.T) {
+	src := `
+fn main() {
+	let x = 'a: loop { loop { break 'a 1 } }
+	loop { break 2 }
+	print(x)
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	yes := &hir.ExprLiteral{Val: hir.NewValueBoolean(true)}
+	one, two := &hir.ExprLiteral{Val: hir.NewValueInt(1)}, &hir.ExprLiteral{Val: hir.NewValueInt(2)}
+	want := []hir.Expr{
+		&hir.ExprBinding{Binding: hir.NewBinding("x"), Rhs: &hir.ExprLoop{
+			Cond: yes,
+			Body: &hir.ExprBlock{Body: []hir.Expr{&hir.ExprLoop{
+				Cond: yes,
+				Body: &hir.ExprBlock{Body: []hir.Expr{&hir.ExprBreak{Expr: one, Label: "a"}}},
+				Pos:  posOf(src, "loop { break 'a"),
+			}}},
+			Label:    "a",
+			HasValue: true,
+			Pos:      posOf(src, "'a: loop"),
+		}},
+		// the value of a loop statement is discarded
+		&hir.ExprLoop{
+			Cond: yes,
+			Body: &hir.ExprBlock{Body: []hir.Expr{&hir.ExprBlock{Body: []hir.Expr{&hir.ExprDiscard{Expr: two}, &hir.ExprBreak{}}}}},
+			Pos:  posOf(src, "loop { break 2"),
+		},
+	}
+	if got := main.Func.Body.Body[:2]; !reflect.DeepEqual(want, got) {
+		t.Errorf("main body mismatch:\n want %#v\n  got %#v", want, got)
+	}
+}
+
+func TestVisitTry(t *testing.T) {
+	src := `
+fn main() {
+	let x = try { 1 } catch e { e } finally { print(1) }
+	try { throw 1 } catch { }
+	print(x)
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	one := &hir.ExprLiteral{Val: hir.NewValueInt(1)}
+	want := []hir.Expr{
+		&hir.ExprBinding{Binding: hir.NewBinding("x"), Rhs: &hir.ExprTry{
+			Body:      &hir.ExprBlock{Body: []hir.Expr{one}},
+			Catch:     hir.NewBinding("e"),
+			CatchBody: &hir.ExprBlock{Body: []hir.Expr{&hir.ExprVar{VarBinding: hir.NewBinding("e")}}},
+			Finally:   &hir.ExprBlock{Body: []hir.Expr{&hir.ExprPrint{Expr: []hir.Expr{one}}}},
+			Height:    hir.NewBinding("in#0"),
+			Exception: hir.NewBinding("in#1"),
+		}},
+		// the thrown value is dropped
+		&hir.ExprTry{
+			Body:      &hir.ExprBlock{Body: []hir.Expr{&hir.ExprThrow{Expr: one, Pos: posOf(src, "throw")}}},
+			CatchBody: &hir.ExprBlock{Body: []hir.Expr{}},
+			Height:    hir.NewBinding("in#2"),
+		},
+	}
+	if got := main.Func.Body.Body[:2]; !reflect.DeepEqual(want, got) {
+		t.Errorf("main body mismatch:\n want %#v\n  got %#v", want, got)
+	}
+}
+
+func TestVisitResult(t *testing.T) {
+	src := `
+fn half(n) {
+	if n % 2 == 1 { return err("odd") }
+	return ok(n / 2)
+}
+fn main() {
+	let x = 1 + half(4)?
+	print(unwrap_or(half(x), 0))
+	print(x)
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	height, x := hir.NewBinding("in#0"), hir.NewBinding("x")
+	if !reflect.DeepEqual(height, main.Func.Height) {
+		t.Errorf("want height %#v; got %#v", height, main.Func.Height)
+	}
+	call := func(arg hir.Expr, pos string) *hir.ExprCall {
+		return &hir.ExprCall{
+			Callee: &hir.ExprVar{VarBinding: hir.NewBinding("half")},
+			Args:   []hir.Expr{arg},
+			Pos:    posOf(src, pos),
+		}
+	}
+	want := []hir.Expr{
+		&hir.ExprBinding{Binding: x, Rhs: &hir.ExprBinary{
+			Lhs: &hir.ExprLiteral{Val: hir.NewValueInt(1)},
+			Rhs: &hir.ExprPropagate{
+				Expr: call(&hir.ExprLiteral{Val: hir.NewValueInt(4)}, "half(4)"),
+				Pos:  posOf(src, "half(4)"),
+			},
+			Op:  hir.OpAdd,
+			Pos: posOf(src, "+ half"),
+		}},
+		&hir.ExprPrint{Expr: []hir.Expr{&hir.ExprUnwrap{
+			Expr:    call(&hir.ExprVar{VarBinding: x}, "half(x)"),
+			Default: &hir.ExprLiteral{Val: hir.NewValueInt(0)},
+			Pos:     posOf(src, "unwrap_or"),
+		}}},
+	}
+	if got := main.Func.Body.Body[:2]; !reflect.DeepEqual(want, got) {
+		t.Errorf("main body mismatch:\n want %#v\n  got %#v", want, got)
+	}
+	if half, _ := prog.FindFunc("half"); half.Func.Height != nil {
+		t.Errorf("want no height in half; got %#v", half.Func.Height)
+	}
+}
+
+func TestVisitDestructure(t *testing.T) {
+	src := `
+fn divmod(a, b) { return a / b, a % b }
+fn main() {
+	let (_, r) = divmod(7, 2), [h, ..t] = r
+	print(h, t)
+}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	r, arr := hir.NewBinding("r"), hir.NewBinding("in#0")
+	want := &hir.ExprBlock{Body: []hir.Expr{
+		&hir.ExprDestructure{
+			Bindings: []*hir.Binding{nil, r},
+			Call: &hir.ExprCall{
+				Callee:  &hir.ExprVar{VarBinding: hir.NewBinding("divmod")},
+				Args:    []hir.Expr{&hir.ExprLiteral{Val: hir.NewValueInt(7)}, &hir.ExprLiteral{Val: hir.NewValueInt(2)}},
+				Pos:     posOf(src, "divmod(7"),
+				Results: 2,
+			},
+		},
+		&hir.ExprBlock{Body: []hir.Expr{
+			&hir.ExprBinding{Binding: arr, Rhs: &hir.ExprVar{VarBinding: r}},
+			&hir.ExprBinding{Binding: hir.NewBinding("h"), Rhs: &hir.ExprGetElement{
+				ArrayAddr: &hir.ExprVar{VarBinding: arr},
+				Index:     &hir.ExprLiteral{Val: hir.NewValueInt(0)},
+				Pos:       posOf(src, "h,"),
+			}},
+			&hir.ExprBinding{Binding: hir.NewBinding("t"), Rhs: &hir.ExprBinary{
+				Lhs: &hir.ExprVar{VarBinding: arr},
+				Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(1)},
+				Op:  hir.OpAdd,
+				Pos: posOf(src, "t]"),
+			}},
+		}},
+	}}
+	if got := main.Func.Body.Body[0]; !reflect.DeepEqual(want, got) {
+		t.Errorf("let mismatch:\n want %#v\n  got %#v", want, got)
+	}
+}
+
+func TestVisitFunc(t *testing.T) {
+	src := `
+// main is the entry.
+fn main() {
+	let a = 1;
+	a += 2;
+	if true { let a = 3; };
+	foo(a);
+	print(a);
+}
+fn foo(x) {}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	main, _ := prog.FindFunc("main")
+	if main.Func.Doc != "main is the entry." {
+		t.Errorf("want doc of main; got %q", main.Func.Doc)
+	}
+	a := hir.NewBinding("a")
+	inner := hir.NewBinding("a#1")
+	nilLit := &hir.ExprLiteral{Val: hir.NewValueNil()}
+	want := []hir.Expr{
+		&hir.ExprBinding{Binding: a, Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(1)}},
+		&hir.ExprMutate{
+			Lhs: &hir.ExprVar{VarBinding: a},
+			Rhs: &hir.ExprBinary{
+				Lhs: &hir.ExprVar{VarBinding: a},
+				Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(2)},
+				Op:  hir.OpAdd,
+				Pos: posOf(src, "+="),
+			},
+		},
+		&hir.ExprIf{
+			Cond: &hir.ExprLiteral{Val: hir.NewValueBoolean(true)},
+			Body: &hir.ExprBlock{Body: []hir.Expr{
+				&hir.ExprBinding{Binding: inner, Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(3)}},
+			}},
+			Pos: posOf(src, "true {"),
+		},
+		&hir.ExprDiscard{Expr: &hir.ExprCall{
+			Callee: &hir.ExprVar{VarBinding: hir.NewBinding("foo")},
+			Args:   []hir.Expr{&hir.ExprVar{VarBinding: a}},
+			Pos:    posOf(src, "foo(a)"),
+		}},
+		&hir.ExprPrint{Expr: []hir.Expr{&hir.ExprVar{VarBinding: a}}},
+		&hir.ExprReturn{Expr: nilLit},
+	}
+	if !reflect.DeepEqual(want, main.Func.Body.Body) {
+		t.Errorf("main body mismatch:\n want %#v\n  got %#v", want, main.Func.Body.Body)
+	}
+}
+
+func TestVisitParams(t *testing.T) {
+	src := `
+fn main() { log(1) }
+fn log(level, msg = level + 1, ..rest) {}
+`
+	prog, v := visit(src)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", v.Diagnostics())
+	}
+	log, _ := prog.FindFunc("log")
+	level := hir.NewBinding("level")
+	wantDefaults := []hir.Expr{
+		nil,
+		&hir.ExprBinary{
+			Lhs: &hir.ExprVar{VarBinding: level},
+			Rhs: &hir.ExprLiteral{Val: hir.NewValueInt(1)},
+			Op:  hir.OpAdd,
+			Pos: posOf(src, "+"),
+		},
+	}
+	if !reflect.DeepEqual(wantDefaults, log.Func.Defaults) {
+		t.Errorf("defaults mismatch:\n want %#v\n  got %#v", wantDefaults, log.Func.Defaults)
+	}
+	if want := hir.NewBinding("rest"); !reflect.DeepEqual(want, log.Func.Rest) {
+		t.Errorf("want rest %v; got %v", want, log.Func.Rest)
+	}
+	if got := log.Func.Required(); got != 1 {
+		t.Errorf("want 1 required argument; got %d", got)
+	}
+}
@@ -2,7 +2,9 @@ package assembly
 
 import (
 	"errors"
+	"fmt"
 	"sometimes/hir"
+	"sometimes/token"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -16,6 +18,17 @@ type AssemblyProgram struct {
 	Labels       map[string]Ptr
 	Consts       *Consts
 	Instructions []AssemblyInstruction
+	Positions    []token.Pos        // source position of each instruction; token.NoPos if unknown
+	Handlers     []*AssemblyHandler // the handlers of inner try blocks come first
+}
+
+// AssemblyHandler catches the values thrown by the instructions in [Start, End) of the function Func,
+// it jumps to Target after unwinding the operand stack to the height saved in the local at offset Height.
+type AssemblyHandler struct {
+	Func       string
+	Start, End Ptr
+	Target     string
+	Height     int
 }
 
 func NewAssemblyProgram() *AssemblyProgram {
@@ -61,7 +74,13 @@ func (ap *AssemblyProgram) EmitPush(val hir.Value) {
 }
 
 func (ap *AssemblyProgram) Emit(assemblyInstr AssemblyInstruction) {
+	ap.EmitAt(token.NoPos, assemblyInstr)
+}
+
+// EmitAt emits an instruction which may fail at runtime, pos is reported with the error.
+func (ap *AssemblyProgram) EmitAt(pos token.Pos, assemblyInstr AssemblyInstruction) {
 	ap.Instructions = append(ap.Instructions, assemblyInstr)
+	ap.Positions = append(ap.Positions, pos)
 }
 
 func (ap *AssemblyProgram) String() string {
@@ -89,6 +108,9 @@ func (ap *AssemblyProgram) String() string {
 		sb.WriteString(instr.String())
 		sb.WriteRune('\n')
 	}
+	for _, h := range ap.Handlers {
+		fmt.Fprintf(&sb, "handler %s [%d, %d) %s height %d\n", h.Func, h.Start, h.End, h.Target, h.Height)
+	}
 	return sb.String()
 }
 
@@ -9,24 +9,32 @@ import (
 type compileState struct {
 	localIdx int
 	locals   map[string]int // local varname -> localIdx
+	fn       string         // label of the function
+	height   *hir.Binding   // the local which holds the height of the operand stack when the body starts
+	regions  []*tryRegion   // the try regions around the current instruction, innermost last
 }
 
-func newCompileState() *compileState {
+func newCompileState(fn string) *compileState {
 	return &compileState{
 		localIdx: 0,
 		locals:   make(map[string]int),
+		fn:       fn,
 	}
 }
 
 func (cs *compileState) StoreVar(b *hir.Binding) *AssemblyInstrStore {
+	return &AssemblyInstrStore{Offset: cs.Offset(b)}
+}
+
+// Offset returns the offset of the local, the local is allocated if it is new.
+func (cs *compileState) Offset(b *hir.Binding) int {
 	localIdx, ok := cs.locals[b.Name]
 	if !ok {
 		localIdx = cs.localIdx
 		cs.locals[b.Name] = localIdx
 		cs.localIdx += b.Len
 	}
-	return &AssemblyInstrStore{Offset: localIdx}
-
+	return localIdx
 }
 
 func (cs *compileState) IsLocalVar(b *hir.Binding) bool {
@@ -38,10 +46,6 @@ func (cs *compileState) LoadVar(b *hir.Binding) *AssemblyInstrLoad {
 	return &AssemblyInstrLoad{Offset: cs.locals[b.Name]}
 }
 
-func (cs *compileState) LoadVarPtr(b *hir.Binding) *AssemblyInstrLoadPtr {
-	return &AssemblyInstrLoadPtr{Offset: cs.locals[b.Name], IsLocal: true}
-}
-
 func (cs *compileState) MaxLocals() int {
 	return cs.localIdx
 }
@@ -81,6 +85,7 @@ type Compiler struct {
 	hirProgram          *hir.Program
 	states              compileStateStack
 	constsDataIdMapping map[string]DataID
+	closureLocals       map[string]int // MaxLocals of the closures compiled so far
 }
 
 func NewCompiler(hirProgram *hir.Program) *Compiler {
@@ -89,9 +94,10 @@ func NewCompiler(hirProgram *hir.Program) *Compiler {
 		hirProgram: hirProgram,
 		asm:        NewAssemblyProgram(),
 		states: []*compileState{ // todo temp
-			newCompileState(),
+			newCompileState(""),
 		},
 		constsDataIdMapping: make(map[string]DataID),
+		closureLocals:       make(map[string]int),
 	}
 }
 
@@ -101,17 +107,14 @@ func (c *Compiler) Compile() *AssemblyProgram {
 	funcs := c.hirProgram.Funcs()
 	// save funcs to consts
 	for _, f := range funcs {
-		dataID := c.asm.Consts.insertConst(&hir.ValueFunc{
-			FuncName:  f.Func.Name,
-			MaxLoacls: 0, // MaxLocals compute after compile this func
-		})
+		dataID := c.asm.Consts.insertConst(funcValue(f.Func, 0)) // MaxLocals compute after compile this func
 		c.constsDataIdMapping[f.Func.Name] = dataID
 	}
 
 	// call entry function
 	entryFunc := c.hirProgram.EntryFunc()
 	c.asm.Emit(&AssemblyInstrPush{DataID: c.FindConst(entryFunc.Func.Name)})
-	c.asm.Emit(&AssemblyInstrCall{})
+	c.asm.Emit(&AssemblyInstrCall{Rets: 1})
 
 	for _, f := range funcs {
 		c.compileExpr(f)
@@ -147,51 +150,77 @@ func (c *Compiler) compileExpr(expr hir.Expr) {
 			instr = &AssemblyInstrPush{DataID: c.FindConst(e.VarBinding.Name)}
 		}
 		c.asm.Emit(instr)
+	case *hir.ExprUpvalue:
+		c.asm.Emit(&AssemblyInstrLoadUpvalue{Index: e.Index})
 	case *hir.ExprMutate:
-		c.compileExpr(e.Rhs)
 		if variable, ok := e.Lhs.(*hir.ExprVar); ok {
+			c.compileExpr(e.Rhs)
 			instr := c.states.Last().StoreVar(variable.VarBinding)
 			c.asm.Emit(instr)
+		} else if upvalue, ok := e.Lhs.(*hir.ExprUpvalue); ok {
+			c.compileExpr(e.Rhs)
+			c.asm.Emit(&AssemblyInstrStoreUpvalue{Index: upvalue.Index})
 		} else {
 			c.compileExpr(e.Lhs)
+			c.compileExpr(e.Rhs)
 			c.asm.Emit(&AssemblyInstrStoreToPtr{})
 		}
 	case *hir.ExprBinary:
 		c.compileExpr(e.Lhs)
 		c.compileExpr(e.Rhs)
-		c.asm.Emit(hirBinaryOpToAssemblyInstr(e.Op))
+		c.asm.EmitAt(e.Pos, hirBinaryOpToAssemblyInstr(e.Op))
 	case *hir.ExprCall:
-		for i := len(e.Args) - 1; i >= 0; i-- {
-			c.compileExpr(e.Args[i])
+		rets := 1
+		if e.Results > 0 {
+			rets = e.Results
+		}
+		c.compileCall(e, rets)
+	case *hir.ExprDestructure:
+		c.compileCall(e.Call, len(e.Bindings))
+		// the last value is on the stack top
+		for i := len(e.Bindings) - 1; i >= 0; i-- {
+			if e.Bindings[i] == nil {
+				c.asm.Emit(&AssemblyInstrPop{})
+			} else {
+				c.asm.Emit(c.states.Last().StoreVar(e.Bindings[i]))
+			}
 		}
-		c.compileExpr(e.Callee)
-		c.asm.Emit(&AssemblyInstrCall{})
 	case *hir.ExprFunction:
-		c.states.Push(newCompileState())
+		c.states.Push(newCompileState(e.Func.Name))
 		c.asm.Label(e.Func.Name)
-		for _, arg := range e.Func.Args {
-			instr := c.states.Last().StoreVar(arg)
-			c.asm.Emit(instr)
-		}
+		c.compilePrologue(e.Func)
 		c.compileExpr(e.Func.Body)
 		state, _ := c.states.Pop()
 		cnst := c.asm.Consts.GetConst(c.FindConst(e.Func.Name)).(*hir.ValueFunc)
 		cnst.MaxLoacls = state.MaxLocals()
 	case *hir.ExprAnonFunction:
-		panic("unimplement!")
+		c.compileClosure(e)
 	case *hir.ExprUnary:
 		c.compileExpr(e.Expr)
 		switch e.Op {
 		case hir.OpNeg:
-			c.asm.Emit(&AssemblyInstrNeg{})
+			c.asm.EmitAt(e.Pos, &AssemblyInstrNeg{})
 		case hir.OpNot:
-			c.asm.Emit(&AssemblyInstrNot{})
+			c.asm.EmitAt(e.Pos, &AssemblyInstrNot{})
+		case hir.OpBitNot:
+			c.asm.EmitAt(e.Pos, &AssemblyInstrBitNot{})
 		}
 	case *hir.ExprReturn:
-		if e.Expr != nil {
+		count := 1
+		switch {
+		case e.Exprs != nil:
+			for _, x := range e.Exprs {
+				c.compileExpr(x)
+			}
+			count = len(e.Exprs)
+		case e.Expr != nil:
 			c.compileExpr(e.Expr)
+		default:
+			c.asm.EmitPush(hir.NewValueNil())
 		}
-		c.asm.Emit(&AssemblyInstrRet{})
+		c.jumpOut(0, func() {
+			c.asm.EmitAt(e.Pos, &AssemblyInstrRet{Count: count})
+		})
 	case *hir.ExprIf:
 		c.compileExpr(e.Cond)
 		elseLabel, endifLabel := c.labelGen.NextIfLabel()
@@ -201,7 +230,7 @@ func (c *Compiler) compileExpr(expr hir.Expr) {
 		} else {
 			jf.Label = endifLabel
 		}
-		c.asm.Emit(jf)
+		c.asm.EmitAt(e.Pos, jf)
 		c.compileExpr(e.Body)
 		if e.Else != nil {
 			c.asm.Emit(&AssemblyInstrJmp{Label: endifLabel})
@@ -209,14 +238,23 @@ func (c *Compiler) compileExpr(expr hir.Expr) {
 			c.compileExpr(e.Else)
 		}
 		c.asm.Label(endifLabel)
+	case *hir.ExprSwitch:
+		c.compileSwitch(e)
+	case *hir.ExprMatch:
+		c.compileMatch(e)
 	case *hir.ExprLoop:
-		loopStartLabel, loopEndLabel := c.labelGen.NextLoopLabel()
-		c.loopLabelStack.StartLoop(loopStartLabel, loopEndLabel)
+		loopStartLabel, loopExitLabel, loopEndLabel := c.labelGen.NextLoopLabel()
+		c.loopLabelStack.StartLoop(e.Label, loopStartLabel, loopEndLabel, len(c.states.Last().regions))
 		c.asm.Label(loopStartLabel)
 		c.compileExpr(e.Cond)
-		c.asm.Emit(&AssemblyInstrJF{Label: loopEndLabel})
+		c.asm.EmitAt(e.Pos, &AssemblyInstrJF{Label: loopExitLabel})
 		c.compileExpr(e.Body)
 		c.asm.Emit(&AssemblyInstrJmp{Label: loopStartLabel})
+		c.asm.Label(loopExitLabel)
+		if e.HasValue {
+			// the loop ends without break, a break jumps over this with its value on the stack
+			c.asm.EmitPush(hir.NewValueNil())
+		}
 		c.asm.Label(loopEndLabel)
 		c.loopLabelStack.EndLoop()
 	case *hir.ExprBlock:
@@ -224,49 +262,314 @@ func (c *Compiler) compileExpr(expr hir.Expr) {
 			c.compileExpr(body)
 		}
 	case *hir.ExprBreak:
-		c.compileExpr(e.Expr)
-		_, loopEndLabel := c.loopLabelStack.CurrentLabel()
-		c.asm.Emit(&AssemblyInstrJmp{Label: loopEndLabel})
+		if e.Expr != nil {
+			c.compileExpr(e.Expr)
+		}
+		_, loopEndLabel, regions := c.loopLabelStack.Find(e.Label)
+		c.jumpOut(regions, func() {
+			c.asm.Emit(&AssemblyInstrJmp{Label: loopEndLabel})
+		})
 	case *hir.ExprContinue:
-		loopStartLabel, _ := c.loopLabelStack.CurrentLabel()
-		c.asm.Emit(&AssemblyInstrJmp{Label: loopStartLabel})
-	case *hir.ExprArray:
-		state := c.states.Last()
-		if !state.IsLocalVar(e.Arr.VarBinding) {
-			state.StoreVar(e.Arr.VarBinding)
+		loopStartLabel, _, regions := c.loopLabelStack.Find(e.Label)
+		c.jumpOut(regions, func() {
+			c.asm.Emit(&AssemblyInstrJmp{Label: loopStartLabel})
+		})
+	case *hir.ExprTry:
+		c.compileTry(e)
+	case *hir.ExprPropagate:
+		c.compilePropagate(e)
+	case *hir.ExprResult:
+		c.compileExpr(e.Expr)
+		c.asm.Emit(&AssemblyInstrResult{Ok: e.Ok})
+	case *hir.ExprIsOk:
+		c.compileExpr(e.Expr)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrIsOk{})
+	case *hir.ExprUnwrap:
+		c.compileExpr(e.Expr)
+		if e.Default == nil {
+			c.asm.EmitAt(e.Pos, &AssemblyInstrUnwrap{})
+			break
 		}
-		c.asm.Emit(state.LoadVarPtr(e.Arr.VarBinding))
-		// c.asm.EmitPush(hir.NewValueInt(len(e.Exprs)))
-		for i, x := range e.Exprs {
-			if i != len(e.Exprs)-1 {
-				c.asm.Emit(&AssemblyInstrDup{})
-			}
-			c.asm.EmitPush(hir.NewValueInt(i)) // offset
-			c.asm.Emit(&AssemblyInstrAdd{})
+		c.compileExpr(e.Default)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrUnwrapOr{})
+	case *hir.ExprThrow:
+		c.compileExpr(e.Expr)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrThrow{})
+	case *hir.ExprArray:
+		for _, x := range e.Exprs {
 			c.compileExpr(x)
-			c.asm.Emit(&AssemblyInstrStoreToPtr{})
 		}
+		c.asm.Emit(&AssemblyInstrNewArray{Len: len(e.Exprs)})
 	case *hir.ExprSetElement:
-		c.compileExpr(e.Value)
 		c.compileExpr(e.ArrayAddr)
 		c.compileExpr(e.Index)
-		c.asm.Emit(&AssemblyInstrAdd{})
-		c.asm.Emit(&AssemblyInstrStoreToPtr{})
+		c.compileExpr(e.Value)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrSetIndex{})
+	case *hir.ExprLen:
+		c.compileExpr(e.Expr)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrLen{})
 	case *hir.ExprGetElement:
 		c.compileExpr(e.ArrayAddr)
 		c.compileExpr(e.Index)
-		c.asm.Emit(&AssemblyInstrAdd{})
-		c.asm.Emit(&AssemblyInstrLoadFromPtr{})
+		c.asm.EmitAt(e.Pos, &AssemblyInstrIndex{})
+	case *hir.ExprMap:
+		for i, k := range e.Keys {
+			c.compileExpr(k)
+			c.compileExpr(e.Values[i])
+		}
+		c.asm.EmitAt(e.Pos, &AssemblyInstrNewMap{Len: len(e.Keys)})
+	case *hir.ExprDelete:
+		c.compileExpr(e.Map)
+		c.compileExpr(e.Key)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrDelete{})
+	case *hir.ExprIter:
+		c.compileExpr(e.Expr)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrIter{})
+	case *hir.ExprNext:
+		c.compileExpr(e.Iter)
+		c.compileExpr(e.Index)
+		c.asm.Emit(&AssemblyInstrNext{})
+	case *hir.ExprEntry:
+		c.compileExpr(e.Iter)
+		c.compileExpr(e.Index)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrEntry{Key: e.Key})
 	case *hir.ExprPrint:
 		for i := len(e.Expr) - 1; i >= 0; i-- {
 			c.compileExpr(e.Expr[i])
 		}
 		c.asm.Emit(&AssemblyInstrPrint{ArgLen: len(e.Expr)})
+	case *hir.ExprDiscard:
+		if call, ok := e.Expr.(*hir.ExprCall); ok {
+			// the callee drops all its values
+			c.compileCall(call, 0)
+			break
+		}
+		c.compileExpr(e.Expr)
+		c.asm.Emit(&AssemblyInstrPop{})
+	case *hir.ExprStruct:
+		for _, x := range e.Values {
+			c.compileExpr(x)
+		}
+		c.asm.EmitAt(e.Pos, &AssemblyInstrNewStruct{Name: e.Struct.Name, Fields: e.Struct.Fields})
+	case *hir.ExprGetField:
+		c.compileExpr(e.Expr)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrGetField{Name: e.Field})
+	case *hir.ExprSetField:
+		c.compileExpr(e.Expr)
+		c.compileExpr(e.Value)
+		c.asm.EmitAt(e.Pos, &AssemblyInstrSetField{Name: e.Field})
+	}
+}
+
+// compilePrologue emits the instructions which store the arguments of a function into its locals,
+// and the height of the operand stack if the body needs it.
+// The default value of an argument is evaluated if the call passed fewer arguments than its index.
+func (c *Compiler) compilePrologue(f *hir.Function) {
+	state := c.states.Last()
+	for _, arg := range f.Args {
+		c.asm.Emit(state.StoreVar(arg))
+	}
+	if f.Rest != nil {
+		c.asm.Emit(state.StoreVar(f.Rest))
+	}
+	if f.Height != nil {
+		state.height = f.Height
+		c.asm.Emit(&AssemblyInstrHeight{})
+		c.asm.Emit(state.StoreVar(f.Height))
+	}
+	for i, d := range f.Defaults {
+		if d == nil {
+			continue
+		}
+		_, passedLabel := c.labelGen.NextIfLabel()
+		c.asm.Emit(&AssemblyInstrArgs{})
+		c.asm.EmitPush(hir.NewValueInt(i))
+		c.asm.Emit(&AssemblyInstrLTE{})
+		c.asm.Emit(&AssemblyInstrJF{Label: passedLabel})
+		c.compileExpr(d)
+		c.asm.Emit(state.StoreVar(f.Args[i]))
+		c.asm.Label(passedLabel)
+	}
+}
+
+// funcValue returns the constant of a function.
+func funcValue(f *hir.Function, maxLocals int) *hir.ValueFunc {
+	return &hir.ValueFunc{
+		FuncName:  f.Name,
+		MaxLoacls: maxLocals,
+		Params:    len(f.Args),
+		Required:  f.Required(),
+		Variadic:  f.Rest != nil,
+	}
+}
+
+// compilePropagate emits `r?`, an err is returned with the values below it on the stack dropped.
+func (c *Compiler) compilePropagate(e *hir.ExprPropagate) {
+	state := c.states.Last()
+	errLabel, endLabel := c.labelGen.NextPropagateLabel()
+	c.compileExpr(e.Expr)
+	c.asm.Emit(&AssemblyInstrDup{})
+	c.asm.EmitAt(e.Pos, &AssemblyInstrIsOk{})
+	c.asm.Emit(&AssemblyInstrJF{Label: errLabel})
+	c.asm.Emit(&AssemblyInstrUnwrap{})
+	c.asm.Emit(&AssemblyInstrJmp{Label: endLabel})
+	c.asm.Label(errLabel)
+	c.asm.Emit(&AssemblyInstrUnwind{Offset: state.Offset(state.height)})
+	c.jumpOut(0, func() {
+		c.asm.EmitAt(e.Pos, &AssemblyInstrRet{Count: 1})
+	})
+	c.asm.Label(endLabel)
+}
+
+// compileCall emits a call which leaves rets values of the callee on the stack.
+func (c *Compiler) compileCall(e *hir.ExprCall, rets int) {
+	for i := len(e.Args) - 1; i >= 0; i-- {
+		c.compileExpr(e.Args[i])
+	}
+	c.compileExpr(e.Callee)
+	c.asm.EmitAt(e.Pos, &AssemblyInstrCall{Rets: rets, Args: len(e.Args)})
+}
+
+// compileClosure emits the body of an anonymous function in place, jumped over,
+// and then the instructions which create a closure of it.
+// The body is emitted only once if the closure is compiled again in another copy of a finally block.
+func (c *Compiler) compileClosure(e *hir.ExprAnonFunction) {
+	captures := make([]Capture, len(e.Func.Upvalues))
+	for i, uv := range e.Func.Upvalues {
+		if uv.IsLocal {
+			captures[i] = Capture{IsLocal: true, Index: c.states.Last().Offset(uv.Binding)}
+		} else {
+			captures[i] = Capture{Index: uv.Index}
+		}
+	}
+
+	maxLocals, compiled := c.closureLocals[e.Func.Name]
+	if !compiled {
+		endLabel := e.Func.Name + "-end"
+		c.asm.Emit(&AssemblyInstrJmp{Label: endLabel})
+		c.states.Push(newCompileState(e.Func.Name))
+		c.asm.Label(e.Func.Name)
+		c.compilePrologue(e.Func)
+		c.compileExpr(e.Func.Body)
+		state, _ := c.states.Pop()
+		c.asm.Label(endLabel)
+		maxLocals = state.MaxLocals()
+		c.closureLocals[e.Func.Name] = maxLocals
+	}
+
+	c.asm.EmitPush(funcValue(e.Func, maxLocals))
+	c.asm.Emit(&AssemblyInstrClosure{Captures: captures})
+}
+
+// minJumpTableCases is the least number of case values for which a jump table is emitted.
+const minJumpTableCases = 4
+
+// compileSwitch emits a jump table if the case values are dense int constants,
+// otherwise the tag is compared with each case value in order.
+// A case matches if its value == the tag, a tag which cannot be compared with any case value goes to default.
+func (c *Compiler) compileSwitch(e *hir.ExprSwitch) {
+	caseLabels, defaultLabel, endLabel := c.labelGen.NextSwitchLabel(len(e.Cases))
+	c.compileExpr(e.Tag)
+
+	min, table, isTable := switchJumpTable(e)
+	if isTable {
+		labels := make([]string, len(table))
+		for i, caseIdx := range table {
+			if caseIdx < 0 {
+				labels[i] = defaultLabel
+			} else {
+				labels[i] = caseLabels[caseIdx]
+			}
+		}
+		c.asm.EmitAt(e.Pos, &AssemblyInstrJmpTable{Min: min, Labels: labels, Default: defaultLabel})
+	} else {
+		// the tag stays on the stack until a case matches
+		for i, sc := range e.Cases {
+			for _, x := range sc.Values {
+				c.compileExpr(x)
+				c.asm.Emit(&AssemblyInstrCase{Label: caseLabels[i]})
+			}
+		}
+		c.asm.Emit(&AssemblyInstrPop{})
+	}
+
+	c.asm.Label(defaultLabel)
+	if e.Default != nil {
+		c.compileExpr(e.Default)
+	}
+	c.asm.Emit(&AssemblyInstrJmp{Label: endLabel})
+	for i, sc := range e.Cases {
+		c.asm.Label(caseLabels[i])
+		if !isTable {
+			c.asm.Emit(&AssemblyInstrPop{})
+		}
+		c.compileExpr(sc.Body)
+		c.asm.Emit(&AssemblyInstrJmp{Label: endLabel})
+	}
+	c.asm.Label(endLabel)
+}
+
+// switchJumpTable returns the jump table of a switch whose case values are dense int constants.
+// table[x-min] is the index of the case whose value is x, or -1 if no case has the value x.
+func switchJumpTable(e *hir.ExprSwitch) (min int, table []int, ok bool) {
+	var values, cases []int
+	for caseIdx, sc := range e.Cases {
+		for _, x := range sc.Values {
+			lit, isLit := x.(*hir.ExprLiteral)
+			if !isLit {
+				return 0, nil, false
+			}
+			i, isInt := lit.Val.(*hir.ValueInt)
+			if !isInt {
+				return 0, nil, false
+			}
+			values = append(values, i.Val)
+			cases = append(cases, caseIdx)
+		}
+	}
+	min, table, ok = denseJumpTable(values)
+	if !ok {
+		return 0, nil, false
+	}
+	for i, valueIdx := range table {
+		if valueIdx >= 0 {
+			table[i] = cases[valueIdx]
+		}
+	}
+	return min, table, true
+}
+
+// denseJumpTable returns the jump table of values if they are dense.
+// table[x-min] is the index of the first value x, or -1 if x is not in values.
+func denseJumpTable(values []int) (min int, table []int, ok bool) {
+	n, max := len(values), 0
+	for i, x := range values {
+		if i == 0 || x < min {
+			min = x
+		}
+		if i == 0 || x > max {
+			max = x
+		}
+	}
+	// at least half of the table is used, max-min may overflow
+	if n < minJumpTableCases || max-min < 0 || max-min >= 2*n {
+		return 0, nil, false
+	}
+
+	table = make([]int, max-min+1)
+	for i := range table {
+		table[i] = -1
+	}
+	for valueIdx, x := range values {
+		if i := x - min; table[i] < 0 {
+			table[i] = valueIdx
+		}
 	}
+	return min, table, true
 }
 
 type LabelGen struct {
-	ifID, loopID uint32
+	ifID, loopID, switchID, matchID, tryID, propagateID uint32
 }
 
 func NewLabelGen() *LabelGen {
@@ -282,19 +585,56 @@ func (lg *LabelGen) NextIfLabel() (elseIf, endIf string) {
 	return fmt.Sprintf("else-%d", ifID), fmt.Sprintf("endif-%d", ifID)
 }
 
-func (lg *LabelGen) NextLoopLabel() (loopStart, loopEnd string) {
+func (lg *LabelGen) NextSwitchLabel(cases int) (caseLabels []string, defaultLabel, endLabel string) {
+	switchID := lg.switchID
+	atomic.AddUint32(&lg.switchID, 1)
+	caseLabels = make([]string, cases)
+	for i := range caseLabels {
+		caseLabels[i] = fmt.Sprintf("switch-%d-case-%d", switchID, i)
+	}
+	return caseLabels, fmt.Sprintf("switch-%d-default", switchID), fmt.Sprintf("switch-%d-end", switchID)
+}
+
+// NextMatchLabel returns the prefix of the labels of a match.
+func (lg *LabelGen) NextMatchLabel() string {
+	matchID := lg.matchID
+	atomic.AddUint32(&lg.matchID, 1)
+	return fmt.Sprintf("match-%d", matchID)
+}
+
+// NextTryLabel returns the labels of the handlers and of the end of a try.
+func (lg *LabelGen) NextTryLabel() (catchLabel, finallyLabel, endLabel string) {
+	tryID := lg.tryID
+	atomic.AddUint32(&lg.tryID, 1)
+	return fmt.Sprintf("try-%d-catch", tryID), fmt.Sprintf("try-%d-finally", tryID), fmt.Sprintf("try-%d-end", tryID)
+}
+
+// NextPropagateLabel returns the labels of the return of an err and of the end of a `?`.
+func (lg *LabelGen) NextPropagateLabel() (errLabel, endLabel string) {
+	propagateID := lg.propagateID
+	atomic.AddUint32(&lg.propagateID, 1)
+	return fmt.Sprintf("propagate-%d-err", propagateID), fmt.Sprintf("propagate-%d-end", propagateID)
+}
+
+// NextLoopLabel returns the labels of a loop, loopExit is jumped to when the condition is false.
+func (lg *LabelGen) NextLoopLabel() (loopStart, loopExit, loopEnd string) {
 	atomic.AddUint32(&lg.loopID, 1)
-	return fmt.Sprintf("loopStart-%d", lg.loopID), fmt.Sprintf("loopEnd-%d", lg.loopID)
+	return fmt.Sprintf("loopStart-%d", lg.loopID), fmt.Sprintf("loopExit-%d", lg.loopID), fmt.Sprintf("loopEnd-%d", lg.loopID)
 }
 
-type LoopLabelStack []struct{ loopStart, loopEnd string }
+type LoopLabelStack []struct {
+	label, loopStart, loopEnd string
+	regions                   int
+}
 
-func (l *LoopLabelStack) StartLoop(loopStart, loopEnd string) {
+// StartLoop pushes a loop, label is the label of the loop in the source and may be empty.
+// regions is the number of try regions around the loop, a break or continue leaves the regions above.
+func (l *LoopLabelStack) StartLoop(label, loopStart, loopEnd string, regions int) {
 
 	d := struct {
-		loopStart string
-		loopEnd   string
-	}{loopStart: loopStart, loopEnd: loopEnd}
+		label, loopStart, loopEnd string
+		regions                   int
+	}{label: label, loopStart: loopStart, loopEnd: loopEnd, regions: regions}
 	*l = append(*l, d)
 }
 
@@ -310,6 +650,17 @@ func (l *LoopLabelStack) CurrentLabel() (loopStart, loopEnd string) {
 	return label.loopStart, label.loopEnd
 }
 
+// Find returns the labels of the innermost loop with the label, or of the innermost loop if label is empty.
+// The loop must exist, the visitor reports break and continue without a loop.
+func (l *LoopLabelStack) Find(label string) (loopStart, loopEnd string, regions int) {
+	for i := len(*l) - 1; i >= 0; i-- {
+		if d := (*l)[i]; label == "" || d.label == label {
+			return d.loopStart, d.loopEnd, d.regions
+		}
+	}
+	panic(fmt.Sprintf("loop '%s not found", label))
+}
+
 func hirBinaryOpToAssemblyInstr(bop hir.BinaryOp) AssemblyInstruction {
 	switch bop {
 	case hir.OpAdd:
@@ -334,6 +685,20 @@ func hirBinaryOpToAssemblyInstr(bop hir.BinaryOp) AssemblyInstruction {
 		return &AssemblyInstrGTE{}
 	case hir.OpLTE:
 		return &AssemblyInstrLTE{}
+	case hir.OpAnd:
+		return &AssemblyInstrAnd{}
+	case hir.OpOr:
+		return &AssemblyInstrOr{}
+	case hir.OpBitAnd:
+		return &AssemblyInstrBitAnd{}
+	case hir.OpBitOr:
+		return &AssemblyInstrBitOr{}
+	case hir.OpXor:
+		return &AssemblyInstrXor{}
+	case hir.OpShl:
+		return &AssemblyInstrShl{}
+	case hir.OpShr:
+		return &AssemblyInstrShr{}
 	}
 	panic(fmt.Errorf("unsupport op: %d", bop))
 }
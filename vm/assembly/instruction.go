@@ -1,6 +1,10 @@
 package assembly
 
-import "fmt"
+import (
+	"fmt"
+	"sometimes/vm/value"
+	"strings"
+)
 
 type DataID = uint32
 
@@ -17,6 +21,14 @@ type (
 	AssemblyInstrDiv struct{}
 	AssemblyInstrMod struct{}
 	AssemblyInstrNeg struct{}
+
+	AssemblyInstrBitAnd struct{}
+	AssemblyInstrBitOr  struct{}
+	AssemblyInstrXor    struct{}
+	AssemblyInstrShl    struct{}
+	AssemblyInstrShr    struct{}
+	AssemblyInstrBitNot struct{}
+
 	AssemblyInstrEq  struct{}
 	AssemblyInstrNE  struct{}
 	AssemblyInstrGT  struct{}
@@ -34,21 +46,41 @@ type (
 	AssemblyInstrJF struct {
 		Label string
 	}
+	// jump to Labels[x-Min] where x is the int on the stack top, or to Default if x is out of range
+	AssemblyInstrJmpTable struct {
+		Min     int
+		Labels  []string
+		Default string
+	}
+	// pop a case value and jump to Label if it equals the tag on the stack top
+	AssemblyInstrCase struct {
+		Label string
+	}
 
-	AssemblyInstrCall struct{}
+	// Rets is the number of values the caller takes, 0 drops them all
+	AssemblyInstrCall struct {
+		Rets int
+		Args int
+	}
+	// AssemblyInstrArgs pushes the number of arguments the function was called with
+	AssemblyInstrArgs struct{}
 
-	AssemblyInstrRet struct{}
+	// Count is the number of values returned
+	AssemblyInstrRet struct {
+		Count int
+	}
 
 	AssemblyInstrPush struct {
 		DataID DataID
 	}
 	AssemblyInstrDup  struct{}
+	AssemblyInstrPop  struct{}
 	AssemblyInstrLoad struct {
 		Offset int
 	}
-	AssemblyInstrLoadPtr struct {
-		Offset  int
-		IsLocal bool
+	// AssemblyInstrNewArray pops Len elements, the first is the deepest, and pushes a new array
+	AssemblyInstrNewArray struct {
+		Len int
 	}
 	AssemblyInstrStore struct {
 		Offset int
@@ -56,18 +88,105 @@ type (
 
 	AssemblyInstrLoadFromPtr struct{}
 	AssemblyInstrStoreToPtr  struct{}
+	AssemblyInstrLen         struct{}
+
+	// AssemblyInstrIsType pops a value and pushes whether it has Type,
+	// and also is a struct named Struct if Struct is set
+	AssemblyInstrIsType struct {
+		Type   value.Type
+		Struct string
+	}
 
 	AssemblyInstrPrint struct {
 		ArgLen int
 	}
+
+	AssemblyInstrNewStruct struct {
+		Name   string
+		Fields []string
+	}
+	AssemblyInstrGetField struct {
+		Name string
+	}
+	AssemblyInstrSetField struct {
+		Name string
+	}
+
+	// AssemblyInstrNewMap pops Len keys and values, the first key is the deepest, and pushes a new map
+	AssemblyInstrNewMap struct {
+		Len int
+	}
+	// AssemblyInstrIndex pops an index or a key and an array or a map, and pushes the element or the value
+	AssemblyInstrIndex    struct{}
+	AssemblyInstrSetIndex struct{}
+	AssemblyInstrDelete   struct{}
+	// AssemblyInstrEntry pops an index and the state of a loop, and pushes the element or the value of the entry
+	// at the index, or with Key, the index of the element or the key of the entry
+	AssemblyInstrEntry struct {
+		Key bool
+	}
+	// AssemblyInstrIter pops an array or a map and pushes the state of a loop over it
+	AssemblyInstrIter struct{}
+	// AssemblyInstrNext pops an index and the state of a loop,
+	// and pushes the index of the next element or entry, or -1 if there is none
+	AssemblyInstrNext struct{}
+
+	// AssemblyInstrHeight pushes the number of values on the operand stack
+	AssemblyInstrHeight struct{}
+	// AssemblyInstrThrow pops a value and throws it, Rethrow if a finally throws again the value it caught
+	AssemblyInstrThrow struct {
+		Rethrow bool
+	}
+	// AssemblyInstrUnwind pops a value, truncates the operand stack to the height in the local at Offset
+	// and pushes the value back
+	AssemblyInstrUnwind struct {
+		Offset int
+	}
+
+	// AssemblyInstrResult pops a value and pushes an ok, or with !Ok an err, of it
+	AssemblyInstrResult struct {
+		Ok bool
+	}
+	AssemblyInstrIsOk     struct{}
+	AssemblyInstrUnwrap   struct{}
+	AssemblyInstrUnwrapOr struct{}
+
+	AssemblyInstrClosure struct {
+		Captures []Capture
+	}
+	AssemblyInstrLoadUpvalue struct {
+		Index int
+	}
+	AssemblyInstrStoreUpvalue struct {
+		Index int
+	}
 )
 
+// Capture tells where an upvalue of a new closure comes from.
+type Capture struct {
+	IsLocal bool // a local of the current function, or else an upvalue of it
+	Index   int  // offset of the local or index of the upvalue
+}
+
+func (c Capture) String() string {
+	if c.IsLocal {
+		return fmt.Sprintf("local %d", c.Index)
+	}
+	return fmt.Sprintf("upvalue %d", c.Index)
+}
+
 func (*AssemblyInstrAdd) isAssemblyInstruction()         {}
 func (*AssemblyInstrSub) isAssemblyInstruction()         {}
 func (*AssemblyInstrMul) isAssemblyInstruction()         {}
 func (*AssemblyInstrDiv) isAssemblyInstruction()         {}
 func (*AssemblyInstrMod) isAssemblyInstruction()         {}
 func (*AssemblyInstrNeg) isAssemblyInstruction()         {}
+func (*AssemblyInstrBitAnd) isAssemblyInstruction()      {}
+func (*AssemblyInstrBitOr) isAssemblyInstruction()       {}
+func (*AssemblyInstrXor) isAssemblyInstruction()         {}
+func (*AssemblyInstrShl) isAssemblyInstruction()         {}
+func (*AssemblyInstrShr) isAssemblyInstruction()         {}
+func (*AssemblyInstrBitNot) isAssemblyInstruction()      {}
 func (*AssemblyInstrEq) isAssemblyInstruction()          {}
 func (*AssemblyInstrNE) isAssemblyInstruction()          {}
 func (*AssemblyInstrGT) isAssemblyInstruction()          {}
@@ -79,16 +198,43 @@ func (*AssemblyInstrAnd) isAssemblyInstruction()         {}
 func (*AssemblyInstrOr) isAssemblyInstruction()          {}
 func (*AssemblyInstrJmp) isAssemblyInstruction()         {}
 func (*AssemblyInstrJF) isAssemblyInstruction()          {}
+func (*AssemblyInstrJmpTable) isAssemblyInstruction()    {}
+func (*AssemblyInstrCase) isAssemblyInstruction()        {}
 func (*AssemblyInstrCall) isAssemblyInstruction()        {}
+func (*AssemblyInstrArgs) isAssemblyInstruction()        {}
 func (*AssemblyInstrRet) isAssemblyInstruction()         {}
 func (*AssemblyInstrPush) isAssemblyInstruction()        {}
 func (*AssemblyInstrDup) isAssemblyInstruction()         {}
+func (*AssemblyInstrPop) isAssemblyInstruction()         {}
 func (*AssemblyInstrLoad) isAssemblyInstruction()        {}
 func (*AssemblyInstrStore) isAssemblyInstruction()       {}
 func (*AssemblyInstrLoadFromPtr) isAssemblyInstruction() {}
 func (*AssemblyInstrStoreToPtr) isAssemblyInstruction()  {}
-func (*AssemblyInstrLoadPtr) isAssemblyInstruction()     {}
+func (*AssemblyInstrNewArray) isAssemblyInstruction()    {}
+func (*AssemblyInstrLen) isAssemblyInstruction()         {}
+func (*AssemblyInstrIsType) isAssemblyInstruction()      {}
 func (*AssemblyInstrPrint) isAssemblyInstruction()       {}
+func (*AssemblyInstrNewStruct) isAssemblyInstruction()   {}
+func (*AssemblyInstrGetField) isAssemblyInstruction()    {}
+func (*AssemblyInstrSetField) isAssemblyInstruction()    {}
+func (*AssemblyInstrNewMap) isAssemblyInstruction()      {}
+func (*AssemblyInstrIndex) isAssemblyInstruction()       {}
+func (*AssemblyInstrSetIndex) isAssemblyInstruction()    {}
+func (*AssemblyInstrDelete) isAssemblyInstruction()      {}
+func (*AssemblyInstrEntry) isAssemblyInstruction()       {}
+func (*AssemblyInstrIter) isAssemblyInstruction()        {}
+func (*AssemblyInstrNext) isAssemblyInstruction()        {}
+func (*AssemblyInstrHeight) isAssemblyInstruction()      {}
+func (*AssemblyInstrThrow) isAssemblyInstruction()       {}
+func (*AssemblyInstrUnwind) isAssemblyInstruction()      {}
+func (*AssemblyInstrResult) isAssemblyInstruction()      {}
+func (*AssemblyInstrIsOk) isAssemblyInstruction()        {}
+func (*AssemblyInstrUnwrap) isAssemblyInstruction()      {}
+func (*AssemblyInstrUnwrapOr) isAssemblyInstruction()    {}
+
+func (*AssemblyInstrClosure) isAssemblyInstruction()      {}
+func (*AssemblyInstrLoadUpvalue) isAssemblyInstruction()  {}
+func (*AssemblyInstrStoreUpvalue) isAssemblyInstruction() {}
 
 func (*AssemblyInstrAdd) String() string         { return "Add" }
 func (*AssemblyInstrSub) String() string         { return "Sub" }
@@ -96,6 +242,12 @@ func (*AssemblyInstrMul) String() string         { return "Mul" }
 func (*AssemblyInstrDiv) String() string         { return "Div" }
 func (*AssemblyInstrMod) String() string         { return "Mod" }
 func (*AssemblyInstrNeg) String() string         { return "Neg" }
+func (*AssemblyInstrBitAnd) String() string      { return "BitAnd" }
+func (*AssemblyInstrBitOr) String() string       { return "BitOr" }
+func (*AssemblyInstrXor) String() string         { return "Xor" }
+func (*AssemblyInstrShl) String() string         { return "Shl" }
+func (*AssemblyInstrShr) String() string         { return "Shr" }
+func (*AssemblyInstrBitNot) String() string      { return "BitNot" }
 func (*AssemblyInstrEq) String() string          { return "Eq" }
 func (*AssemblyInstrNE) String() string          { return "NE" }
 func (*AssemblyInstrGT) String() string          { return "GT" }
@@ -107,19 +259,73 @@ func (*AssemblyInstrAnd) String() string         { return "And" }
 func (*AssemblyInstrOr) String() string          { return "Or" }
 func (jmp *AssemblyInstrJmp) String() string     { return fmt.Sprintf("Jmp %s", jmp.Label) }
 func (jf *AssemblyInstrJF) String() string       { return fmt.Sprintf("JF %s", jf.Label) }
-func (*AssemblyInstrCall) String() string        { return "Call" }
-func (*AssemblyInstrRet) String() string         { return "Ret" }
+func (c *AssemblyInstrCase) String() string      { return fmt.Sprintf("Case %s", c.Label) }
+func (ret *AssemblyInstrRet) String() string     { return fmt.Sprintf("Ret %d", ret.Count) }
 func (p *AssemblyInstrPush) String() string      { return fmt.Sprintf("Push @%d", p.DataID) }
 func (*AssemblyInstrDup) String() string         { return "Dup" }
+func (*AssemblyInstrPop) String() string         { return "Pop" }
 func (l *AssemblyInstrLoad) String() string      { return fmt.Sprintf("Load %d", l.Offset) }
 func (s *AssemblyInstrStore) String() string     { return fmt.Sprintf("Store %d", s.Offset) }
 func (*AssemblyInstrLoadFromPtr) String() string { return "LoadFromPtr" }
 func (*AssemblyInstrStoreToPtr) String() string  { return "StoreToPtr" }
-func (lp *AssemblyInstrLoadPtr) String() string {
-	s := ""
-	if lp.IsLocal {
-		s = "local"
+func (*AssemblyInstrLen) String() string         { return "Len" }
+func (it *AssemblyInstrIsType) String() string {
+	if it.Struct != "" {
+		return fmt.Sprintf("IsType %s %s", it.Type, it.Struct)
 	}
-	return fmt.Sprintf("Load%sPtr #%d", s, lp.Offset)
+	return fmt.Sprintf("IsType %s", it.Type)
 }
 func (lp *AssemblyInstrPrint) String() string { return fmt.Sprintf("Print %d", lp.ArgLen) }
+func (ns *AssemblyInstrNewStruct) String() string {
+	return fmt.Sprintf("NewStruct %s {%s}", ns.Name, strings.Join(ns.Fields, ", "))
+}
+func (gf *AssemblyInstrGetField) String() string { return fmt.Sprintf("GetField %s", gf.Name) }
+func (sf *AssemblyInstrSetField) String() string { return fmt.Sprintf("SetField %s", sf.Name) }
+func (na *AssemblyInstrNewArray) String() string { return fmt.Sprintf("NewArray %d", na.Len) }
+func (nm *AssemblyInstrNewMap) String() string   { return fmt.Sprintf("NewMap %d", nm.Len) }
+func (*AssemblyInstrIndex) String() string       { return "Index" }
+func (*AssemblyInstrSetIndex) String() string    { return "SetIndex" }
+func (*AssemblyInstrDelete) String() string      { return "Delete" }
+func (e *AssemblyInstrEntry) String() string {
+	if e.Key {
+		return "Entry key"
+	}
+	return "Entry"
+}
+func (*AssemblyInstrHeight) String() string { return "Height" }
+func (*AssemblyInstrIter) String() string   { return "Iter" }
+func (*AssemblyInstrNext) String() string   { return "Next" }
+func (*AssemblyInstrArgs) String() string   { return "Args" }
+func (t *AssemblyInstrThrow) String() string {
+	if t.Rethrow {
+		return "Rethrow"
+	}
+	return "Throw"
+}
+func (u *AssemblyInstrUnwind) String() string { return fmt.Sprintf("Unwind %d", u.Offset) }
+func (r *AssemblyInstrResult) String() string {
+	if r.Ok {
+		return "Result ok"
+	}
+	return "Result err"
+}
+func (*AssemblyInstrIsOk) String() string     { return "IsOk" }
+func (*AssemblyInstrUnwrap) String() string   { return "Unwrap" }
+func (*AssemblyInstrUnwrapOr) String() string { return "UnwrapOr" }
+func (jt *AssemblyInstrJmpTable) String() string {
+	return fmt.Sprintf("JmpTable %d [%s] %s", jt.Min, strings.Join(jt.Labels, ", "), jt.Default)
+}
+
+func (c *AssemblyInstrClosure) String() string {
+	captures := make([]string, len(c.Captures))
+	for i, capture := range c.Captures {
+		captures[i] = capture.String()
+	}
+	return fmt.Sprintf("Closure [%s]", strings.Join(captures, ", "))
+}
+func (lu *AssemblyInstrLoadUpvalue) String() string  { return fmt.Sprintf("LoadUpvalue %d", lu.Index) }
+func (su *AssemblyInstrStoreUpvalue) String() string { return fmt.Sprintf("StoreUpvalue %d", su.Index) }
+
+func (call *AssemblyInstrCall) String() string {
+	return fmt.Sprintf("Call args %d rets %d", call.Args, call.Rets)
+}
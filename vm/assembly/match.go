@@ -0,0 +1,448 @@
+package assembly
+
+import (
+	"fmt"
+	"sometimes/hir"
+	"sometimes/vm/value"
+)
+
+// A match is compiled to a decision tree, see "Compiling Pattern Matching to Good Decision Trees"
+// by Luc Maranget. Each value in the subject is tested at most once on a path of the tree,
+// the tree jumps to the arm which matches:
+//
+//	subject is stored to the hidden local
+//	decision tree
+//	the decision trees restarting after the arms with a guard
+//	arm-0: bindings, guard (jumps to the restart after arm 0 if false), body, jump to the end
+//	...
+//	end:
+//
+// Guards and bodies are emitted once, even if the tree reaches an arm in several leaves.
+
+// pathStep is a step from a value to a part of it.
+type pathStep struct {
+	field string // the field of a struct, if set
+	index int    // the element of an array
+	rest  bool   // the elements from index, instead of the element
+}
+
+// matchPath locates a part of the subject, the subject itself is the empty path.
+type matchPath []pathStep
+
+func (p matchPath) equal(q matchPath) bool {
+	if len(p) != len(q) {
+		return false
+	}
+	for i := range p {
+		if p[i] != q[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (p matchPath) elem(i int) matchPath {
+	return append(p[:len(p):len(p)], pathStep{index: i})
+}
+
+func (p matchPath) restFrom(i int) matchPath {
+	return append(p[:len(p):len(p)], pathStep{index: i, rest: true})
+}
+
+func (p matchPath) field(name string) matchPath {
+	return append(p[:len(p):len(p)], pathStep{field: name})
+}
+
+// matchTest is a pattern which is not tested yet, the subpatterns are tested after it.
+type matchTest struct {
+	path matchPath
+	pat  hir.Pat
+}
+
+// matchRow is an arm with the patterns it still needs to match.
+type matchRow struct {
+	tests []matchTest
+	arm   int
+}
+
+// expand returns the tests of p at path, the bindings are not tested.
+func expand(path matchPath, p hir.Pat) []matchTest {
+	switch p.(type) {
+	case *hir.PatWildcard, *hir.PatBinding:
+		return nil
+	}
+	return []matchTest{{path: path, pat: p}}
+}
+
+// subtests returns the tests of the parts of the value at t.path, after the value matched t.pat.
+func subtests(t matchTest) []matchTest {
+	var tests []matchTest
+	switch p := t.pat.(type) {
+	case *hir.PatArray:
+		for i, elem := range p.Elems {
+			tests = append(tests, expand(t.path.elem(i), elem)...)
+		}
+	case *hir.PatStruct:
+		for i, f := range p.Fields {
+			tests = append(tests, expand(t.path.field(p.Struct.Fields[i]), f)...)
+		}
+	}
+	return tests
+}
+
+// testAt returns the index of the test of r at path, or -1.
+func (r *matchRow) testAt(path matchPath) int {
+	for i, t := range r.tests {
+		if t.path.equal(path) {
+			return i
+		}
+	}
+	return -1
+}
+
+type matchCompiler struct {
+	c        *Compiler
+	e        *hir.ExprMatch
+	prefix   string
+	labels   int
+	restarts map[int]string // label of the tree which tries the arms from the index
+}
+
+func (c *Compiler) compileMatch(e *hir.ExprMatch) {
+	m := &matchCompiler{c: c, e: e, prefix: c.labelGen.NextMatchLabel(), restarts: make(map[int]string)}
+	endLabel := m.prefix + "-end"
+
+	c.compileExpr(e.Subject)
+	c.asm.Emit(c.states.Last().StoreVar(e.Binding))
+	m.compileTree(m.rows(0))
+	for i, arm := range e.Arms {
+		if arm.Guard != nil {
+			m.restarts[i+1] = m.newLabel()
+		}
+	}
+	for i := range e.Arms {
+		if label, ok := m.restarts[i]; ok {
+			c.asm.Label(label)
+			m.compileTree(m.rows(i))
+		}
+	}
+
+	for i, arm := range e.Arms {
+		c.asm.Label(m.armLabel(i))
+		m.compileBindings(nil, arm.Pat)
+		if arm.Guard != nil {
+			c.compileExpr(arm.Guard)
+			c.asm.Emit(&AssemblyInstrJF{Label: m.restarts[i+1]})
+		}
+		c.compileExpr(arm.Body)
+		c.asm.Emit(&AssemblyInstrJmp{Label: endLabel})
+	}
+	c.asm.Label(endLabel)
+}
+
+// rows returns the rows of the arms from the index.
+func (m *matchCompiler) rows(from int) []*matchRow {
+	rows := make([]*matchRow, 0, len(m.e.Arms)-from)
+	for i := from; i < len(m.e.Arms); i++ {
+		rows = append(rows, &matchRow{tests: expand(nil, m.e.Arms[i].Pat), arm: i})
+	}
+	return rows
+}
+
+func (m *matchCompiler) newLabel() string {
+	m.labels++
+	return fmt.Sprintf("%s-%d", m.prefix, m.labels)
+}
+
+func (m *matchCompiler) armLabel(i int) string {
+	return fmt.Sprintf("%s-arm-%d", m.prefix, i)
+}
+
+// compileTree emits the decision tree of rows, it branches on the first test of the first row.
+// The rows are never empty, because the visitor checks that the match is exhaustive.
+func (m *matchCompiler) compileTree(rows []*matchRow) {
+	if len(rows) == 0 {
+		panic("match is not exhaustive")
+	}
+	if len(rows[0].tests) == 0 {
+		m.c.asm.Emit(&AssemblyInstrJmp{Label: m.armLabel(rows[0].arm)})
+		return
+	}
+
+	path := rows[0].tests[0].path
+	var heads []hir.Pat
+	for _, r := range rows {
+		if i := r.testAt(path); i >= 0 && !containsPat(heads, r.tests[i].pat) {
+			heads = append(heads, r.tests[i].pat)
+		}
+	}
+
+	if typ, min, table, ok := literalJumpTable(heads); ok {
+		defaultLabel := m.newLabel()
+		labels := make([]string, len(heads))
+		for i := range labels {
+			labels[i] = m.newLabel()
+		}
+		tableLabels := make([]string, len(table))
+		for i, headIdx := range table {
+			if headIdx < 0 {
+				tableLabels[i] = defaultLabel
+			} else {
+				tableLabels[i] = labels[headIdx]
+			}
+		}
+		m.compileLoad(path)
+		m.c.asm.Emit(&AssemblyInstrIsType{Type: typ})
+		m.c.asm.Emit(&AssemblyInstrJF{Label: defaultLabel})
+		m.compileLoad(path)
+		m.c.asm.Emit(&AssemblyInstrJmpTable{Min: min, Labels: tableLabels, Default: defaultLabel})
+		for i, head := range heads {
+			m.c.asm.Label(labels[i])
+			m.compileTree(specialize(rows, path, head))
+		}
+		m.c.asm.Label(defaultLabel)
+		m.compileTree(defaultRows(rows, path, heads))
+		return
+	}
+
+	for _, head := range heads {
+		next := m.newLabel()
+		m.compileTest(path, head, next)
+		m.compileTree(specialize(rows, path, head))
+		m.c.asm.Label(next)
+	}
+	m.compileTree(defaultRows(rows, path, heads))
+}
+
+// specialize returns the rows which may match after the value at path matched head.
+func specialize(rows []*matchRow, path matchPath, head hir.Pat) []*matchRow {
+	var spec []*matchRow
+	for _, r := range rows {
+		i := r.testAt(path)
+		switch {
+		case i < 0:
+			spec = append(spec, r)
+		case subsumes(r.tests[i].pat, head):
+			// the test passes, its subpatterns are tested instead
+			tests := append([]matchTest{}, r.tests[:i]...)
+			tests = append(tests, subtests(r.tests[i])...)
+			tests = append(tests, r.tests[i+1:]...)
+			spec = append(spec, &matchRow{tests: tests, arm: r.arm})
+		case overlaps(r.tests[i].pat, head):
+			spec = append(spec, r)
+		}
+	}
+	return spec
+}
+
+// defaultRows returns the rows which may match after the value at path matched none of heads.
+func defaultRows(rows []*matchRow, path matchPath, heads []hir.Pat) []*matchRow {
+	var def []*matchRow
+next:
+	for _, r := range rows {
+		if i := r.testAt(path); i >= 0 {
+			for _, head := range heads {
+				if subsumes(head, r.tests[i].pat) {
+					continue next
+				}
+			}
+		}
+		def = append(def, r)
+	}
+	return def
+}
+
+// compileTest emits a test of the value at path which jumps to fail if the value does not match p.
+// The parts of the value are not tested.
+func (m *matchCompiler) compileTest(path matchPath, p hir.Pat, fail string) {
+	asm := m.c.asm
+	switch p := p.(type) {
+	case *hir.PatLiteral:
+		m.compileLoad(path)
+		asm.Emit(&AssemblyInstrIsType{Type: literalType(p.Val)})
+		asm.Emit(&AssemblyInstrJF{Label: fail})
+		if _, isNil := p.Val.(*hir.ValueNil); !isNil {
+			m.compileLoad(path)
+			asm.EmitPush(p.Val)
+			asm.Emit(&AssemblyInstrEq{})
+			asm.Emit(&AssemblyInstrJF{Label: fail})
+		}
+	case *hir.PatRange:
+		m.compileLoad(path)
+		asm.Emit(&AssemblyInstrIsType{Type: literalType(p.Lo)})
+		asm.Emit(&AssemblyInstrJF{Label: fail})
+		m.compileLoad(path)
+		asm.EmitPush(p.Lo)
+		asm.Emit(&AssemblyInstrGTE{})
+		asm.Emit(&AssemblyInstrJF{Label: fail})
+		m.compileLoad(path)
+		asm.EmitPush(p.Hi)
+		if p.Inclusive {
+			asm.Emit(&AssemblyInstrLTE{})
+		} else {
+			asm.Emit(&AssemblyInstrLT{})
+		}
+		asm.Emit(&AssemblyInstrJF{Label: fail})
+	case *hir.PatArray:
+		m.compileLoad(path)
+		asm.Emit(&AssemblyInstrIsType{Type: value.TypePointer})
+		asm.Emit(&AssemblyInstrJF{Label: fail})
+		if len(p.Elems) > 0 || !p.HasRest {
+			m.compileLoad(path)
+			asm.Emit(&AssemblyInstrLen{})
+			asm.EmitPush(hir.NewValueInt(len(p.Elems)))
+			if p.HasRest {
+				asm.Emit(&AssemblyInstrGTE{})
+			} else {
+				asm.Emit(&AssemblyInstrEq{})
+			}
+			asm.Emit(&AssemblyInstrJF{Label: fail})
+		}
+	case *hir.PatStruct:
+		m.compileLoad(path)
+		asm.Emit(&AssemblyInstrIsType{Type: value.TypeStruct, Struct: p.Struct.Name})
+		asm.Emit(&AssemblyInstrJF{Label: fail})
+	}
+}
+
+// compileBindings emits the stores of the bindings of p, the value at path matched p.
+func (m *matchCompiler) compileBindings(path matchPath, p hir.Pat) {
+	switch p := p.(type) {
+	case *hir.PatBinding:
+		m.compileLoad(path)
+		m.c.asm.Emit(m.c.states.Last().StoreVar(p.Binding))
+	case *hir.PatArray:
+		for i, elem := range p.Elems {
+			m.compileBindings(path.elem(i), elem)
+		}
+		if p.Rest != nil {
+			m.compileLoad(path.restFrom(len(p.Elems)))
+			m.c.asm.Emit(m.c.states.Last().StoreVar(p.Rest))
+		}
+	case *hir.PatStruct:
+		for i, f := range p.Fields {
+			m.compileBindings(path.field(p.Struct.Fields[i]), f)
+		}
+	}
+}
+
+// compileLoad pushes the value at path.
+func (m *matchCompiler) compileLoad(path matchPath) {
+	asm := m.c.asm
+	asm.Emit(m.c.states.Last().LoadVar(m.e.Binding))
+	for _, step := range path {
+		switch {
+		case step.field != "":
+			asm.Emit(&AssemblyInstrGetField{Name: step.field})
+		case step.rest && step.index == 0:
+		case step.rest:
+			asm.EmitPush(hir.NewValueInt(step.index))
+			asm.Emit(&AssemblyInstrAdd{})
+		default:
+			asm.EmitPush(hir.NewValueInt(step.index))
+			asm.Emit(&AssemblyInstrAdd{})
+			asm.Emit(&AssemblyInstrLoadFromPtr{})
+		}
+	}
+}
+
+// literalJumpTable returns the jump table of heads if they are dense int or char literals.
+func literalJumpTable(heads []hir.Pat) (typ value.Type, min int, table []int, ok bool) {
+	values := make([]int, 0, len(heads))
+	for i, head := range heads {
+		lit, isLit := head.(*hir.PatLiteral)
+		if !isLit {
+			return 0, 0, nil, false
+		}
+		x, isInt := hir.IntValue(lit.Val)
+		if !isInt || i > 0 && literalType(lit.Val) != typ {
+			return 0, 0, nil, false
+		}
+		typ = literalType(lit.Val)
+		values = append(values, x)
+	}
+	min, table, ok = denseJumpTable(values)
+	return typ, min, table, ok
+}
+
+// subsumes reports whether the values which match q all match p, the parts of the values are not considered.
+func subsumes(p, q hir.Pat) bool {
+	switch p := p.(type) {
+	case *hir.PatArray:
+		q, ok := q.(*hir.PatArray)
+		if !ok {
+			return false
+		}
+		if p.HasRest {
+			return len(q.Elems) >= len(p.Elems)
+		}
+		return !q.HasRest && len(q.Elems) == len(p.Elems)
+	case *hir.PatStruct:
+		q, ok := q.(*hir.PatStruct)
+		return ok && q.Struct.Name == p.Struct.Name
+	}
+	if plo, phi, ok := hir.Bounds(p); ok {
+		qlo, qhi, ok := hir.Bounds(q)
+		return ok && hir.SameKind(p, q) && plo <= qlo && qhi <= phi
+	}
+	return equalLiterals(p, q)
+}
+
+// overlaps reports whether some values match both p and q, the parts of the values are not considered.
+func overlaps(p, q hir.Pat) bool {
+	switch p := p.(type) {
+	case *hir.PatArray:
+		q, ok := q.(*hir.PatArray)
+		if !ok {
+			return false
+		}
+		switch {
+		case p.HasRest && q.HasRest:
+			return true
+		case p.HasRest:
+			return len(q.Elems) >= len(p.Elems)
+		case q.HasRest:
+			return len(p.Elems) >= len(q.Elems)
+		}
+		return len(p.Elems) == len(q.Elems)
+	case *hir.PatStruct:
+		q, ok := q.(*hir.PatStruct)
+		return ok && q.Struct.Name == p.Struct.Name
+	}
+	if plo, phi, ok := hir.Bounds(p); ok {
+		qlo, qhi, ok := hir.Bounds(q)
+		return ok && hir.SameKind(p, q) && plo <= qhi && qlo <= phi
+	}
+	return equalLiterals(p, q)
+}
+
+func equalLiterals(p, q hir.Pat) bool {
+	x, xok := p.(*hir.PatLiteral)
+	y, yok := q.(*hir.PatLiteral)
+	return xok && yok && hir.ValueEqual(x.Val, y.Val)
+}
+
+func literalType(v hir.Value) value.Type {
+	switch v.(type) {
+	case *hir.ValueInt:
+		return value.TypeInt
+	case *hir.ValueFloat:
+		return value.TypeFloat
+	case *hir.ValueBoolean:
+		return value.TypeBoolean
+	case *hir.ValueChar:
+		return value.TypeChar
+	case *hir.ValueString:
+		return value.TypeString
+	}
+	return value.TypeNil
+}
+
+func containsPat(l []hir.Pat, p hir.Pat) bool {
+	for _, x := range l {
+		if subsumes(x, p) && subsumes(p, x) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package assembly
+
+import "sometimes/hir"
+
+// tryRegion is a block of a try whose instructions are covered by a handler.
+// The instructions are covered in ranges, a jump out of the region suspends it
+// while the finally blocks it leaves are emitted.
+type tryRegion struct {
+	target  string         // label of the handler
+	height  int            // offset of the local which holds the height of the operand stack
+	finally *hir.ExprBlock // evaluated when a jump leaves the region; nil if none
+	start   Ptr            // start of the range being covered
+}
+
+// compileTry emits
+//
+//	Height; Store height
+//	body                      // covered by the catch, or by the finally if no catch
+//	finally; Jmp end
+//	catch: Store e            // covered by the finally
+//	catch body
+//	finally; Jmp end
+//	finally: Store exception
+//	finally; Load exception; Rethrow
+//	end:
+//
+// The finally block is emitted once more for each return, break or continue which leaves the try.
+func (c *Compiler) compileTry(e *hir.ExprTry) {
+	state := c.states.Last()
+	catchLabel, finallyLabel, endLabel := c.labelGen.NextTryLabel()
+	height := state.Offset(e.Height)
+	c.asm.Emit(&AssemblyInstrHeight{})
+	c.asm.Emit(state.StoreVar(e.Height))
+
+	target := finallyLabel
+	if e.CatchBody != nil {
+		target = catchLabel
+	}
+	c.compileRegion(&tryRegion{target: target, height: height, finally: e.Finally}, e.Body)
+	c.compileFinally(e, endLabel)
+
+	if e.CatchBody != nil {
+		c.asm.Label(catchLabel)
+		if e.Catch != nil {
+			c.asm.Emit(state.StoreVar(e.Catch))
+		} else {
+			c.asm.Emit(&AssemblyInstrPop{})
+		}
+		if e.Finally != nil {
+			c.compileRegion(&tryRegion{target: finallyLabel, height: height, finally: e.Finally}, e.CatchBody)
+		} else {
+			c.compileExpr(e.CatchBody)
+		}
+		c.compileFinally(e, endLabel)
+	}
+
+	if e.Finally != nil {
+		c.asm.Label(finallyLabel)
+		c.asm.Emit(state.StoreVar(e.Exception))
+		c.compileExpr(e.Finally)
+		c.asm.Emit(state.LoadVar(e.Exception))
+		c.asm.Emit(&AssemblyInstrThrow{Rethrow: true})
+	}
+	c.asm.Label(endLabel)
+}
+
+// compileFinally emits the finally block of a try, if any, and the jump to its end.
+func (c *Compiler) compileFinally(e *hir.ExprTry, endLabel string) {
+	if e.Finally != nil {
+		c.compileExpr(e.Finally)
+	}
+	c.asm.Emit(&AssemblyInstrJmp{Label: endLabel})
+}
+
+// compileRegion emits a block covered by the handler of the region.
+func (c *Compiler) compileRegion(r *tryRegion, body hir.Expr) {
+	state := c.states.Last()
+	r.start = len(c.asm.Instructions)
+	state.regions = append(state.regions, r)
+	c.compileExpr(body)
+	state.regions = state.regions[:len(state.regions)-1]
+	c.closeRegions([]*tryRegion{r})
+}
+
+// closeRegions adds the handlers of the ranges covered so far by the regions, innermost first.
+func (c *Compiler) closeRegions(regions []*tryRegion) {
+	state := c.states.Last()
+	end := len(c.asm.Instructions)
+	for i := len(regions) - 1; i >= 0; i-- {
+		r := regions[i]
+		if r.start < end {
+			c.asm.Handlers = append(c.asm.Handlers, &AssemblyHandler{
+				Func:   state.fn,
+				Start:  r.start,
+				End:    end,
+				Target: r.target,
+				Height: r.height,
+			})
+		}
+		r.start = end
+	}
+}
+
+// jumpOut emits a jump, by emit, out of the try regions above the first base regions.
+// The finally blocks of the regions are emitted before it, innermost first,
+// each of them covered only by the regions around its try.
+func (c *Compiler) jumpOut(base int, emit func()) {
+	state := c.states.Last()
+	regions := state.regions
+	covered := len(regions)
+	for i := len(regions) - 1; i >= base; i-- {
+		if regions[i].finally == nil {
+			continue
+		}
+		c.closeRegions(regions[i:covered])
+		covered = i
+		// a try in the finally block must not overwrite the regions
+		state.regions = regions[:i:i]
+		c.compileExpr(regions[i].finally)
+		state.regions = regions
+	}
+	c.closeRegions(regions[base:covered])
+	emit()
+	for _, r := range regions[base:] {
+		r.start = len(c.asm.Instructions)
+	}
+}
@@ -22,9 +22,18 @@ func (l *Local) Store(idx int, v value.Value) {
 	l.locals[idx] = v
 }
 
+// Ref returns a pointer to the local, it is valid as long as l is referenced.
+func (l *Local) Ref(idx int) *value.Value {
+	return &l.locals[idx]
+}
+
 type Frame struct {
-	Local   *Local
-	RetAddr Ptr
+	Local    *Local
+	Upvalues []*value.Value // upvalues of the closure being executed
+	Func     Ptr            // address of the function being executed
+	RetAddr  Ptr
+	Rets     int // number of values the caller takes, 0 drops them all
+	Args     int // number of arguments the caller passed
 }
 
 type frameNode struct {
@@ -73,17 +82,28 @@ func (fs *FrameStack) Push(frame *Frame) {
 
 func (fs *FrameStack) Pop() *Frame {
 	if fs.IsEmpty() {
-		panic(StackOverflow)
+		panic(StackUnderflow)
 	}
 	tail := fs.head.prev
 	tail.prev.next = nil
 	fs.head.prev = tail.prev
+	fs.len--
 	return tail.frame
 }
 
 func (fs *FrameStack) Top() *Frame {
 	if fs.IsEmpty() {
-		panic(StackOverflow)
+		panic(StackUnderflow)
 	}
 	return fs.head.prev.frame
 }
+
+// Each calls f for each frame, from the top of the stack to the bottom.
+func (fs *FrameStack) Each(f func(*Frame)) {
+	if fs.IsEmpty() {
+		return
+	}
+	for node := fs.head.prev; node != fs.head; node = node.prev {
+		f(node.frame)
+	}
+}
@@ -1,6 +1,9 @@
 package vm
 
-import "encoding/gob"
+import (
+	"encoding/gob"
+	"sometimes/vm/value"
+)
 
 type Ptr = int
 type DataID = int
@@ -17,6 +20,12 @@ const (
 	OpDiv
 	OpMod
 	OpNeg // negate
+	OpBitAnd
+	OpBitOr
+	OpXor
+	OpShl    // shift left
+	OpShr    // arithmetic shift right
+	OpBitNot // bitwise complement
 	op_arith_end
 
 	op_logic_start
@@ -33,19 +42,50 @@ const (
 	OpPrint
 	OpJmp // jump
 	OpJF  // jump if false
+	OpJmpTable
+	OpCase // Pop a case value and jump if it equals the tag on the stack top, values which cannot be compared are not equal
 
 	OpCall
-	OpRet // return
+	OpRet  // return
+	OpArgs // Push the number of arguments the function being executed was called with
 
 	OpPush
 	OpDup
+	OpPop
 
 	OpLoad  // Push a copy of the local with the given offset on to the stack
 	OpStore // Store value of stack top to local with the given offset
 
-	OpLoadPtr
+	OpNewArray // Pop the elements and push a pointer to the first element of a new array
 	OpLoadFromPtr
 	OpStoreToPtr
+	OpLen    // Pop an array pointer and push the number of its elements
+	OpIsType // Pop a value and push whether it has the given type
+
+	OpNewStruct // Pop the field values and push a new struct
+	OpGetField
+	OpSetField
+
+	OpNewMap   // Pop the keys and the values and push a new map
+	OpIndex    // Pop an index or a key and an array or a map, and push the element or the value
+	OpSetIndex // Pop a value, an index or a key and an array or a map, and set the element or the value
+	OpDelete   // Pop a key and a map, and remove the entry of the key
+	OpEntry    // Pop an index and the state of a loop, and push the element or the entry at the index
+	OpIter     // Pop an array or a map and push the state of a loop over it
+	OpNext     // Pop an index and the state of a loop, and push the index of the next element or entry, or -1
+
+	OpHeight // Push the number of values on the operand stack
+	OpThrow  // Pop a value and unwind to the handler of the innermost try which encloses the instruction
+	OpUnwind // Pop a value, truncate the operand stack to the height in the local at the given offset and push the value
+
+	OpResult   // Pop a value and push an ok or an err of it
+	OpIsOk     // Pop a result and push whether it is an ok
+	OpUnwrap   // Pop a result and push the value of an ok, or throw if it is an err
+	OpUnwrapOr // Pop a default and a result, and push the value of an ok or else the default
+
+	OpClosure      // Pop a function and push a closure of it
+	OpLoadUpvalue  // Push the value of the upvalue with the given index
+	OpStoreUpvalue // Store value of stack top to the upvalue with the given index
 )
 
 // Instruction is one instruction executed by the vm
@@ -62,6 +102,13 @@ type (
 	InstrMod struct{}
 	InstrNeg struct{}
 
+	InstrBitAnd struct{}
+	InstrBitOr  struct{}
+	InstrXor    struct{}
+	InstrShl    struct{}
+	InstrShr    struct{}
+	InstrBitNot struct{}
+
 	InstrEq  struct{}
 	InstrNE  struct{}
 	InstrGT  struct{}
@@ -79,10 +126,24 @@ type (
 	InstrJF struct {
 		Addr Ptr
 	}
+	InstrJmpTable struct {
+		Min     int
+		Addrs   []Ptr
+		Default Ptr
+	}
+	InstrCase struct {
+		Addr Ptr
+	}
 
-	InstrCall struct{}
+	InstrCall struct {
+		Rets int // number of values the caller takes, 0 drops them all
+		Args int // number of arguments below the callee, the first on top
+	}
+	InstrArgs struct{}
 
-	InstrRet struct{}
+	InstrRet struct {
+		Count int // number of values returned
+	}
 
 	InstrPrint struct{ ArgLen int }
 
@@ -90,14 +151,14 @@ type (
 		DataID DataID
 	}
 	InstrDup struct{}
+	InstrPop struct{}
 
 	InstrLoad struct {
 		Offset int
 	}
 
-	InstrLoadPtr struct {
-		Offset  int
-		IsLocal bool
+	InstrNewArray struct {
+		Len int // number of elements, the first is the deepest
 	}
 
 	InstrStore struct {
@@ -106,15 +167,81 @@ type (
 
 	InstrLoadFromPtr struct{}
 	InstrStoreToPtr  struct{}
+	InstrLen         struct{}
+
+	InstrIsType struct {
+		Type   value.Type
+		Struct string // the name of the struct if Type is TypeStruct; optional
+	}
+
+	InstrNewStruct struct {
+		Name   string
+		Fields []string
+	}
+	InstrGetField struct {
+		Name string
+	}
+	InstrSetField struct {
+		Name string
+	}
+
+	InstrNewMap struct {
+		Len int // number of entries, the first key is the deepest
+	}
+	InstrIndex    struct{}
+	InstrSetIndex struct{}
+	InstrDelete   struct{}
+	InstrEntry    struct {
+		Key bool // push the index of the element or the key of the entry instead
+	}
+	InstrIter struct{}
+	InstrNext struct{}
+
+	InstrHeight struct{}
+	InstrThrow  struct {
+		Rethrow bool // the value is being thrown again by a finally, the error keeps the position it was first thrown at
+	}
+	InstrUnwind struct {
+		Offset int
+	}
+
+	InstrResult struct {
+		Ok bool
+	}
+	InstrIsOk     struct{}
+	InstrUnwrap   struct{}
+	InstrUnwrapOr struct{}
+
+	InstrClosure struct {
+		Captures []Capture
+	}
+	InstrLoadUpvalue struct {
+		Index int
+	}
+	InstrStoreUpvalue struct {
+		Index int
+	}
 )
 
-func (*InstrPrint) Op() Op       { return OpAdd }
+// Capture tells where an upvalue of a new closure comes from.
+type Capture struct {
+	IsLocal bool // a local of the current frame, or else an upvalue of the current closure
+	Index   int  // offset of the local or index of the upvalue
+}
+
+func (*InstrPrint) Op() Op       { return OpPrint }
 func (*InstrAdd) Op() Op         { return OpAdd }
 func (*InstrSub) Op() Op         { return OpSub }
 func (*InstrMul) Op() Op         { return OpMul }
 func (*InstrDiv) Op() Op         { return OpDiv }
 func (*InstrMod) Op() Op         { return OpMod }
 func (*InstrNeg) Op() Op         { return OpNeg }
+func (*InstrBitAnd) Op() Op      { return OpBitAnd }
+func (*InstrBitOr) Op() Op       { return OpBitOr }
+func (*InstrXor) Op() Op         { return OpXor }
+func (*InstrShl) Op() Op         { return OpShl }
+func (*InstrShr) Op() Op         { return OpShr }
+func (*InstrBitNot) Op() Op      { return OpBitNot }
 func (*InstrEq) Op() Op          { return OpEq }
 func (*InstrNE) Op() Op          { return OpNE }
 func (*InstrGT) Op() Op          { return OpGT }
@@ -126,23 +253,58 @@ func (*InstrAnd) Op() Op         { return OpAnd }
 func (*InstrOr) Op() Op          { return OpOr }
 func (*InstrJmp) Op() Op         { return OpJmp }
 func (*InstrJF) Op() Op          { return OpJF }
+func (*InstrJmpTable) Op() Op    { return OpJmpTable }
+func (*InstrCase) Op() Op        { return OpCase }
 func (*InstrCall) Op() Op        { return OpCall }
+func (*InstrArgs) Op() Op        { return OpArgs }
 func (*InstrRet) Op() Op         { return OpRet }
 func (*InstrPush) Op() Op        { return OpPush }
 func (*InstrDup) Op() Op         { return OpDup }
+func (*InstrPop) Op() Op         { return OpPop }
 func (*InstrLoad) Op() Op        { return OpLoad }
 func (*InstrStore) Op() Op       { return OpStore }
-func (*InstrLoadPtr) Op() Op     { return OpLoadPtr }
+func (*InstrNewArray) Op() Op    { return OpNewArray }
 func (*InstrLoadFromPtr) Op() Op { return OpLoadFromPtr }
 func (*InstrStoreToPtr) Op() Op  { return OpStoreToPtr }
+func (*InstrLen) Op() Op         { return OpLen }
+func (*InstrIsType) Op() Op      { return OpIsType }
+func (*InstrNewStruct) Op() Op   { return OpNewStruct }
+func (*InstrGetField) Op() Op    { return OpGetField }
+func (*InstrSetField) Op() Op    { return OpSetField }
+func (*InstrNewMap) Op() Op      { return OpNewMap }
+func (*InstrIndex) Op() Op       { return OpIndex }
+func (*InstrSetIndex) Op() Op    { return OpSetIndex }
+func (*InstrDelete) Op() Op      { return OpDelete }
+func (*InstrEntry) Op() Op       { return OpEntry }
+func (*InstrIter) Op() Op        { return OpIter }
+func (*InstrNext) Op() Op        { return OpNext }
+func (*InstrHeight) Op() Op      { return OpHeight }
+func (*InstrThrow) Op() Op       { return OpThrow }
+func (*InstrUnwind) Op() Op      { return OpUnwind }
+
+func (*InstrResult) Op() Op   { return OpResult }
+func (*InstrIsOk) Op() Op     { return OpIsOk }
+func (*InstrUnwrap) Op() Op   { return OpUnwrap }
+func (*InstrUnwrapOr) Op() Op { return OpUnwrapOr }
+
+func (*InstrClosure) Op() Op      { return OpClosure }
+func (*InstrLoadUpvalue) Op() Op  { return OpLoadUpvalue }
+func (*InstrStoreUpvalue) Op() Op { return OpStoreUpvalue }
 
 func init() {
+	gob.RegisterName("sometimes/vm.InstrPrint", &InstrPrint{})
 	gob.RegisterName("sometimes/vm.InstrAdd", &InstrAdd{})
 	gob.RegisterName("sometimes/vm.InstrSub", &InstrSub{})
 	gob.RegisterName("sometimes/vm.InstrMul", &InstrMul{})
 	gob.RegisterName("sometimes/vm.InstrDiv", &InstrDiv{})
 	gob.RegisterName("sometimes/vm.InstrMod", &InstrMod{})
 	gob.RegisterName("sometimes/vm.InstrNeg", &InstrNeg{})
+	gob.RegisterName("sometimes/vm.InstrBitAnd", &InstrBitAnd{})
+	gob.RegisterName("sometimes/vm.InstrBitOr", &InstrBitOr{})
+	gob.RegisterName("sometimes/vm.InstrXor", &InstrXor{})
+	gob.RegisterName("sometimes/vm.InstrShl", &InstrShl{})
+	gob.RegisterName("sometimes/vm.InstrShr", &InstrShr{})
+	gob.RegisterName("sometimes/vm.InstrBitNot", &InstrBitNot{})
 	gob.RegisterName("sometimes/vm.InstrEq", &InstrEq{})
 	gob.RegisterName("sometimes/vm.InstrNE", &InstrNE{})
 	gob.RegisterName("sometimes/vm.InstrGT", &InstrGT{})
@@ -154,13 +316,39 @@ func init() {
 	gob.RegisterName("sometimes/vm.InstrOr", &InstrOr{})
 	gob.RegisterName("sometimes/vm.InstrJmp", &InstrJmp{})
 	gob.RegisterName("sometimes/vm.InstrJF", &InstrJF{})
+	gob.RegisterName("sometimes/vm.InstrJmpTable", &InstrJmpTable{})
+	gob.RegisterName("sometimes/vm.InstrCase", &InstrCase{})
 	gob.RegisterName("sometimes/vm.InstrCall", &InstrCall{})
 	gob.RegisterName("sometimes/vm.InstrRet", &InstrRet{})
 	gob.RegisterName("sometimes/vm.InstrPush", &InstrPush{})
 	gob.RegisterName("sometimes/vm.InstrDup", &InstrDup{})
+	gob.RegisterName("sometimes/vm.InstrPop", &InstrPop{})
 	gob.RegisterName("sometimes/vm.InstrLoad", &InstrLoad{})
 	gob.RegisterName("sometimes/vm.InstrStore", &InstrStore{})
-	gob.RegisterName("sometimes/vm.InstrLoadPtr", &InstrLoadPtr{})
+	gob.RegisterName("sometimes/vm.InstrNewArray", &InstrNewArray{})
 	gob.RegisterName("sometimes/vm.InstrLoadFromPtr", &InstrLoadFromPtr{})
 	gob.RegisterName("sometimes/vm.InstrStoreToPtr", &InstrStoreToPtr{})
+	gob.RegisterName("sometimes/vm.InstrLen", &InstrLen{})
+	gob.RegisterName("sometimes/vm.InstrIsType", &InstrIsType{})
+	gob.RegisterName("sometimes/vm.InstrNewStruct", &InstrNewStruct{})
+	gob.RegisterName("sometimes/vm.InstrGetField", &InstrGetField{})
+	gob.RegisterName("sometimes/vm.InstrSetField", &InstrSetField{})
+	gob.RegisterName("sometimes/vm.InstrNewMap", &InstrNewMap{})
+	gob.RegisterName("sometimes/vm.InstrIndex", &InstrIndex{})
+	gob.RegisterName("sometimes/vm.InstrSetIndex", &InstrSetIndex{})
+	gob.RegisterName("sometimes/vm.InstrDelete", &InstrDelete{})
+	gob.RegisterName("sometimes/vm.InstrEntry", &InstrEntry{})
+	gob.RegisterName("sometimes/vm.InstrIter", &InstrIter{})
+	gob.RegisterName("sometimes/vm.InstrNext", &InstrNext{})
+	gob.RegisterName("sometimes/vm.InstrHeight", &InstrHeight{})
+	gob.RegisterName("sometimes/vm.InstrThrow", &InstrThrow{})
+	gob.RegisterName("sometimes/vm.InstrArgs", &InstrArgs{})
+	gob.RegisterName("sometimes/vm.InstrUnwind", &InstrUnwind{})
+	gob.RegisterName("sometimes/vm.InstrResult", &InstrResult{})
+	gob.RegisterName("sometimes/vm.InstrIsOk", &InstrIsOk{})
+	gob.RegisterName("sometimes/vm.InstrUnwrap", &InstrUnwrap{})
+	gob.RegisterName("sometimes/vm.InstrUnwrapOr", &InstrUnwrapOr{})
+	gob.RegisterName("sometimes/vm.InstrClosure", &InstrClosure{})
+	gob.RegisterName("sometimes/vm.InstrLoadUpvalue", &InstrLoadUpvalue{})
+	gob.RegisterName("sometimes/vm.InstrStoreUpvalue", &InstrStoreUpvalue{})
 }
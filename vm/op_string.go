@@ -15,39 +15,72 @@ func _() {
 	_ = x[OpDiv-4]
 	_ = x[OpMod-5]
 	_ = x[OpNeg-6]
-	_ = x[op_arith_end-7]
-	_ = x[op_logic_start-8]
-	_ = x[OpEq-9]
-	_ = x[OpNE-10]
-	_ = x[OpGT-11]
-	_ = x[OpLT-12]
-	_ = x[OpGTE-13]
-	_ = x[OpLTE-14]
-	_ = x[OpNot-15]
-	_ = x[OpAnd-16]
-	_ = x[OpOr-17]
-	_ = x[op_logic_end-18]
-	_ = x[OpPrint-19]
-	_ = x[OpJmp-20]
-	_ = x[OpJF-21]
-	_ = x[OpCall-22]
-	_ = x[OpRet-23]
-	_ = x[OpPush-24]
-	_ = x[OpDup-25]
-	_ = x[OpLoad-26]
-	_ = x[OpStore-27]
-	_ = x[OpLoadPtr-28]
-	_ = x[OpLoadFromPtr-29]
-	_ = x[OpStoreToPtr-30]
+	_ = x[OpBitAnd-7]
+	_ = x[OpBitOr-8]
+	_ = x[OpXor-9]
+	_ = x[OpShl-10]
+	_ = x[OpShr-11]
+	_ = x[OpBitNot-12]
+	_ = x[op_arith_end-13]
+	_ = x[op_logic_start-14]
+	_ = x[OpEq-15]
+	_ = x[OpNE-16]
+	_ = x[OpGT-17]
+	_ = x[OpLT-18]
+	_ = x[OpGTE-19]
+	_ = x[OpLTE-20]
+	_ = x[OpNot-21]
+	_ = x[OpAnd-22]
+	_ = x[OpOr-23]
+	_ = x[op_logic_end-24]
+	_ = x[OpPrint-25]
+	_ = x[OpJmp-26]
+	_ = x[OpJF-27]
+	_ = x[OpJmpTable-28]
+	_ = x[OpCase-29]
+	_ = x[OpCall-30]
+	_ = x[OpRet-31]
+	_ = x[OpArgs-32]
+	_ = x[OpPush-33]
+	_ = x[OpDup-34]
+	_ = x[OpPop-35]
+	_ = x[OpLoad-36]
+	_ = x[OpStore-37]
+	_ = x[OpNewArray-38]
+	_ = x[OpLoadFromPtr-39]
+	_ = x[OpStoreToPtr-40]
+	_ = x[OpLen-41]
+	_ = x[OpIsType-42]
+	_ = x[OpNewStruct-43]
+	_ = x[OpGetField-44]
+	_ = x[OpSetField-45]
+	_ = x[OpNewMap-46]
+	_ = x[OpIndex-47]
+	_ = x[OpSetIndex-48]
+	_ = x[OpDelete-49]
+	_ = x[OpEntry-50]
+	_ = x[OpIter-51]
+	_ = x[OpNext-52]
+	_ = x[OpHeight-53]
+	_ = x[OpThrow-54]
+	_ = x[OpUnwind-55]
+	_ = x[OpResult-56]
+	_ = x[OpIsOk-57]
+	_ = x[OpUnwrap-58]
+	_ = x[OpUnwrapOr-59]
+	_ = x[OpClosure-60]
+	_ = x[OpLoadUpvalue-61]
+	_ = x[OpStoreUpvalue-62]
 }
 
-const _Op_name = "op_arith_startAddSubMulDivModNegop_arith_endop_logic_startEqNEGTLTGTELTENotAndOrop_logic_endPrintJmpJFCallRetPushDupLoadStoreLoadPtrLoadFromPtrStoreToPtr"
+const _Op_name = "op_arith_startAddSubMulDivModNegBitAndBitOrXorShlShrBitNotop_arith_endop_logic_startEqNEGTLTGTELTENotAndOrop_logic_endPrintJmpJFJmpTableCaseCallRetArgsPushDupPopLoadStoreNewArrayLoadFromPtrStoreToPtrLenIsTypeNewStructGetFieldSetFieldNewMapIndexSetIndexDeleteEntryIterNextHeightThrowUnwindResultIsOkUnwrapUnwrapOrClosureLoadUpvalueStoreUpvalue"
 
-var _Op_index = [...]uint8{0, 14, 17, 20, 23, 26, 29, 32, 44, 58, 60, 62, 64, 66, 69, 72, 75, 78, 80, 92, 97, 100, 102, 106, 109, 113, 116, 120, 125, 132, 143, 153}
+var _Op_index = [...]uint16{0, 14, 17, 20, 23, 26, 29, 32, 38, 43, 46, 49, 52, 58, 70, 84, 86, 88, 90, 92, 95, 98, 101, 104, 106, 118, 123, 126, 128, 136, 140, 144, 147, 151, 155, 158, 161, 165, 170, 178, 189, 199, 202, 208, 217, 225, 233, 239, 244, 252, 258, 263, 267, 271, 277, 282, 288, 294, 298, 304, 312, 319, 330, 342}
 
 func (i Op) String() string {
-	if i >= Op(len(_Op_index)-1) {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_Op_index)-1 {
 		return "Op(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _Op_name[_Op_index[i]:_Op_index[i+1]]
+	return _Op_name[_Op_index[idx]:_Op_index[idx+1]]
 }
@@ -1,14 +1,13 @@
 package vm
 
 import (
-	"fmt"
 	"math"
 	"sometimes/vm/value"
 )
 
 type arithOperator struct {
 	intFunc   func(int, int) int
-	floatFunc func(float64, float64) float64
+	floatFunc func(float64, float64) float64 // nil if the operator takes only ints
 }
 
 var arithOperators = []arithOperator{
@@ -18,6 +17,13 @@ var arithOperators = []arithOperator{
 	OpDiv - op_arith_start: {intFunc: _idiv, floatFunc: _fdiv},
 	OpMod - op_arith_start: {intFunc: _imod, floatFunc: _fmod},
 	OpNeg - op_arith_start: {intFunc: _ineg, floatFunc: _fneg},
+
+	OpBitAnd - op_arith_start: {intFunc: _iand},
+	OpBitOr - op_arith_start:  {intFunc: _ior},
+	OpXor - op_arith_start:    {intFunc: _ixor},
+	OpShl - op_arith_start:    {intFunc: _ishl},
+	OpShr - op_arith_start:    {intFunc: _ishr},
+	OpBitNot - op_arith_start: {intFunc: _inot},
 }
 
 type ArithInstruction interface {
@@ -50,29 +56,54 @@ func (*InstrDiv) isBinaryArith() {}
 func (*InstrMod) isBinaryArith() {}
 func (*InstrNeg) isUnaryArith()  {}
 
+func (*InstrBitAnd) isArith() {}
+func (*InstrBitOr) isArith()  {}
+func (*InstrXor) isArith()    {}
+func (*InstrShl) isArith()    {}
+func (*InstrShr) isArith()    {}
+func (*InstrBitNot) isArith() {}
+
+func (*InstrBitAnd) isBinaryArith() {}
+func (*InstrBitOr) isBinaryArith()  {}
+func (*InstrXor) isBinaryArith()    {}
+func (*InstrShl) isBinaryArith()    {}
+func (*InstrShr) isBinaryArith()    {}
+func (*InstrBitNot) isUnaryArith()  {}
+
 func arith(op ArithInstruction, x, y value.Value) value.Value {
 	if ptr, xIsPtr := x.(*value.Pointer); xIsPtr {
 		if offset, yIsInt := y.(*value.Int); yIsInt {
 			switch op.Op() {
 			case OpAdd:
-				ptr.Addr += offset.Val
-				return ptr
+				return &value.Pointer{Elems: ptr.Elems, Addr: ptr.Addr + offset.Val}
 			case OpSub:
-				ptr.Addr -= offset.Val
-				return ptr
+				return &value.Pointer{Elems: ptr.Elems, Addr: ptr.Addr - offset.Val}
 			}
 		}
 		panic(unsupportedOperandError(op.Op(), x, y))
 	}
 
+	if _, isUnary := op.(UnaryArithInstruction); isUnary {
+		// y of a unary operator is unused, the operand is checked twice instead
+		y = x
+	}
+
+	f := arithOperators[op.Op()-op_arith_start]
+	if f.floatFunc == nil {
+		a, xIsInt := x.(*value.Int)
+		b, yIsInt := y.(*value.Int)
+		if !(xIsInt && yIsInt) {
+			panic(intOperandError(op, x, y))
+		}
+		return &value.Int{Val: f.intFunc(a.Val, b.Val)}
+	}
+
 	_, xIsNumber := x.(value.NumberValue)
 	_, yIsNumber := y.(value.NumberValue)
 	if !(xIsNumber && yIsNumber) {
 		panic(unsupportedOperandError(op.Op(), x, y))
 	}
 
-	f := arithOperators[op.Op()-op_arith_start]
-
 	switch a := x.(type) {
 	case (*value.Int):
 		switch b := y.(type) {
@@ -103,16 +134,54 @@ func _fsub(x, y float64) float64 { return x - y }
 func _imul(x, y int) int         { return x * y }
 func _fmul(x, y float64) float64 { return x * y }
 
-func _idiv(x, y int) int         { return x / y }
+func _idiv(x, y int) int {
+	if y == 0 {
+		panic(fault(value.KindArithError, "integer divide by zero"))
+	}
+	return x / y
+}
+
 func _fdiv(x, y float64) float64 { return x / y }
 
-func _imod(x, y int) int { return x % y }
+func _imod(x, y int) int {
+	if y == 0 {
+		panic(fault(value.KindArithError, "integer divide by zero"))
+	}
+	return x % y
+}
 
 var _fmod = math.Mod
 
 func _ineg(x, _ int) int         { return -x }
 func _fneg(x, _ float64) float64 { return -x }
 
+func _iand(x, y int) int { return x & y }
+func _ior(x, y int) int  { return x | y }
+func _ixor(x, y int) int { return x ^ y }
+func _inot(x, _ int) int { return ^x }
+
+func _ishl(x, y int) int {
+	if y < 0 {
+		panic(fault(value.KindArithError, "negative shift count %d", y))
+	}
+	return x << y
+}
+
+func _ishr(x, y int) int {
+	if y < 0 {
+		panic(fault(value.KindArithError, "negative shift count %d", y))
+	}
+	return x >> y
+}
+
+func intOperandError(op ArithInstruction, x, y value.Value) *value.Error {
+	if _, isUnary := op.(UnaryArithInstruction); isUnary {
+		return fault(value.KindTypeError, "`%s` requires an `Int` operand: `%s`", op.Op().String(), x.Type().String())
+	}
+	return fault(value.KindTypeError, "`%s` requires `Int` operands: lhs: `%s` rhs: `%s`",
+		op.Op().String(), x.Type().String(), y.Type().String())
+}
+
 var logicOperators = []func(x, y value.Value) bool{
 	OpEq - op_logic_start:  _eq,
 	OpNE - op_logic_start:  _ne,
@@ -167,43 +236,74 @@ func logic(op LogicInstruction, x, y value.Value) bool {
 }
 
 func _eq(x, y value.Value) bool {
+	eq, ok := equal(x, y)
+	if !ok {
+		panic(unsupportedOperandError(OpEq, x, y))
+	}
+	return eq
+}
+
+// equal reports whether x == y, ok is false if values of their types cannot be compared.
+func equal(x, y value.Value) (eq, ok bool) {
 	switch a := x.(type) {
 	case (*value.Int):
 		switch b := y.(type) {
 		case (*value.Int):
-			return a.Val == b.Val
+			return a.Val == b.Val, true
 		case (*value.Float):
-			return float64(a.Val) == b.Val
+			return float64(a.Val) == b.Val, true
 		case (*value.Char):
-			return a.Val == int(b.Val)
+			return a.Val == int(b.Val), true
 		}
 	case (*value.Float):
 		switch b := y.(type) {
 		case (*value.Int):
-			return a.Val == float64(b.Val)
+			return a.Val == float64(b.Val), true
 		case (*value.Float):
-			return a.Val == b.Val
+			return a.Val == b.Val, true
 		case (*value.Char):
-			return a.Val == float64(b.Val)
+			return a.Val == float64(b.Val), true
 		}
 	case (*value.Char):
 		switch b := y.(type) {
 		case (*value.Int):
-			return int(a.Val) == b.Val
+			return int(a.Val) == b.Val, true
 		case (*value.Float):
-			return float64(a.Val) == b.Val
+			return float64(a.Val) == b.Val, true
 		case (*value.Char):
-			return a.Val == b.Val
+			return a.Val == b.Val, true
 		}
 	case (*value.Boolean):
 		if b, ok := y.(*value.Boolean); ok {
-			return a.Val == b.Val
+			return a.Val == b.Val, true
+		}
+	case (*value.String):
+		if b, ok := y.(*value.String); ok {
+			return a.Val == b.Val, true
 		}
 	case (*value.Nil):
 		_, ok := y.(*value.Nil)
-		return ok
+		return ok, true
+	case (*value.Struct):
+		// structs are equal only if they are the same struct
+		if b, ok := y.(*value.Struct); ok {
+			return a == b, true
+		}
+	case (*value.Map):
+		// so are maps
+		if b, ok := y.(*value.Map); ok {
+			return a == b, true
+		}
+	case (*value.Result):
+		// results are equal if both are ok or both are err, and their values are equal
+		if b, ok := y.(*value.Result); ok {
+			if a.Ok != b.Ok {
+				return false, true
+			}
+			return equal(a.Val, b.Val)
+		}
 	}
-	panic(unsupportedOperandError(OpEq, x, y))
+	return false, false
 }
 
 func _ne(x, y value.Value) bool {
@@ -346,7 +446,7 @@ func _not(x, _ value.Value) bool {
 	if a, ok := x.(*value.Boolean); ok {
 		return !a.Val
 	}
-	panic(unsupportedOperandError(OpEq, x, &value.Nil{}))
+	panic(unsupportedOperandError(OpNot, x, &value.Nil{}))
 }
 
 func _and(x, y value.Value) bool {
@@ -361,13 +461,13 @@ func _and(x, y value.Value) bool {
 func _or(x, y value.Value) bool {
 	if a, xIsBool := x.(*value.Boolean); xIsBool {
 		if b, bIsBool := y.(*value.Boolean); bIsBool {
-			return a.Val && b.Val
+			return a.Val || b.Val
 		}
 	}
 	panic(unsupportedOperandError(OpOr, x, y))
 }
 
-func unsupportedOperandError(op Op, lhs, rhs value.Value) error {
-	panic(fmt.Errorf("unsupported operand type for `%s`: lhs: `%s` rhs: `%s`",
-		op.String(), lhs.Type().String(), rhs.Type().String()))
+func unsupportedOperandError(op Op, lhs, rhs value.Value) *value.Error {
+	return fault(value.KindTypeError, "unsupported operand type for `%s`: lhs: `%s` rhs: `%s`",
+		op.String(), lhs.Type().String(), rhs.Type().String())
 }
@@ -5,16 +5,28 @@ import (
 	"fmt"
 	"io"
 	"sometimes/hir"
+	"sometimes/token"
 	"sometimes/vm/assembly"
 	"sometimes/vm/value"
 )
 
 type Program struct {
 	Instructions []Instruction
+	Positions    []token.Pos // source position of each instruction; token.NoPos if unknown
 	Consts       []value.Value
+	Handlers     []Handler // the handlers of inner try blocks come first
 	Entry        Ptr
 }
 
+// Handler catches the values thrown by the instructions in [Start, End) of the function at Func.
+// The instructions of a closure between Start and End belong to another function, so they are not covered.
+type Handler struct {
+	Func       Ptr
+	Start, End Ptr
+	Target     Ptr // the handler is entered with the thrown value pushed
+	Height     int // offset of the local which holds the height of the operand stack to unwind to
+}
+
 func NewProgramFromBinary(r io.Reader) *Program {
 	dec := gob.NewDecoder(r)
 	var p Program
@@ -40,6 +52,18 @@ func NewProgramFromAsm(asm *assembly.AssemblyProgram) *Program {
 			instrs[i] = &InstrMod{}
 		case *assembly.AssemblyInstrNeg:
 			instrs[i] = &InstrNeg{}
+		case *assembly.AssemblyInstrBitAnd:
+			instrs[i] = &InstrBitAnd{}
+		case *assembly.AssemblyInstrBitOr:
+			instrs[i] = &InstrBitOr{}
+		case *assembly.AssemblyInstrXor:
+			instrs[i] = &InstrXor{}
+		case *assembly.AssemblyInstrShl:
+			instrs[i] = &InstrShl{}
+		case *assembly.AssemblyInstrShr:
+			instrs[i] = &InstrShr{}
+		case *assembly.AssemblyInstrBitNot:
+			instrs[i] = &InstrBitNot{}
 		case *assembly.AssemblyInstrEq:
 			instrs[i] = &InstrEq{}
 		case *assembly.AssemblyInstrNE:
@@ -62,10 +86,24 @@ func NewProgramFromAsm(asm *assembly.AssemblyProgram) *Program {
 			instrs[i] = &InstrJmp{Addr: getAsmLabelAddr(asm, asmInstr.Label)}
 		case *assembly.AssemblyInstrJF:
 			instrs[i] = &InstrJF{Addr: getAsmLabelAddr(asm, asmInstr.Label)}
+		case *assembly.AssemblyInstrJmpTable:
+			addrs := make([]Ptr, len(asmInstr.Labels))
+			for j, label := range asmInstr.Labels {
+				addrs[j] = getAsmLabelAddr(asm, label)
+			}
+			instrs[i] = &InstrJmpTable{
+				Min:     asmInstr.Min,
+				Addrs:   addrs,
+				Default: getAsmLabelAddr(asm, asmInstr.Default),
+			}
+		case *assembly.AssemblyInstrCase:
+			instrs[i] = &InstrCase{Addr: getAsmLabelAddr(asm, asmInstr.Label)}
 		case *assembly.AssemblyInstrCall:
-			instrs[i] = &InstrCall{}
+			instrs[i] = &InstrCall{Rets: asmInstr.Rets, Args: asmInstr.Args}
+		case *assembly.AssemblyInstrArgs:
+			instrs[i] = &InstrArgs{}
 		case *assembly.AssemblyInstrRet:
-			instrs[i] = &InstrRet{}
+			instrs[i] = &InstrRet{Count: asmInstr.Count}
 		case *assembly.AssemblyInstrPush:
 			instrs[i] = &InstrPush{int(asmInstr.DataID)}
 		case *assembly.AssemblyInstrLoad:
@@ -74,17 +112,64 @@ func NewProgramFromAsm(asm *assembly.AssemblyProgram) *Program {
 			instrs[i] = &InstrStore{Offset: asmInstr.Offset}
 		case *assembly.AssemblyInstrDup:
 			instrs[i] = &InstrDup{}
+		case *assembly.AssemblyInstrPop:
+			instrs[i] = &InstrPop{}
 		case *assembly.AssemblyInstrLoadFromPtr:
 			instrs[i] = &InstrLoadFromPtr{}
-		case *assembly.AssemblyInstrLoadPtr:
-			instrs[i] = &InstrLoadPtr{
-				Offset:  asmInstr.Offset,
-				IsLocal: asmInstr.IsLocal,
-			}
+		case *assembly.AssemblyInstrNewArray:
+			instrs[i] = &InstrNewArray{Len: asmInstr.Len}
 		case *assembly.AssemblyInstrStoreToPtr:
 			instrs[i] = &InstrStoreToPtr{}
+		case *assembly.AssemblyInstrLen:
+			instrs[i] = &InstrLen{}
+		case *assembly.AssemblyInstrIsType:
+			instrs[i] = &InstrIsType{Type: asmInstr.Type, Struct: asmInstr.Struct}
 		case *assembly.AssemblyInstrPrint:
 			instrs[i] = &InstrPrint{ArgLen: asmInstr.ArgLen}
+		case *assembly.AssemblyInstrNewStruct:
+			instrs[i] = &InstrNewStruct{Name: asmInstr.Name, Fields: asmInstr.Fields}
+		case *assembly.AssemblyInstrGetField:
+			instrs[i] = &InstrGetField{Name: asmInstr.Name}
+		case *assembly.AssemblyInstrSetField:
+			instrs[i] = &InstrSetField{Name: asmInstr.Name}
+		case *assembly.AssemblyInstrNewMap:
+			instrs[i] = &InstrNewMap{Len: asmInstr.Len}
+		case *assembly.AssemblyInstrIndex:
+			instrs[i] = &InstrIndex{}
+		case *assembly.AssemblyInstrSetIndex:
+			instrs[i] = &InstrSetIndex{}
+		case *assembly.AssemblyInstrDelete:
+			instrs[i] = &InstrDelete{}
+		case *assembly.AssemblyInstrEntry:
+			instrs[i] = &InstrEntry{Key: asmInstr.Key}
+		case *assembly.AssemblyInstrIter:
+			instrs[i] = &InstrIter{}
+		case *assembly.AssemblyInstrNext:
+			instrs[i] = &InstrNext{}
+		case *assembly.AssemblyInstrHeight:
+			instrs[i] = &InstrHeight{}
+		case *assembly.AssemblyInstrThrow:
+			instrs[i] = &InstrThrow{Rethrow: asmInstr.Rethrow}
+		case *assembly.AssemblyInstrUnwind:
+			instrs[i] = &InstrUnwind{Offset: asmInstr.Offset}
+		case *assembly.AssemblyInstrResult:
+			instrs[i] = &InstrResult{Ok: asmInstr.Ok}
+		case *assembly.AssemblyInstrIsOk:
+			instrs[i] = &InstrIsOk{}
+		case *assembly.AssemblyInstrUnwrap:
+			instrs[i] = &InstrUnwrap{}
+		case *assembly.AssemblyInstrUnwrapOr:
+			instrs[i] = &InstrUnwrapOr{}
+		case *assembly.AssemblyInstrClosure:
+			captures := make([]Capture, len(asmInstr.Captures))
+			for j, c := range asmInstr.Captures {
+				captures[j] = Capture{IsLocal: c.IsLocal, Index: c.Index}
+			}
+			instrs[i] = &InstrClosure{Captures: captures}
+		case *assembly.AssemblyInstrLoadUpvalue:
+			instrs[i] = &InstrLoadUpvalue{Index: asmInstr.Index}
+		case *assembly.AssemblyInstrStoreUpvalue:
+			instrs[i] = &InstrStoreUpvalue{Index: asmInstr.Index}
 		}
 	}
 
@@ -94,14 +179,29 @@ func NewProgramFromAsm(asm *assembly.AssemblyProgram) *Program {
 			consts[id] = &value.Func{
 				Addr:      getAsmLabelAddr(asm, f.FuncName),
 				MaxLocals: f.MaxLoacls,
+				Params:    f.Params,
+				Required:  f.Required,
+				Variadic:  f.Variadic,
 			}
 		} else {
 			consts[id] = hirValueToVmValue(v)
 		}
 	}
+	handlers := make([]Handler, len(asm.Handlers))
+	for i, h := range asm.Handlers {
+		handlers[i] = Handler{
+			Func:   getAsmLabelAddr(asm, h.Func),
+			Start:  h.Start,
+			End:    h.End,
+			Target: getAsmLabelAddr(asm, h.Target),
+			Height: h.Height,
+		}
+	}
 	return &Program{
 		Instructions: instrs,
+		Positions:    asm.Positions,
 		Consts:       consts,
+		Handlers:     handlers,
 		Entry:        0,
 	}
 }
@@ -122,6 +222,24 @@ func (p *Program) FetchInstruction(addr Ptr) (ins Instruction, exist bool) {
 	return
 }
 
+// Pos returns the source position of the instruction at addr.
+func (p *Program) Pos(addr Ptr) token.Pos {
+	if addr >= 0 && addr < len(p.Positions) {
+		return p.Positions[addr]
+	}
+	return token.NoPos
+}
+
+// Handler returns the handler of the innermost try which encloses the instruction at addr of the function at fn.
+func (p *Program) Handler(fn, addr Ptr) (*Handler, bool) {
+	for i := range p.Handlers {
+		if h := &p.Handlers[i]; h.Func == fn && h.Start <= addr && addr < h.End {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
 func (p *Program) GetConst(dataId int) (val value.Value, exist bool) {
 	if len(p.Consts) > dataId {
 		val, exist = p.Consts[dataId], true
@@ -148,10 +266,18 @@ func hirValueToVmValue(hirVal hir.Value) value.Value {
 	case *hir.ValueBoolean:
 		return &value.Boolean{Val: hv.Val}
 	case *hir.ValueString:
-		// todo vm value unsupport string
-		return &value.Char{Val: rune(hv.Val[0])}
+		return &value.String{Val: hv.Val}
+	case *hir.ValueChar:
+		return &value.Char{Val: hv.Val}
 	case *hir.ValueNil:
 		return &value.Nil{}
+	case *hir.ValueMap:
+		m := value.NewMap(len(hv.Keys))
+		for i, k := range hv.Keys {
+			// the visitor allows only hashable keys
+			m.Set(hirValueToVmValue(k).(value.Hashable), hirValueToVmValue(hv.Vals[i]))
+		}
+		return m
 	}
 	return &value.Nil{}
 }
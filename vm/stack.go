@@ -5,7 +5,11 @@ import (
 	"sometimes/vm/value"
 )
 
-var StackOverflow = errors.New("stack overflow")
+var (
+	StackOverflow = errors.New("stack overflow")
+	// StackUnderflow is a bug of the vm, unlike StackOverflow it is not turned into an exception.
+	StackUnderflow = errors.New("stack underflow")
+)
 
 type OperandStack struct {
 	inner []value.Value
@@ -46,20 +50,28 @@ func (s *OperandStack) Pop() value.Value {
 // or panic if it is empty.
 func (s *OperandStack) PopN(n int) value.Value {
 	if s.top < n {
-		panic(StackOverflow)
+		panic(StackUnderflow)
 	}
 	// 考虑缩容问题
 	s.top -= n
 	return s.inner[s.top]
 }
 
+// Truncate removes the elements above the first n.
+func (s *OperandStack) Truncate(n int) {
+	for i := n; i < s.top; i++ {
+		s.inner[i] = nil
+	}
+	s.top = n
+}
+
 func (s *OperandStack) IsEmpty() bool {
 	return s.top == 0
 }
 
 func (s *OperandStack) Get(idx int) value.Value {
-	if idx < 0 && idx >= s.top {
-		panic(StackOverflow)
+	if idx < 0 || idx >= s.top {
+		panic(StackUnderflow)
 	}
 	return s.inner[idx]
 }
@@ -0,0 +1,43 @@
+package value
+
+// Kinds of the errors raised by the vm for runtime faults.
+const (
+	KindTypeError     = "TypeError"       // an operand, a condition or a callee of an unexpected type
+	KindKeyError      = "KeyError"        // an unhashable map key
+	KindIndexError    = "IndexError"      // an index out of the range of an array
+	KindFieldError    = "FieldError"      // an access to a field a struct does not have
+	KindArityError    = "ArityError"      // a function which returns an unexpected number of values
+	KindArithError    = "ArithmeticError" // an integer division by zero or a negative shift count
+	KindUnwrapError   = "UnwrapError"     // an unwrap of an err
+	KindStackOverflow = "StackOverflow"
+)
+
+// Error is the value thrown for a runtime fault, a program reads its fields `kind` and `message`.
+type Error struct {
+	Kind string
+	Msg  string
+}
+
+func (*Error) Type() Type { return TypeError }
+
+func (x *Error) Clone() Value { return x }
+
+func (x *Error) String() string {
+	return x.Kind + ": " + x.Msg
+}
+
+// Error returns the message, so an Error is also a Go error.
+func (x *Error) Error() string {
+	return x.Msg
+}
+
+// Field returns the value of the field, ok is false if the name is neither kind nor message.
+func (x *Error) Field(name string) (v Value, ok bool) {
+	switch name {
+	case "kind":
+		return &String{Val: x.Kind}, true
+	case "message":
+		return &String{Val: x.Msg}, true
+	}
+	return nil, false
+}
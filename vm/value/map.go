@@ -0,0 +1,190 @@
+package value
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Hashable is implemented by the values which can be keys of a Map.
+type Hashable interface {
+	Value
+	HashKey() HashKey
+}
+
+// HashKey identifies a key of a Map.
+// Two keys are the same if they have the same type and equal values, so 1, 1.0 and '\x01' are different keys.
+type HashKey struct {
+	Type  Type
+	Int   int // value of an Int, a Char or a Boolean
+	Float float64
+	Str   string
+}
+
+func (x *Int) HashKey() HashKey    { return HashKey{Type: TypeInt, Int: x.Val} }
+func (x *Float) HashKey() HashKey  { return HashKey{Type: TypeFloat, Float: x.Val} }
+func (x *Char) HashKey() HashKey   { return HashKey{Type: TypeChar, Int: int(x.Val)} }
+func (x *String) HashKey() HashKey { return HashKey{Type: TypeString, Str: x.Val} }
+func (x *Nil) HashKey() HashKey    { return HashKey{Type: TypeNil} }
+func (x *Boolean) HashKey() HashKey {
+	k := HashKey{Type: TypeBoolean}
+	if x.Val {
+		k.Int = 1
+	}
+	return k
+}
+
+// UnhashableError is the error of using a value which is not Hashable as a key of a Map.
+type UnhashableError struct {
+	Type Type
+}
+
+func (e *UnhashableError) Error() string {
+	return fmt.Sprintf("unhashable map key `%s`", e.Type)
+}
+
+// ToHashable returns v as a key of a Map, or an *UnhashableError.
+func ToHashable(v Value) (Hashable, error) {
+	if k, ok := v.(Hashable); ok {
+		return k, nil
+	}
+	return nil, &UnhashableError{Type: v.Type()}
+}
+
+// Map is allocated on the heap like Struct, copies of a Map value refer to the same entries.
+// The entries are kept in insertion order, deleting an entry moves the entries after it.
+type Map struct {
+	Keys  []Value
+	Vals  []Value
+	index map[HashKey]int // index of the entry of each key, built on the first lookup after decoding
+}
+
+// NewMap returns an empty map with room for n entries.
+func NewMap(n int) *Map {
+	return &Map{
+		Keys:  make([]Value, 0, n),
+		Vals:  make([]Value, 0, n),
+		index: make(map[HashKey]int, n),
+	}
+}
+
+func (*Map) Type() Type { return TypeMap }
+
+func (m *Map) Clone() Value { return m }
+
+// Len returns the number of entries.
+func (m *Map) Len() int {
+	return len(m.Keys)
+}
+
+// Get returns the value of the key, ok is false if m has no such key.
+func (m *Map) Get(k Hashable) (v Value, ok bool) {
+	i, ok := m.indexOf(k)
+	if !ok {
+		return nil, false
+	}
+	return m.Vals[i], true
+}
+
+// Set sets the value of the key, a new key is appended after the other entries.
+func (m *Map) Set(k Hashable, v Value) {
+	if i, ok := m.indexOf(k); ok {
+		m.Vals[i] = v
+		return
+	}
+	m.index[k.HashKey()] = len(m.Keys)
+	m.Keys = append(m.Keys, k)
+	m.Vals = append(m.Vals, v)
+}
+
+// Delete removes the entry of the key, it returns false if m has no such key.
+func (m *Map) Delete(k Hashable) bool {
+	i, ok := m.indexOf(k)
+	if !ok {
+		return false
+	}
+	delete(m.index, k.HashKey())
+	m.Keys = append(m.Keys[:i], m.Keys[i+1:]...)
+	m.Vals = append(m.Vals[:i], m.Vals[i+1:]...)
+	for j := i; j < len(m.Keys); j++ {
+		m.index[m.Keys[j].(Hashable).HashKey()] = j
+	}
+	return true
+}
+
+// Copy returns a new map with the same entries, the maps among the values are copied too.
+func (m *Map) Copy() *Map {
+	c := NewMap(m.Len())
+	for i, k := range m.Keys {
+		v := m.Vals[i]
+		if x, ok := v.(*Map); ok {
+			v = x.Copy()
+		}
+		c.Set(k.(Hashable), v)
+	}
+	return c
+}
+
+// Iter returns the state of a loop over the entries of m.
+func (m *Map) Iter() *MapIter {
+	return &MapIter{Map: m, Keys: append([]Value(nil), m.Keys...)}
+}
+
+func (m *Map) indexOf(k Hashable) (int, bool) {
+	if m.index == nil {
+		m.index = make(map[HashKey]int, len(m.Keys))
+		for i, k := range m.Keys {
+			m.index[k.(Hashable).HashKey()] = i
+		}
+	}
+	i, ok := m.index[k.HashKey()]
+	return i, ok
+}
+
+func (m *Map) String() string {
+	var sb strings.Builder
+	sb.WriteRune('{')
+	for i, k := range m.Keys {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(k.String())
+		sb.WriteString(": ")
+		sb.WriteString(m.Vals[i].String())
+	}
+	sb.WriteRune('}')
+	return sb.String()
+}
+
+// MapIter is the state of a loop over the entries of a map, it holds the keys the map had when the loop started.
+// The loop is not changed by the entries set or deleted since, except that the deleted keys are skipped.
+type MapIter struct {
+	Map  *Map
+	Keys []Value
+}
+
+func (*MapIter) Type() Type { return TypeMapIter }
+
+func (it *MapIter) Clone() Value { return it }
+
+func (it *MapIter) String() string {
+	return fmt.Sprintf("MapIter(%d)", len(it.Keys))
+}
+
+// Next returns the index of the next key after i which is still in the map, or -1 if there is none.
+func (it *MapIter) Next(i int) int {
+	for i++; i < len(it.Keys); i++ {
+		if _, ok := it.Map.indexOf(it.Keys[i].(Hashable)); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// Entry returns the key at i and its value in the map, nil if the key has been deleted.
+func (it *MapIter) Entry(i int) (k, v Value) {
+	k = it.Keys[i]
+	if v, ok := it.Map.Get(k.(Hashable)); ok {
+		return k, v
+	}
+	return k, &Nil{}
+}
@@ -0,0 +1,19 @@
+package value
+
+// Result is the value of `ok(v)` or `err(e)`.
+type Result struct {
+	Ok  bool
+	Val Value // the value of an ok, or the error of an err
+}
+
+func (*Result) Type() Type { return TypeResult }
+
+// Clone returns x, a result cannot be modified.
+func (x *Result) Clone() Value { return x }
+
+func (x *Result) String() string {
+	if x.Ok {
+		return "ok(" + x.Val.String() + ")"
+	}
+	return "err(" + x.Val.String() + ")"
+}
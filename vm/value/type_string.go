@@ -15,15 +15,23 @@ func _() {
 	_ = x[TypeNil-4]
 	_ = x[TypeFunc-5]
 	_ = x[TypePointer-6]
+	_ = x[TypeString-7]
+	_ = x[TypeStruct-8]
+	_ = x[TypeClosure-9]
+	_ = x[TypeMap-10]
+	_ = x[TypeError-11]
+	_ = x[TypeResult-12]
+	_ = x[TypeMapIter-13]
 }
 
-const _Type_name = "IntFloatBooleanCharNilFuncPointer"
+const _Type_name = "IntFloatBooleanCharNilFuncPointerStringStructClosureMapErrorResultMapIter"
 
-var _Type_index = [...]uint8{0, 3, 8, 15, 19, 22, 26, 33}
+var _Type_index = [...]uint8{0, 3, 8, 15, 19, 22, 26, 33, 39, 45, 52, 55, 60, 66, 73}
 
 func (i Type) String() string {
-	if i >= Type(len(_Type_index)-1) {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_Type_index)-1 {
 		return "Type(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _Type_name[_Type_index[i]:_Type_index[i+1]]
+	return _Type_name[_Type_index[idx]:_Type_index[idx+1]]
 }
@@ -20,6 +20,13 @@ const (
 	TypeNil
 	TypeFunc
 	TypePointer
+	TypeString
+	TypeStruct
+	TypeClosure
+	TypeMap
+	TypeError
+	TypeResult
+	TypeMapIter
 )
 
 type Value interface {
@@ -51,11 +58,33 @@ type (
 	Func struct {
 		Addr      Ptr
 		MaxLocals int
+		Params    int  // number of arguments without the rest argument
+		Required  int  // number of arguments a call must pass
+		Variadic  bool // the arguments after Params are passed in an array
 	}
 
+	// Closure is a function with the variables it captured, the variables are shared with the enclosing function.
+	Closure struct {
+		Func     *Func
+		Upvalues []*Value // each points to a local slot of the frame which declared the variable
+	}
+
+	// Pointer points to an element of an array, the elements are allocated on the heap like a Struct,
+	// copies of a Pointer and the pointers into the same array refer to the same elements.
 	Pointer struct {
-		Addr    Ptr
-		IsLocal bool
+		Elems []Value // the elements of the array
+		Addr  Ptr     // index in Elems of the element pointed to
+	}
+
+	String struct {
+		Val string
+	}
+
+	// Struct is allocated on the heap, copies of a Struct value refer to the same fields.
+	Struct struct {
+		Name   string
+		Fields []string
+		Vals   []Value
 	}
 )
 
@@ -66,6 +95,9 @@ func (*Char) Type() Type    { return TypeChar }
 func (*Nil) Type() Type     { return TypeNil }
 func (*Func) Type() Type    { return TypeFunc }
 func (*Pointer) Type() Type { return TypePointer }
+func (*String) Type() Type  { return TypeString }
+func (*Struct) Type() Type  { return TypeStruct }
+func (*Closure) Type() Type { return TypeClosure }
 
 func (x *Int) Clone() Value     { return &Int{Val: x.Val} }
 func (x *Float) Clone() Value   { return &Float{Val: x.Val} }
@@ -76,15 +108,22 @@ func (x *Func) Clone() Value {
 	return &Func{
 		Addr:      x.Addr,
 		MaxLocals: x.MaxLocals,
+		Params:    x.Params,
+		Required:  x.Required,
+		Variadic:  x.Variadic,
 	}
 }
 func (x *Pointer) Clone() Value {
 	return &Pointer{
-		Addr:    x.Addr,
-		IsLocal: x.IsLocal,
+		Elems: x.Elems,
+		Addr:  x.Addr,
 	}
 }
 
+func (x *String) Clone() Value  { return &String{Val: x.Val} }
+func (x *Struct) Clone() Value  { return x }
+func (x *Closure) Clone() Value { return x }
+
 func (*Int) isNumber()   {}
 func (*Float) isNumber() {}
 
@@ -116,17 +155,64 @@ func (f *Func) String() string {
 	return fmt.Sprintf("Func #%d", f.Addr)
 }
 
+func (c *Closure) String() string {
+	return fmt.Sprintf("Closure #%d", c.Func.Addr)
+}
+
+// Len returns the number of elements from the element p points to, p.Addr must be in [0, len(p.Elems)].
+func (p *Pointer) Len() int {
+	return len(p.Elems) - p.Addr
+}
+
 func (p *Pointer) String() string {
 	var sb strings.Builder
-	if p.IsLocal {
-		sb.WriteString("Local")
-	}
 	sb.WriteString("Ptr(")
 	sb.WriteString(strconv.Itoa(p.Addr))
 	sb.WriteRune(')')
 	return sb.String()
 }
 
+func (s *String) String() string {
+	return s.Val
+}
+
+// Field returns the value of the field, ok is false if s has no such field.
+func (s *Struct) Field(name string) (v Value, ok bool) {
+	for i, f := range s.Fields {
+		if f == name {
+			return s.Vals[i], true
+		}
+	}
+	return nil, false
+}
+
+// SetField sets the value of the field, it returns false if s has no such field.
+func (s *Struct) SetField(name string, v Value) bool {
+	for i, f := range s.Fields {
+		if f == name {
+			s.Vals[i] = v
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Struct) String() string {
+	var sb strings.Builder
+	sb.WriteString(s.Name)
+	sb.WriteRune('{')
+	for i, f := range s.Fields {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(f)
+		sb.WriteString(": ")
+		sb.WriteString(s.Vals[i].String())
+	}
+	sb.WriteRune('}')
+	return sb.String()
+}
+
 func init() {
 	gob.RegisterName("sometimes/vm/value.Int", &Int{})
 	gob.RegisterName("sometimes/vm/value.Float", &Float{})
@@ -135,4 +221,11 @@ func init() {
 	gob.RegisterName("sometimes/vm/value.Nil", &Nil{})
 	gob.RegisterName("sometimes/vm/value.Func", &Func{})
 	gob.RegisterName("sometimes/vm/value.Pointer", &Pointer{})
+	gob.RegisterName("sometimes/vm/value.String", &String{})
+	gob.RegisterName("sometimes/vm/value.Struct", &Struct{})
+	gob.RegisterName("sometimes/vm/value.Closure", &Closure{})
+	gob.RegisterName("sometimes/vm/value.Map", &Map{})
+	gob.RegisterName("sometimes/vm/value.Error", &Error{})
+	gob.RegisterName("sometimes/vm/value.Result", &Result{})
+	gob.RegisterName("sometimes/vm/value.MapIter", &MapIter{})
 }
@@ -2,6 +2,9 @@ package vm
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"sometimes/token"
 	"sometimes/vm/value"
 )
 
@@ -10,6 +13,8 @@ type VM struct {
 	frames       *FrameStack
 	pc           Ptr
 	program      *Program
+	caught       *RuntimeError // the error of the value last caught, in case it is thrown again
+	out          io.Writer     // where print writes
 }
 
 func New(program *Program, operandStackCap, frameStackCap int) *VM {
@@ -19,6 +24,7 @@ func New(program *Program, operandStackCap, frameStackCap int) *VM {
 		frames:       frames,
 		pc:           program.Entry,
 		program:      program,
+		out:          os.Stdout,
 	}
 }
 
@@ -29,7 +35,97 @@ func (vm *VM) fetch() (ins Instruction, exist bool) {
 	return
 }
 
-func (vm *VM) Execute() {
+// RuntimeError is an error raised while executing a program.
+type RuntimeError struct {
+	Pos   token.Pos   // position of the failing instruction; token.NoPos if unknown
+	Trace []token.Pos // call sites of the active functions, innermost first
+	Err   error
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// Exception is the error of a RuntimeError, Val is the value thrown by the program,
+// or the *value.Error of a runtime fault.
+type Exception struct {
+	Val     value.Value
+	rethrow bool // thrown again by a finally
+}
+
+func (e *Exception) Error() string {
+	if err, ok := e.Val.(*value.Error); ok {
+		return err.Msg
+	}
+	return "uncaught exception: " + e.Val.String()
+}
+
+// Execute runs the program until the entry function returns,
+// or until a value is thrown and no try catches it.
+func (vm *VM) Execute() error {
+	for {
+		exc := vm.run()
+		if exc == nil {
+			return nil
+		}
+		rerr := vm.runtimeError(exc)
+		if exc.rethrow && vm.caught != nil && vm.caught.Err.(*Exception).Val == exc.Val {
+			// report where the value was thrown first
+			rerr = vm.caught
+		}
+		if !vm.unwind(exc.Val) {
+			return rerr
+		}
+		vm.caught = rerr
+	}
+}
+
+// unwind pops the frames up to the innermost try which encloses the failing instruction
+// and jumps to its handler, it returns false if there is no such try.
+func (vm *VM) unwind(v value.Value) bool {
+	var h *Handler
+	n, addr := 0, vm.pc-1
+	vm.frames.Each(func(f *Frame) {
+		if h != nil {
+			return
+		}
+		if x, ok := vm.program.Handler(f.Func, addr); ok {
+			h = x
+			return
+		}
+		// the caller is at the call instruction
+		addr = f.RetAddr - 1
+		n++
+	})
+	if h == nil {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		vm.frames.Pop()
+	}
+	height := vm.frames.Top().Local.Load(h.Height).(*value.Int)
+	vm.operandStack.Truncate(height.Val)
+	vm.operandStack.Push(v)
+	vm.pc = h.Target
+	return true
+}
+
+// run executes the instructions until the entry function returns or a value is thrown.
+func (vm *VM) run() (exc *Exception) {
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			if exc, ok = exceptionOf(r); !ok {
+				// a bug of the vm, not a fault of the program
+				panic(r)
+			}
+		}
+	}()
+
 	for ins, exist := vm.fetch(); exist; ins, exist = vm.fetch() {
 		// fmt.Printf("op: %s, pc:%d\n", ins.Op().String(), vm.pc)
 		// vm.PrintOperandStack()
@@ -37,62 +133,257 @@ func (vm *VM) Execute() {
 		case *InstrPrint:
 			for i := 0; i < instr.ArgLen; i++ {
 				v := vm.operandStack.Pop()
-				fmt.Print(v.String() + " ")
+				fmt.Fprint(vm.out, v.String()+" ")
 			}
-			fmt.Println()
+			fmt.Fprintln(vm.out)
 		case *InstrPush:
 			v, _ := vm.program.GetConst(instr.DataID)
+			if m, ok := v.(*value.Map); ok {
+				// a constant map is a new map each time, like a map literal
+				v = m.Copy()
+			}
 			vm.operandStack.Push(v)
 		case *InstrDup:
 			v := vm.operandStack.TopValue()
 			vm.operandStack.Push(v.Clone())
+		case *InstrPop:
+			vm.operandStack.Pop()
 		case *InstrJmp:
 			vm.pc = instr.Addr
 		case *InstrJF:
-			b := vm.operandStack.Pop().(*value.Boolean)
+			v := vm.operandStack.Pop()
+			b, ok := v.(*value.Boolean)
+			if !ok {
+				panic(fault(value.KindTypeError, "non-boolean condition `%s`", v.Type()))
+			}
 			if !b.Val {
 				vm.pc = instr.Addr
 			}
+		case *InstrJmpTable:
+			vm.pc = instr.Default
+			if i, ok := jmpTableIndex(vm.operandStack.Pop()); ok && i >= instr.Min {
+				// i-instr.Min may overflow
+				if j := i - instr.Min; j >= 0 && j < len(instr.Addrs) {
+					vm.pc = instr.Addrs[j]
+				}
+			}
+		case *InstrCase:
+			x := vm.operandStack.Pop()
+			if eq, ok := equal(vm.operandStack.TopValue(), x); ok && eq {
+				vm.pc = instr.Addr
+			}
 		case *InstrCall:
-			f := vm.operandStack.Pop().(*value.Func)
-			vm.frames.Push(&Frame{
-				Local:   NewLocal(f.MaxLocals),
-				RetAddr: vm.pc,
-			})
+			frame := &Frame{RetAddr: vm.pc, Rets: instr.Rets, Args: instr.Args}
+			var f *value.Func
+			switch callee := vm.operandStack.Pop().(type) {
+			case *value.Func:
+				f = callee
+			case *value.Closure:
+				f = callee.Func
+				frame.Upvalues = callee.Upvalues
+			default:
+				panic(fault(value.KindTypeError, "cannot call `%s`", callee.Type()))
+			}
+			vm.arrangeArgs(f, instr.Args)
+			frame.Func = f.Addr
+			frame.Local = NewLocal(f.MaxLocals)
+			vm.frames.Push(frame)
 			// jump to function
 			vm.pc = f.Addr
 		case *InstrRet:
+			if rets := vm.frames.Top().Rets; rets != 0 && rets != instr.Count {
+				panic(fault(value.KindArityError, "function returns %s, want %d", values(instr.Count), rets))
+			}
 			frame := vm.frames.Pop()
 			if vm.frames.IsEmpty() {
-				return
+				return nil
+			}
+			if frame.Rets == 0 {
+				for i := 0; i < instr.Count; i++ {
+					vm.operandStack.Pop()
+				}
 			}
 			// jump to caller
 			vm.pc = frame.RetAddr
+		case *InstrArgs:
+			vm.operandStack.Push(&value.Int{Val: vm.frames.Top().Args})
 		case *InstrLoad:
 			v := vm.frames.Top().Local.Load(instr.Offset)
 			vm.operandStack.Push(v)
 		case *InstrStore:
 			v := vm.operandStack.Pop()
 			vm.frames.Top().Local.Store(instr.Offset, v)
-		case *InstrLoadPtr:
-			vm.operandStack.Push(&value.Pointer{
-				Addr:    instr.Offset,
-				IsLocal: instr.IsLocal,
-			})
+		case *InstrNewArray:
+			elems := make([]value.Value, instr.Len)
+			for i := len(elems) - 1; i >= 0; i-- {
+				elems[i] = vm.operandStack.Pop()
+			}
+			vm.operandStack.Push(&value.Pointer{Elems: elems})
 		case *InstrLoadFromPtr:
 			ptr := vm.operandStack.Pop().(*value.Pointer)
-			if !ptr.IsLocal {
-				panic("unimplement")
-			}
-			v := vm.frames.Top().Local.Load(ptr.Addr)
-			vm.operandStack.Push(v)
+			vm.operandStack.Push(load(ptr))
 		case *InstrStoreToPtr:
 			v := vm.operandStack.Pop()
 			ptr := vm.operandStack.Pop().(*value.Pointer)
-			if !ptr.IsLocal {
-				panic("unimplement")
+			store(ptr, v)
+		case *InstrLen:
+			switch v := vm.operandStack.Pop().(type) {
+			case *value.Pointer:
+				vm.operandStack.Push(&value.Int{Val: length(v)})
+			case *value.Map:
+				vm.operandStack.Push(&value.Int{Val: v.Len()})
+			default:
+				panic(fault(value.KindTypeError, "`%s` is not an array or a map", v.Type()))
+			}
+		case *InstrIsType:
+			v := vm.operandStack.Pop()
+			is := v.Type() == instr.Type
+			if s, ok := v.(*value.Struct); ok && instr.Struct != "" {
+				is = s.Name == instr.Struct
+			}
+			vm.operandStack.Push(&value.Boolean{Val: is})
+		case *InstrNewStruct:
+			vals := make([]value.Value, len(instr.Fields))
+			for i := len(vals) - 1; i >= 0; i-- {
+				vals[i] = vm.operandStack.Pop()
+			}
+			vm.operandStack.Push(&value.Struct{
+				Name:   instr.Name,
+				Fields: instr.Fields,
+				Vals:   vals,
+			})
+		case *InstrGetField:
+			vm.operandStack.Push(getField(vm.operandStack.Pop(), instr.Name))
+		case *InstrSetField:
+			v := vm.operandStack.Pop()
+			s := popStruct(vm.operandStack, instr.Name)
+			if !s.SetField(instr.Name, v) {
+				panic(fault(value.KindFieldError, "struct %s has no field %s", s.Name, instr.Name))
+			}
+		case *InstrNewMap:
+			kvs := make([]value.Value, 2*instr.Len)
+			for i := len(kvs) - 1; i >= 0; i-- {
+				kvs[i] = vm.operandStack.Pop()
+			}
+			m := value.NewMap(instr.Len)
+			for i := 0; i < len(kvs); i += 2 {
+				m.Set(hashable(kvs[i]), kvs[i+1])
+			}
+			vm.operandStack.Push(m)
+		case *InstrIndex:
+			index := vm.operandStack.Pop()
+			switch x := vm.operandStack.Pop().(type) {
+			case *value.Map:
+				v, ok := x.Get(hashable(index))
+				if !ok {
+					v = &value.Nil{}
+				}
+				vm.operandStack.Push(v)
+			default:
+				vm.operandStack.Push(load(vm.elementPtr(x, index)))
+			}
+		case *InstrSetIndex:
+			v := vm.operandStack.Pop()
+			index := vm.operandStack.Pop()
+			switch x := vm.operandStack.Pop().(type) {
+			case *value.Map:
+				x.Set(hashable(index), v)
+			default:
+				store(vm.elementPtr(x, index), v)
+			}
+		case *InstrDelete:
+			k := vm.operandStack.Pop()
+			v := vm.operandStack.Pop()
+			m, ok := v.(*value.Map)
+			if !ok {
+				panic(fault(value.KindTypeError, "cannot delete from `%s`", v.Type()))
+			}
+			m.Delete(hashable(k))
+		case *InstrIter:
+			switch x := vm.operandStack.Pop().(type) {
+			case *value.Map:
+				vm.operandStack.Push(x.Iter())
+			case *value.Pointer:
+				vm.operandStack.Push(x)
+			default:
+				panic(fault(value.KindTypeError, "`%s` is not an array or a map", x.Type()))
+			}
+		case *InstrNext:
+			i := vm.operandStack.Pop().(*value.Int)
+			next := -1
+			switch x := vm.operandStack.Pop().(type) {
+			case *value.MapIter:
+				next = x.Next(i.Val)
+			case *value.Pointer:
+				if i.Val+1 < length(x) {
+					next = i.Val + 1
+				}
+			}
+			vm.operandStack.Push(&value.Int{Val: next})
+		case *InstrEntry:
+			i := vm.operandStack.Pop().(*value.Int)
+			switch x := vm.operandStack.Pop().(type) {
+			case *value.MapIter:
+				k, v := x.Entry(i.Val)
+				if instr.Key {
+					vm.operandStack.Push(k)
+				} else {
+					vm.operandStack.Push(v)
+				}
+			default:
+				if instr.Key {
+					vm.operandStack.Push(i)
+				} else {
+					vm.operandStack.Push(load(vm.elementPtr(x, i)))
+				}
+			}
+		case *InstrHeight:
+			vm.operandStack.Push(&value.Int{Val: vm.operandStack.top})
+		case *InstrThrow:
+			panic(&Exception{Val: vm.operandStack.Pop(), rethrow: instr.Rethrow})
+		case *InstrUnwind:
+			v := vm.operandStack.Pop()
+			height := vm.frames.Top().Local.Load(instr.Offset).(*value.Int)
+			vm.operandStack.Truncate(height.Val)
+			vm.operandStack.Push(v)
+		case *InstrResult:
+			vm.operandStack.Push(&value.Result{Ok: instr.Ok, Val: vm.operandStack.Pop()})
+		case *InstrIsOk:
+			r := popResult(vm.operandStack)
+			vm.operandStack.Push(&value.Boolean{Val: r.Ok})
+		case *InstrUnwrap:
+			r := popResult(vm.operandStack)
+			if !r.Ok {
+				panic(fault(value.KindUnwrapError, "unwrap of %s", r))
 			}
-			vm.frames.Top().Local.Store(ptr.Addr, v)
+			vm.operandStack.Push(r.Val)
+		case *InstrUnwrapOr:
+			d := vm.operandStack.Pop()
+			if r := popResult(vm.operandStack); r.Ok {
+				vm.operandStack.Push(r.Val)
+			} else {
+				vm.operandStack.Push(d)
+			}
+		case *InstrClosure:
+			f := vm.operandStack.Pop().(*value.Func)
+			frame := vm.frames.Top()
+			upvalues := make([]*value.Value, len(instr.Captures))
+			for i, c := range instr.Captures {
+				if c.IsLocal {
+					upvalues[i] = frame.Local.Ref(c.Index)
+				} else {
+					upvalues[i] = frame.Upvalues[c.Index]
+				}
+			}
+			vm.operandStack.Push(&value.Closure{Func: f, Upvalues: upvalues})
+		case *InstrLoadUpvalue:
+			v := *vm.frames.Top().Upvalues[instr.Index]
+			if v == nil {
+				v = &value.Nil{}
+			}
+			vm.operandStack.Push(v)
+		case *InstrStoreUpvalue:
+			*vm.frames.Top().Upvalues[instr.Index] = vm.operandStack.Pop()
 		case BinaryArithInstruction:
 			rhs := vm.operandStack.Pop()
 			lhs := vm.operandStack.Pop()
@@ -109,7 +400,194 @@ func (vm *VM) Execute() {
 			vm.operandStack.Push(&value.Boolean{Val: logic(instr, x, &value.Nil{})})
 		}
 	}
+	return nil
+}
+
+// jmpTableIndex returns the int value of v, like `==`, a char or a whole float equals an int.
+func jmpTableIndex(v value.Value) (int, bool) {
+	switch v := v.(type) {
+	case *value.Int:
+		return v.Val, true
+	case *value.Char:
+		return int(v.Val), true
+	case *value.Float:
+		if i := int(v.Val); float64(i) == v.Val {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func load(ptr *value.Pointer) value.Value {
+	checkPtr(ptr)
+	return ptr.Elems[ptr.Addr]
+}
+
+func store(ptr *value.Pointer, v value.Value) {
+	checkPtr(ptr)
+	ptr.Elems[ptr.Addr] = v
+}
+
+// length returns the number of elements from the element ptr points to,
+// it raises an IndexError if ptr points outside of its array and not just after its last element.
+func length(ptr *value.Pointer) int {
+	if ptr.Addr < 0 || ptr.Addr > len(ptr.Elems) {
+		panic(fault(value.KindIndexError, "pointer out of range [%d] with length %d", ptr.Addr, len(ptr.Elems)))
+	}
+	return ptr.Len()
+}
+
+// checkPtr raises an IndexError if ptr points outside of its array.
+func checkPtr(ptr *value.Pointer) {
+	if ptr.Addr < 0 || ptr.Addr >= len(ptr.Elems) {
+		panic(fault(value.KindIndexError, "pointer out of range [%d] with length %d", ptr.Addr, len(ptr.Elems)))
+	}
+}
+
+// elementPtr returns the pointer to the element of the array x at index,
+// it raises an IndexError if the array has no such element.
+func (vm *VM) elementPtr(x, index value.Value) *value.Pointer {
+	ptr, ok := x.(*value.Pointer)
+	if !ok {
+		panic(fault(value.KindTypeError, "cannot index `%s`", x.Type()))
+	}
+	if i, ok := index.(*value.Int); ok {
+		if n := length(ptr); i.Val < 0 || i.Val >= n {
+			panic(fault(value.KindIndexError, "index out of range [%d] with length %d", i.Val, n))
+		}
+	}
+	return arith(&InstrAdd{}, x, index).(*value.Pointer)
+}
+
+// hashable returns v as a key of a map, it panics with an *value.UnhashableError if v is unhashable.
+func hashable(v value.Value) value.Hashable {
+	k, err := value.ToHashable(v)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// popStruct pops the struct whose field is set.
+func popStruct(s *OperandStack, field string) *value.Struct {
+	v := s.Pop()
+	if x, ok := v.(*value.Struct); ok {
+		return x
+	}
+	panic(fault(value.KindTypeError, "cannot set field %s of `%s`", field, v.Type()))
+}
 
+// arrangeArgs checks the number of arguments of a call to f, and leaves one value for each argument
+// on the stack, the first on top, nil if the argument is left out.
+// The arguments after f.Params are put in a new array, and the array is left below the other arguments.
+func (vm *VM) arrangeArgs(f *value.Func, n int) {
+	switch {
+	case n < f.Required:
+		panic(fault(value.KindArityError, "not enough arguments in call: have %d, want %s", n, arity(f)))
+	case n > f.Params && !f.Variadic:
+		panic(fault(value.KindArityError, "too many arguments in call: have %d, want %s", n, arity(f)))
+	case n == f.Params && !f.Variadic:
+		return
+	}
+	args := make([]value.Value, n)
+	for i := range args {
+		args[i] = vm.operandStack.Pop()
+	}
+	var rest []value.Value
+	if n > f.Params {
+		args, rest = args[:f.Params], args[f.Params:]
+	}
+	if f.Variadic {
+		vm.operandStack.Push(&value.Pointer{Elems: rest})
+	}
+	for i := f.Params - 1; i >= 0; i-- {
+		if i < n {
+			vm.operandStack.Push(args[i])
+		} else {
+			vm.operandStack.Push(&value.Nil{})
+		}
+	}
+}
+
+// arity describes the number of arguments f takes.
+func arity(f *value.Func) string {
+	switch {
+	case f.Variadic:
+		return fmt.Sprintf("at least %d", f.Required)
+	case f.Required < f.Params:
+		return fmt.Sprintf("%d to %d", f.Required, f.Params)
+	}
+	return fmt.Sprint(f.Params)
+}
+
+// popResult pops the operand of a result builtin.
+func popResult(s *OperandStack) *value.Result {
+	v := s.Pop()
+	if r, ok := v.(*value.Result); ok {
+		return r
+	}
+	panic(fault(value.KindTypeError, "`%s` is not a result", v.Type()))
+}
+
+// getField returns the value of the field of a struct or an error.
+func getField(v value.Value, field string) value.Value {
+	switch x := v.(type) {
+	case *value.Struct:
+		if f, ok := x.Field(field); ok {
+			return f
+		}
+		panic(fault(value.KindFieldError, "struct %s has no field %s", x.Name, field))
+	case *value.Error:
+		if f, ok := x.Field(field); ok {
+			return f
+		}
+		panic(fault(value.KindFieldError, "error has no field %s", field))
+	}
+	panic(fault(value.KindTypeError, "cannot access field %s of `%s`", field, v.Type()))
+}
+
+// fault returns the error thrown for a runtime fault.
+func fault(kind, format string, args ...interface{}) *value.Error {
+	return &value.Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// exceptionOf returns the exception of a value the vm panics with, the faults become *value.Error.
+// ok is false if r is not a throw or a fault of the program.
+func exceptionOf(r interface{}) (exc *Exception, ok bool) {
+	switch e := r.(type) {
+	case *Exception:
+		return e, true
+	case *value.Error:
+		return &Exception{Val: e}, true
+	case *value.UnhashableError:
+		return &Exception{Val: fault(value.KindKeyError, "%s", e.Error())}, true
+	}
+	if r == StackOverflow {
+		return &Exception{Val: fault(value.KindStackOverflow, "%s", StackOverflow.Error())}, true
+	}
+	return nil, false
+}
+
+func (vm *VM) runtimeError(err *Exception) *RuntimeError {
+	rerr := &RuntimeError{
+		Pos: vm.program.Pos(vm.pc - 1), // pc has moved past the failing instruction
+		Err: err,
+	}
+	vm.frames.Each(func(f *Frame) {
+		// the entry function is not called from the source
+		if pos := vm.program.Pos(f.RetAddr - 1); pos.IsValid() {
+			rerr.Trace = append(rerr.Trace, pos)
+		}
+	})
+	return rerr
+}
+
+// values returns "1 value" or "n values".
+func values(n int) string {
+	if n == 1 {
+		return "1 value"
+	}
+	return fmt.Sprintf("%d values", n)
 }
 
 func (vm *VM) PrintOperandStack() {
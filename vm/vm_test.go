@@ -0,0 +1,655 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"sometimes/lexer"
+	"sometimes/parser"
+	"sometimes/token"
+	"sometimes/visitor"
+	"sometimes/vm/assembly"
+	"sometimes/vm/value"
+	"strings"
+	"testing"
+)
+
+// execute compiles and executes src, it returns what the program prints and the error of Execute.
+func execute(t *testing.T, src string) (string, error) {
+	t.Helper()
+	fset := token.NewFileSet()
+	p := parser.NewParser(lexer.NewTokenCursor(lexer.NewSrcCursor(fset.AddFile("", []byte(src)))))
+	file, diags := p.Parse()
+	if len(diags) > 0 {
+		t.Fatalf("`%s`: unexpected parser diagnostics: %v", src, diags)
+	}
+	v := visitor.NewVistor(fset)
+	prog := v.Visit(file)
+	if len(v.Diagnostics()) > 0 {
+		t.Fatalf("`%s`: unexpected diagnostics: %v", src, v.Diagnostics())
+	}
+	var out bytes.Buffer
+	machine := New(NewProgramFromAsm(assembly.NewCompiler(prog).Compile()), 256, 128)
+	machine.out = &out
+	err := machine.Execute()
+	return out.String(), err
+}
+
+type executeTest struct {
+	name string
+	src  string
+	want string // the output, followed by the error if Execute fails
+}
+
+func runExecuteTests(t *testing.T, tests []executeTest) {
+	t.Helper()
+	for _, testcase := range tests {
+		got, err := execute(t, testcase.src)
+		if err != nil {
+			got += "error: " + err.Error()
+		}
+		if got != testcase.want {
+			t.Errorf("%s:\n want %q\n  got %q", testcase.name, testcase.want, got)
+		}
+	}
+}
+
+func TestExecuteArray(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "loop over an argument",
+			src: `
+fn total(a) { let s = 0; loop x in a { s += x }; return s }
+fn main() { print(total([1, 2, 3])) }
+`,
+			want: "6 \n",
+		},
+		{
+			name: "array returned from a function",
+			src: `
+fn pair(x) { return [x, x + 1] }
+fn main() { let p = pair(1); let q = pair(5); print(p[1]); print(q[0]) }
+`,
+			want: "2 \n5 \n",
+		},
+		{
+			name: "array literal evaluated in a loop",
+			src: `
+fn main() {
+	let xs = [0, 0]
+	loop i in 0..2 { xs[i] = [i] }
+	print(xs[0][0]); print(xs[1][0])
+}
+`,
+			want: "0 \n1 \n",
+		},
+		{
+			name: "store out of range",
+			src: `
+fn main() { let arr = [1, 2]; arr[2] = 99 }
+`,
+			want: "error: index out of range [2] with length 2",
+		},
+		{
+			name: "load out of range",
+			src: `
+fn main() {
+	let arr = [1, 2]
+	try { arr[-1] } catch e { print(e.kind); print(e.message) }
+	try { (arr + 1)[1] } catch e { print(e.message) }
+	try { (arr - 1)[0] } catch e { print(e.message) }
+	print(arr[0]); print((arr + 1)[0])
+}
+`,
+			want: "IndexError \nindex out of range [-1] with length 2 \nindex out of range [1] with length 1 \npointer out of range [-1] with length 2 \n1 \n2 \n",
+		},
+		{
+			name: "length out of range",
+			src: `
+fn main() {
+	let arr = [1, 2]
+	print(len(arr + 2))
+	try { len(arr - 5) } catch e { print(e.kind); print(e.message) }
+	try { len(arr + 3) } catch e { print(e.message) }
+	try { loop x in arr + 3 { print(x) } } catch e { print(e.message) }
+}
+`,
+			want: "0 \nIndexError \npointer out of range [-5] with length 2 \npointer out of range [3] with length 2 \npointer out of range [3] with length 2 \n",
+		},
+		{
+			name: "copies refer to the same elements",
+			src: `
+fn set(a) { a[0] = 9 }
+fn main() { let a = [1, 2]; let b = a; set(b); print(a[0]); print(len(a + 1)) }
+`,
+			want: "9 \n1 \n",
+		},
+	})
+}
+
+func TestExecuteVariadic(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "rest array returned",
+			src: `
+fn rest(..r) { return r }
+fn main() { let r = rest(1, 2); print(r[0]); print(r[1]); print(len(rest())) }
+`,
+			want: "1 \n2 \n0 \n",
+		},
+		{
+			name: "rest array passed on",
+			src: `
+fn sum(xs) { let s = 0; loop x in xs { s += x }; return s }
+fn log(level, msg = level * 10, ..rest) { print(level); print(msg); print(sum(rest)) }
+fn main() { log(1); log(2, 3, 4, 5) }
+`,
+			want: "1 \n10 \n0 \n2 \n3 \n9 \n",
+		},
+		{
+			name: "too many arguments in an indirect call",
+			src: `
+fn add(a, b = 1) { a + b }
+fn main() { let f = add; print(f(1)); f(1, 2, 3) }
+`,
+			want: "2 \nerror: too many arguments in call: have 3, want 1 to 2",
+		},
+		{
+			name: "not enough arguments to a closure",
+			src: `
+fn main() {
+	let g = fn(x, ..r) { x }
+	try { g() } catch e { print(e.kind); print(e.message) }
+}
+`,
+			want: "ArityError \nnot enough arguments in call: have 0, want at least 1 \n",
+		},
+	})
+}
+
+func TestExecuteClosure(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "captured array",
+			src: `
+fn main() {
+	let a = [5, 6]
+	let f = fn() { return a[1] }
+	let g = fn(x) { a[1] = x }
+	print(f()); g(7); print(f()); print(a[1])
+}
+`,
+			want: "6 \n7 \n7 \n",
+		},
+		{
+			name: "captured variable outlives its frame",
+			src: `
+fn counter() { let n = 0; return fn() { n += 1; return n } }
+fn main() { let c = counter(); c(); print(c()) }
+`,
+			want: "2 \n",
+		},
+	})
+}
+
+func TestExecuteMatch(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "array argument",
+			src: `
+fn sum2(v) { return match v { [a, b] => a + b, [a, ..r] => a + len(r), _ => 0 } }
+fn main() { print(sum2([3, 4])); print(sum2([1, 2, 3])); print(sum2([])); print(sum2(7)) }
+`,
+			want: "7 \n3 \n0 \n0 \n",
+		},
+		{
+			name: "decision tree",
+			src: `
+struct P { x, y }
+const MAX = 100
+fn classify(n) {
+	return match n {
+		0 => "zero",
+		1..=9 => "digit",
+		-5..0 => "negative",
+		MAX => "max",
+		x if x > MAX => "big",
+		_ => "other",
+	}
+}
+fn kind(v) {
+	return match v {
+		P{x, y} if x > y => "x > y",
+		P{x: 0, y} => y,
+		P{x, y: _} => x,
+		'a'..='z' => "lower",
+		"hi" => "greeting",
+		true => "yes",
+		_ => "?",
+	}
+}
+fn main() {
+	print(classify(0), classify(5), classify(-3), classify(-6), classify(100), classify(200), classify(50), classify('a'))
+	print(kind(P{x: 2, y: 1}), kind(P{x: 0, y: 7}), kind(P{x: 3, y: 9}))
+	print(kind('q'), kind('Q'), kind("hi"), kind(true), kind(false), kind(1.5))
+}
+`,
+			want: "zero digit negative other max big other other \nx > y 7 3 \nlower ? greeting yes ? ? \n",
+		},
+		{
+			name: "dense int literals",
+			src: `
+fn dense(n) { return match n { 0 => "a", 1 => "b", 2 => "c", 3 => "d", 5 => "f", _ => "z" } }
+fn main() { print(dense(0), dense(3), dense(4), dense(5), dense(-1), dense('a'), dense(2.0)) }
+`,
+			want: "a d z f z z z \n",
+		},
+	})
+}
+
+func TestExecuteMap(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "iteration in insertion order",
+			src: `
+fn main() { let m = {"b": 1, "a": 2}; m["c"] = 3; loop k, v in m { print(k, v) } }
+`,
+			want: "b 1 \na 2 \nc 3 \n",
+		},
+		{
+			name: "delete the current key",
+			src: `
+fn main() { let m = {1: 1, 2: 2, 3: 3, 4: 4}; let n = 0; loop k, v in m { delete(m, k); n += 1 }; print(m); print(n) }
+`,
+			want: "{} \n4 \n",
+		},
+		{
+			name: "deleted and added keys",
+			src: `
+fn main() {
+	let m = {1: "a", 2: "b", 3: "c"}
+	loop k, v in m {
+		print(k, v)
+		if k == 1 { delete(m, 2); m[3] = "C"; m[4] = "d" }
+	}
+	print(len(m))
+}
+`,
+			want: "1 a \n3 C \n3 \n",
+		},
+	})
+}
+
+func TestExecuteAssign(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "compound assignment to an element",
+			src: `
+fn main() {
+	let arr = [1, 2], calls = 0
+	let f = fn() { calls += 1; return 1 }
+	arr[f()] += 10
+	arr[f()]++
+	print(arr[1]); print(calls)
+}
+`,
+			want: "13 \n2 \n",
+		},
+		{
+			name: "compound assignment to a field",
+			src: `
+struct P { x }
+fn main() {
+	let p = P { x: 1 }, calls = 0
+	let f = fn() { calls += 1; return p }
+	f().x *= 5
+	f().x--
+	print(p.x); print(calls)
+}
+`,
+			want: "4 \n2 \n",
+		},
+	})
+}
+
+func TestExceptionOf(t *testing.T) {
+	// a runtime.Error, like the vm panics with if it has a bug
+	var outOfRange error
+	func() {
+		defer func() { outOfRange = recover().(error) }()
+		var elems []int
+		i := 1
+		_ = elems[i]
+	}()
+	tests := []struct {
+		r    interface{}
+		want string // the error of the exception, or empty if the vm must panic again
+	}{
+		{r: fault(value.KindTypeError, "cannot call `Int`"), want: "cannot call `Int`"},
+		{r: &value.UnhashableError{Type: value.TypeMap}, want: "unhashable map key `Map`"},
+		{r: StackOverflow, want: "stack overflow"},
+		{r: &Exception{Val: &value.Int{Val: 1}}, want: "uncaught exception: 1"},
+		{r: outOfRange},
+		{r: StackUnderflow},
+		{r: errors.New("label: x not exist")},
+		{r: "unimplement"},
+	}
+	for _, testcase := range tests {
+		exc, ok := exceptionOf(testcase.r)
+		switch {
+		case testcase.want == "" && ok:
+			t.Errorf("%v: want no exception; got %v", testcase.r, exc)
+		case testcase.want != "" && (!ok || exc.Error() != testcase.want):
+			t.Errorf("%v: want exception %q; got %v", testcase.r, testcase.want, exc)
+		}
+	}
+}
+
+func TestExecuteSwitch(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "mismatched type compare chain",
+			src: `
+fn main() {
+	switch 1 { case "a" { print("a") } default { print("default") } }
+	switch "b" { case 1, 100 { print(1) } case "b" { print("b") } }
+}
+`,
+			want: "default \nb \n",
+		},
+		{
+			name: "mismatched type variable case",
+			src: `
+fn sw2(x, y) { return switch x { case y { "y" } case "s" { "s" } default { "default" } } }
+fn main() { print(sw2("s", 0), sw2(0, 0), sw2(true, "s"), sw2([1], 1)) }
+`,
+			want: "s y default default \n",
+		},
+		{
+			name: "float tag against int cases",
+			src: `
+fn table(n) { return switch n { case 0, 1, 2, 3 { "int" } default { "default" } } }
+fn chain(n) { return switch n { case 0, 100 { "zero" } case 2 { "two" } default { "default" } } }
+fn main() { print(table(2.0), table(2.5), table('a'), chain(2.0), chain(0.0), chain(2.5)) }
+`,
+			want: "int default default two zero default \n",
+		},
+		{
+			name: "jump table and compare chain",
+			src: `
+fn table(n) { return switch n { case 0 { "a" } case 1, 2 { "b" } case 4 { "c" } default { "d" } } }
+fn chain(n) { let two = 2; return switch n { case 0 { "a" } case 1, two { "b" } case 4 { "c" } default { "d" } } }
+fn main() {
+	let i = -1
+	loop i < 6 { print(table(i), chain(i)); i += 1 }
+}
+`,
+			want: "d d \na a \nb b \nb b \nd d \nc c \nd d \n",
+		},
+	})
+}
+
+func TestExecuteException(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "throw across frames",
+			src: `
+fn thrower(x) { throw x }
+fn add(x) { return 1 + 2 * thrower(x) }
+fn main() {
+	try { print(add("deep")) } catch e { print("caught", e) }
+	print(add(1))
+}
+`,
+			want: "caught deep \nerror: uncaught exception: 1",
+		},
+		{
+			name: "finally on return, break and continue",
+			src: `
+fn ret() { try { return 1 } finally { print("return") } }
+fn loops() {
+	let i = 0
+	loop i < 5 {
+		try {
+			if i == 1 { i += 1; continue }
+			if i == 3 { break }
+		} finally {
+			print("finally", i)
+		}
+		i += 1
+	}
+	return i
+}
+fn main() { print(ret()); print(loops()) }
+`,
+			want: "return \n1 \nfinally 0 \nfinally 2 \nfinally 2 \nfinally 3 \n3 \n",
+		},
+		{
+			name: "rethrow from catch",
+			src: `
+fn main() {
+	try {
+		try { throw 1 } catch e { throw e + 1 } finally { print("inner") }
+	} catch e {
+		print("outer", e)
+	}
+	try { throw "x" } catch e { throw e }
+}
+`,
+			want: "inner \nouter 2 \nerror: uncaught exception: x",
+		},
+		{
+			name: "kinds of faults",
+			src: `
+fn rec(n) { return rec(n + 1) }
+fn main() {
+	try { 1 + "s" } catch e { print(e.kind) }
+	try { 1 / 0 } catch e { print(e.kind) }
+	try { let m = {}; m[[1]] = 1 } catch e { print(e.kind) }
+	try { let a = [1]; a[1] } catch e { print(e.kind) }
+	try { rec(0) } catch e { print(e.kind) }
+	try { let f = fn(a) { a }; f() } catch e { print(e.kind) }
+	try { unwrap(err(0)) } catch e { print(e.kind) }
+}
+`,
+			want: "TypeError \nArithmeticError \nKeyError \nIndexError \nStackOverflow \nArityError \nUnwrapError \n",
+		},
+	})
+}
+
+func TestExecuteConditionPos(t *testing.T) {
+	tests := []struct {
+		src  string
+		cond string // the non-boolean condition
+	}{
+		{src: "fn main() {\n\tif 1 {}\n}", cond: "1 {"},
+		{src: "fn main() {\n\tlet x = \"s\"\n\tloop (x) {}\n}", cond: "(x)"},
+	}
+	for _, testcase := range tests {
+		_, err := execute(t, testcase.src)
+		var rerr *RuntimeError
+		if !errors.As(err, &rerr) {
+			t.Errorf("`%s`: want a runtime error; got %v", testcase.src, err)
+			continue
+		}
+		if want := token.Pos(1 + strings.Index(testcase.src, testcase.cond)); rerr.Pos != want {
+			t.Errorf("`%s`: want error at %d; got %d: %v", testcase.src, want, rerr.Pos, err)
+		}
+	}
+}
+
+func TestExecutePropagate(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "propagate in expressions and arguments",
+			src: `
+fn half(n) { if n % 2 == 1 { return err("odd") }; return ok(n / 2) }
+fn twice(n) { return ok(100 + half(n)? + half(n)?) }
+fn args(a, b) { print("args", a?, b?); return ok(0) }
+fn main() {
+	print(twice(4), twice(3))
+	print(args(ok(1), ok(2)), args(ok(1), err("b")), args(err("a"), ok(2)))
+	let f = fn(r) { return ok(r? + 1) }
+	print(f(ok(1)), f(err(0)))
+}
+`,
+			want: "ok(104) err(odd) \nargs 1 2 \nok(0) err(b) err(a) \nok(2) err(0) \n",
+		},
+		{
+			name: "propagate runs finally",
+			src: `
+fn fin(r) { try { return ok(r? * 10) } finally { print("finally") } }
+fn main() { print(fin(ok(2))); print(fin(err(1))) }
+`,
+			want: "finally \nok(20) \nfinally \nerr(1) \n",
+		},
+	})
+}
+
+func TestExecuteStruct(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "fields are shared by every reference to a struct",
+			src: `
+struct Point { x, y }
+fn move(p, dx) { p.x += dx }
+fn main() {
+	let p = Point { x: 1, y: 2 }
+	let q = p
+	q.x = 3
+	move(p, 10)
+	let ps = [p]
+	ps[0].y = 7
+	print(p.x, p.y, q.x)
+	print(p)
+}
+`,
+			want: "13 7 13 \nPoint{x: 13, y: 7} \n",
+		},
+		{
+			name: "unknown field",
+			src: `
+struct Point { x, y }
+fn main() {
+	let p = Point { x: 1, y: 2 }
+	try { p.z } catch e { print(e.kind) }
+	p.z = 1
+}
+`,
+			want: "FieldError \nerror: struct Point has no field z",
+		},
+	})
+}
+
+func TestExecuteBreak(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "loop value from break",
+			src: `
+fn find(a, want) {
+	let i = 0
+	return loop i < len(a) {
+		if a[i] == want { break i }
+		i += 1
+	}
+}
+fn main() {
+	print(find([4, 5, 6], 5), find([4], 5))
+	let y = loop x in [1, 2, 3] { if x == 2 { break x * 10 } }
+	print(y)
+}
+`,
+			want: "1 <nil> \n20 \n",
+		},
+		{
+			name: "labeled break and continue",
+			src: `
+fn main() {
+	let n = 0
+	let x = 'outer: loop {
+		loop {
+			n += 1
+			if n == 3 { break 'outer n * 10 }
+			continue 'outer
+		}
+		print("unreachable")
+	}
+	print(x, n)
+	'rows: loop i in [1, 2, 3] {
+		loop j in [1, 2, 3] {
+			if j > i { continue 'rows }
+			if i * j == 4 { break 'rows }
+			print(i, j)
+		}
+	}
+}
+`,
+			want: "30 3 \n1 1 \n2 1 \n",
+		},
+	})
+}
+
+func TestExecuteBitwise(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "integer operands",
+			src:  "fn main() { print(6 & 3, 6 | 3, 6 ^ 3, ~0, 1 << 4, -16 >> 2) }",
+			want: "2 7 5 -1 16 -4 \n",
+		},
+		{
+			name: "float operands fault",
+			src: `
+fn main() {
+	let f = 1.5
+	try { f & 1 } catch e { print(e.kind, e.message) }
+	try { 1 | f } catch e { print(e.kind, e.message) }
+	try { ~f } catch e { print(e.kind, e.message) }
+	try { 1 << 2.0 } catch e { print(e.kind, e.message) }
+	try { 1 << -1 } catch e { print(e.kind, e.message) }
+	print(f ^ 1)
+}
+`,
+			want: "TypeError `BitAnd` requires `Int` operands: lhs: `Float` rhs: `Int` \n" +
+				"TypeError `BitOr` requires `Int` operands: lhs: `Int` rhs: `Float` \n" +
+				"TypeError `BitNot` requires an `Int` operand: `Float` \n" +
+				"TypeError `Shl` requires `Int` operands: lhs: `Int` rhs: `Float` \n" +
+				"ArithmeticError negative shift count -1 \n" +
+				"error: `Xor` requires `Int` operands: lhs: `Float` rhs: `Int`",
+		},
+	})
+}
+
+func TestExecuteReturn(t *testing.T) {
+	runExecuteTests(t, []executeTest{
+		{
+			name: "destructure returned values and arrays",
+			src: `
+fn divmod(x, y) { return x / y, x % y }
+fn main() {
+	let (q, r) = divmod(7, 2)
+	print(q, r)
+	let [h, ..t] = [1, 2, 3]
+	print(h, len(t), t[0], t[1])
+	let [x, ..rest] = [1]
+	print(x, len(rest))
+}
+`,
+			want: "3 1 \n1 2 2 3 \n1 0 \n",
+		},
+		{
+			name: "arity checked at runtime",
+			src: `
+fn divmod(x, y) { return x / y, x % y }
+fn one() { return 1 }
+fn main() {
+	let f = divmod, g = one, arr = [1]
+	try { let (a, b, c) = f(7, 2); print(a) } catch e { print(e.kind, e.message) }
+	try { let (a, b) = g(); print(a) } catch e { print(e.kind, e.message) }
+	try { let [a, b] = arr; print(a) } catch e { print(e.kind, e.message) }
+}
+`,
+			want: "ArityError function returns 2 values, want 3 \n" +
+				"ArityError function returns 1 value, want 2 \n" +
+				"IndexError index out of range [1] with length 1 \n",
+		},
+	})
+}